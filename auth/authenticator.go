@@ -0,0 +1,272 @@
+// auth package implements server side digest authentication - RFC 3261 - 22.
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ygj201011/gosip"
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/sip/parser"
+)
+
+const defaultNonceExpiry = 5 * time.Minute
+
+// Config describes authenticator options.
+type Config struct {
+	Realm string
+	// Proxy enables Proxy-Authenticate challenges with 407 instead of WWW-Authenticate with 401.
+	Proxy bool
+	// NonceExpiry limits lifetime of the nonce, stale=true is signaled after it, 5 minutes by default.
+	NonceExpiry time.Duration
+	// Algorithms are offered in separate challenges, strongest first - RFC 8760 - 2.4, MD5 by default.
+	Algorithms []string
+}
+
+// Authenticator challenges requests and checks digest credentials.
+type Authenticator interface {
+	String() string
+	// Authenticate returns the username of the authenticated request.
+	// Otherwise it responds on the request with challenge or 403 Forbidden and returns false.
+	Authenticate(req sip.Request, tx sip.ServerTransaction) (string, bool)
+	// Wrap returns handler that passes only authenticated requests to the handler,
+	// it is used with gosip.Server.OnRequest.
+	Wrap(handler gosip.RequestHandler) gosip.RequestHandler
+}
+
+type authenticator struct {
+	store  CredentialStore
+	config Config
+	nonces *nonceStore
+
+	log log.Logger
+}
+
+func NewAuthenticator(store CredentialStore, config Config, logger log.Logger) Authenticator {
+	if config.NonceExpiry == 0 {
+		config.NonceExpiry = defaultNonceExpiry
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{"MD5"}
+	}
+
+	a := &authenticator{
+		store:  store,
+		config: config,
+		nonces: newNonceStore(config.NonceExpiry),
+	}
+	a.log = logger.
+		WithPrefix("auth.Authenticator").
+		WithFields(log.Fields{
+			"authenticator_ptr": fmt.Sprintf("%p", a),
+			"realm":             config.Realm,
+		})
+
+	return a
+}
+
+func (a *authenticator) String() string {
+	if a == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("auth.Authenticator<%s>", a.Log().Fields())
+}
+
+func (a *authenticator) Log() log.Logger {
+	return a.log
+}
+
+func (a *authenticator) Wrap(handler gosip.RequestHandler) gosip.RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		if _, ok := a.Authenticate(req, tx); ok {
+			handler(req, tx)
+		}
+	}
+}
+
+func (a *authenticator) Authenticate(req sip.Request, tx sip.ServerTransaction) (string, bool) {
+	// RFC 3261 - 22.1. ACK and CANCEL can not be challenged.
+	if req.IsAck() || req.IsCancel() || tx == nil {
+		return "", true
+	}
+
+	logger := a.Log().WithFields(req.Fields())
+
+	auth := a.credentials(req)
+	if auth == nil {
+		a.challenge(req, tx, false, logger)
+		return "", false
+	}
+
+	username := auth.Username()
+	if auth.Nonce() == "" || auth.GetResponse() == "" || username == "" {
+		a.respond(tx, sip.NewResponseFromRequest("", req, 400, "Bad Request", ""), logger)
+		return "", false
+	}
+	if !isRequestUri(req, auth.Uri()) {
+		logger.Warnf("digest uri %s of %s doesn't match the Request-URI", auth.Uri(), username)
+		a.respond(tx, sip.NewResponseFromRequest("", req, 400, "Bad Request", ""), logger)
+		return "", false
+	}
+	if !a.offered(auth.Algorithm()) {
+		a.challenge(req, tx, false, logger)
+		return "", false
+	}
+
+	credentials, err := a.store.Credentials(username, a.config.Realm)
+	if err != nil {
+		logger.Errorf("get credentials of %s failed: %s", username, err)
+		a.respond(tx, sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""), logger)
+		return "", false
+	}
+	if credentials == nil || !a.verify(req, auth, credentials) {
+		logger.Warnf("authentication of %s failed", username)
+		a.respond(tx, sip.NewResponseFromRequest("", req, 403, "Forbidden", ""), logger)
+		return "", false
+	}
+
+	if value, ok := auth.Param("nc"); ok {
+		if _, err = strconv.ParseUint(value, 16, 32); err != nil {
+			a.respond(tx, sip.NewResponseFromRequest("", req, 400, "Bad Request", ""), logger)
+			return "", false
+		}
+	}
+
+	switch a.nonces.use(auth.Nonce(), uint64(auth.NonceCount())) {
+	case nonceValid:
+		return username, true
+	case nonceStale:
+		// credentials are valid, so the client can retry with the new nonce silently
+		a.challenge(req, tx, true, logger)
+	case nonceReplayed:
+		logger.Warnf("replayed nonce of %s rejected", username)
+		a.challenge(req, tx, false, logger)
+	default:
+		logger.Warnf("unknown nonce of %s rejected", username)
+		a.challenge(req, tx, false, logger)
+	}
+
+	return "", false
+}
+
+// credentials returns digest credentials of the request for own realm.
+func (a *authenticator) credentials(req sip.Request) *sip.Authorization {
+	for _, hdr := range req.GetHeaders(a.authorizationHeaderName()) {
+		if !strings.HasPrefix(strings.ToLower(hdr.Value()), "digest ") {
+			continue
+		}
+
+		auth := sip.AuthFromHeader(hdr)
+		if auth.Realm() == a.config.Realm {
+			return auth
+		}
+	}
+
+	return nil
+}
+
+// verify checks digest response - RFC 7616 - 3.4.1.
+func (a *authenticator) verify(req sip.Request, auth *sip.Authorization, credentials *Credentials) bool {
+	switch auth.Qop() {
+	case "", "auth", "auth-int":
+	default:
+		return false
+	}
+
+	response := auth.GetResponse()
+	auth.SetMethod(string(req.Method())).SetBody(req.Body())
+	if credentials.Password != "" {
+		auth.SetPassword(credentials.Password)
+	} else if credentials.HA1 != "" && isMD5(auth.Algorithm()) {
+		auth.SetHA1(credentials.HA1)
+	} else {
+		return false
+	}
+
+	return strings.EqualFold(auth.CalcResponse().GetResponse(), response)
+}
+
+// offered returns true if the algorithm is one of the challenged ones.
+func (a *authenticator) offered(algorithm string) bool {
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	for _, offered := range a.config.Algorithms {
+		if strings.EqualFold(algorithm, offered) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *authenticator) challenge(req sip.Request, tx sip.ServerTransaction, stale bool, logger log.Logger) {
+	nonce, err := a.nonces.issue()
+	if err != nil {
+		logger.Errorf("generate nonce failed: %s", err)
+		a.respond(tx, sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""), logger)
+		return
+	}
+
+	var res sip.Response
+	if a.config.Proxy {
+		res = sip.NewResponseFromRequest("", req, 407, "Proxy Authentication Required", "")
+	} else {
+		res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
+	}
+
+	for _, algorithm := range a.config.Algorithms {
+		value := sip.AuthValue{
+			Scheme: "Digest",
+			Params: []sip.AuthParam{
+				{Name: "realm", Value: a.config.Realm, Quoted: true},
+				{Name: "nonce", Value: nonce, Quoted: true},
+				{Name: "algorithm", Value: algorithm},
+				{Name: "qop", Value: "auth", Quoted: true},
+			},
+		}
+		if stale {
+			value.SetParam("stale", "true", false)
+		}
+
+		if a.config.Proxy {
+			res.AppendHeader(&sip.ProxyAuthenticateHeader{AuthValue: value})
+		} else {
+			res.AppendHeader(&sip.WWWAuthenticateHeader{AuthValue: value})
+		}
+	}
+
+	a.respond(tx, res, logger)
+}
+
+func (a *authenticator) respond(tx sip.ServerTransaction, res sip.Response, logger log.Logger) {
+	if err := tx.Respond(res); err != nil {
+		logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
+
+func (a *authenticator) authorizationHeaderName() string {
+	if a.config.Proxy {
+		return "Proxy-Authorization"
+	}
+
+	return "Authorization"
+}
+
+// isRequestUri checks that the digest uri is the Request-URI - RFC 7616 - 3.4.6.
+func isRequestUri(req sip.Request, value string) bool {
+	if value == req.Recipient().String() {
+		return true
+	}
+
+	uri, err := parser.ParseUri(value)
+	return err == nil && uri.Equals(req.Recipient())
+}
+
+func isMD5(algorithm string) bool {
+	return algorithm == "" || strings.EqualFold(algorithm, "MD5") || strings.EqualFold(algorithm, "MD5-sess")
+}
@@ -0,0 +1,219 @@
+package auth_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/auth"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+)
+
+// serverTx captures responses of the authenticator.
+type serverTx struct {
+	sip.ServerTransaction
+	responses []sip.Response
+}
+
+func (tx *serverTx) Respond(res sip.Response) error {
+	tx.responses = append(tx.responses, res)
+	return nil
+}
+
+func param(auth *sip.Authorization, name string) string {
+	value, _ := auth.Param(name)
+	return value
+}
+
+func md5Hex(value string) string {
+	sum := md5.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+var _ = Describe("Authenticator", func() {
+	var (
+		store         auth.MemoryCredentialStore
+		authenticator auth.Authenticator
+		config        auth.Config
+	)
+
+	register := func(extraHeaders ...string) sip.Request {
+		lines := []string{
+			"REGISTER sip:example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:alice@example.com>",
+			"Call-ID: call-1",
+			"CSeq: 1 REGISTER",
+		}
+		lines = append(lines, extraHeaders...)
+		lines = append(lines, "Content-Length: 0", "", "")
+		return testutils.Request(lines)
+	}
+	authenticate := func(req sip.Request) (sip.Response, bool) {
+		tx := &serverTx{}
+		_, ok := authenticator.Authenticate(req, tx)
+		if ok {
+			Expect(tx.responses).To(BeEmpty())
+			return nil, true
+		}
+		Expect(tx.responses).To(HaveLen(1))
+		return tx.responses[0], false
+	}
+	challenge := func() *sip.Authorization {
+		res, ok := authenticate(register())
+		Expect(ok).To(BeFalse())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		return sip.AuthFromValue(res.GetHeaders("WWW-Authenticate")[0].Value())
+	}
+	// authorization builds qop=auth credentials - RFC 2617 - 3.2.2.
+	authorization := func(nonce, password, nc string) string {
+		ha1 := md5Hex("alice:example.com:" + password)
+		ha2 := md5Hex("REGISTER:sip:example.com")
+		response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":0a4f113b:auth:" + ha2)
+		return fmt.Sprintf(
+			`Authorization: Digest username="alice", realm="example.com", nonce="%s", uri="sip:example.com", `+
+				`response="%s", algorithm=MD5, qop=auth, nc=%s, cnonce="0a4f113b"`,
+			nonce, response, nc,
+		)
+	}
+
+	BeforeEach(func() {
+		store = auth.NewMemoryCredentialStore()
+		store.Set("alice", auth.Credentials{Password: "secret"})
+		config = auth.Config{Realm: "example.com"}
+	})
+	JustBeforeEach(func() {
+		authenticator = auth.NewAuthenticator(store, config, testutils.NewLogrusLogger())
+	})
+
+	It("should challenge request without credentials", func() {
+		chal := challenge()
+		Expect(chal.Realm()).To(Equal("example.com"))
+		Expect(chal.Nonce()).ToNot(BeEmpty())
+		Expect(param(chal, "qop")).To(Equal("auth"))
+		Expect(param(chal, "stale")).To(BeEmpty())
+	})
+
+	It("should accept valid credentials and reject replayed nonce-count", func() {
+		nonce := challenge().Nonce()
+
+		_, ok := authenticate(register(authorization(nonce, "secret", "00000001")))
+		Expect(ok).To(BeTrue())
+		_, ok = authenticate(register(authorization(nonce, "secret", "00000002")))
+		Expect(ok).To(BeTrue())
+
+		res, ok := authenticate(register(authorization(nonce, "secret", "00000002")))
+		Expect(ok).To(BeFalse())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		chal := sip.AuthFromValue(res.GetHeaders("WWW-Authenticate")[0].Value())
+		// the replayed request is not retried silently
+		Expect(param(chal, "stale")).To(BeEmpty())
+		Expect(chal.Nonce()).ToNot(Equal(nonce))
+	})
+
+	It("should challenge unknown nonce without stale", func() {
+		res, ok := authenticate(register(authorization("unknown-nonce", "secret", "00000001")))
+		Expect(ok).To(BeFalse())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		chal := sip.AuthFromValue(res.GetHeaders("WWW-Authenticate")[0].Value())
+		Expect(param(chal, "stale")).To(BeEmpty())
+	})
+
+	It("should reject digest uri other than the Request-URI with 400", func() {
+		nonce := challenge().Nonce()
+
+		req := register(authorization(nonce, "secret", "00000001"))
+		req.SetRecipient(&sip.SipUri{FHost: "other.example.com"})
+		res, ok := authenticate(req)
+		Expect(ok).To(BeFalse())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(400)))
+	})
+
+	It("should accept legacy response of the client authorizer once", func() {
+		req := register()
+		res, _ := authenticate(req)
+		Expect(sip.AuthorizeRequest(req, res, sip.String{Str: "alice"}, sip.String{Str: "secret"})).To(Succeed())
+
+		_, ok := authenticate(req)
+		Expect(ok).To(BeTrue())
+		_, ok = authenticate(req)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should reject wrong password with 403", func() {
+		nonce := challenge().Nonce()
+
+		res, ok := authenticate(register(authorization(nonce, "wrong", "00000001")))
+		Expect(ok).To(BeFalse())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(403)))
+	})
+
+	Context("with HA1 credentials and short nonce expiry", func() {
+		BeforeEach(func() {
+			store.Set("alice", auth.Credentials{HA1: md5Hex("alice:example.com:secret")})
+			config.NonceExpiry = 50 * time.Millisecond
+		})
+
+		It("should signal stale=true for expired nonce", func() {
+			nonce := challenge().Nonce()
+			time.Sleep(100 * time.Millisecond)
+
+			res, ok := authenticate(register(authorization(nonce, "secret", "00000001")))
+			Expect(ok).To(BeFalse())
+			Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+			Expect(param(sip.AuthFromValue(res.GetHeaders("WWW-Authenticate")[0].Value()), "stale")).To(Equal("true"))
+
+			nonce = challenge().Nonce()
+			_, ok = authenticate(register(authorization(nonce, "secret", "00000001")))
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("with nonce expiry", func() {
+		BeforeEach(func() {
+			config.NonceExpiry = 200 * time.Millisecond
+		})
+
+		It("should signal stale=true for expired nonce after new nonces were issued", func() {
+			nonce := challenge().Nonce()
+			time.Sleep(250 * time.Millisecond)
+			// issuing the new nonce prunes the old ones
+			challenge()
+
+			res, ok := authenticate(register(authorization(nonce, "secret", "00000001")))
+			Expect(ok).To(BeFalse())
+			Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+			Expect(param(sip.AuthFromValue(res.GetHeaders("WWW-Authenticate")[0].Value()), "stale")).To(Equal("true"))
+		})
+	})
+
+	Context("as proxy", func() {
+		BeforeEach(func() {
+			config.Proxy = true
+		})
+
+		It("should challenge with 407 and wrap the handler", func() {
+			called := false
+			handler := authenticator.Wrap(func(req sip.Request, tx sip.ServerTransaction) {
+				called = true
+			})
+
+			tx := &serverTx{}
+			handler(register(), tx)
+			Expect(called).To(BeFalse())
+			Expect(tx.responses[0].StatusCode()).To(Equal(sip.StatusCode(407)))
+			Expect(tx.responses[0].GetHeaders("Proxy-Authenticate")).To(HaveLen(1))
+
+			req := register()
+			Expect(sip.AuthorizeRequest(req, tx.responses[0], sip.String{Str: "alice"}, sip.String{Str: "secret"})).To(Succeed())
+			handler(req, &serverTx{})
+			Expect(called).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"sync"
+)
+
+// Credentials of the user, HA1 is used if Password is empty.
+type Credentials struct {
+	Password string
+	// HA1 is precomputed hex encoded MD5(username:realm:password) - RFC 2617 - 3.2.2.2.
+	HA1 string
+}
+
+// CredentialStore supplies credentials to check requests against.
+type CredentialStore interface {
+	// Credentials returns credentials of the user in the realm, nil if the user is unknown.
+	Credentials(username, realm string) (*Credentials, error)
+}
+
+// CredentialStoreFunc is an adapter to use function as CredentialStore.
+type CredentialStoreFunc func(username, realm string) (*Credentials, error)
+
+func (f CredentialStoreFunc) Credentials(username, realm string) (*Credentials, error) {
+	return f(username, realm)
+}
+
+// MemoryCredentialStore keeps credentials of the users in memory.
+type MemoryCredentialStore interface {
+	CredentialStore
+	Set(username string, credentials Credentials)
+	Remove(username string)
+}
+
+type memoryCredentialStore struct {
+	credentials map[string]Credentials
+	mu          sync.RWMutex
+}
+
+func NewMemoryCredentialStore() MemoryCredentialStore {
+	return &memoryCredentialStore{
+		credentials: make(map[string]Credentials),
+	}
+}
+
+func (store *memoryCredentialStore) Credentials(username, realm string) (*Credentials, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	credentials, ok := store.credentials[username]
+	if !ok {
+		return nil, nil
+	}
+
+	return &credentials, nil
+}
+
+func (store *memoryCredentialStore) Set(username string, credentials Credentials) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.credentials[username] = credentials
+}
+
+func (store *memoryCredentialStore) Remove(username string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.credentials, username)
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/timing"
+)
+
+type nonceStatus int
+
+const (
+	nonceValid nonceStatus = iota
+	nonceUnknown
+	nonceStale
+	nonceReplayed
+)
+
+type nonceEntry struct {
+	issued time.Time
+	// nc is the last accepted nonce-count
+	nc uint64
+}
+
+// nonceStore tracks issued nonces, so expired and replayed ones are rejected.
+type nonceStore struct {
+	expiry    time.Duration
+	nonces    map[string]*nonceEntry
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+func newNonceStore(expiry time.Duration) *nonceStore {
+	return &nonceStore{
+		expiry:    expiry,
+		nonces:    make(map[string]*nonceEntry),
+		lastPrune: timing.Now(),
+	}
+}
+
+func (store *nonceStore) issue() (string, error) {
+	// nonce must be unpredictable, so crypto/rand is used
+	randomness := make([]byte, 16)
+	if _, err := rand.Read(randomness); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(randomness)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := timing.Now()
+	store.prune(now)
+	store.nonces[nonce] = &nonceEntry{issued: now}
+
+	return nonce, nil
+}
+
+// use checks the nonce and stores nonce-count of the request,
+// nc is 0 for requests without qop, then the nonce can be used only once.
+func (store *nonceStore) use(nonce string, nc uint64) nonceStatus {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.nonces[nonce]
+	if !ok {
+		return nonceUnknown
+	}
+	if timing.Now().Sub(entry.issued) > store.expiry {
+		return nonceStale
+	}
+
+	if nc == 0 {
+		nc = 1
+	}
+	if nc <= entry.nc {
+		return nonceReplayed
+	}
+	entry.nc = nc
+
+	return nonceValid
+}
+
+// prune removes expired nonces once per expiry interval.
+// Expired nonces are kept for one more expiry interval, so the client retrying with them gets stale=true.
+func (store *nonceStore) prune(now time.Time) {
+	if now.Sub(store.lastPrune) < store.expiry {
+		return
+	}
+	store.lastPrune = now
+
+	for nonce, entry := range store.nonces {
+		if now.Sub(entry.issued) > 2*store.expiry {
+			delete(store.nonces, nonce)
+		}
+	}
+}
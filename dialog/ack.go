@@ -0,0 +1,138 @@
+package dialog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/timing"
+	"github.com/ygj201011/gosip/transaction"
+)
+
+// NoAckError is reported on the dialog when ACK for 2xx response on INVITE
+// was not received in 64*T1 - RFC 3261 - 13.3.1.4.
+// The application should terminate the dialog with BYE.
+type NoAckError struct {
+	DialogID string
+	Response sip.Response
+}
+
+func (err *NoAckError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("no ACK received for '%s' in dialog %s", err.Response.Short(), err.DialogID)
+}
+
+// ackWaiter retransmits 2xx response on INVITE until the ACK arrives.
+type ackWaiter struct {
+	seqNo uint32
+	done  chan struct{}
+}
+
+// waitAck starts 2xx response retransmission with T1/T2 backoff.
+// Response is not retransmitted over reliable transport, but ACK is still awaited.
+func (dl *layer) waitAck(dlg *dialog, res sip.Response) {
+	cseq, ok := res.CSeq()
+	if !ok {
+		return
+	}
+
+	waiter := &ackWaiter{
+		seqNo: cseq.SeqNo,
+		done:  make(chan struct{}),
+	}
+
+	dlg.mu.Lock()
+	if dlg.ackWaiter != nil {
+		close(dlg.ackWaiter.done)
+	}
+	dlg.ackWaiter = waiter
+	dlg.mu.Unlock()
+
+	reliable := dl.tpl.IsReliable(res.Transport())
+	res = sip.CopyResponse(res)
+
+	go func() {
+		timeout := timing.After(64 * transaction.T1)
+
+		var retransmit <-chan time.Time
+		interval := transaction.T1
+		if !reliable {
+			retransmit = timing.After(interval)
+		}
+
+		for {
+			select {
+			case <-waiter.done:
+				return
+			case <-dlg.Done():
+				return
+			case <-dl.canceled:
+				return
+			case <-retransmit:
+				dlg.Log().Debugf("retransmitting '%s'", res.Short())
+
+				if err := dl.tpl.Send(res); err != nil {
+					dlg.Log().Warnf("retransmit '%s' failed: %s", res.Short(), err)
+				}
+
+				interval *= 2
+				if interval > transaction.T2 {
+					interval = transaction.T2
+				}
+				retransmit = timing.After(interval)
+			case <-timeout:
+				dlg.mu.Lock()
+				if dlg.ackWaiter != waiter {
+					// ACK was received concurrently
+					dlg.mu.Unlock()
+					return
+				}
+				dlg.ackWaiter = nil
+				dlg.mu.Unlock()
+
+				err := &NoAckError{
+					DialogID: dlg.ID(),
+					Response: res,
+				}
+
+				dlg.Log().Warn(err)
+				dlg.reportError(err)
+
+				return
+			}
+		}
+	}()
+}
+
+// receiveAck stops 2xx retransmission when ACK matches by CSeq.
+func (dlg *dialog) receiveAck(ack sip.Request) bool {
+	cseq, ok := ack.CSeq()
+	if !ok {
+		return false
+	}
+
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.ackWaiter == nil || dlg.ackWaiter.seqNo != cseq.SeqNo {
+		return false
+	}
+
+	close(dlg.ackWaiter.done)
+	dlg.ackWaiter = nil
+
+	return true
+}
+
+func (dlg *dialog) stopAckWaiter() {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.ackWaiter != nil {
+		close(dlg.ackWaiter.done)
+		dlg.ackWaiter = nil
+	}
+}
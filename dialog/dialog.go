@@ -0,0 +1,593 @@
+// dialog package implements SIP dialog tracking - RFC 3261 - 12.
+package dialog
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+)
+
+// target refresh requests update remote target of the dialog - RFC 3261 - 12.2, RFC 3311, RFC 6665.
+var targetRefreshMethods = map[sip.RequestMethod]bool{
+	sip.INVITE:    true,
+	sip.UPDATE:    true,
+	sip.SUBSCRIBE: true,
+	sip.NOTIFY:    true,
+	sip.REFER:     true,
+}
+
+// dialog creating requests - RFC 3261 - 12.1, RFC 6665 - 4.1.2.
+var creatingMethods = map[sip.RequestMethod]bool{
+	sip.INVITE:    true,
+	sip.SUBSCRIBE: true,
+}
+
+type dialog struct {
+	id           string
+	state        sip.DialogState
+	server       bool
+	callID       sip.CallID
+	localTag     string
+	remoteTag    string
+	localUri     *sip.Address
+	remoteUri    *sip.Address
+	localTarget  sip.Uri
+	remoteTarget sip.Uri
+	routeSet     []sip.Uri
+	localSeq     uint32
+	remoteSeq    uint32
+	inviteSeq    uint32
+	secure       bool
+	transport    string
+
+	ackWaiter   *ackWaiter
+	done        chan struct{}
+	errs        chan error
+	closeOnce   sync.Once
+	onTerminate func(dlg *dialog)
+	mu          sync.RWMutex
+
+	log log.Logger
+}
+
+// newClientDialog creates UAC dialog from the response on the dialog creating request - RFC 3261 - 12.1.2.
+// The route set and the remote target are taken from the response.
+func newClientDialog(req sip.Request, res sip.Response, logger log.Logger) (*dialog, error) {
+	callID, ok := req.CallID()
+	if !ok {
+		return nil, fmt.Errorf("missing 'Call-ID' header in request '%s'", req.Short())
+	}
+	from, ok := req.From()
+	if !ok {
+		return nil, fmt.Errorf("missing 'From' header in request '%s'", req.Short())
+	}
+	to, ok := res.To()
+	if !ok {
+		return nil, fmt.Errorf("missing 'To' header in response '%s'", res.Short())
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return nil, fmt.Errorf("missing 'CSeq' header in request '%s'", req.Short())
+	}
+	localTag, ok := from.Params.Get("tag")
+	if !ok {
+		return nil, fmt.Errorf("missing tag param in 'From' header of request '%s'", req.Short())
+	}
+	remoteTag, ok := to.Params.Get("tag")
+	if !ok {
+		return nil, fmt.Errorf("missing tag param in 'To' header of response '%s'", res.Short())
+	}
+
+	dlg := &dialog{
+		state:     sip.DialogStateEarly,
+		server:    false,
+		callID:    *callID,
+		localTag:  localTag.String(),
+		remoteTag: remoteTag.String(),
+		localUri:  addressWithoutTag(sip.NewAddressFromFromHeader(from)),
+		remoteUri: addressWithoutTag(sip.NewAddressFromToHeader(to)),
+		routeSet:  reverseUris(recordRoutes(res)),
+		localSeq:  cseq.SeqNo,
+		transport: req.Transport(),
+		secure:    req.Recipient().IsEncrypted() && req.Transport() == "TLS",
+		done:      make(chan struct{}),
+		errs:      make(chan error, 1),
+	}
+	if cseq.MethodName == sip.INVITE {
+		dlg.inviteSeq = cseq.SeqNo
+	}
+	if contact, ok := req.Contact(); ok {
+		dlg.localTarget = contact.Address.Clone()
+	}
+	if contact, ok := res.Contact(); ok {
+		dlg.remoteTarget = contact.Address.Clone()
+	} else {
+		dlg.remoteTarget = req.Recipient().Clone()
+	}
+	if res.IsSuccess() {
+		dlg.state = sip.DialogStateConfirmed
+	}
+	dlg.init(logger)
+
+	return dlg, nil
+}
+
+// newServerDialog creates UAS dialog from the received request and the response sent on it - RFC 3261 - 12.1.1.
+// The route set and the remote target are taken from the request.
+func newServerDialog(req sip.Request, res sip.Response, logger log.Logger) (*dialog, error) {
+	callID, ok := req.CallID()
+	if !ok {
+		return nil, fmt.Errorf("missing 'Call-ID' header in request '%s'", req.Short())
+	}
+	from, ok := req.From()
+	if !ok {
+		return nil, fmt.Errorf("missing 'From' header in request '%s'", req.Short())
+	}
+	to, ok := res.To()
+	if !ok {
+		return nil, fmt.Errorf("missing 'To' header in response '%s'", res.Short())
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return nil, fmt.Errorf("missing 'CSeq' header in request '%s'", req.Short())
+	}
+	remoteTag, ok := from.Params.Get("tag")
+	if !ok {
+		return nil, fmt.Errorf("missing tag param in 'From' header of request '%s'", req.Short())
+	}
+	localTag, ok := to.Params.Get("tag")
+	if !ok {
+		return nil, fmt.Errorf("missing tag param in 'To' header of response '%s'", res.Short())
+	}
+
+	dlg := &dialog{
+		state:     sip.DialogStateEarly,
+		server:    true,
+		callID:    *callID,
+		localTag:  localTag.String(),
+		remoteTag: remoteTag.String(),
+		localUri:  addressWithoutTag(sip.NewAddressFromToHeader(to)),
+		remoteUri: addressWithoutTag(sip.NewAddressFromFromHeader(from)),
+		routeSet:  recordRoutes(req),
+		remoteSeq: cseq.SeqNo,
+		transport: req.Transport(),
+		secure:    req.Recipient().IsEncrypted() && req.Transport() == "TLS",
+		done:      make(chan struct{}),
+		errs:      make(chan error, 1),
+	}
+	if contact, ok := req.Contact(); ok {
+		dlg.remoteTarget = contact.Address.Clone()
+	}
+	if contact, ok := res.Contact(); ok {
+		dlg.localTarget = contact.Address.Clone()
+	}
+	if res.IsSuccess() {
+		dlg.state = sip.DialogStateConfirmed
+	}
+	dlg.init(logger)
+
+	return dlg, nil
+}
+
+// newNotifyDialog creates UAC dialog from NOTIFY request received on pending SUBSCRIBE - RFC 6665 - 4.1.2.4.
+func newNotifyDialog(subscribe sip.Request, notify sip.Request, logger log.Logger) (*dialog, error) {
+	callID, ok := subscribe.CallID()
+	if !ok {
+		return nil, fmt.Errorf("missing 'Call-ID' header in request '%s'", subscribe.Short())
+	}
+	from, ok := subscribe.From()
+	if !ok {
+		return nil, fmt.Errorf("missing 'From' header in request '%s'", subscribe.Short())
+	}
+	notifyFrom, ok := notify.From()
+	if !ok {
+		return nil, fmt.Errorf("missing 'From' header in request '%s'", notify.Short())
+	}
+	cseq, ok := subscribe.CSeq()
+	if !ok {
+		return nil, fmt.Errorf("missing 'CSeq' header in request '%s'", subscribe.Short())
+	}
+	notifyCSeq, ok := notify.CSeq()
+	if !ok {
+		return nil, fmt.Errorf("missing 'CSeq' header in request '%s'", notify.Short())
+	}
+	localTag, ok := from.Params.Get("tag")
+	if !ok {
+		return nil, fmt.Errorf("missing tag param in 'From' header of request '%s'", subscribe.Short())
+	}
+	remoteTag, ok := notifyFrom.Params.Get("tag")
+	if !ok {
+		return nil, fmt.Errorf("missing tag param in 'From' header of request '%s'", notify.Short())
+	}
+
+	dlg := &dialog{
+		state:     sip.DialogStateConfirmed,
+		server:    false,
+		callID:    *callID,
+		localTag:  localTag.String(),
+		remoteTag: remoteTag.String(),
+		localUri:  addressWithoutTag(sip.NewAddressFromFromHeader(from)),
+		remoteUri: addressWithoutTag(sip.NewAddressFromFromHeader(notifyFrom)),
+		routeSet:  recordRoutes(notify),
+		localSeq:  cseq.SeqNo,
+		remoteSeq: notifyCSeq.SeqNo,
+		transport: subscribe.Transport(),
+		secure:    subscribe.Recipient().IsEncrypted() && subscribe.Transport() == "TLS",
+		done:      make(chan struct{}),
+		errs:      make(chan error, 1),
+	}
+	if contact, ok := subscribe.Contact(); ok {
+		dlg.localTarget = contact.Address.Clone()
+	}
+	if contact, ok := notify.Contact(); ok {
+		dlg.remoteTarget = contact.Address.Clone()
+	} else {
+		dlg.remoteTarget = subscribe.Recipient().Clone()
+	}
+	dlg.init(logger)
+
+	return dlg, nil
+}
+
+func (dlg *dialog) init(logger log.Logger) {
+	dlg.id = sip.MakeDialogID(string(dlg.callID), dlg.localTag, dlg.remoteTag)
+	dlg.log = logger.
+		WithPrefix("dialog.Dialog").
+		WithFields(log.Fields{
+			"dialog_ptr": fmt.Sprintf("%p", dlg),
+			"dialog_id":  dlg.id,
+		})
+}
+
+func (dlg *dialog) String() string {
+	if dlg == nil {
+		return "<nil>"
+	}
+
+	fields := dlg.Log().Fields().WithFields(log.Fields{
+		"state":  dlg.State(),
+		"server": dlg.server,
+	})
+
+	return fmt.Sprintf("dialog.Dialog<%s>", fields)
+}
+
+func (dlg *dialog) Log() log.Logger {
+	return dlg.log
+}
+
+func (dlg *dialog) ID() string {
+	return dlg.id
+}
+
+func (dlg *dialog) State() sip.DialogState {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.state
+}
+
+func (dlg *dialog) Server() bool {
+	return dlg.server
+}
+
+func (dlg *dialog) CallID() sip.CallID {
+	return dlg.callID
+}
+
+func (dlg *dialog) LocalTag() string {
+	return dlg.localTag
+}
+
+func (dlg *dialog) RemoteTag() string {
+	return dlg.remoteTag
+}
+
+func (dlg *dialog) LocalUri() *sip.Address {
+	return dlg.localUri.Clone()
+}
+
+func (dlg *dialog) RemoteUri() *sip.Address {
+	return dlg.remoteUri.Clone()
+}
+
+func (dlg *dialog) LocalTarget() sip.Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	if dlg.localTarget == nil {
+		return nil
+	}
+	return dlg.localTarget.Clone()
+}
+
+func (dlg *dialog) RemoteTarget() sip.Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	if dlg.remoteTarget == nil {
+		return nil
+	}
+	return dlg.remoteTarget.Clone()
+}
+
+func (dlg *dialog) RouteSet() []sip.Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	routes := make([]sip.Uri, len(dlg.routeSet))
+	for i, uri := range dlg.routeSet {
+		routes[i] = uri.Clone()
+	}
+	return routes
+}
+
+func (dlg *dialog) LocalSeq() uint32 {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.localSeq
+}
+
+func (dlg *dialog) RemoteSeq() uint32 {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.remoteSeq
+}
+
+func (dlg *dialog) Secure() bool {
+	return dlg.secure
+}
+
+func (dlg *dialog) Done() <-chan struct{} {
+	return dlg.done
+}
+
+func (dlg *dialog) Errors() <-chan error {
+	return dlg.errs
+}
+
+func (dlg *dialog) NewRequest(method sip.RequestMethod) (sip.Request, error) {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.state == sip.DialogStateTerminated {
+		return nil, fmt.Errorf("%s is terminated", dlg)
+	}
+	if dlg.remoteTarget == nil {
+		return nil, fmt.Errorf("%s has no remote target", dlg)
+	}
+
+	var seqNo uint32
+	switch method {
+	case sip.ACK:
+		seqNo = dlg.inviteSeq
+	case sip.CANCEL:
+		seqNo = dlg.localSeq
+	default:
+		// RFC 3261 - 12.2.1.1. If the local sequence number is empty, an initial value MUST be chosen.
+		if dlg.localSeq == 0 {
+			dlg.localSeq = 1
+		} else {
+			dlg.localSeq++
+		}
+		seqNo = dlg.localSeq
+		if method == sip.INVITE {
+			dlg.inviteSeq = seqNo
+		}
+	}
+
+	// RFC 3261 - 12.2.1.1. Loose and strict routing of the request within dialog.
+	recipient := dlg.remoteTarget.Clone()
+	routes := make([]sip.Uri, 0, len(dlg.routeSet)+1)
+	for _, uri := range dlg.routeSet {
+		routes = append(routes, uri.Clone())
+	}
+	if len(routes) > 0 && !isLooseRoute(routes[0]) {
+		recipient = routes[0]
+		if params := recipient.UriParams(); params != nil {
+			params.Remove("lr").Remove("maddr").Remove("ttl").Remove("method")
+		}
+		routes = append(routes[1:], dlg.remoteTarget.Clone())
+	}
+
+	hdrs := make([]sip.Header, 0)
+
+	var viaHost string
+	if dlg.localTarget != nil {
+		viaHost = dlg.localTarget.Host()
+	}
+	hdrs = append(hdrs, sip.ViaHeader{
+		&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       dlg.transport,
+			Host:            viaHost,
+			Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		},
+	})
+	if len(routes) > 0 {
+		hdrs = append(hdrs, &sip.RouteHeader{Addresses: routes})
+	}
+
+	maxForwards := sip.MaxForwards(70)
+	from := dlg.localUri.AsFromHeader()
+	if from.Params == nil {
+		from.Params = sip.NewParams()
+	}
+	from.Params.Add("tag", sip.String{Str: dlg.localTag})
+	to := dlg.remoteUri.AsToHeader()
+	if to.Params == nil {
+		to.Params = sip.NewParams()
+	}
+	to.Params.Add("tag", sip.String{Str: dlg.remoteTag})
+	callID := dlg.callID
+
+	hdrs = append(hdrs,
+		&maxForwards,
+		from,
+		to,
+		&callID,
+		&sip.CSeq{SeqNo: seqNo, MethodName: method},
+	)
+
+	if targetRefreshMethods[method] && dlg.localTarget != nil {
+		hdrs = append(hdrs, &sip.ContactHeader{
+			Address: dlg.localTarget.Clone(),
+			Params:  sip.NewParams(),
+		})
+	}
+
+	req := sip.NewRequest(
+		"",
+		method,
+		recipient,
+		"SIP/2.0",
+		hdrs,
+		"",
+		log.Fields{
+			"dialog_id": dlg.id,
+		},
+	)
+	req.SetBody("", true)
+
+	return req, nil
+}
+
+func (dlg *dialog) Terminate() {
+	dlg.mu.Lock()
+	if dlg.state == sip.DialogStateTerminated {
+		dlg.mu.Unlock()
+		return
+	}
+	dlg.state = sip.DialogStateTerminated
+	dlg.mu.Unlock()
+
+	dlg.stopAckWaiter()
+
+	dlg.closeOnce.Do(func() {
+		close(dlg.done)
+
+		dlg.Log().Debug("dialog terminated")
+	})
+
+	if dlg.onTerminate != nil {
+		dlg.onTerminate(dlg)
+	}
+}
+
+// reportError passes error to the application, error is dropped when nobody listens.
+func (dlg *dialog) reportError(err error) {
+	select {
+	case dlg.errs <- err:
+	default:
+		dlg.Log().Warnf("dialog error dropped: %s", err)
+	}
+}
+
+func (dlg *dialog) confirm() {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.state == sip.DialogStateEarly {
+		dlg.state = sip.DialogStateConfirmed
+
+		dlg.Log().Debug("dialog confirmed")
+	}
+}
+
+// receiveRequest validates and applies request received within the dialog - RFC 3261 - 12.2.2.
+func (dlg *dialog) receiveRequest(req sip.Request) error {
+	cseq, ok := req.CSeq()
+	if !ok {
+		return fmt.Errorf("missing 'CSeq' header in request '%s'", req.Short())
+	}
+
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if !req.IsAck() && !req.IsCancel() {
+		if dlg.remoteSeq != 0 && cseq.SeqNo < dlg.remoteSeq {
+			return sip.NewRequestError(500, "Server Internal Error", req, nil)
+		}
+
+		dlg.remoteSeq = cseq.SeqNo
+	}
+
+	if targetRefreshMethods[req.Method()] {
+		if contact, ok := req.Contact(); ok {
+			dlg.remoteTarget = contact.Address.Clone()
+		}
+	}
+
+	return nil
+}
+
+// receiveResponse applies response on request sent within the dialog - RFC 3261 - 12.2.1.2.
+func (dlg *dialog) receiveResponse(res sip.Response) {
+	cseq, ok := res.CSeq()
+	if !ok {
+		return
+	}
+
+	if res.StatusCode() == 481 || res.StatusCode() == 408 {
+		dlg.Terminate()
+		return
+	}
+
+	if cseq.MethodName == sip.BYE && !res.IsProvisional() {
+		dlg.Terminate()
+		return
+	}
+
+	if res.IsSuccess() && targetRefreshMethods[cseq.MethodName] {
+		if contact, ok := res.Contact(); ok {
+			dlg.mu.Lock()
+			dlg.remoteTarget = contact.Address.Clone()
+			dlg.mu.Unlock()
+		}
+	}
+}
+
+// updateEarly refreshes route set and remote target of the UAC dialog
+// on response to the dialog creating request - RFC 3261 - 12.1.2, 13.2.2.4.
+func (dlg *dialog) updateEarly(res sip.Response) {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.state != sip.DialogStateEarly {
+		return
+	}
+
+	dlg.routeSet = reverseUris(recordRoutes(res))
+	if contact, ok := res.Contact(); ok {
+		dlg.remoteTarget = contact.Address.Clone()
+	}
+}
+
+func addressWithoutTag(addr *sip.Address) *sip.Address {
+	if addr.Params != nil {
+		addr.Params.Remove("tag")
+	}
+	return addr
+}
+
+func recordRoutes(msg sip.Message) []sip.Uri {
+	uris := make([]sip.Uri, 0)
+	for _, hdr := range msg.GetHeaders("Record-Route") {
+		if rr, ok := hdr.(*sip.RecordRouteHeader); ok {
+			for _, uri := range rr.Addresses {
+				uris = append(uris, uri.Clone())
+			}
+		}
+	}
+	return uris
+}
+
+func reverseUris(uris []sip.Uri) []sip.Uri {
+	for i, j := 0, len(uris)-1; i < j; i, j = i+1, j-1 {
+		uris[i], uris[j] = uris[j], uris[i]
+	}
+	return uris
+}
+
+func isLooseRoute(uri sip.Uri) bool {
+	return uri.UriParams() != nil && uri.UriParams().Has("lr")
+}
@@ -0,0 +1,601 @@
+package dialog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/timing"
+	"github.com/ygj201011/gosip/transaction"
+	"github.com/ygj201011/gosip/util"
+)
+
+// Layer tracks dialogs created and used by the UA core - RFC 3261 - 12.
+// It should be fed with every request and response that passes through the core.
+type Layer interface {
+	Cancel()
+	Done() <-chan struct{}
+	String() string
+	// Get returns dialog by ID.
+	Get(id string) (sip.Dialog, bool)
+	All() []sip.Dialog
+	// Match returns dialog that the message belongs to.
+	Match(msg sip.Message) (sip.Dialog, bool)
+	// Request handles request sent by the UAC core.
+	// Should be called before the request is sent, so responses can't outrun the dialog.
+	Request(req sip.Request) (sip.Dialog, error)
+	// ReceiveResponse handles response received by the UAC core.
+	ReceiveResponse(res sip.Response) (sip.Dialog, error)
+	// ReceiveRequest handles request received by the UAS core.
+	// Returns *sip.RequestError if the request should be rejected.
+	ReceiveRequest(req sip.Request) (sip.Dialog, error)
+	// Respond handles response sent by the UAS core.
+	// Should be called before the response is sent, because it adds
+	// 'To' tag to dialog creating responses.
+	// 2xx responses on INVITE are retransmitted until the ACK arrives,
+	// *NoAckError is reported on the dialog errors channel otherwise.
+	Respond(res sip.Response) (sip.Dialog, error)
+}
+
+// pendingTimeout limits how long the dialog creating request waits for the final response,
+// matches proxy Timer C - RFC 3261 - 16.6.
+const pendingTimeout = 3 * time.Minute
+
+type pendingRequest struct {
+	req      sip.Request
+	localTag string
+	final    bool
+	timer    timing.Timer
+}
+
+type layer struct {
+	tpl           sip.Transport
+	dialogs       map[string]*dialog
+	clientPending map[transaction.TxKey]*pendingRequest
+	serverPending map[transaction.TxKey]*pendingRequest
+
+	canceled   chan struct{}
+	done       chan struct{}
+	cancelOnce sync.Once
+	mu         sync.RWMutex
+
+	log log.Logger
+}
+
+func NewLayer(tpl sip.Transport, logger log.Logger) Layer {
+	dl := &layer{
+		tpl:           tpl,
+		dialogs:       make(map[string]*dialog),
+		clientPending: make(map[transaction.TxKey]*pendingRequest),
+		serverPending: make(map[transaction.TxKey]*pendingRequest),
+
+		canceled: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	dl.log = logger.
+		WithPrefix("dialog.Layer").
+		WithFields(log.Fields{
+			"dialog_layer_ptr": fmt.Sprintf("%p", dl),
+		})
+
+	return dl
+}
+
+func (dl *layer) String() string {
+	if dl == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("dialog.Layer<%s>", dl.Log().Fields())
+}
+
+func (dl *layer) Log() log.Logger {
+	return dl.log
+}
+
+func (dl *layer) Cancel() {
+	select {
+	case <-dl.canceled:
+		return
+	default:
+	}
+
+	dl.cancelOnce.Do(func() {
+		close(dl.canceled)
+
+		for _, dlg := range dl.all() {
+			dlg.Terminate()
+		}
+
+		dl.mu.Lock()
+		for key, pending := range dl.clientPending {
+			pending.timer.Stop()
+			delete(dl.clientPending, key)
+		}
+		for key, pending := range dl.serverPending {
+			pending.timer.Stop()
+			delete(dl.serverPending, key)
+		}
+		dl.mu.Unlock()
+
+		close(dl.done)
+
+		dl.Log().Debug("dialog layer canceled")
+	})
+}
+
+func (dl *layer) Done() <-chan struct{} {
+	return dl.done
+}
+
+func (dl *layer) Get(id string) (sip.Dialog, bool) {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	dlg, ok := dl.dialogs[id]
+	if !ok {
+		return nil, false
+	}
+	return dlg, true
+}
+
+func (dl *layer) All() []sip.Dialog {
+	all := make([]sip.Dialog, 0)
+	for _, dlg := range dl.all() {
+		all = append(all, dlg)
+	}
+	return all
+}
+
+func (dl *layer) Match(msg sip.Message) (sip.Dialog, bool) {
+	dlg, ok := dl.match(msg)
+	if !ok {
+		return nil, false
+	}
+	return dlg, true
+}
+
+func (dl *layer) Request(req sip.Request) (sip.Dialog, error) {
+	select {
+	case <-dl.canceled:
+		return nil, fmt.Errorf("dialog layer is canceled")
+	default:
+	}
+
+	if req.IsAck() || req.IsCancel() {
+		dlg, ok := dl.match(req)
+		if !ok {
+			return nil, nil
+		}
+		return dlg, nil
+	}
+
+	if creatingMethods[req.Method()] && !hasToTag(req) {
+		key, err := transaction.MakeClientTxKey(req)
+		if err != nil {
+			return nil, err
+		}
+
+		dl.mu.Lock()
+		dl.clientPending[key] = &pendingRequest{
+			req:   req,
+			timer: dl.forgetAfter(dl.clientPending, key, pendingTimeout),
+		}
+		dl.mu.Unlock()
+
+		return nil, nil
+	}
+
+	dlg, ok := dl.match(req)
+	if !ok {
+		return nil, nil
+	}
+
+	// keep local sequence in sync with requests built outside of the dialog
+	if cseq, ok := req.CSeq(); ok {
+		dlg.mu.Lock()
+		if cseq.SeqNo > dlg.localSeq {
+			dlg.localSeq = cseq.SeqNo
+		}
+		if req.IsInvite() {
+			dlg.inviteSeq = cseq.SeqNo
+		}
+		dlg.mu.Unlock()
+	}
+
+	return dlg, nil
+}
+
+func (dl *layer) ReceiveResponse(res sip.Response) (sip.Dialog, error) {
+	select {
+	case <-dl.canceled:
+		return nil, fmt.Errorf("dialog layer is canceled")
+	default:
+	}
+
+	key, err := transaction.MakeClientTxKey(res)
+	if err == nil {
+		dl.mu.RLock()
+		pending, ok := dl.clientPending[key]
+		dl.mu.RUnlock()
+
+		if ok {
+			return dl.receiveCreatingResponse(key, pending.req, res)
+		}
+	}
+
+	dlg, ok := dl.match(res)
+	if !ok {
+		return nil, nil
+	}
+
+	dlg.receiveResponse(res)
+
+	return dlg, nil
+}
+
+func (dl *layer) receiveCreatingResponse(key transaction.TxKey, req sip.Request, res sip.Response) (sip.Dialog, error) {
+	if !res.IsProvisional() {
+		dl.forgetClientRequest(key, req)
+	}
+
+	if res.StatusCode() >= 300 {
+		// RFC 3261 - 12.3. Non-2xx final response terminates all early dialogs created by the request.
+		localTag := fromTag(req)
+		for _, dlg := range dl.all() {
+			if !dlg.Server() && dlg.CallID() == callIDOf(req) && dlg.LocalTag() == localTag &&
+				dlg.State() == sip.DialogStateEarly {
+
+				dlg.Terminate()
+			}
+		}
+
+		return nil, nil
+	}
+
+	if res.StatusCode() == 100 || !hasToTag(res) {
+		return nil, nil
+	}
+
+	if dlg, ok := dl.match(res); ok {
+		if res.IsSuccess() {
+			dlg.updateEarly(res)
+			dlg.confirm()
+		} else {
+			dlg.updateEarly(res)
+		}
+
+		return dlg, nil
+	}
+
+	dlg, err := newClientDialog(req, res, dl.Log())
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to create dialog from '%s': %w", dl, res.Short(), err)
+	}
+
+	dl.put(dlg)
+
+	return dlg, nil
+}
+
+// forgetClientRequest drops pending request after final response.
+// INVITE request is kept a bit longer to catch 2xx responses from the other forks.
+func (dl *layer) forgetClientRequest(key transaction.TxKey, req sip.Request) {
+	if !req.IsInvite() {
+		dl.mu.Lock()
+		if pending, ok := dl.clientPending[key]; ok {
+			pending.timer.Stop()
+			delete(dl.clientPending, key)
+		}
+		dl.mu.Unlock()
+
+		return
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	pending, ok := dl.clientPending[key]
+	if !ok || pending.final {
+		return
+	}
+
+	pending.final = true
+	pending.timer.Stop()
+	pending.timer = dl.forgetAfter(dl.clientPending, key, transaction.Timer_M)
+}
+
+func (dl *layer) forgetAfter(
+	store map[transaction.TxKey]*pendingRequest,
+	key transaction.TxKey,
+	timeout time.Duration,
+) timing.Timer {
+	return timing.AfterFunc(timeout, func() {
+		dl.mu.Lock()
+		delete(store, key)
+		dl.mu.Unlock()
+	})
+}
+
+func (dl *layer) ReceiveRequest(req sip.Request) (sip.Dialog, error) {
+	select {
+	case <-dl.canceled:
+		return nil, fmt.Errorf("dialog layer is canceled")
+	default:
+	}
+
+	if !hasToTag(req) {
+		if creatingMethods[req.Method()] {
+			key, err := transaction.MakeServerTxKey(req)
+			if err != nil {
+				return nil, err
+			}
+
+			dl.mu.Lock()
+			if _, ok := dl.serverPending[key]; !ok {
+				dl.serverPending[key] = &pendingRequest{
+					req:   req,
+					timer: dl.forgetAfter(dl.serverPending, key, pendingTimeout),
+				}
+			}
+			dl.mu.Unlock()
+		}
+
+		return nil, nil
+	}
+
+	dlg, ok := dl.match(req)
+	if !ok {
+		if req.Method() == sip.NOTIFY {
+			return dl.receiveNotify(req)
+		}
+
+		return nil, nil
+	}
+
+	if err := dlg.receiveRequest(req); err != nil {
+		return dlg, err
+	}
+
+	if req.IsAck() && dlg.receiveAck(req) {
+		dlg.Log().Debug("ACK on 2xx response received")
+	}
+
+	// RFC 3261 - 15.1.2
+	if req.Method() == sip.BYE {
+		dlg.Terminate()
+	}
+
+	return dlg, nil
+}
+
+// receiveNotify creates dialog from NOTIFY that arrives before 2xx response on SUBSCRIBE - RFC 6665 - 4.1.2.4.
+func (dl *layer) receiveNotify(req sip.Request) (sip.Dialog, error) {
+	to, _ := req.To()
+	localTag, _ := to.Params.Get("tag")
+
+	var subscribe sip.Request
+	dl.mu.RLock()
+	for _, pending := range dl.clientPending {
+		if pending.req.Method() == sip.SUBSCRIBE &&
+			callIDOf(pending.req) == callIDOf(req) &&
+			fromTag(pending.req) == localTag.String() {
+
+			subscribe = pending.req
+			break
+		}
+	}
+	dl.mu.RUnlock()
+
+	if subscribe == nil {
+		return nil, nil
+	}
+
+	dlg, err := newNotifyDialog(subscribe, req, dl.Log())
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to create dialog from '%s': %w", dl, req.Short(), err)
+	}
+
+	dl.put(dlg)
+
+	return dlg, nil
+}
+
+func (dl *layer) Respond(res sip.Response) (sip.Dialog, error) {
+	select {
+	case <-dl.canceled:
+		return nil, fmt.Errorf("dialog layer is canceled")
+	default:
+	}
+
+	key, err := transaction.MakeServerTxKey(res)
+	if err == nil {
+		dl.mu.RLock()
+		pending, ok := dl.serverPending[key]
+		dl.mu.RUnlock()
+
+		if ok {
+			return dl.respondCreating(key, pending, res)
+		}
+	}
+
+	dlg, ok := dl.match(res)
+	if !ok {
+		return nil, nil
+	}
+
+	if cseq, ok := res.CSeq(); ok && res.IsSuccess() && targetRefreshMethods[cseq.MethodName] {
+		if contact, ok := res.Contact(); ok {
+			dlg.mu.Lock()
+			dlg.localTarget = contact.Address.Clone()
+			dlg.mu.Unlock()
+		}
+
+		// re-INVITE
+		if cseq.MethodName == sip.INVITE {
+			dl.waitAck(dlg, res)
+		}
+	}
+
+	return dlg, nil
+}
+
+func (dl *layer) respondCreating(key transaction.TxKey, pending *pendingRequest, res sip.Response) (sip.Dialog, error) {
+	if !res.IsProvisional() {
+		pending.timer.Stop()
+
+		dl.mu.Lock()
+		delete(dl.serverPending, key)
+		dl.mu.Unlock()
+	}
+
+	if res.StatusCode() >= 300 {
+		// RFC 3261 - 12.3. Non-2xx final response terminates early dialog.
+		if pending.localTag != "" {
+			id := sip.MakeDialogID(string(callIDOf(pending.req)), pending.localTag, fromTag(pending.req))
+			if dlg, ok := dl.get(id); ok && dlg.State() == sip.DialogStateEarly {
+				dlg.Terminate()
+			}
+		}
+
+		return nil, nil
+	}
+
+	if res.StatusCode() == 100 {
+		return nil, nil
+	}
+
+	// RFC 3261 - 12.1.1. UAS MUST add a tag to the 'To' header of dialog establishing response.
+	to, ok := res.To()
+	if !ok {
+		return nil, fmt.Errorf("missing 'To' header in response '%s'", res.Short())
+	}
+	if to.Params == nil {
+		to.Params = sip.NewParams()
+	}
+	if tag, ok := to.Params.Get("tag"); ok && tag.String() != "" {
+		pending.localTag = tag.String()
+	} else {
+		if pending.localTag == "" {
+			pending.localTag = util.RandString(16)
+		}
+		to.Params.Add("tag", sip.String{Str: pending.localTag})
+	}
+
+	dlg, ok := dl.match(res)
+	if ok {
+		if res.IsSuccess() {
+			dlg.confirm()
+		}
+	} else {
+		var err error
+		dlg, err = newServerDialog(pending.req, res, dl.Log())
+		if err != nil {
+			return nil, fmt.Errorf("%s failed to create dialog from '%s': %w", dl, res.Short(), err)
+		}
+
+		dl.put(dlg)
+	}
+
+	if res.IsSuccess() && pending.req.IsInvite() {
+		dl.waitAck(dlg, res)
+	}
+
+	return dlg, nil
+}
+
+func (dl *layer) put(dlg *dialog) {
+	dlg.onTerminate = dl.drop
+
+	dl.mu.Lock()
+	dl.dialogs[dlg.ID()] = dlg
+	dl.mu.Unlock()
+
+	dlg.Log().Debug("dialog created")
+}
+
+func (dl *layer) get(id string) (*dialog, bool) {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	dlg, ok := dl.dialogs[id]
+	return dlg, ok
+}
+
+func (dl *layer) drop(dlg *dialog) {
+	dl.mu.Lock()
+	if current, ok := dl.dialogs[dlg.ID()]; ok && current == dlg {
+		delete(dl.dialogs, dlg.ID())
+	}
+	dl.mu.Unlock()
+}
+
+func (dl *layer) all() []*dialog {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	all := make([]*dialog, 0, len(dl.dialogs))
+	for _, dlg := range dl.dialogs {
+		all = append(all, dlg)
+	}
+	return all
+}
+
+// match searches dialog by message tags, both for sent and received messages.
+func (dl *layer) match(msg sip.Message) (*dialog, bool) {
+	callID, ok := msg.CallID()
+	if !ok {
+		return nil, false
+	}
+	from, ok := msg.From()
+	if !ok || from.Params == nil {
+		return nil, false
+	}
+	to, ok := msg.To()
+	if !ok || to.Params == nil {
+		return nil, false
+	}
+	fromTag, ok := from.Params.Get("tag")
+	if !ok {
+		return nil, false
+	}
+	toTag, ok := to.Params.Get("tag")
+	if !ok {
+		return nil, false
+	}
+
+	if dlg, ok := dl.get(sip.MakeDialogID(string(*callID), toTag.String(), fromTag.String())); ok {
+		return dlg, true
+	}
+	if dlg, ok := dl.get(sip.MakeDialogID(string(*callID), fromTag.String(), toTag.String())); ok {
+		return dlg, true
+	}
+
+	return nil, false
+}
+
+func hasToTag(msg sip.Message) bool {
+	to, ok := msg.To()
+	if !ok || to.Params == nil {
+		return false
+	}
+	tag, ok := to.Params.Get("tag")
+	return ok && tag.String() != ""
+}
+
+func fromTag(msg sip.Message) string {
+	from, ok := msg.From()
+	if !ok || from.Params == nil {
+		return ""
+	}
+	if tag, ok := from.Params.Get("tag"); ok {
+		return tag.String()
+	}
+	return ""
+}
+
+func callIDOf(msg sip.Message) sip.CallID {
+	if callID, ok := msg.CallID(); ok {
+		return *callID
+	}
+	return ""
+}
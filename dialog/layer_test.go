@@ -0,0 +1,227 @@
+package dialog_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/dialog"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+)
+
+type unreliableTransport struct {
+	*testutils.MockTransportLayer
+}
+
+func (tpl *unreliableTransport) IsReliable(network string) bool {
+	return false
+}
+
+var _ = Describe("Layer", func() {
+	var (
+		tpl    *unreliableTransport
+		dl     dialog.Layer
+		branch string
+		invite sip.Request
+	)
+
+	BeforeEach(func() {
+		tpl = &unreliableTransport{testutils.NewMockTransportLayer()}
+		dl = dialog.NewLayer(tpl, testutils.NewLogrusLogger())
+		branch = sip.GenerateBranch()
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP alice.example.com:5060;branch=" + branch,
+			"From: \"Alice\" <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: call-1",
+			"CSeq: 10 INVITE",
+			"Contact: <sip:alice@alice.example.com:5060>",
+			"Max-Forwards: 70",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+	})
+	AfterEach(func() {
+		dl.Cancel()
+		<-dl.Done()
+		tpl.Cancel()
+	})
+
+	Context("UAC", func() {
+		response := func(status string, toTag string) sip.Response {
+			return testutils.Response([]string{
+				"SIP/2.0 " + status,
+				"Via: SIP/2.0/UDP alice.example.com:5060;branch=" + branch,
+				"Record-Route: <sip:p2.example.com;lr>, <sip:p1.example.com;lr>",
+				"From: \"Alice\" <sip:alice@example.com>;tag=alice-tag",
+				"To: <sip:bob@example.com>;tag=" + toTag,
+				"Call-ID: call-1",
+				"CSeq: 10 INVITE",
+				"Contact: <sip:bob@bob.example.com:5060>",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+		}
+
+		BeforeEach(func() {
+			dlg, err := dl.Request(invite)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dlg).To(BeNil())
+		})
+
+		It("should create early dialog and confirm it on 2xx", func() {
+			dlg, err := dl.ReceiveResponse(response("180 Ringing", "bob-tag"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dlg).ToNot(BeNil())
+			Expect(dlg.State()).To(Equal(sip.DialogStateEarly))
+			Expect(dlg.Server()).To(BeFalse())
+			Expect(dlg.LocalTag()).To(Equal("alice-tag"))
+			Expect(dlg.RemoteTag()).To(Equal("bob-tag"))
+			Expect(dlg.LocalSeq()).To(Equal(uint32(10)))
+
+			confirmed, err := dl.ReceiveResponse(response("200 OK", "bob-tag"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(confirmed).To(Equal(dlg))
+			Expect(dlg.State()).To(Equal(sip.DialogStateConfirmed))
+			Expect(dlg.RemoteTarget().String()).To(Equal("sip:bob@bob.example.com:5060"))
+			Expect(dlg.RouteSet()).To(HaveLen(2))
+			Expect(dlg.RouteSet()[0].String()).To(Equal("sip:p1.example.com;lr"))
+
+			found, ok := dl.Get(dlg.ID())
+			Expect(ok).To(BeTrue())
+			Expect(found).To(Equal(dlg))
+		})
+
+		It("should terminate early dialogs on non-2xx final response", func() {
+			dlg, err := dl.ReceiveResponse(response("183 Session Progress", "bob-tag"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dlg).ToNot(BeNil())
+
+			_, err = dl.ReceiveResponse(response("486 Busy Here", "bob-tag"))
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(dlg.Done()).Should(BeClosed())
+			Expect(dlg.State()).To(Equal(sip.DialogStateTerminated))
+			Expect(dl.All()).To(BeEmpty())
+		})
+
+		It("should build requests within the dialog", func() {
+			dlg, err := dl.ReceiveResponse(response("200 OK", "bob-tag"))
+			Expect(err).ToNot(HaveOccurred())
+
+			ack, err := dlg.NewRequest(sip.ACK)
+			Expect(err).ToNot(HaveOccurred())
+			cseq, _ := ack.CSeq()
+			Expect(cseq.SeqNo).To(Equal(uint32(10)))
+
+			bye, err := dlg.NewRequest(sip.BYE)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bye.Recipient().String()).To(Equal("sip:bob@bob.example.com:5060"))
+			cseq, _ = bye.CSeq()
+			Expect(cseq.SeqNo).To(Equal(uint32(11)))
+			routes := bye.GetHeaders("Route")
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Value()).To(Equal("<sip:p1.example.com;lr>, <sip:p2.example.com;lr>"))
+
+			matched, ok := dl.Match(bye)
+			Expect(ok).To(BeTrue())
+			Expect(matched).To(Equal(dlg))
+		})
+	})
+
+	Context("UAS", func() {
+		It("should add To tag and create dialog", func() {
+			dlg, err := dl.ReceiveRequest(invite)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dlg).To(BeNil())
+
+			ringing := sip.NewResponseFromRequest("", invite, 180, "Ringing", "")
+			ringing.AppendHeader(&sip.ContactHeader{
+				Address: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "bob.example.com"},
+			})
+			dlg, err = dl.Respond(ringing)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dlg).ToNot(BeNil())
+			Expect(dlg.Server()).To(BeTrue())
+			Expect(dlg.State()).To(Equal(sip.DialogStateEarly))
+			Expect(dlg.RemoteSeq()).To(Equal(uint32(10)))
+
+			to, _ := ringing.To()
+			tag, ok := to.Params.Get("tag")
+			Expect(ok).To(BeTrue())
+			Expect(tag.String()).To(Equal(dlg.LocalTag()))
+
+			ok200 := sip.NewResponseFromRequest("", invite, 200, "OK", "")
+			confirmed, err := dl.Respond(ok200)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(confirmed).To(Equal(dlg))
+			Expect(dlg.State()).To(Equal(sip.DialogStateConfirmed))
+
+			to, _ = ok200.To()
+			tag, _ = to.Params.Get("tag")
+			Expect(tag.String()).To(Equal(dlg.LocalTag()))
+		})
+
+		Context("with confirmed dialog", func() {
+			var dlg sip.Dialog
+
+			inDialog := func(method string, seq string) sip.Request {
+				return testutils.Request([]string{
+					method + " sip:bob@bob.example.com SIP/2.0",
+					"Via: SIP/2.0/UDP alice.example.com:5060;branch=" + sip.GenerateBranch(),
+					"From: \"Alice\" <sip:alice@example.com>;tag=alice-tag",
+					"To: <sip:bob@example.com>;tag=" + dlg.LocalTag(),
+					"Call-ID: call-1",
+					"CSeq: " + seq + " " + method,
+					"Max-Forwards: 70",
+					"Content-Length: 0",
+					"",
+					"",
+				})
+			}
+
+			BeforeEach(func() {
+				_, err := dl.ReceiveRequest(invite)
+				Expect(err).ToNot(HaveOccurred())
+				dlg, err = dl.Respond(sip.NewResponseFromRequest("", invite, 200, "OK", ""))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dlg).ToNot(BeNil())
+			})
+
+			It("should reject request with lower CSeq", func() {
+				_, err := dl.ReceiveRequest(inDialog("INFO", "9"))
+				Expect(err).To(HaveOccurred())
+				reqErr, ok := err.(*sip.RequestError)
+				Expect(ok).To(BeTrue())
+				Expect(reqErr.Code).To(Equal(uint(500)))
+			})
+
+			It("should retransmit 2xx response until ACK arrives", func() {
+				var res sip.Message
+				Eventually(tpl.OutMsgs, time.Second).Should(Receive(&res))
+				Expect(res.(sip.Response).StatusCode()).To(Equal(sip.StatusCode(200)))
+
+				matched, err := dl.ReceiveRequest(inDialog("ACK", "10"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(matched).To(Equal(dlg))
+
+				Consistently(tpl.OutMsgs, 3*time.Second).ShouldNot(Receive())
+				Expect(dlg.Errors()).ToNot(Receive())
+			})
+
+			It("should terminate dialog on BYE", func() {
+				matched, err := dl.ReceiveRequest(inDialog("BYE", "11"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(matched).To(Equal(dlg))
+				Expect(dlg.RemoteSeq()).To(Equal(uint32(11)))
+				Eventually(dlg.Done()).Should(BeClosed())
+				_, ok := dl.Get(dlg.ID())
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+})
@@ -0,0 +1,290 @@
+package gosip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ygj201011/gosip/proxy"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/timing"
+)
+
+// ForkBranch aggregates responses received on one forked request.
+type ForkBranch struct {
+	Target    proxy.Target
+	Request   sip.Request
+	Responses []sip.Response
+	// Err is set when the branch failed without final response.
+	Err error
+}
+
+// Final returns the first final response of the branch.
+func (branch *ForkBranch) Final() sip.Response {
+	for _, res := range branch.Responses {
+		if !res.IsProvisional() {
+			return res
+		}
+	}
+
+	return nil
+}
+
+// ForkResult is a result of the forked request.
+type ForkResult struct {
+	Branches []*ForkBranch
+	// Successes holds every 2xx response in order of arrival,
+	// forked INVITE can be answered by several UAS and create several dialogs.
+	Successes []sip.Response
+}
+
+// forkContext tracks branches of the forked request.
+type forkContext struct {
+	srv     *server
+	ctx     context.Context
+	request sip.Request
+	options *ForkOptions
+
+	result   *ForkResult
+	pending  map[*ForkBranch]sip.ClientTransaction
+	stopped  bool
+	returned bool
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+func (srv *server) Fork(
+	ctx context.Context,
+	request sip.Request,
+	targets []proxy.Target,
+	options ...ForkOption,
+) (*ForkResult, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("empty target set")
+	}
+
+	optionsHash := &ForkOptions{}
+	for _, opt := range options {
+		opt.ApplyFork(optionsHash)
+	}
+
+	fc := &forkContext{
+		srv:     srv,
+		ctx:     ctx,
+		request: request,
+		options: optionsHash,
+		result: &ForkResult{
+			Branches:  make([]*ForkBranch, 0),
+			Successes: make([]sip.Response, 0),
+		},
+		pending: make(map[*ForkBranch]sip.ClientTransaction),
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fc.cancelPending()
+		case <-done:
+		}
+	}()
+
+	stopped := func() bool {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+
+		return fc.stopped || ctx.Err() != nil
+	}
+	proxy.ForkTargets(targets, optionsHash.Mode, stopped, fc.forward, fc.wg.Wait)
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.returned = true
+	res := &ForkResult{
+		Branches:  append([]*ForkBranch{}, fc.result.Branches...),
+		Successes: append([]sip.Response{}, fc.result.Successes...),
+	}
+
+	if len(res.Successes) > 0 {
+		return res, nil
+	}
+
+	finals := make([]sip.Response, 0)
+	var lastErr error
+	for _, branch := range res.Branches {
+		if final := branch.Final(); final != nil {
+			finals = append(finals, final)
+		} else if branch.Err != nil {
+			lastErr = branch.Err
+		}
+	}
+	if len(finals) > 0 {
+		final := proxy.FinalResponse(finals)
+		return res, sip.NewRequestError(uint(final.StatusCode()), final.Reason(), request, final)
+	}
+	if lastErr == nil {
+		lastErr = sip.NewRequestError(487, "Request Terminated", request, nil)
+	}
+
+	return res, lastErr
+}
+
+func (fc *forkContext) forward(target proxy.Target) {
+	branch := &ForkBranch{
+		Target:    target,
+		Request:   forkRequest(fc.request, target),
+		Responses: make([]sip.Response, 0),
+	}
+
+	fc.mu.Lock()
+	fc.result.Branches = append(fc.result.Branches, branch)
+	fc.mu.Unlock()
+
+	tx, err := fc.srv.Request(branch.Request)
+	if err != nil {
+		branch.Err = err
+		return
+	}
+
+	fc.mu.Lock()
+	fc.pending[branch] = tx
+	stopped := fc.stopped
+	fc.mu.Unlock()
+
+	if stopped {
+		fc.cancelBranch(tx)
+	}
+
+	// INVITE branch is canceled on timeout, other branches are completed with 408 at once
+	timedOut := make(chan struct{})
+	var timer timing.Timer
+	if target.Timeout > 0 {
+		timer = timing.AfterFunc(target.Timeout, func() {
+			if tx.Origin().IsInvite() {
+				fc.cancelBranch(tx)
+			} else {
+				close(timedOut)
+			}
+		})
+	}
+
+	fc.wg.Add(1)
+	go func() {
+		completed := false
+		complete := func() {
+			if !completed {
+				completed = true
+
+				fc.mu.Lock()
+				delete(fc.pending, branch)
+				fc.mu.Unlock()
+
+				if timer != nil {
+					timer.Stop()
+				}
+				fc.wg.Done()
+			}
+		}
+		defer complete()
+
+		responses := tx.Responses()
+		errs := tx.Errors()
+		for responses != nil || errs != nil {
+			select {
+			case <-timedOut:
+				fc.receiveResponse(branch, sip.NewResponseFromRequest("", branch.Request, 408, "Request Timeout", ""))
+				return
+			case res, ok := <-responses:
+				if !ok {
+					responses = nil
+					continue
+				}
+
+				fc.receiveResponse(branch, res)
+				if !res.IsProvisional() {
+					complete()
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+
+				fc.mu.Lock()
+				if !completed {
+					branch.Err = err
+				}
+				fc.mu.Unlock()
+
+				complete()
+			}
+		}
+	}()
+}
+
+func (fc *forkContext) receiveResponse(branch *ForkBranch, res sip.Response) {
+	res = sip.CopyResponse(res)
+
+	fc.mu.Lock()
+	if !fc.returned {
+		branch.Responses = append(branch.Responses, res)
+		if res.IsSuccess() {
+			fc.result.Successes = append(fc.result.Successes, res)
+		}
+	}
+	// RFC 3261 - 16.7.5. 2xx and 6xx stop forking.
+	stop := res.IsSuccess() || res.StatusCode() >= 600
+	if stop {
+		fc.stopped = true
+	}
+	fc.mu.Unlock()
+
+	if fc.options.ResponseHandler != nil {
+		fc.options.ResponseHandler(res, branch.Request)
+	}
+
+	if stop {
+		fc.cancelPending()
+	}
+}
+
+func (fc *forkContext) cancelPending() {
+	fc.mu.Lock()
+	txs := make([]sip.ClientTransaction, 0, len(fc.pending))
+	for _, tx := range fc.pending {
+		txs = append(txs, tx)
+	}
+	fc.mu.Unlock()
+
+	for _, tx := range txs {
+		fc.cancelBranch(tx)
+	}
+}
+
+func (fc *forkContext) cancelBranch(tx sip.ClientTransaction) {
+	if !tx.Origin().IsInvite() {
+		return
+	}
+
+	if err := tx.Cancel(); err != nil {
+		fc.srv.Log().Warnf("cancel forked request %s failed: %s", tx, err)
+	}
+}
+
+// forkRequest copies request for the target with own Via branch.
+func forkRequest(request sip.Request, target proxy.Target) sip.Request {
+	req := sip.CopyRequest(request)
+	proxy.SetTarget(req, target)
+	req.SetDestination("")
+
+	if viaHop, ok := req.ViaHop(); ok {
+		if viaHop.Params == nil {
+			viaHop.Params = sip.NewParams()
+		}
+		viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+	}
+
+	return req
+}
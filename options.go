@@ -1,6 +1,9 @@
 package gosip
 
-import "github.com/ygj201011/gosip/sip"
+import (
+	"github.com/ygj201011/gosip/proxy"
+	"github.com/ygj201011/gosip/sip"
+)
 
 type RequestWithContextOption interface {
 	ApplyRequestWithContext(options *RequestWithContextOptions)
@@ -34,3 +37,34 @@ func (o withAuthorizer) ApplyRequestWithContext(options *RequestWithContextOptio
 func WithAuthorizer(authorizer sip.Authorizer) RequestWithContextOption {
 	return withAuthorizer{authorizer}
 }
+
+type ForkOption interface {
+	ApplyFork(options *ForkOptions)
+}
+
+type ForkOptions struct {
+	Mode proxy.ForkMode
+	// ResponseHandler is called on every response of every branch,
+	// including 2xx responses that arrive after Fork returned.
+	ResponseHandler func(res sip.Response, request sip.Request)
+}
+
+type withForkMode struct {
+	mode proxy.ForkMode
+}
+
+func (o withForkMode) ApplyFork(options *ForkOptions) {
+	options.Mode = o.mode
+}
+
+func WithForkMode(mode proxy.ForkMode) ForkOption {
+	return withForkMode{mode}
+}
+
+func (o withResponseHandler) ApplyFork(options *ForkOptions) {
+	options.ResponseHandler = o.handler
+}
+
+func WithForkResponseHandler(handler func(res sip.Response, request sip.Request)) ForkOption {
+	return withResponseHandler{handler}
+}
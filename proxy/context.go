@@ -0,0 +1,491 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/timing"
+	"github.com/ygj201011/gosip/transaction"
+)
+
+// Timer_C limits INVITE branch waiting for the final response - RFC 3261 - 16.6.
+const Timer_C = 3 * time.Minute
+
+// branch is a client transaction created for one target.
+type branch struct {
+	target  Target
+	req     sip.Request
+	tx      sip.ClientTransaction
+	final   sip.Response
+	timerC  timing.Timer
+	timeout timing.Timer
+}
+
+// responseContext groups client transactions created for one server transaction - RFC 3261 - 16.7.
+type responseContext struct {
+	proxy    *proxy
+	req      sip.Request
+	tx       sip.ServerTransaction
+	loopHash string
+
+	branches  []*branch
+	responses []sip.Response
+	started   bool
+	finalSent bool
+	canceled  bool
+	stopped   bool
+	idle      chan struct{}
+	// outgoing responses and branches to cancel are queued under the lock and sent by unlock
+	outgoing []sip.Response
+	cancels  []*branch
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+
+	log log.Logger
+}
+
+func newResponseContext(p *proxy, req sip.Request, tx sip.ServerTransaction, loopHash string) *responseContext {
+	ctx := &responseContext{
+		proxy:     p,
+		req:       req,
+		tx:        tx,
+		loopHash:  loopHash,
+		branches:  make([]*branch, 0),
+		responses: make([]sip.Response, 0),
+		idle:      make(chan struct{}, 1),
+	}
+	ctx.log = p.Log().
+		WithPrefix("proxy.responseContext").
+		WithFields(req.Fields()).
+		WithFields(log.Fields{
+			"response_context_ptr": fmt.Sprintf("%p", ctx),
+		})
+
+	return ctx
+}
+
+func (ctx *responseContext) Log() log.Logger {
+	return ctx.log
+}
+
+// serve forwards request to the target groups one after another - RFC 3261 - 16.6.
+func (ctx *responseContext) serve(targets []Target) {
+	go ctx.serveCancels()
+
+	stopped := func() bool {
+		ctx.mu.Lock()
+		stopped := ctx.finalSent || ctx.canceled || ctx.stopped
+		ctx.mu.Unlock()
+		if stopped {
+			return true
+		}
+
+		// drop the completion signal of the previous group
+		select {
+		case <-ctx.idle:
+		default:
+		}
+
+		return false
+	}
+	wait := func() {
+		ctx.mu.Lock()
+		ctx.checkCompleted()
+		ctx.unlock()
+
+		select {
+		case <-ctx.idle:
+		case <-ctx.proxy.canceled:
+		}
+	}
+	ForkTargets(targets, ctx.proxy.config.Forking, stopped, ctx.forward, wait)
+
+	ctx.mu.Lock()
+	ctx.started = true
+	ctx.checkCompleted()
+	ctx.unlock()
+
+	ctx.wg.Wait()
+}
+
+func (ctx *responseContext) forward(target Target) {
+	b := &branch{
+		target: target,
+		req:    ctx.proxy.prepareRequest(ctx.req, target, ctx.loopHash),
+	}
+
+	ctx.mu.Lock()
+	if ctx.finalSent || ctx.canceled {
+		ctx.mu.Unlock()
+		return
+	}
+	ctx.branches = append(ctx.branches, b)
+	ctx.mu.Unlock()
+
+	tx, err := ctx.proxy.txl.Request(b.req)
+	if err != nil {
+		ctx.Log().Warnf("forward '%s' to %s failed: %s", b.req.Short(), target.Uri, err)
+
+		// RFC 3261 - 16.9. Transport error is treated as 503.
+		ctx.mu.Lock()
+		ctx.branchFinished(b, sip.NewResponseFromRequest("", b.req, 503, "Service Unavailable", ""))
+		ctx.unlock()
+
+		return
+	}
+
+	ctx.mu.Lock()
+	b.tx = tx
+	if ctx.req.IsInvite() {
+		b.timerC = timing.AfterFunc(Timer_C, func() {
+			ctx.Log().Debugf("timer C fired on branch %s", b.target.Uri)
+
+			ctx.cancelBranch(b)
+		})
+	}
+	if target.Timeout > 0 {
+		b.timeout = timing.AfterFunc(target.Timeout, func() {
+			ctx.Log().Debugf("branch %s timed out", b.target.Uri)
+
+			ctx.timeoutBranch(b)
+		})
+	}
+	// CANCEL was received while the branch was started
+	canceled := ctx.canceled || ctx.finalSent
+	ctx.mu.Unlock()
+
+	if canceled {
+		ctx.cancelBranch(b)
+	}
+
+	ctx.wg.Add(1)
+	go ctx.serveBranch(b)
+}
+
+func (ctx *responseContext) serveBranch(b *branch) {
+	defer ctx.wg.Done()
+
+	responses := b.tx.Responses()
+	errs := b.tx.Errors()
+	for responses != nil || errs != nil {
+		select {
+		case res, ok := <-responses:
+			if !ok {
+				responses = nil
+				continue
+			}
+
+			ctx.receiveResponse(b, res)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			ctx.receiveError(b, err)
+		}
+	}
+
+	ctx.mu.Lock()
+	defer ctx.unlock()
+
+	if b.timerC != nil {
+		b.timerC.Stop()
+	}
+	if b.timeout != nil {
+		b.timeout.Stop()
+	}
+	if b.final == nil {
+		ctx.branchFinished(b, sip.NewResponseFromRequest("", b.req, 408, "Request Timeout", ""))
+	}
+}
+
+func (ctx *responseContext) receiveError(b *branch, err error) {
+	ctx.Log().Debugf("branch %s failed: %s", b.target.Uri, err)
+
+	var res sip.Response
+	if txErr, ok := err.(transaction.TxError); ok && txErr.Transport() {
+		res = sip.NewResponseFromRequest("", b.req, 503, "Service Unavailable", "")
+	} else {
+		res = sip.NewResponseFromRequest("", b.req, 408, "Request Timeout", "")
+	}
+
+	ctx.mu.Lock()
+	defer ctx.unlock()
+
+	if b.final == nil {
+		ctx.branchFinished(b, res)
+	}
+}
+
+// receiveResponse processes response of the branch - RFC 3261 - 16.7.
+func (ctx *responseContext) receiveResponse(b *branch, res sip.Response) {
+	ctx.mu.Lock()
+	defer ctx.unlock()
+
+	switch {
+	case res.StatusCode() == 100:
+		return
+	case res.IsProvisional():
+		if b.timerC != nil {
+			b.timerC.Reset(Timer_C)
+		}
+		if !ctx.finalSent {
+			ctx.sendResponse(res)
+		}
+	case res.IsSuccess():
+		// every 2xx on INVITE is forwarded - RFC 3261 - 16.7.5
+		if b.final == nil {
+			b.final = res
+		}
+		if !ctx.finalSent || ctx.req.IsInvite() {
+			ctx.finalSent = true
+			ctx.sendResponse(res)
+		}
+		ctx.cancelPending()
+		ctx.checkCompleted()
+	default:
+		if b.final != nil {
+			return
+		}
+		ctx.branchFinished(b, res)
+	}
+}
+
+// branchFinished stores non-2xx final response of the branch.
+func (ctx *responseContext) branchFinished(b *branch, res sip.Response) {
+	b.final = res
+	ctx.responses = append(ctx.responses, res)
+
+	// RFC 3261 - 16.7.5. 6xx cancels pending branches and stops forking.
+	if res.StatusCode() >= 600 {
+		ctx.stopped = true
+		ctx.cancelPending()
+	}
+
+	ctx.checkCompleted()
+}
+
+// checkCompleted signals that all branches got final responses,
+// the best response is sent when there are no more targets.
+func (ctx *responseContext) checkCompleted() {
+	for _, b := range ctx.branches {
+		if b.final == nil {
+			return
+		}
+	}
+
+	select {
+	case ctx.idle <- struct{}{}:
+	default:
+	}
+
+	if ctx.started {
+		ctx.sendBest()
+	}
+}
+
+// sendBest forwards the best stored response when all branches completed - RFC 3261 - 16.7.6.
+func (ctx *responseContext) sendBest() {
+	if ctx.finalSent {
+		return
+	}
+	ctx.finalSent = true
+
+	if len(ctx.responses) == 0 {
+		// no branch was started
+		res := sip.NewResponseFromRequest("", ctx.req, 408, "Request Timeout", "")
+		if ctx.canceled {
+			res = sip.NewResponseFromRequest("", ctx.req, 487, "Request Terminated", "")
+		}
+		ctx.outgoing = append(ctx.outgoing, res)
+
+		return
+	}
+
+	res := copyResponse(FinalResponse(ctx.responses))
+	if res.StatusCode() == 503 {
+		// RFC 3261 - 16.7.6. 503 is not forwarded upstream.
+		res.SetStatusCode(500)
+		res.SetReason("Server Internal Error")
+	}
+
+	ctx.sendResponse(res)
+}
+
+// sendResponse queues response forwarded upstream without own Via - RFC 3261 - 16.7.3.
+func (ctx *responseContext) sendResponse(res sip.Response) {
+	fwd := copyResponse(res)
+	removeTopVia(fwd)
+
+	ctx.outgoing = append(ctx.outgoing, fwd)
+}
+
+// unlock releases the context and then sends the queued responses and CANCELs,
+// so the network I/O doesn't block the other branches.
+func (ctx *responseContext) unlock() {
+	outgoing := ctx.outgoing
+	cancels := ctx.cancels
+	ctx.outgoing = nil
+	ctx.cancels = nil
+	ctx.mu.Unlock()
+
+	for _, res := range outgoing {
+		if err := ctx.tx.Respond(res); err != nil {
+			ctx.Log().Errorf("forward '%s' failed: %s", res.Short(), err)
+		}
+	}
+	for _, b := range cancels {
+		ctx.cancelBranch(b)
+	}
+}
+
+// serveCancels cancels all branches on CANCEL from upstream - RFC 3261 - 16.10.
+func (ctx *responseContext) serveCancels() {
+	select {
+	case <-ctx.tx.Done():
+	case <-ctx.proxy.canceled:
+	case cancel, ok := <-ctx.tx.Cancels():
+		if !ok {
+			return
+		}
+
+		res := sip.NewResponseFromRequest("", cancel, 200, "OK", "")
+		if err := ctx.tx.Respond(res); err != nil {
+			ctx.Log().Errorf("respond '200 OK' on CANCEL failed: %s", err)
+		}
+
+		ctx.cancel()
+	}
+}
+
+func (ctx *responseContext) cancel() {
+	ctx.mu.Lock()
+	defer ctx.unlock()
+
+	ctx.canceled = true
+	ctx.cancelPending()
+}
+
+func (ctx *responseContext) cancelPending() {
+	for _, b := range ctx.branches {
+		if b.final == nil && b.tx != nil {
+			ctx.cancels = append(ctx.cancels, b)
+		}
+	}
+}
+
+func (ctx *responseContext) cancelBranch(b *branch) {
+	if !b.req.IsInvite() {
+		return
+	}
+
+	if err := b.tx.Cancel(); err != nil {
+		ctx.Log().Warnf("cancel branch %s failed: %s", b.target.Uri, err)
+	}
+}
+
+// timeoutBranch cancels INVITE branch, other branches are completed with 408 at once.
+func (ctx *responseContext) timeoutBranch(b *branch) {
+	if b.req.IsInvite() {
+		ctx.cancelBranch(b)
+		return
+	}
+
+	ctx.mu.Lock()
+	defer ctx.unlock()
+
+	if b.final == nil {
+		ctx.branchFinished(b, sip.NewResponseFromRequest("", b.req, 408, "Request Timeout", ""))
+	}
+}
+
+// BestResponse chooses 6xx if any, otherwise the lowest response class - RFC 3261 - 16.7.6.
+// Among 4xx responses 401, 407, 415, 420 and 484 are preferred.
+func BestResponse(responses []sip.Response) sip.Response {
+	var best sip.Response
+	for _, res := range responses {
+		if res.StatusCode() >= 600 {
+			return res
+		}
+		if best == nil || res.StatusCode()/100 < best.StatusCode()/100 {
+			best = res
+			continue
+		}
+		if res.StatusCode()/100 == best.StatusCode()/100 && isPreferred(res) && !isPreferred(best) {
+			best = res
+		}
+	}
+
+	return best
+}
+
+// FinalResponse builds the response of the forked request from the final responses of its branches:
+// the best response is chosen and challenges of all branches are collected into it - RFC 3261 - 16.7.7.
+func FinalResponse(responses []sip.Response) sip.Response {
+	best := BestResponse(responses)
+	if best == nil {
+		return nil
+	}
+
+	res := sip.CopyResponse(best)
+	if res.StatusCode() != 401 && res.StatusCode() != 407 {
+		return res
+	}
+
+	for _, other := range responses {
+		if other == best {
+			continue
+		}
+		for _, name := range []string{"WWW-Authenticate", "Proxy-Authenticate"} {
+			for _, hdr := range other.GetHeaders(name) {
+				res.AppendHeader(hdr.Clone())
+			}
+		}
+	}
+
+	return res
+}
+
+// isPreferred checks that the 4xx response lets the UAC retry the request - RFC 3261 - 16.7.6.
+func isPreferred(res sip.Response) bool {
+	switch res.StatusCode() {
+	case 401, 407, 415, 420, 484:
+		return true
+	default:
+		return false
+	}
+}
+
+func copyResponse(res sip.Response) sip.Response {
+	cp := sip.CopyResponse(res)
+	// next hop is resolved from the Via
+	cp.SetSource("")
+	cp.SetDestination("")
+
+	return cp
+}
+
+func removeTopVia(msg sip.Message) {
+	hdrs := msg.GetHeaders("Via")
+	if len(hdrs) == 0 {
+		return
+	}
+
+	via, ok := hdrs[0].(sip.ViaHeader)
+	if ok && len(via) > 1 {
+		rest := append([]sip.Header{via[1:]}, hdrs[1:]...)
+		msg.ReplaceHeaders("Via", rest)
+		return
+	}
+
+	if len(hdrs) == 1 {
+		msg.RemoveHeader("Via")
+		return
+	}
+
+	msg.ReplaceHeaders("Via", hdrs[1:])
+}
@@ -0,0 +1,495 @@
+// proxy package implements stateful SIP proxy - RFC 3261 - 16.
+package proxy
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/transaction"
+	"github.com/ygj201011/gosip/util"
+)
+
+const defaultMaxForwards = 70
+
+// TargetsFunc supplies the target set for the request addressed to the proxy domain - RFC 3261 - 16.5.
+// Returned *sip.RequestError is used to respond on the request,
+// empty target set results in 480 Temporarily Unavailable.
+type TargetsFunc func(req sip.Request) ([]Target, error)
+
+// Config describes proxy options.
+type Config struct {
+	// Host of the proxy, used in Record-Route and to recognize own Route entries.
+	Host string
+	// Port of the proxy, default port of the transport is used if not set.
+	Port *sip.Port
+	// Domains the proxy is responsible for, Host is used if empty.
+	Domains []string
+	// RecordRoute enables Record-Route insertion to stay in the path of the dialog.
+	RecordRoute bool
+	// Extensions lists option tags supported in Proxy-Require.
+	Extensions []string
+	Targets    TargetsFunc
+	// Forking defines how the request is forked to the target set.
+	Forking ForkMode
+}
+
+// Proxy forwards requests and responses statefully.
+type Proxy interface {
+	Cancel()
+	Done() <-chan struct{}
+	String() string
+	// ServeRequest handles request received by the server,
+	// it has the signature of gosip.RequestHandler.
+	// tx is nil for ACK on 2xx response, it is forwarded statelessly.
+	ServeRequest(req sip.Request, tx sip.ServerTransaction)
+}
+
+type proxy struct {
+	txl        transaction.Layer
+	config     Config
+	instanceID string
+
+	contexts   map[*responseContext]bool
+	ctxWg      sync.WaitGroup
+	canceled   chan struct{}
+	done       chan struct{}
+	cancelOnce sync.Once
+	mu         sync.RWMutex
+
+	log log.Logger
+}
+
+func NewProxy(txl transaction.Layer, config Config, logger log.Logger) Proxy {
+	p := &proxy{
+		txl:        txl,
+		config:     config,
+		instanceID: util.RandString(16),
+		contexts:   make(map[*responseContext]bool),
+		canceled:   make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	p.log = logger.
+		WithPrefix("proxy.Proxy").
+		WithFields(log.Fields{
+			"proxy_ptr": fmt.Sprintf("%p", p),
+		})
+
+	return p
+}
+
+func (p *proxy) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("proxy.Proxy<%s>", p.Log().Fields())
+}
+
+func (p *proxy) Log() log.Logger {
+	return p.log
+}
+
+func (p *proxy) Cancel() {
+	select {
+	case <-p.canceled:
+		return
+	default:
+	}
+
+	p.cancelOnce.Do(func() {
+		close(p.canceled)
+
+		p.mu.RLock()
+		for ctx := range p.contexts {
+			ctx.cancel()
+		}
+		p.mu.RUnlock()
+
+		p.ctxWg.Wait()
+
+		close(p.done)
+
+		p.Log().Debug("proxy canceled")
+	})
+}
+
+func (p *proxy) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *proxy) ServeRequest(req sip.Request, tx sip.ServerTransaction) {
+	select {
+	case <-p.canceled:
+		return
+	default:
+	}
+
+	logger := p.Log().WithFields(req.Fields())
+	logger.Debug("proxying SIP request...")
+
+	if tx == nil && !req.IsAck() {
+		logger.Warn("SIP request without server transaction is dropped")
+		return
+	}
+
+	// the hash of the request as received, before the Request-URI is rewritten by route processing
+	loopHash := p.loopHash(req)
+	if err := p.validate(req, loopHash); err != nil {
+		p.reject(req, tx, err, logger)
+		return
+	}
+
+	origin := p.copyRequest(req)
+	p.preprocessRoutes(origin)
+
+	targets, err := p.targets(origin)
+	if err != nil {
+		p.reject(req, tx, err, logger)
+		return
+	}
+
+	if req.IsAck() {
+		p.forwardAck(origin, ForkGroups(targets, ForkSequential)[0][0], loopHash, logger)
+		return
+	}
+
+	ctx := newResponseContext(p, origin, tx, loopHash)
+	if !p.addContext(ctx) {
+		return
+	}
+
+	go func() {
+		defer p.removeContext(ctx)
+
+		ctx.serve(targets)
+	}()
+}
+
+// validate checks request - RFC 3261 - 16.3.
+func (p *proxy) validate(req sip.Request, loopHash string) error {
+	if _, ok := req.Recipient().(*sip.SipUri); !ok {
+		return sip.NewRequestError(416, "Unsupported URI Scheme", req, nil)
+	}
+
+	if hdrs := req.GetHeaders("Max-Forwards"); len(hdrs) > 0 {
+		if maxForwards, ok := hdrs[0].(*sip.MaxForwards); ok && *maxForwards == 0 {
+			return sip.NewRequestError(483, "Too Many Hops", req, nil)
+		}
+	}
+
+	if isLooped(req, loopHash) {
+		return sip.NewRequestError(482, "Loop Detected", req, nil)
+	}
+
+	if unsupported := p.unsupportedOptions(req); len(unsupported) > 0 {
+		res := sip.NewResponseFromRequest("", req, 420, "Bad Extension", "")
+		res.AppendHeader(&sip.UnsupportedHeader{Options: unsupported})
+		return sip.NewRequestError(420, "Bad Extension", req, res)
+	}
+
+	return nil
+}
+
+func (p *proxy) reject(req sip.Request, tx sip.ServerTransaction, err error, logger log.Logger) {
+	var reqErr *sip.RequestError
+	if !errors.As(err, &reqErr) {
+		reqErr = sip.NewRequestError(500, "Server Internal Error", req, nil)
+	}
+
+	logger.Warnf("SIP request rejected: %s", err)
+
+	if req.IsAck() {
+		return
+	}
+
+	res := reqErr.Response
+	if res == nil {
+		res = sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, "")
+	}
+
+	if err := tx.Respond(res); err != nil {
+		logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
+
+func (p *proxy) unsupportedOptions(req sip.Request) []string {
+	supported := make(map[string]bool)
+	for _, ext := range p.config.Extensions {
+		supported[strings.ToLower(ext)] = true
+	}
+
+	unsupported := make([]string, 0)
+	for _, option := range headerValues(req, "Proxy-Require") {
+		if !supported[strings.ToLower(option)] {
+			unsupported = append(unsupported, option)
+		}
+	}
+
+	return unsupported
+}
+
+// isLooped detects loops by own Via branch - RFC 3261 - 16.3.4.
+// The hash doesn't include the topmost Via, so the request that comes back
+// with the same Request-URI is detected as loop, spirals pass.
+func isLooped(req sip.Request, loopHash string) bool {
+	suffix := "." + loopHash
+	for _, hdr := range req.GetHeaders("Via") {
+		via, ok := hdr.(sip.ViaHeader)
+		if !ok {
+			continue
+		}
+		for _, hop := range via {
+			if hop.Params == nil {
+				continue
+			}
+			if branch, ok := hop.Params.Get("branch"); ok && strings.HasSuffix(branch.String(), suffix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *proxy) loopHash(req sip.Request) string {
+	parts := []string{p.instanceID, req.Recipient().String()}
+	if to, ok := req.To(); ok && to.Params != nil {
+		if tag, ok := to.Params.Get("tag"); ok {
+			parts = append(parts, tag.String())
+		}
+	}
+	if from, ok := req.From(); ok && from.Params != nil {
+		if tag, ok := from.Params.Get("tag"); ok {
+			parts = append(parts, tag.String())
+		}
+	}
+	if callID, ok := req.CallID(); ok {
+		parts = append(parts, string(*callID))
+	}
+	if cseq, ok := req.CSeq(); ok {
+		parts = append(parts, fmt.Sprint(cseq.SeqNo))
+	}
+	parts = append(parts, headerValues(req, "Proxy-Require")...)
+	parts = append(parts, headerValues(req, "Proxy-Authorization")...)
+
+	return fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(parts, "|"))))[:16]
+}
+
+// preprocessRoutes handles route information - RFC 3261 - 16.4.
+func (p *proxy) preprocessRoutes(req sip.Request) {
+	routes := routeUris(req)
+
+	// next hop is a strict router, it gets its URI as Request-URI,
+	// and the Request-URI is moved to the end of the route set - RFC 3261 - 16.6 (6).
+	if p.isRecordRouteUri(req.Recipient()) && len(routes) > 0 {
+		req.SetRecipient(routes[len(routes)-1])
+		routes = routes[:len(routes)-1]
+	}
+
+	if len(routes) > 0 && p.isOwnUri(routes[0]) {
+		routes = routes[1:]
+	}
+
+	setRoutes(req, routes)
+}
+
+// targets determines target set - RFC 3261 - 16.5.
+func (p *proxy) targets(req sip.Request) ([]Target, error) {
+	if len(routeUris(req)) > 0 || !p.isOwnDomain(req.Recipient()) || p.config.Targets == nil {
+		return NewTargets(req.Recipient()), nil
+	}
+
+	targets, err := p.config.Targets(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, sip.NewRequestError(480, "Temporarily Unavailable", req, nil)
+	}
+
+	return targets, nil
+}
+
+// prepareRequest builds request for the target - RFC 3261 - 16.6.
+// loopHash is the hash of the received request, it is appended to the branch to detect loops.
+func (p *proxy) prepareRequest(req sip.Request, target Target, loopHash string) sip.Request {
+	fwd := p.copyRequest(req)
+
+	SetTarget(fwd, target)
+
+	maxForwards := sip.MaxForwards(defaultMaxForwards)
+	if hdrs := fwd.GetHeaders("Max-Forwards"); len(hdrs) > 0 {
+		if value, ok := hdrs[0].(*sip.MaxForwards); ok {
+			maxForwards = *value - 1
+		}
+		fwd.ReplaceHeaders("Max-Forwards", []sip.Header{&maxForwards})
+	} else {
+		fwd.AppendHeader(&maxForwards)
+	}
+
+	if p.config.RecordRoute && !req.IsAck() && req.Method() != sip.REGISTER {
+		fwd.PrependHeader(&sip.RecordRouteHeader{
+			Addresses: []sip.Uri{p.recordRouteUri(req)},
+		})
+	}
+
+	// next hop is a strict router, it gets its URI as Request-URI,
+	// and the Request-URI is moved to the end of the route set - RFC 3261 - 16.6 (6).
+	routes := routeUris(fwd)
+	if len(routes) > 0 && !isLooseRoute(routes[0]) {
+		routes = append(routes, fwd.Recipient())
+		fwd.SetRecipient(routes[0])
+		setRoutes(fwd, routes[1:])
+	}
+
+	fwd.PrependHeader(sip.ViaHeader{
+		&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       fwd.Transport(),
+			Host:            p.config.Host,
+			Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch() + "." + loopHash}),
+		},
+	})
+
+	return fwd
+}
+
+// forwardAck forwards ACK on 2xx response statelessly.
+func (p *proxy) forwardAck(ack sip.Request, target Target, loopHash string, logger log.Logger) {
+	fwd := p.prepareRequest(ack, target, loopHash)
+	if err := p.txl.Transport().Send(fwd); err != nil {
+		logger.Errorf("forward '%s' failed: %s", fwd.Short(), err)
+	}
+}
+
+func (p *proxy) copyRequest(req sip.Request) sip.Request {
+	cp := sip.CopyRequest(req)
+	// next hop is resolved from the request
+	cp.SetSource("")
+	cp.SetDestination("")
+
+	return cp
+}
+
+func (p *proxy) recordRouteUri(req sip.Request) sip.Uri {
+	params := sip.NewParams().Add("lr", nil)
+	if tp := strings.ToLower(req.Transport()); tp != "udp" {
+		params.Add("transport", sip.String{Str: tp})
+	}
+
+	return &sip.SipUri{
+		FHost:      p.config.Host,
+		FPort:      p.config.Port,
+		FUriParams: params,
+	}
+}
+
+func (p *proxy) isOwnUri(uri sip.Uri) bool {
+	if !strings.EqualFold(uri.Host(), p.config.Host) {
+		return false
+	}
+
+	return p.config.Port == nil || uri.Port() == nil || *uri.Port() == *p.config.Port
+}
+
+func (p *proxy) isRecordRouteUri(uri sip.Uri) bool {
+	if !p.isOwnUri(uri) {
+		return false
+	}
+	if uri.User() != nil && uri.User().String() != "" {
+		return false
+	}
+
+	return isLooseRoute(uri)
+}
+
+func (p *proxy) isOwnDomain(uri sip.Uri) bool {
+	if len(p.config.Domains) == 0 {
+		return strings.EqualFold(uri.Host(), p.config.Host)
+	}
+
+	for _, domain := range p.config.Domains {
+		if strings.EqualFold(uri.Host(), domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *proxy) addContext(ctx *responseContext) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.canceled:
+		return false
+	default:
+	}
+
+	p.contexts[ctx] = true
+	p.ctxWg.Add(1)
+
+	return true
+}
+
+func (p *proxy) removeContext(ctx *responseContext) {
+	p.mu.Lock()
+	delete(p.contexts, ctx)
+	p.mu.Unlock()
+
+	p.ctxWg.Done()
+}
+
+func routeUris(msg sip.Message) []sip.Uri {
+	uris := make([]sip.Uri, 0)
+	for _, hdr := range msg.GetHeaders("Route") {
+		if route, ok := hdr.(*sip.RouteHeader); ok {
+			uris = append(uris, route.Addresses...)
+		}
+	}
+
+	return uris
+}
+
+func setRoutes(msg sip.Message, uris []sip.Uri) {
+	msg.RemoveHeader("Route")
+	if len(uris) == 0 {
+		return
+	}
+
+	route := &sip.RouteHeader{Addresses: uris}
+	if len(msg.GetHeaders("Via")) > 0 {
+		msg.PrependHeaderAfter(route, "Via")
+	} else {
+		msg.PrependHeader(route)
+	}
+}
+
+func isLooseRoute(uri sip.Uri) bool {
+	if params := uri.UriParams(); params != nil {
+		return params.Has("lr")
+	}
+
+	return false
+}
+
+// headerValues returns comma separated values of the header.
+func headerValues(msg sip.Message, name string) []string {
+	values := make([]string, 0)
+	for _, hdr := range msg.GetHeaders(name) {
+		for _, value := range strings.Split(hdr.Value(), ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,348 @@
+package proxy_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/proxy"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transaction"
+)
+
+var _ = Describe("Proxy", func() {
+	var (
+		tpl     *testutils.MockTransportLayer
+		txl     transaction.Layer
+		p       proxy.Proxy
+		targets []proxy.Target
+		forking proxy.ForkMode
+	)
+
+	inviteBranch := sip.GenerateBranch()
+	invite := func(extraHeaders ...string) sip.Request {
+		lines := []string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP alice.example.com:5060;branch=" + inviteBranch,
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: proxy-call-1",
+			"CSeq: 1 INVITE",
+		}
+		lines = append(lines, extraHeaders...)
+		lines = append(lines, "Content-Length: 0", "", "")
+		return testutils.Request(lines)
+	}
+
+	// waitMessage skips messages that do not match, like 100 Trying or ACK.
+	waitMessage := func(match func(msg sip.Message) bool) sip.Message {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-tpl.OutMsgs:
+				if match(msg) {
+					return msg
+				}
+			case <-timeout:
+				Fail("message not received")
+				return nil
+			}
+		}
+	}
+	waitRequest := func(method sip.RequestMethod) sip.Request {
+		return waitMessage(func(msg sip.Message) bool {
+			req, ok := msg.(sip.Request)
+			return ok && req.Method() == method
+		}).(sip.Request)
+	}
+	waitResponse := func(method sip.RequestMethod) sip.Response {
+		return waitMessage(func(msg sip.Message) bool {
+			res, ok := msg.(sip.Response)
+			if !ok || res.StatusCode() == 100 {
+				return false
+			}
+			cseq, ok := res.CSeq()
+			return ok && cseq.MethodName == method
+		}).(sip.Response)
+	}
+	serve := func(req sip.Request) {
+		in := tpl.InMsgs
+		go func() {
+			in <- req
+		}()
+
+		var tx sip.ServerTransaction
+		Eventually(txl.Requests(), time.Second).Should(Receive(&tx))
+		go p.ServeRequest(tx.Origin(), tx)
+	}
+	answer := func(req sip.Request, code sip.StatusCode, reason string, headers ...sip.Header) sip.Response {
+		res := sip.NewResponseFromRequest("", req, code, reason, "")
+		if to, ok := res.To(); ok && to.Params != nil {
+			to.Params.Add("tag", sip.String{Str: "bob-tag"})
+		}
+		for _, hdr := range headers {
+			res.AppendHeader(hdr)
+		}
+		// the responder may outlive the spec, so it must not read tpl reassigned by the next one
+		in := tpl.InMsgs
+		go func() {
+			// client tx is stored right after the request was sent
+			time.Sleep(10 * time.Millisecond)
+			in <- res
+		}()
+		return res
+	}
+	viaHops := func(msg sip.Message) int {
+		count := 0
+		for _, hdr := range msg.GetHeaders("Via") {
+			count += len(hdr.(sip.ViaHeader))
+		}
+		return count
+	}
+
+	BeforeEach(func() {
+		port := sip.Port(5060)
+		targets = proxy.NewTargets(
+			&sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.1", FPort: &port},
+		)
+		forking = proxy.ForkParallel
+	})
+	JustBeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger())
+		p = proxy.NewProxy(txl, proxy.Config{
+			Host:        "proxy.example.com",
+			Domains:     []string{"example.com"},
+			RecordRoute: true,
+			Forking:     forking,
+			Targets: func(req sip.Request) ([]proxy.Target, error) {
+				return targets, nil
+			},
+		}, testutils.NewLogrusLogger())
+	})
+	AfterEach(func() {
+		// drop messages sent by the terminating transactions
+		out := tpl.OutMsgs
+		go func() {
+			for range out {
+			}
+		}()
+
+		txl.Cancel()
+		<-txl.Done()
+		p.Cancel()
+		<-p.Done()
+		tpl.Cancel()
+	})
+
+	It("should forward INVITE to the target and responses back", func() {
+		serve(invite("Max-Forwards: 70"))
+
+		fwd := waitRequest(sip.INVITE)
+		Expect(fwd.Recipient().String()).To(Equal("sip:bob@10.0.0.1:5060"))
+		Expect(fwd.GetHeaders("Max-Forwards")[0].Value()).To(Equal("69"))
+		Expect(fwd.GetHeaders("Record-Route")[0].Value()).To(Equal("<sip:proxy.example.com;lr>"))
+		Expect(viaHops(fwd)).To(Equal(2))
+		viaHop, _ := fwd.ViaHop()
+		Expect(viaHop.Host).To(Equal("proxy.example.com"))
+
+		answer(fwd, 180, "Ringing")
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(180)))
+		Expect(viaHops(res)).To(Equal(1))
+
+		answer(fwd, 200, "OK")
+		res = waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		viaHop, _ = res.ViaHop()
+		Expect(viaHop.Host).To(Equal("alice.example.com"))
+	})
+
+	It("should preload the route set of the target", func() {
+		targets[0].Route = []sip.Uri{
+			&sip.SipUri{FHost: "edge.example.com", FUriParams: sip.NewParams().Add("lr", nil)},
+		}
+		serve(invite())
+
+		fwd := waitRequest(sip.INVITE)
+		Expect(fwd.Recipient().String()).To(Equal("sip:bob@10.0.0.1:5060"))
+		Expect(fwd.GetHeaders("Route")).To(HaveLen(1))
+		Expect(fwd.GetHeaders("Route")[0].Value()).To(Equal("<sip:edge.example.com;lr>"))
+	})
+
+	It("should reject request with exhausted Max-Forwards", func() {
+		serve(invite("Max-Forwards: 0"))
+
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(483)))
+	})
+
+	It("should reject request with unsupported Proxy-Require", func() {
+		serve(invite("Proxy-Require: foo"))
+
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(420)))
+		Expect(res.GetHeaders("Unsupported")[0].Value()).To(Equal("foo"))
+	})
+
+	It("should detect loop", func() {
+		serve(invite())
+		fwd := waitRequest(sip.INVITE)
+
+		// the request comes back with the same Request-URI
+		looped := sip.CopyRequest(fwd)
+		looped.SetRecipient(invite().Recipient())
+		looped.PrependHeader(sip.ViaHeader{&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       "UDP",
+			Host:            "10.0.0.1",
+			Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		}})
+		serve(looped)
+
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(482)))
+	})
+
+	It("should detect loop of the request received from strict router", func() {
+		// the previous hop is a strict router, it puts the Record-Route of the proxy to the Request-URI
+		strict := func() sip.Request {
+			req := invite("Route: <sip:bob@example.com>")
+			req.SetRecipient(&sip.SipUri{
+				FHost:      "proxy.example.com",
+				FUriParams: sip.NewParams().Add("lr", nil),
+			})
+			return req
+		}
+		serve(strict())
+		fwd := waitRequest(sip.INVITE)
+		Expect(fwd.Recipient().String()).To(Equal("sip:bob@10.0.0.1:5060"))
+
+		// the request comes back through the strict router
+		looped := strict()
+		looped.ReplaceHeaders("Via", fwd.GetHeaders("Via"))
+		looped.PrependHeader(sip.ViaHeader{&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       "UDP",
+			Host:            "10.0.0.1",
+			Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		}})
+		serve(looped)
+
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(482)))
+	})
+
+	It("should respond with the lowest class response when all branches failed", func() {
+		port := sip.Port(5060)
+		targets = append(targets, proxy.NewTargets(
+			&sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.2", FPort: &port},
+		)...)
+
+		serve(invite())
+		fwd1 := waitRequest(sip.INVITE)
+		fwd2 := waitRequest(sip.INVITE)
+
+		answer(fwd1, 503, "Service Unavailable")
+		answer(fwd2, 404, "Not Found")
+
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(404)))
+	})
+
+	It("should prefer challenges among 4xx responses and collect them", func() {
+		port := sip.Port(5060)
+		targets = append(targets, proxy.NewTargets(
+			&sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.2", FPort: &port},
+			&sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.3", FPort: &port},
+		)...)
+
+		serve(invite())
+		fwd1 := waitRequest(sip.INVITE)
+		fwd2 := waitRequest(sip.INVITE)
+		fwd3 := waitRequest(sip.INVITE)
+
+		answer(fwd1, 404, "Not Found")
+		answer(fwd2, 407, "Proxy Authentication Required",
+			&sip.GenericHeader{HeaderName: "Proxy-Authenticate", Contents: `Digest realm="a.example.com", nonce="1"`})
+		answer(fwd3, 401, "Unauthorized",
+			&sip.GenericHeader{HeaderName: "WWW-Authenticate", Contents: `Digest realm="b.example.com", nonce="2"`})
+
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(BeElementOf(sip.StatusCode(401), sip.StatusCode(407)))
+		Expect(res.GetHeaders("Proxy-Authenticate")).To(HaveLen(1))
+		Expect(res.GetHeaders("WWW-Authenticate")).To(HaveLen(1))
+	})
+
+	It("should forward CANCEL to the pending branches", func() {
+		serve(invite())
+		fwd := waitRequest(sip.INVITE)
+		answer(fwd, 180, "Ringing")
+		waitResponse(sip.INVITE)
+
+		in := tpl.InMsgs
+		go func() {
+			in <- sip.NewCancelRequest("", invite(), nil)
+		}()
+
+		cancel := waitRequest(sip.CANCEL)
+		cancelBranch, _ := cancel.ViaHop()
+		fwdBranch, _ := fwd.ViaHop()
+		Expect(cancelBranch.Params.Equals(fwdBranch.Params)).To(BeTrue())
+
+		answer(fwd, 487, "Request Terminated")
+		res := waitResponse(sip.INVITE)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(487)))
+	})
+
+	Context("with sequential forking", func() {
+		BeforeEach(func() {
+			port := sip.Port(5060)
+			forking = proxy.ForkSequential
+			targets = []proxy.Target{
+				{Uri: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.1", FPort: &port}, Q: 0.5},
+				{Uri: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.2", FPort: &port}, Q: 1},
+				{Uri: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.3", FPort: &port}, Q: 0.1},
+			}
+		})
+
+		It("should try targets by q-value until one succeeds", func() {
+			serve(invite())
+
+			fwd := waitRequest(sip.INVITE)
+			Expect(fwd.Recipient().Host()).To(Equal("10.0.0.2"))
+			answer(fwd, 486, "Busy Here")
+
+			fwd = waitRequest(sip.INVITE)
+			Expect(fwd.Recipient().Host()).To(Equal("10.0.0.1"))
+			answer(fwd, 200, "OK")
+
+			res := waitResponse(sip.INVITE)
+			Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+
+			Consistently(func() bool {
+				select {
+				case msg := <-tpl.OutMsgs:
+					req, ok := msg.(sip.Request)
+					return ok && req.IsInvite()
+				default:
+					return false
+				}
+			}, 100*time.Millisecond).Should(BeFalse())
+		})
+
+		It("should stop forking on 6xx", func() {
+			serve(invite())
+
+			fwd := waitRequest(sip.INVITE)
+			answer(fwd, 603, "Decline")
+
+			res := waitResponse(sip.INVITE)
+			Expect(res.StatusCode()).To(Equal(sip.StatusCode(603)))
+		})
+	})
+})
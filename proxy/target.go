@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ygj201011/gosip/sip"
+)
+
+// ForkMode defines how the request is forked to the target set - RFC 3261 - 16.6.
+type ForkMode int
+
+const (
+	// ForkParallel sends request to all targets at once.
+	ForkParallel ForkMode = iota
+	// ForkSequential tries targets one by one in q-value order,
+	// next target is tried when the previous one failed or timed out.
+	ForkSequential
+)
+
+func (mode ForkMode) String() string {
+	switch mode {
+	case ForkParallel:
+		return "Parallel"
+	case ForkSequential:
+		return "Sequential"
+	default:
+		return "Unknown"
+	}
+}
+
+// Target is a request destination with preference.
+type Target struct {
+	Uri sip.Uri
+	// Q is a preference in 0..1 range, targets with higher q-value are tried first.
+	Q float32
+	// Timeout limits waiting for the final response on the branch,
+	// the branch is canceled when it expires. Zero means no limit.
+	Timeout time.Duration
+	// Route is the route set to reach the target, e.g. Path of the registered contact - RFC 3327 - 5.2.
+	// It is added to Route headers of the request forwarded to the target.
+	Route []sip.Uri
+}
+
+// NewTargets makes targets with equal preference from URIs.
+func NewTargets(uris ...sip.Uri) []Target {
+	targets := make([]Target, 0, len(uris))
+	for _, uri := range uris {
+		targets = append(targets, Target{Uri: uri, Q: 1})
+	}
+
+	return targets
+}
+
+// ForkGroups orders targets by q-value and splits them into groups
+// tried one after another. Targets of one group are forked in parallel.
+func ForkGroups(targets []Target, mode ForkMode) [][]Target {
+	sorted := make([]Target, len(targets))
+	copy(sorted, targets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Q > sorted[j].Q
+	})
+
+	if mode == ForkParallel {
+		if len(sorted) == 0 {
+			return [][]Target{}
+		}
+
+		return [][]Target{sorted}
+	}
+
+	groups := make([][]Target, 0, len(sorted))
+	for _, target := range sorted {
+		groups = append(groups, []Target{target})
+	}
+
+	return groups
+}
+
+// ForkTargets forwards request to the target groups one after another - RFC 3261 - 16.6.
+// The next group is tried only when all branches of the current group failed:
+// forward starts the branch of the target, wait blocks until branches of the group are finished
+// and stopped reports that forking is over, e.g. on 2xx, 6xx or CANCEL.
+func ForkTargets(targets []Target, mode ForkMode, stopped func() bool, forward func(target Target), wait func()) {
+	for _, group := range ForkGroups(targets, mode) {
+		if stopped() {
+			break
+		}
+
+		for _, target := range group {
+			forward(target)
+		}
+
+		wait()
+	}
+}
+
+// SetTarget points the request to the target: the target URI becomes the Request-URI
+// and the route set of the target is added after the Route headers of the request - RFC 3261 - 16.6.
+func SetTarget(req sip.Request, target Target) {
+	req.SetRecipient(target.Uri.Clone())
+	if len(target.Route) == 0 {
+		return
+	}
+
+	routes := routeUris(req)
+	for _, uri := range target.Route {
+		routes = append(routes, uri.Clone())
+	}
+	setRoutes(req, routes)
+}
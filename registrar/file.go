@@ -0,0 +1,358 @@
+package registrar
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/sip/parser"
+	"github.com/ygj201011/gosip/timing"
+)
+
+// FileLocationService is LocationService persisted to the local file.
+// It is deliberately not an embedded key-value or SQLite database: bindings are appended
+// to the file as JSON lines and the file is compacted, so no database dependency is needed.
+type FileLocationService interface {
+	LocationService
+	// Compact rewrites the file with the actual bindings only.
+	Compact() error
+	Close() error
+}
+
+var errLocationServiceClosed = errors.New("location service closed")
+
+// fileRecord is one line of the file, it replaces all bindings of the AOR.
+type fileRecord struct {
+	AOR      string          `json:"aor"`
+	Bindings []bindingRecord `json:"bindings,omitempty"`
+}
+
+type bindingRecord struct {
+	// Contact is the Contact header value without expires parameter.
+	Contact string   `json:"contact"`
+	Path    []string `json:"path,omitempty"`
+	CallID  string   `json:"call_id"`
+	CSeq    uint32   `json:"cseq"`
+	Expires int64    `json:"expires"`
+}
+
+// fileLocationService keeps bindings in memory and appends every update to the file,
+// the file is compacted on start and when it grows twice as large as needed.
+type fileLocationService struct {
+	path     string
+	file     *os.File
+	bindings map[string][]*Binding
+	// records is count of lines in the file
+	records int
+	closed  bool
+	mu      sync.RWMutex
+
+	log log.Logger
+}
+
+// NewFileLocationService loads non-expired bindings from the file and compacts it.
+// The file is created if not exists.
+func NewFileLocationService(path string, logger log.Logger) (FileLocationService, error) {
+	ls := &fileLocationService{
+		path:     path,
+		bindings: make(map[string][]*Binding),
+	}
+	ls.log = logger.
+		WithPrefix("registrar.FileLocationService").
+		WithFields(log.Fields{
+			"location_service_ptr": fmt.Sprintf("%p", ls),
+			"path":                 path,
+		})
+
+	if err := ls.load(); err != nil {
+		return nil, fmt.Errorf("load bindings from %s: %w", path, err)
+	}
+	if err := ls.Compact(); err != nil {
+		return nil, err
+	}
+
+	return ls, nil
+}
+
+func (ls *fileLocationService) String() string {
+	if ls == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("registrar.FileLocationService<%s>", ls.Log().Fields())
+}
+
+func (ls *fileLocationService) Log() log.Logger {
+	return ls.log
+}
+
+func (ls *fileLocationService) Bindings(aor string) ([]*Binding, error) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	now := timing.Now()
+	bindings := make([]*Binding, 0, len(ls.bindings[aor]))
+	for _, b := range ls.bindings[aor] {
+		if b.Expires.After(now) {
+			bindings = append(bindings, b.Clone())
+		}
+	}
+
+	return bindings, nil
+}
+
+func (ls *fileLocationService) Update(aor string, bindings []*Binding) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.closed {
+		return errLocationServiceClosed
+	}
+
+	stored := make([]*Binding, 0, len(bindings))
+	for _, b := range bindings {
+		stored = append(stored, b.Clone())
+	}
+
+	if err := ls.append(newFileRecord(aor, stored)); err != nil {
+		return fmt.Errorf("write bindings of %s: %w", aor, err)
+	}
+
+	if len(stored) == 0 {
+		delete(ls.bindings, aor)
+	} else {
+		ls.bindings[aor] = stored
+	}
+
+	return nil
+}
+
+func (ls *fileLocationService) Expire(now time.Time) ([]*Binding, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	expired := make([]*Binding, 0)
+	for aor, bindings := range ls.bindings {
+		alive := make([]*Binding, 0, len(bindings))
+		for _, b := range bindings {
+			if b.Expires.After(now) {
+				alive = append(alive, b)
+			} else {
+				expired = append(expired, b)
+			}
+		}
+
+		if len(alive) == 0 {
+			delete(ls.bindings, aor)
+		} else {
+			ls.bindings[aor] = alive
+		}
+	}
+
+	// the closed file is not reopened by compaction
+	if !ls.closed && (len(expired) > 0 || ls.records > 2*len(ls.bindings)) {
+		if err := ls.compact(); err != nil {
+			return expired, err
+		}
+	}
+
+	return expired, nil
+}
+
+func (ls *fileLocationService) Compact() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	return ls.compact()
+}
+
+func (ls *fileLocationService) Close() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.closed {
+		return nil
+	}
+	ls.closed = true
+
+	err := ls.file.Close()
+	ls.file = nil
+
+	return err
+}
+
+// load reads records from the file, the last record of the AOR wins.
+func (ls *fileLocationService) load() error {
+	file, err := os.Open(ls.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := timing.Now()
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var record fileRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			// the last line can be truncated on crash
+			ls.Log().Warnf("skip broken record at line %d: %s", line, err)
+			continue
+		}
+
+		bindings := make([]*Binding, 0, len(record.Bindings))
+		for _, br := range record.Bindings {
+			b, err := br.binding(record.AOR)
+			if err != nil {
+				ls.Log().Warnf("skip broken binding of %s at line %d: %s", record.AOR, line, err)
+				continue
+			}
+			if b.Expires.After(now) {
+				bindings = append(bindings, b)
+			}
+		}
+
+		if len(bindings) == 0 {
+			delete(ls.bindings, record.AOR)
+		} else {
+			ls.bindings[record.AOR] = bindings
+		}
+	}
+
+	return nil
+}
+
+// compact writes actual bindings to the temporary file and replaces the file with it.
+func (ls *fileLocationService) compact() error {
+	if ls.closed {
+		return errLocationServiceClosed
+	}
+
+	tmpPath := ls.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("compact %s: %w", ls.path, err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for aor, bindings := range ls.bindings {
+		if err = encoder.Encode(newFileRecord(aor, bindings)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, ls.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("compact %s: %w", ls.path, err)
+	}
+
+	if ls.file != nil {
+		ls.file.Close()
+	}
+	ls.file, err = os.OpenFile(ls.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", ls.path, err)
+	}
+	ls.records = len(ls.bindings)
+
+	ls.Log().Debugf("%d AORs compacted", ls.records)
+
+	return nil
+}
+
+func (ls *fileLocationService) append(record fileRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ls.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	ls.records++
+
+	return ls.file.Sync()
+}
+
+func newFileRecord(aor string, bindings []*Binding) fileRecord {
+	record := fileRecord{
+		AOR:      aor,
+		Bindings: make([]bindingRecord, 0, len(bindings)),
+	}
+	for _, b := range bindings {
+		contact := &sip.ContactHeader{
+			Address: b.Contact,
+			Params:  b.Params,
+		}
+		br := bindingRecord{
+			Contact: contact.Value(),
+			CallID:  b.CallID,
+			CSeq:    b.CSeq,
+			Expires: b.Expires.Unix(),
+		}
+		for _, uri := range b.Path {
+			br.Path = append(br.Path, uri.String())
+		}
+
+		record.Bindings = append(record.Bindings, br)
+	}
+
+	return record
+}
+
+func (br bindingRecord) binding(aor string) (*Binding, error) {
+	_, uris, params, err := parser.ParseAddressValues(br.Contact)
+	if err != nil {
+		return nil, err
+	}
+	if len(uris) != 1 {
+		return nil, fmt.Errorf("invalid contact %s", br.Contact)
+	}
+
+	b := &Binding{
+		AOR:     aor,
+		Contact: uris[0],
+		Params:  params[0],
+		CallID:  br.CallID,
+		CSeq:    br.CSeq,
+		Expires: time.Unix(br.Expires, 0),
+	}
+	for _, value := range br.Path {
+		uri, err := parser.ParseUri(value)
+		if err != nil {
+			return nil, err
+		}
+		b.Path = append(b.Path, uri)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,144 @@
+package registrar_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/registrar"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+)
+
+var _ = Describe("FileLocationService", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	open := func() registrar.FileLocationService {
+		ls, err := registrar.NewFileLocationService(path, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		return ls
+	}
+	lines := func() []string {
+		data, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "gosip-registrar")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "bindings.db")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should reload bindings with Path, instance-id and reg-id", func() {
+		ls := open()
+		Expect(ls.Update("sip:alice@example.com", []*registrar.Binding{
+			{
+				AOR:     "sip:alice@example.com",
+				Contact: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "10.0.0.1"},
+				Params: sip.NewParams().
+					Add("+sip.instance", sip.String{Str: `"<urn:uuid:00000000-0000-1000-8000-000A95A0E128>"`}).
+					Add("reg-id", sip.String{Str: "1"}),
+				Path: []sip.Uri{
+					&sip.SipUri{FHost: "edge.example.com", FUriParams: sip.NewParams().Add("lr", nil)},
+				},
+				CallID:  "call-1",
+				CSeq:    2,
+				Expires: time.Now().Add(time.Hour),
+			},
+			{
+				AOR:     "sip:alice@example.com",
+				Contact: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "10.0.0.2"},
+				CallID:  "call-2",
+				CSeq:    1,
+				Expires: time.Now().Add(-time.Second),
+			},
+		})).To(Succeed())
+		Expect(ls.Close()).To(Succeed())
+
+		ls = open()
+		defer ls.Close()
+
+		bindings, err := ls.Bindings("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(HaveLen(1))
+		b := bindings[0]
+		Expect(b.Contact.String()).To(Equal("sip:alice@10.0.0.1"))
+		Expect(b.InstanceID()).To(Equal("<urn:uuid:00000000-0000-1000-8000-000A95A0E128>"))
+		Expect(b.RegID()).To(Equal("1"))
+		Expect(b.Path).To(HaveLen(1))
+		Expect(b.Path[0].String()).To(Equal("sip:edge.example.com;lr"))
+		Expect(b.CallID).To(Equal("call-1"))
+		Expect(b.CSeq).To(Equal(uint32(2)))
+	})
+
+	It("should compact removed and expired entries", func() {
+		ls := open()
+		binding := func(host string, expires time.Duration) *registrar.Binding {
+			return &registrar.Binding{
+				AOR:     "sip:bob@example.com",
+				Contact: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: host},
+				CallID:  "call-1",
+				Expires: time.Now().Add(expires),
+			}
+		}
+
+		Expect(ls.Update("sip:bob@example.com", []*registrar.Binding{binding("10.0.0.1", time.Hour)})).To(Succeed())
+		Expect(ls.Update("sip:bob@example.com", []*registrar.Binding{binding("10.0.0.2", time.Hour)})).To(Succeed())
+		Expect(ls.Update("sip:carol@example.com", []*registrar.Binding{binding("10.0.0.3", time.Minute)})).To(Succeed())
+		Expect(lines()).To(HaveLen(3))
+
+		expired, err := ls.Expire(time.Now().Add(2 * time.Minute))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expired).To(HaveLen(1))
+		Expect(lines()).To(HaveLen(1))
+		Expect(ls.Close()).To(Succeed())
+
+		// crash in the middle of the write
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = file.WriteString(`{"aor":"sip:bob@exam`)
+		Expect(err).ToNot(HaveOccurred())
+		file.Close()
+
+		ls = open()
+		defer ls.Close()
+
+		bindings, err := ls.Bindings("sip:bob@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(HaveLen(1))
+		Expect(bindings[0].Contact.Host()).To(Equal("10.0.0.2"))
+		Expect(lines()).To(HaveLen(1))
+	})
+
+	It("should not reopen the file on expiration after close", func() {
+		ls := open()
+		Expect(ls.Update("sip:bob@example.com", []*registrar.Binding{
+			{
+				AOR:     "sip:bob@example.com",
+				Contact: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.1"},
+				CallID:  "call-1",
+				Expires: time.Now().Add(time.Minute),
+			},
+		})).To(Succeed())
+		Expect(ls.Close()).To(Succeed())
+
+		expired, err := ls.Expire(time.Now().Add(2 * time.Minute))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expired).To(HaveLen(1))
+		Expect(ls.Compact()).ToNot(Succeed())
+		Expect(lines()).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,163 @@
+package registrar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ygj201011/gosip/sip"
+)
+
+// LocationService stores bindings of address-of-records - RFC 3261 - 10.3.
+// Bindings are grouped by the canonical AOR returned by AorKey.
+type LocationService interface {
+	// Bindings returns bindings of the AOR that are not expired yet.
+	Bindings(aor string) ([]*Binding, error)
+	// Update replaces all bindings of the AOR, empty list removes the AOR.
+	Update(aor string, bindings []*Binding) error
+	// Expire removes bindings expired at the moment and returns them.
+	Expire(now time.Time) ([]*Binding, error)
+}
+
+// Binding maps the address-of-record to the contact address.
+type Binding struct {
+	AOR     string
+	Contact sip.Uri
+	// Params of the Contact header except expires, like q or +sip.instance.
+	Params sip.Params
+	// Path is the route set to reach the contact - RFC 3327.
+	Path    []sip.Uri
+	CallID  string
+	CSeq    uint32
+	Expires time.Time
+}
+
+func (b *Binding) String() string {
+	if b == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("registrar.Binding<%s -> %s, expires: %s>", b.AOR, b.Contact, b.Expires)
+}
+
+// Q returns q-value of the contact, 1 if not set.
+func (b *Binding) Q() float32 {
+	if b.Params == nil {
+		return 1
+	}
+
+	value, ok := b.Params.Get("q")
+	if !ok || value == nil {
+		return 1
+	}
+
+	q, err := strconv.ParseFloat(value.String(), 32)
+	if err != nil {
+		return 1
+	}
+
+	return float32(q)
+}
+
+// InstanceID returns +sip.instance parameter of the contact - RFC 5626 - 4.1.
+func (b *Binding) InstanceID() string {
+	return b.param("+sip.instance")
+}
+
+// RegID returns reg-id parameter of the contact - RFC 5626 - 4.2.
+func (b *Binding) RegID() string {
+	return b.param("reg-id")
+}
+
+func (b *Binding) param(name string) string {
+	return paramValue(b.Params, name)
+}
+
+// matches reports whether the Contact header refers to the binding.
+// Contact with +sip.instance is matched by the instance ID and reg-id - RFC 5626 - 6,
+// so the flow is refreshed even if the contact address has changed. Other contacts are matched by URI.
+func (b *Binding) matches(contact *sip.ContactHeader) bool {
+	if instanceID := paramValue(contact.Params, "+sip.instance"); instanceID != "" {
+		return b.InstanceID() == instanceID && b.RegID() == paramValue(contact.Params, "reg-id")
+	}
+
+	return b.InstanceID() == "" && b.Contact.Equals(contact.Address)
+}
+
+// ContactHeader returns Contact header with the expires parameter left at the moment.
+func (b *Binding) ContactHeader(now time.Time) *sip.ContactHeader {
+	params := sip.NewParams()
+	if b.Params != nil {
+		params = b.Params.Clone()
+	}
+
+	expires := b.Expires.Sub(now)
+	if expires < 0 {
+		expires = 0
+	}
+	params.Add("expires", sip.String{Str: strconv.Itoa(int((expires + time.Second/2) / time.Second))})
+
+	return &sip.ContactHeader{
+		Address: b.Contact.Clone(),
+		Params:  params,
+	}
+}
+
+func (b *Binding) Clone() *Binding {
+	if b == nil {
+		return nil
+	}
+
+	cp := *b
+	if b.Contact != nil {
+		cp.Contact = b.Contact.Clone()
+	}
+	if b.Params != nil {
+		cp.Params = b.Params.Clone()
+	}
+	if b.Path != nil {
+		cp.Path = make([]sip.Uri, 0, len(b.Path))
+		for _, uri := range b.Path {
+			cp.Path = append(cp.Path, uri.Clone())
+		}
+	}
+
+	return &cp
+}
+
+// AorKey returns canonical form of the address-of-record URI - RFC 3261 - 10.3.
+// URI parameters, headers and password are dropped, the host is case-insensitive.
+func AorKey(uri sip.Uri) string {
+	var buffer strings.Builder
+	if uri.IsEncrypted() {
+		buffer.WriteString("sips:")
+	} else {
+		buffer.WriteString("sip:")
+	}
+
+	if user := uri.User(); user != nil && user.String() != "" {
+		buffer.WriteString(user.String())
+		buffer.WriteString("@")
+	}
+	buffer.WriteString(strings.ToLower(uri.Host()))
+
+	if port := uri.Port(); port != nil {
+		buffer.WriteString(fmt.Sprintf(":%d", *port))
+	}
+
+	return buffer.String()
+}
+
+func paramValue(params sip.Params, name string) string {
+	if params == nil {
+		return ""
+	}
+
+	value, ok := params.Get(name)
+	if !ok || value == nil {
+		return ""
+	}
+
+	return strings.Trim(value.String(), "\"")
+}
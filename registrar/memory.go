@@ -0,0 +1,78 @@
+package registrar
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/timing"
+)
+
+type memoryLocationService struct {
+	bindings map[string][]*Binding
+	mu       sync.RWMutex
+}
+
+// NewMemoryLocationService returns LocationService that keeps bindings in memory.
+func NewMemoryLocationService() LocationService {
+	return &memoryLocationService{
+		bindings: make(map[string][]*Binding),
+	}
+}
+
+func (ls *memoryLocationService) Bindings(aor string) ([]*Binding, error) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	now := timing.Now()
+	bindings := make([]*Binding, 0, len(ls.bindings[aor]))
+	for _, b := range ls.bindings[aor] {
+		if b.Expires.After(now) {
+			bindings = append(bindings, b.Clone())
+		}
+	}
+
+	return bindings, nil
+}
+
+func (ls *memoryLocationService) Update(aor string, bindings []*Binding) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if len(bindings) == 0 {
+		delete(ls.bindings, aor)
+		return nil
+	}
+
+	stored := make([]*Binding, 0, len(bindings))
+	for _, b := range bindings {
+		stored = append(stored, b.Clone())
+	}
+	ls.bindings[aor] = stored
+
+	return nil
+}
+
+func (ls *memoryLocationService) Expire(now time.Time) ([]*Binding, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	expired := make([]*Binding, 0)
+	for aor, bindings := range ls.bindings {
+		alive := make([]*Binding, 0, len(bindings))
+		for _, b := range bindings {
+			if b.Expires.After(now) {
+				alive = append(alive, b)
+			} else {
+				expired = append(expired, b)
+			}
+		}
+
+		if len(alive) == 0 {
+			delete(ls.bindings, aor)
+		} else {
+			ls.bindings[aor] = alive
+		}
+	}
+
+	return expired, nil
+}
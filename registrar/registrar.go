@@ -0,0 +1,450 @@
+// registrar package implements SIP registrar - RFC 3261 - 10.3.
+package registrar
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/proxy"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/sip/parser"
+	"github.com/ygj201011/gosip/timing"
+)
+
+const (
+	defaultExpires       = time.Hour
+	defaultMinExpires    = time.Minute
+	defaultSweepInterval = 30 * time.Second
+	// dateFormat is SIP-date - RFC 3261 - 20.17.
+	dateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+)
+
+// Config describes registrar options.
+type Config struct {
+	// Domains the registrar is responsible for, any domain is accepted if empty.
+	Domains []string
+	// DefaultExpires is used when the request has no expiration interval, 1 hour by default.
+	DefaultExpires time.Duration
+	// MinExpires is the shortest accepted interval, 1 minute by default.
+	MinExpires time.Duration
+	// MaxExpires caps the granted interval, no limit if zero.
+	MaxExpires time.Duration
+	// SweepInterval defines how often expired bindings are removed, 30 seconds by default.
+	SweepInterval time.Duration
+}
+
+// registration holds fields of REGISTER request applied to the bindings.
+type registration struct {
+	aor        string
+	callID     string
+	seqNo      uint32
+	expires    time.Duration
+	hasExpires bool
+	path       []sip.Uri
+}
+
+// Registrar handles REGISTER requests and keeps bindings in LocationService.
+type Registrar interface {
+	Cancel()
+	Done() <-chan struct{}
+	String() string
+	// ServeRequest handles REGISTER request received by the server,
+	// it has the signature of gosip.RequestHandler.
+	ServeRequest(req sip.Request, tx sip.ServerTransaction)
+	// Targets returns contacts registered for the Request-URI,
+	// it has the signature of proxy.TargetsFunc.
+	Targets(req sip.Request) ([]proxy.Target, error)
+}
+
+type registrar struct {
+	locations LocationService
+	config    Config
+
+	canceled   chan struct{}
+	done       chan struct{}
+	cancelOnce sync.Once
+	mu         sync.Mutex
+
+	log log.Logger
+}
+
+func NewRegistrar(locations LocationService, config Config, logger log.Logger) Registrar {
+	if config.DefaultExpires == 0 {
+		config.DefaultExpires = defaultExpires
+	}
+	if config.MinExpires == 0 {
+		config.MinExpires = defaultMinExpires
+	}
+	if config.SweepInterval == 0 {
+		config.SweepInterval = defaultSweepInterval
+	}
+
+	r := &registrar{
+		locations: locations,
+		config:    config,
+		canceled:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	r.log = logger.
+		WithPrefix("registrar.Registrar").
+		WithFields(log.Fields{
+			"registrar_ptr": fmt.Sprintf("%p", r),
+		})
+
+	go r.sweep()
+
+	return r
+}
+
+func (r *registrar) String() string {
+	if r == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("registrar.Registrar<%s>", r.Log().Fields())
+}
+
+func (r *registrar) Log() log.Logger {
+	return r.log
+}
+
+func (r *registrar) Cancel() {
+	r.cancelOnce.Do(func() {
+		close(r.canceled)
+	})
+}
+
+func (r *registrar) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *registrar) ServeRequest(req sip.Request, tx sip.ServerTransaction) {
+	if tx == nil {
+		return
+	}
+
+	logger := r.Log().WithFields(req.Fields())
+
+	res, err := r.register(req)
+	if err != nil {
+		logger.Warnf("REGISTER rejected: %s", err)
+
+		var reqErr *sip.RequestError
+		if !errors.As(err, &reqErr) {
+			reqErr = sip.NewRequestError(500, "Server Internal Error", req, nil)
+		}
+
+		res = reqErr.Response
+		if res == nil {
+			res = sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, "")
+		}
+	}
+
+	if err := tx.Respond(res); err != nil {
+		logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
+
+// register processes REGISTER request - RFC 3261 - 10.3.
+func (r *registrar) register(req sip.Request) (sip.Response, error) {
+	if req.Method() != sip.REGISTER {
+		return nil, sip.NewRequestError(405, "Method Not Allowed", req, nil)
+	}
+	if !r.isOwnDomain(req.Recipient()) {
+		return nil, sip.NewRequestError(404, "Not Found", req, nil)
+	}
+
+	to, ok := req.To()
+	if !ok || to.Address == nil {
+		return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+	}
+	if _, ok := to.Address.(*sip.SipUri); !ok || !r.isOwnDomain(to.Address) {
+		return nil, sip.NewRequestError(404, "Not Found", req, nil)
+	}
+	callID, ok := req.CallID()
+	if !ok {
+		return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+	}
+
+	contacts := make([]*sip.ContactHeader, 0)
+	for _, hdr := range req.GetHeaders("Contact") {
+		if contact, ok := hdr.(*sip.ContactHeader); ok {
+			contacts = append(contacts, contact)
+		}
+	}
+
+	reg := registration{
+		aor:    AorKey(to.Address),
+		callID: string(*callID),
+		seqNo:  cseq.SeqNo,
+	}
+	reg.expires, reg.hasExpires = requestExpires(req)
+	if !reg.hasExpires {
+		reg.expires = r.config.DefaultExpires
+	}
+	path, err := requestPath(req)
+	if err != nil {
+		return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+	}
+	reg.path = path
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, err := r.locations.Bindings(reg.aor)
+	if err != nil {
+		return nil, fmt.Errorf("get bindings of %s: %w", reg.aor, err)
+	}
+
+	bindings := current
+	if len(contacts) > 0 {
+		bindings, err = r.updateBindings(req, reg, current, contacts)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := r.locations.Update(reg.aor, bindings); err != nil {
+			return nil, fmt.Errorf("update bindings of %s: %w", reg.aor, err)
+		}
+	}
+
+	now := timing.Now()
+	res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+	res.RemoveHeader("Contact")
+	for _, b := range bindings {
+		res.AppendHeader(b.ContactHeader(now))
+	}
+	// RFC 3327 - 5.3. Path is echoed to UA that supports it.
+	if len(reg.path) > 0 && supportsPath(req) {
+		for _, hdr := range req.GetHeaders("Path") {
+			res.AppendHeader(hdr.Clone())
+		}
+	}
+	res.AppendHeader(&sip.GenericHeader{
+		HeaderName: "Date",
+		Contents:   now.UTC().Format(dateFormat),
+	})
+
+	return res, nil
+}
+
+// updateBindings applies Contact headers to the current bindings - RFC 3261 - 10.3, step 6-7.
+// The update is aborted without changes when any contact is invalid.
+func (r *registrar) updateBindings(
+	req sip.Request,
+	reg registration,
+	current []*Binding,
+	contacts []*sip.ContactHeader,
+) ([]*Binding, error) {
+	for _, contact := range contacts {
+		if contact.Address == nil || !contact.Address.IsWildcard() {
+			continue
+		}
+
+		if len(contacts) > 1 || !reg.hasExpires || reg.expires != 0 {
+			return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+		}
+
+		for _, b := range current {
+			if b.CallID == reg.callID && reg.seqNo <= b.CSeq {
+				return nil, sip.NewRequestError(500, "Server Internal Error", req, nil)
+			}
+		}
+
+		return []*Binding{}, nil
+	}
+
+	now := timing.Now()
+	bindings := make([]*Binding, 0, len(current))
+	for _, b := range current {
+		bindings = append(bindings, b.Clone())
+	}
+
+	for _, contact := range contacts {
+		contactExpires := reg.expires
+		if value, ok := paramExpires(contact.Params); ok {
+			contactExpires = value
+		}
+		if contactExpires != 0 && contactExpires < r.config.MinExpires {
+			res := sip.NewResponseFromRequest("", req, 423, "Interval Too Brief", "")
+			res.AppendHeader(&sip.GenericHeader{
+				HeaderName: "Min-Expires",
+				Contents:   strconv.Itoa(int(r.config.MinExpires / time.Second)),
+			})
+			return nil, sip.NewRequestError(423, "Interval Too Brief", req, res)
+		}
+		if r.config.MaxExpires > 0 && contactExpires > r.config.MaxExpires {
+			contactExpires = r.config.MaxExpires
+		}
+
+		idx := -1
+		for i, b := range bindings {
+			if b.matches(contact) {
+				idx = i
+				break
+			}
+		}
+
+		if idx >= 0 {
+			// out of order request
+			if bindings[idx].CallID == reg.callID && reg.seqNo <= bindings[idx].CSeq {
+				return nil, sip.NewRequestError(500, "Server Internal Error", req, nil)
+			}
+
+			if contactExpires == 0 {
+				bindings = append(bindings[:idx], bindings[idx+1:]...)
+				continue
+			}
+		} else if contactExpires == 0 {
+			continue
+		}
+
+		params := sip.NewParams()
+		if contact.Params != nil {
+			params = contact.Params.Clone().Remove("expires")
+		}
+		b := &Binding{
+			AOR:     reg.aor,
+			Contact: contact.Address.Clone(),
+			Params:  params,
+			Path:    reg.path,
+			CallID:  reg.callID,
+			CSeq:    reg.seqNo,
+			Expires: now.Add(contactExpires),
+		}
+
+		if idx >= 0 {
+			bindings[idx] = b
+		} else {
+			bindings = append(bindings, b)
+		}
+	}
+
+	return bindings, nil
+}
+
+// Targets returns registered contacts with Path as the route set - RFC 3327 - 5.2.
+func (r *registrar) Targets(req sip.Request) ([]proxy.Target, error) {
+	bindings, err := r.locations.Bindings(AorKey(req.Recipient()))
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]proxy.Target, 0, len(bindings))
+	for _, b := range bindings {
+		// the contact is reached through the proxies that added Path, e.g. the edge proxy of the flow
+		targets = append(targets, proxy.Target{
+			Uri:   b.Contact,
+			Q:     b.Q(),
+			Route: b.Path,
+		})
+	}
+
+	return targets, nil
+}
+
+// sweep removes expired bindings from the LocationService.
+func (r *registrar) sweep() {
+	defer close(r.done)
+
+	for {
+		select {
+		case <-r.canceled:
+			r.Log().Debug("registrar canceled")
+			return
+		case <-timing.After(r.config.SweepInterval):
+		}
+
+		r.mu.Lock()
+		expired, err := r.locations.Expire(timing.Now())
+		r.mu.Unlock()
+
+		if err != nil {
+			r.Log().Errorf("remove expired bindings failed: %s", err)
+			continue
+		}
+		for _, b := range expired {
+			r.Log().Debugf("%s expired", b)
+		}
+	}
+}
+
+func (r *registrar) isOwnDomain(uri sip.Uri) bool {
+	if len(r.config.Domains) == 0 {
+		return true
+	}
+
+	for _, domain := range r.config.Domains {
+		if strings.EqualFold(uri.Host(), domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func requestExpires(req sip.Request) (time.Duration, bool) {
+	hdrs := req.GetHeaders("Expires")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+
+	if expires, ok := hdrs[0].(*sip.Expires); ok {
+		return time.Duration(*expires) * time.Second, true
+	}
+
+	return 0, false
+}
+
+func paramExpires(params sip.Params) (time.Duration, bool) {
+	if params == nil {
+		return 0, false
+	}
+
+	value, ok := params.Get("expires")
+	if !ok || value == nil {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseUint(value.String(), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// requestPath returns route set from Path headers - RFC 3327 - 5.3.
+func requestPath(req sip.Request) ([]sip.Uri, error) {
+	var path []sip.Uri
+	for _, hdr := range req.GetHeaders("Path") {
+		_, uris, _, err := parser.ParseAddressValues(hdr.Value())
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, uris...)
+	}
+
+	return path, nil
+}
+
+func supportsPath(req sip.Request) bool {
+	for _, hdr := range req.GetHeaders("Supported") {
+		for _, option := range strings.Split(hdr.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "path") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,14 @@
+package registrar_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRegistrar(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RegisterTestingT(t)
+	RunSpecs(t, "Registrar Suite")
+}
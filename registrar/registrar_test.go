@@ -0,0 +1,261 @@
+package registrar_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/registrar"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+)
+
+// serverTx captures responses of the registrar.
+type serverTx struct {
+	sip.ServerTransaction
+	origin    sip.Request
+	responses []sip.Response
+}
+
+func (tx *serverTx) Origin() sip.Request {
+	return tx.origin
+}
+
+func (tx *serverTx) Respond(res sip.Response) error {
+	tx.responses = append(tx.responses, res)
+	return nil
+}
+
+var _ = Describe("Registrar", func() {
+	var (
+		locations registrar.LocationService
+		reg       registrar.Registrar
+		cseq      int
+	)
+
+	register := func(callID string, extraHeaders ...string) sip.Response {
+		cseq++
+		lines := []string{
+			"REGISTER sip:example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:alice@example.com>",
+			"Call-ID: " + callID,
+			fmt.Sprintf("CSeq: %d REGISTER", cseq),
+		}
+		lines = append(lines, extraHeaders...)
+		lines = append(lines, "Content-Length: 0", "", "")
+		req := testutils.Request(lines)
+
+		tx := &serverTx{origin: req}
+		reg.ServeRequest(req, tx)
+		Expect(tx.responses).To(HaveLen(1))
+
+		return tx.responses[0]
+	}
+	contacts := func(res sip.Response) []string {
+		values := make([]string, 0)
+		for _, hdr := range res.GetHeaders("Contact") {
+			values = append(values, hdr.Value())
+		}
+		return values
+	}
+
+	BeforeEach(func() {
+		cseq = 0
+		locations = registrar.NewMemoryLocationService()
+		reg = registrar.NewRegistrar(locations, registrar.Config{
+			Domains:    []string{"example.com"},
+			MinExpires: 60 * time.Second,
+			MaxExpires: time.Hour,
+		}, testutils.NewLogrusLogger())
+	})
+	AfterEach(func() {
+		reg.Cancel()
+		<-reg.Done()
+	})
+
+	It("should add, refresh and remove bindings", func() {
+		res := register("call-1", "Contact: <sip:alice@10.0.0.1>;q=0.5", "Expires: 300")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(contacts(res)).To(ConsistOf("<sip:alice@10.0.0.1>;q=0.5;expires=300"))
+		Expect(res.GetHeaders("Date")).To(HaveLen(1))
+
+		res = register("call-1", "Contact: <sip:alice@10.0.0.2>;expires=7200")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(contacts(res)).To(ConsistOf(
+			"<sip:alice@10.0.0.1>;q=0.5;expires=300",
+			"<sip:alice@10.0.0.2>;expires=3600",
+		))
+
+		res = register("call-1", "Contact: <sip:alice@10.0.0.1>;expires=0")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(contacts(res)).To(ConsistOf("<sip:alice@10.0.0.2>;expires=3600"))
+
+		// query
+		res = register("call-1")
+		Expect(contacts(res)).To(ConsistOf("<sip:alice@10.0.0.2>;expires=3600"))
+	})
+
+	It("should reject too brief interval with 423", func() {
+		res := register("call-1", "Contact: <sip:alice@10.0.0.1>", "Expires: 10")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(423)))
+		Expect(res.GetHeaders("Min-Expires")[0].Value()).To(Equal("60"))
+
+		bindings, err := locations.Bindings("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(BeEmpty())
+	})
+
+	It("should remove all bindings with wildcard contact", func() {
+		register("call-1", "Contact: <sip:alice@10.0.0.1>, <sip:alice@10.0.0.2>")
+
+		res := register("call-2", "Contact: *")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(400)))
+
+		res = register("call-2", "Contact: *", "Expires: 0")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(res.GetHeaders("Contact")).To(BeEmpty())
+	})
+
+	It("should abort out of order update", func() {
+		register("call-1", "Contact: <sip:alice@10.0.0.1>")
+		// CSeq is not higher than the stored one
+		cseq = 0
+		res := register("call-1", "Contact: <sip:alice@10.0.0.1>", "Expires: 0")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(500)))
+
+		// other Call-ID replaces the binding
+		res = register("call-2", "Contact: <sip:alice@10.0.0.1>", "Expires: 0")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(res.GetHeaders("Contact")).To(BeEmpty())
+	})
+
+	It("should store Path and echo it to UA that supports it", func() {
+		res := register("call-1",
+			"Contact: <sip:alice@10.0.0.1>",
+			"Path: <sip:edge.example.com;lr>",
+			"Supported: path",
+		)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(res.GetHeaders("Path")[0].Value()).To(Equal("<sip:edge.example.com;lr>"))
+
+		bindings, err := locations.Bindings("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings[0].Path).To(HaveLen(1))
+		Expect(bindings[0].Path[0].Host()).To(Equal("edge.example.com"))
+	})
+
+	It("should refresh the flow binding by instance-id and reg-id", func() {
+		instance := `+sip.instance="<urn:uuid:00000000-0000-1000-8000-000A95A0E128>"`
+		register("call-1", "Contact: <sip:alice@10.0.0.1>;"+instance+";reg-id=1")
+		register("call-1", "Contact: <sip:alice@10.0.0.1>;"+instance+";reg-id=2")
+		// the UA behind NAT got another address
+		res := register("call-1", "Contact: <sip:alice@192.0.2.7:40123>;"+instance+";reg-id=1")
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+
+		bindings, err := locations.Bindings("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(HaveLen(2))
+		hosts := []string{bindings[0].Contact.Host(), bindings[1].Contact.Host()}
+		Expect(hosts).To(ConsistOf("192.0.2.7", "10.0.0.1"))
+	})
+
+	It("should reject foreign domain with 404", func() {
+		req := testutils.Request([]string{
+			"REGISTER sip:other.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@other.com>;tag=alice-tag",
+			"To: <sip:alice@other.com>",
+			"Call-ID: call-1",
+			"CSeq: 1 REGISTER",
+			"Contact: <sip:alice@10.0.0.1>",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		tx := &serverTx{origin: req}
+		reg.ServeRequest(req, tx)
+		Expect(tx.responses[0].StatusCode()).To(Equal(sip.StatusCode(404)))
+	})
+
+	It("should supply targets ordered by q-value for the proxy", func() {
+		register("call-1", "Contact: <sip:alice@10.0.0.1>;q=0.1, <sip:alice@10.0.0.2>;q=0.9")
+
+		targets, err := reg.Targets(testutils.Request([]string{
+			"INVITE sip:alice@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.3:5060;branch=" + sip.GenerateBranch(),
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(2))
+		Expect(targets[0].Q).To(BeNumerically("~", 0.1, 0.001))
+		Expect(targets[1].Q).To(BeNumerically("~", 0.9, 0.001))
+	})
+
+	It("should supply Path of the binding as the route set of the target", func() {
+		register("call-1",
+			"Contact: <sip:alice@10.0.0.1>",
+			"Path: <sip:edge.example.com;lr>, <sip:core.example.com;lr>",
+		)
+
+		targets, err := reg.Targets(testutils.Request([]string{
+			"INVITE sip:alice@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.3:5060;branch=" + sip.GenerateBranch(),
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(1))
+		Expect(targets[0].Route).To(HaveLen(2))
+		Expect(targets[0].Route[0].String()).To(Equal("sip:edge.example.com;lr"))
+		Expect(targets[0].Route[1].String()).To(Equal("sip:core.example.com;lr"))
+	})
+})
+
+var _ = Describe("MemoryLocationService", func() {
+	It("should remove expired bindings", func() {
+		now := time.Now()
+		locations := registrar.NewMemoryLocationService()
+		Expect(locations.Update("sip:bob@example.com", []*registrar.Binding{
+			{
+				AOR:     "sip:bob@example.com",
+				Contact: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.1"},
+				Expires: now.Add(time.Minute),
+			},
+			{
+				AOR:     "sip:bob@example.com",
+				Contact: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "10.0.0.2"},
+				Expires: now.Add(time.Hour),
+			},
+		})).To(Succeed())
+
+		expired, err := locations.Expire(now.Add(2 * time.Minute))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expired).To(HaveLen(1))
+		Expect(expired[0].Contact.Host()).To(Equal("10.0.0.1"))
+
+		bindings, err := locations.Bindings("sip:bob@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(HaveLen(1))
+		Expect(bindings[0].Contact.Host()).To(Equal("10.0.0.2"))
+	})
+})
+
+var _ = Describe("AorKey", func() {
+	It("should drop parameters and lower the host", func() {
+		port := sip.Port(5070)
+		uri := &sip.SipUri{
+			FUser:      sip.String{Str: "alice"},
+			FHost:      "Example.COM",
+			FPort:      &port,
+			FUriParams: sip.NewParams().Add("transport", sip.String{Str: "tcp"}),
+		}
+		Expect(registrar.AorKey(uri)).To(Equal("sip:alice@example.com:5070"))
+	})
+})
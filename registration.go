@@ -0,0 +1,614 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/timing"
+	"github.com/ygj201011/gosip/transaction"
+	"github.com/ygj201011/gosip/transport"
+	"github.com/ygj201011/gosip/util"
+)
+
+const (
+	defaultRegistrationExpires  = time.Hour
+	defaultRefreshRatio         = 0.5
+	defaultRetryInterval        = 30 * time.Second
+	defaultMaxRetryInterval     = 30 * time.Minute
+	registrationEventsBufferLen = 16
+	// keep-alive intervals if the registrar does not send Flow-Timer - RFC 5626 - 4.4.1
+	defaultKeepAliveInterval    = 120 * time.Second
+	defaultUDPKeepAliveInterval = 29 * time.Second
+)
+
+type RegistrationState int
+
+const (
+	RegistrationUnregistered RegistrationState = iota
+	RegistrationRegistered
+	RegistrationRefreshing
+	RegistrationFailed
+)
+
+func (state RegistrationState) String() string {
+	switch state {
+	case RegistrationUnregistered:
+		return "Unregistered"
+	case RegistrationRegistered:
+		return "Registered"
+	case RegistrationRefreshing:
+		return "Refreshing"
+	case RegistrationFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// RegistrationEvent is emitted on every state change of RegistrationAgent.
+type RegistrationEvent struct {
+	State RegistrationState
+	// Expires is the interval granted by the registrar.
+	Expires time.Duration
+	// Response is the last response of the registrar, if any.
+	Response sip.Response
+	Err      error
+}
+
+// RegistrationConfig describes binding maintained by RegistrationAgent.
+type RegistrationConfig struct {
+	// Registrar is Request-URI of REGISTER, like sip:example.com;transport=tcp.
+	Registrar sip.Uri
+	// AOR is address-of-record used in To and From headers.
+	AOR     sip.Uri
+	Contact sip.Uri
+	// Expires is the requested interval, 1 hour by default.
+	Expires time.Duration
+	// RefreshRatio is part of the granted interval after which the binding is refreshed, 0.5 by default.
+	RefreshRatio float64
+	// RetryInterval is the delay after failure without Retry-After, 30 seconds by default.
+	// It is doubled on each failure up to MaxRetryInterval, 30 minutes by default.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	Authorizer       sip.Authorizer
+	// Resolver finds registrar addresses, net.DefaultResolver is used if nil.
+	Resolver *net.Resolver
+	// InstanceID is +sip.instance of the contact, like urn:uuid:00000000-0000-1000-8000-000A95A0E128.
+	// SIP Outbound is used if it is set together with RegID - RFC 5626 - 4.2.
+	InstanceID string
+	RegID      int
+	// KeepAliveInterval is the interval between keep-alives over the registration flow,
+	// Flow-Timer of the registrar is used if it is zero - RFC 5626 - 4.4.1.
+	// The flow failure is reported as RegistrationFailed and the binding is refreshed at once.
+	KeepAliveInterval time.Duration
+}
+
+// RegistrationAgent keeps the binding alive on the registrar - RFC 3261 - 10.2.
+type RegistrationAgent interface {
+	String() string
+	State() RegistrationState
+	// Events returns channel of state changes, events are dropped if the channel is full.
+	Events() <-chan RegistrationEvent
+	// Shutdown removes the binding and stops the agent,
+	// it must be called before the server shutdown.
+	Shutdown()
+	Done() <-chan struct{}
+}
+
+type registrationAgent struct {
+	srv      Server
+	config   RegistrationConfig
+	resolver transport.Resolver
+	callID   sip.CallID
+	fromTag  string
+	seqNo    uint32
+	expires  time.Duration
+	// target is the destination that accepted the last REGISTER
+	target transport.Destination
+
+	state  RegistrationState
+	events chan RegistrationEvent
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.RWMutex
+
+	log log.Logger
+}
+
+// NewRegistrationAgent starts registration of the contact.
+func NewRegistrationAgent(srv Server, config RegistrationConfig, logger log.Logger) RegistrationAgent {
+	if config.Expires == 0 {
+		config.Expires = defaultRegistrationExpires
+	}
+	if config.RefreshRatio <= 0 || config.RefreshRatio >= 1 {
+		config.RefreshRatio = defaultRefreshRatio
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = defaultRetryInterval
+	}
+	if config.MaxRetryInterval == 0 {
+		config.MaxRetryInterval = defaultMaxRetryInterval
+	}
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	agent := &registrationAgent{
+		srv:     srv,
+		config:  config,
+		callID:  sip.CallID(util.RandString(32)),
+		fromTag: util.RandString(8),
+		expires: config.Expires,
+		events:  make(chan RegistrationEvent, registrationEventsBufferLen),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	agent.log = logger.
+		WithPrefix("gosip.RegistrationAgent").
+		WithFields(log.Fields{
+			"registration_agent_ptr": fmt.Sprintf("%p", agent),
+			"aor":                    config.AOR.String(),
+			"registrar":              config.Registrar.String(),
+		})
+	agent.resolver = transport.NewResolver(config.Resolver, agent.Log())
+
+	go agent.serve()
+
+	return agent
+}
+
+func (agent *registrationAgent) String() string {
+	if agent == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("gosip.RegistrationAgent<%s>", agent.Log().Fields())
+}
+
+func (agent *registrationAgent) Log() log.Logger {
+	return agent.log
+}
+
+func (agent *registrationAgent) State() RegistrationState {
+	agent.mu.RLock()
+	defer agent.mu.RUnlock()
+
+	return agent.state
+}
+
+func (agent *registrationAgent) Events() <-chan RegistrationEvent {
+	return agent.events
+}
+
+func (agent *registrationAgent) Shutdown() {
+	agent.cancel()
+	<-agent.done
+}
+
+func (agent *registrationAgent) Done() <-chan struct{} {
+	return agent.done
+}
+
+func (agent *registrationAgent) serve() {
+	defer close(agent.done)
+
+	retryInterval := agent.config.RetryInterval
+	for {
+		var delay, keepAlive time.Duration
+
+		res, err := agent.register(agent.ctx, agent.expires)
+		if agent.ctx.Err() != nil {
+			break
+		}
+
+		if err == nil {
+			expires := agent.grantedExpires(res)
+			agent.setState(RegistrationEvent{
+				State:    RegistrationRegistered,
+				Expires:  expires,
+				Response: res,
+			})
+
+			retryInterval = agent.config.RetryInterval
+			delay = time.Duration(float64(expires) * agent.config.RefreshRatio)
+			keepAlive = agent.keepAliveInterval(res)
+		} else {
+			agent.Log().Warnf("registration failed: %s", err)
+
+			event := RegistrationEvent{
+				State: RegistrationFailed,
+				Err:   err,
+			}
+			var reqErr *sip.RequestError
+			if errors.As(err, &reqErr) {
+				event.Response = reqErr.Response
+			}
+			agent.setState(event)
+
+			if retryAfter, ok := retryAfter(err); ok {
+				delay = retryAfter
+			} else {
+				delay = retryInterval
+				retryInterval *= 2
+				if retryInterval > agent.config.MaxRetryInterval {
+					retryInterval = agent.config.MaxRetryInterval
+				}
+			}
+		}
+
+		flowAlive := agent.wait(delay, keepAlive)
+		if agent.ctx.Err() != nil {
+			break
+		}
+		if !flowAlive {
+			continue
+		}
+
+		if agent.State() == RegistrationRegistered {
+			agent.setState(RegistrationEvent{State: RegistrationRefreshing})
+		}
+	}
+
+	state := agent.State()
+	if state == RegistrationRegistered || state == RegistrationRefreshing {
+		agent.unregister()
+	}
+
+	agent.setState(RegistrationEvent{State: RegistrationUnregistered})
+	close(agent.events)
+}
+
+// wait waits for the refresh sending keep-alives over the registration flow if interval is set,
+// it returns false if the flow failed - RFC 5626 - 4.4.1.
+func (agent *registrationAgent) wait(delay time.Duration, keepAlive time.Duration) bool {
+	refresh := timing.After(delay)
+	for {
+		var next <-chan time.Time
+		if keepAlive > 0 {
+			// random interval between 80 and 100 percent of the keep-alive interval
+			next = timing.After(time.Duration(float64(keepAlive) * (0.8 + 0.2*rand.Float64())))
+		}
+
+		select {
+		case <-agent.ctx.Done():
+			return true
+		case <-refresh:
+			return true
+		case <-next:
+			agent.mu.RLock()
+			target := agent.target
+			agent.mu.RUnlock()
+
+			err := agent.srv.Transport().KeepAlive(target.Transport, target.Addr(), transport.KeepAliveTimeout)
+			if err == nil {
+				continue
+			}
+
+			agent.Log().Warnf("registration flow failed: %s", err)
+
+			agent.setState(RegistrationEvent{
+				State: RegistrationFailed,
+				Err:   err,
+			})
+
+			return false
+		}
+	}
+}
+
+// unregister removes the binding with Expires: 0 - RFC 3261 - 10.2.2.
+func (agent *registrationAgent) unregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), transaction.Timer_F)
+	defer cancel()
+
+	if _, err := agent.register(ctx, 0); err != nil {
+		agent.Log().Warnf("unregister failed: %s", err)
+		return
+	}
+
+	agent.Log().Debug("binding removed")
+}
+
+// register sends REGISTER to the registrar addresses one by one until some of them
+// responds - RFC 3263 - 4.3. The address that accepted the last request is tried first.
+func (agent *registrationAgent) register(ctx context.Context, expires time.Duration) (sip.Response, error) {
+	targets, err := agent.resolve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve registrar %s: %w", agent.config.Registrar, err)
+	}
+
+	var lastErr error
+	for _, target := range targets {
+		res, err := agent.send(ctx, target, expires)
+		if err == nil {
+			agent.mu.Lock()
+			agent.target = target
+			agent.mu.Unlock()
+
+			return res, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil || !isFailoverError(err) {
+			break
+		}
+
+		agent.Log().Debugf("registrar %s failed, trying next address: %s", target, err)
+	}
+
+	return nil, lastErr
+}
+
+// send sends REGISTER to the target, interval is increased on 423 Interval Too Brief - RFC 3261 - 10.2.8.
+func (agent *registrationAgent) send(
+	ctx context.Context,
+	target transport.Destination,
+	expires time.Duration,
+) (sip.Response, error) {
+	for {
+		req, err := agent.newRequest(target, expires)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := agent.srv.RequestWithContext(ctx, req, WithAuthorizer(agent.config.Authorizer))
+		// authorizer increments CSeq of the request
+		if cseq, ok := req.CSeq(); ok {
+			agent.mu.Lock()
+			agent.seqNo = cseq.SeqNo
+			agent.mu.Unlock()
+		}
+
+		var reqErr *sip.RequestError
+		if expires == 0 || !errors.As(err, &reqErr) || reqErr.Code != 423 || reqErr.Response == nil {
+			return res, err
+		}
+
+		hdrs := reqErr.Response.GetHeaders("Min-Expires")
+		if len(hdrs) == 0 {
+			return res, err
+		}
+		seconds, parseErr := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32)
+		minExpires := time.Duration(seconds) * time.Second
+		if parseErr != nil || minExpires <= expires {
+			return res, err
+		}
+
+		agent.Log().Debugf("registrar requires Min-Expires %s", minExpires)
+
+		expires = minExpires
+		agent.mu.Lock()
+		agent.expires = minExpires
+		agent.mu.Unlock()
+	}
+}
+
+func (agent *registrationAgent) newRequest(target transport.Destination, expires time.Duration) (sip.Request, error) {
+	agent.mu.Lock()
+	agent.seqNo++
+	seqNo := agent.seqNo
+	agent.mu.Unlock()
+
+	callID := agent.callID
+	sipExpires := sip.Expires(expires / time.Second)
+
+	req, err := sip.NewRequestBuilder().
+		SetMethod(sip.REGISTER).
+		SetTransport(target.Transport).
+		SetRecipient(agent.config.Registrar.Clone()).
+		SetSeqNo(uint(seqNo)).
+		SetCallID(&callID).
+		AddVia(&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       target.Transport,
+			Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		}).
+		SetFrom(&sip.Address{
+			Uri:    agent.config.AOR.Clone(),
+			Params: sip.NewParams().Add("tag", sip.String{Str: agent.fromTag}),
+		}).
+		SetTo(&sip.Address{
+			Uri: agent.config.AOR.Clone(),
+		}).
+		SetContact(&sip.Address{
+			Uri:    agent.config.Contact.Clone(),
+			Params: agent.contactParams(),
+		}).
+		SetExpires(&sipExpires).
+		SetUserAgent(nil).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("build REGISTER request: %w", err)
+	}
+	if agent.outbound() {
+		req.AppendHeader(&sip.SupportedHeader{Options: []string{"outbound"}})
+	}
+
+	req.SetDestination(target.Addr())
+
+	return req, nil
+}
+
+// outbound checks that the binding is registered with SIP Outbound - RFC 5626 - 4.2.
+func (agent *registrationAgent) outbound() bool {
+	return agent.config.InstanceID != "" && agent.config.RegID > 0
+}
+
+// contactParams returns +sip.instance and reg-id params of the contact - RFC 5626 - 4.2.1.
+func (agent *registrationAgent) contactParams() sip.Params {
+	if !agent.outbound() {
+		return nil
+	}
+
+	return sip.NewParams().
+		Add("+sip.instance", sip.String{Str: fmt.Sprintf("\"<%s>\"", agent.config.InstanceID)}).
+		Add("reg-id", sip.String{Str: strconv.Itoa(agent.config.RegID)})
+}
+
+// keepAliveInterval returns interval between keep-alives over the registration flow - RFC 5626 - 4.4.1,
+// keep-alives are not sent if the registrar does not support outbound.
+func (agent *registrationAgent) keepAliveInterval(res sip.Response) time.Duration {
+	if !agent.outbound() {
+		return 0
+	}
+	if agent.config.KeepAliveInterval > 0 {
+		return agent.config.KeepAliveInterval
+	}
+
+	if hdrs := res.GetHeaders("Flow-Timer"); len(hdrs) > 0 {
+		seconds, err := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32)
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	supported := false
+	for _, hdr := range res.GetHeaders("Require") {
+		for _, option := range strings.Split(hdr.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "outbound") {
+				supported = true
+			}
+		}
+	}
+	if !supported {
+		return 0
+	}
+
+	agent.mu.RLock()
+	defer agent.mu.RUnlock()
+
+	if strings.EqualFold(agent.target.Transport, "UDP") {
+		return defaultUDPKeepAliveInterval
+	}
+
+	return defaultKeepAliveInterval
+}
+
+// resolve returns registrar destinations - RFC 3263 - 4.
+// The destination that accepted the last request is tried first.
+func (agent *registrationAgent) resolve(ctx context.Context) ([]transport.Destination, error) {
+	dests, err := agent.resolver.Resolve(ctx, agent.config.Registrar)
+	if err != nil {
+		return nil, err
+	}
+
+	agent.mu.RLock()
+	last := agent.target
+	agent.mu.RUnlock()
+	for i, dest := range dests {
+		if dest == last {
+			dests = append([]transport.Destination{dest}, append(dests[:i:i], dests[i+1:]...)...)
+			break
+		}
+	}
+
+	return dests, nil
+}
+
+// grantedExpires returns expires of own contact in 2xx response - RFC 3261 - 10.2.4.
+func (agent *registrationAgent) grantedExpires(res sip.Response) time.Duration {
+	for _, hdr := range res.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil || contact.Params == nil {
+			continue
+		}
+		// cloned URI can differ by empty params, so string forms are compared
+		if contact.Address.String() != agent.config.Contact.String() {
+			continue
+		}
+
+		if value, ok := contact.Params.Get("expires"); ok && value != nil {
+			if seconds, err := strconv.ParseUint(value.String(), 10, 32); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	if hdrs := res.GetHeaders("Expires"); len(hdrs) > 0 {
+		if expires, ok := hdrs[0].(*sip.Expires); ok {
+			return time.Duration(*expires) * time.Second
+		}
+	}
+
+	agent.mu.RLock()
+	defer agent.mu.RUnlock()
+
+	return agent.expires
+}
+
+func (agent *registrationAgent) setState(event RegistrationEvent) {
+	agent.mu.Lock()
+	changed := agent.state != event.State
+	agent.state = event.State
+	agent.mu.Unlock()
+
+	// refreshed binding is reported too
+	if !changed && event.State != RegistrationRegistered && event.State != RegistrationFailed {
+		return
+	}
+
+	agent.Log().Debugf("registration state changed to %s", event.State)
+
+	select {
+	case agent.events <- event:
+	default:
+		agent.Log().Warnf("registration event %s dropped", event.State)
+	}
+}
+
+// isFailoverError returns true if the next registrar address should be tried - RFC 3263 - 4.3.
+func isFailoverError(err error) bool {
+	var txErr transaction.TxError
+	if errors.As(err, &txErr) {
+		return txErr.Timeout() || txErr.Transport()
+	}
+
+	var reqErr *sip.RequestError
+	if errors.As(err, &reqErr) {
+		if reqErr.Code != 503 {
+			return false
+		}
+		_, ok := retryAfter(err)
+		return !ok
+	}
+
+	// request was not sent
+	return true
+}
+
+// retryAfter returns Retry-After interval of 5xx response - RFC 3261 - 20.33.
+func retryAfter(err error) (time.Duration, bool) {
+	var reqErr *sip.RequestError
+	if !errors.As(err, &reqErr) || reqErr.Response == nil || reqErr.Code < 500 || reqErr.Code >= 600 {
+		return 0, false
+	}
+
+	hdrs := reqErr.Response.GetHeaders("Retry-After")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+
+	value := hdrs[0].Value()
+	if idx := strings.IndexAny(value, " ;("); idx >= 0 {
+		value = value[:idx]
+	}
+	seconds, parseErr := strconv.ParseUint(value, 10, 32)
+	if parseErr != nil {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
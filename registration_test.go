@@ -0,0 +1,184 @@
+package gosip_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip"
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("RegistrationAgent", func() {
+	var (
+		tpl    *testutils.MockTransportLayer
+		srv    gosip.Server
+		config gosip.RegistrationConfig
+		agent  gosip.RegistrationAgent
+	)
+
+	logger := testutils.NewLogrusLogger()
+	registrarPort := sip.Port(5060)
+
+	waitRegister := func() sip.Request {
+		var msg sip.Message
+		Eventually(tpl.OutMsgs, 3*time.Second).Should(Receive(&msg))
+		req, ok := msg.(sip.Request)
+		Expect(ok).To(BeTrue())
+		Expect(req.Method()).To(Equal(sip.REGISTER))
+		return req
+	}
+	answer := func(req sip.Request, code sip.StatusCode, reason string, headers ...sip.Header) {
+		res := sip.NewResponseFromRequest("", req, code, reason, "")
+		for _, hdr := range headers {
+			res.AppendHeader(hdr)
+		}
+		go func() {
+			// client tx is stored right after the request was sent
+			time.Sleep(10 * time.Millisecond)
+			tpl.InMsgs <- res
+		}()
+	}
+	expires := func(req sip.Request) uint32 {
+		return uint32(*req.GetHeaders("Expires")[0].(*sip.Expires))
+	}
+	waitEvent := func(state gosip.RegistrationState) gosip.RegistrationEvent {
+		var event gosip.RegistrationEvent
+		Eventually(agent.Events(), 3*time.Second).Should(Receive(&event))
+		Expect(event.State).To(Equal(state))
+		return event
+	}
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		srv = gosip.NewServer(
+			gosip.ServerConfig{Host: "127.0.0.1"},
+			func(ip net.IP, dnsResolver *net.Resolver, msgMapper sip.MessageMapper, logger log.Logger) transport.Layer {
+				return tpl
+			},
+			nil,
+			logger,
+		)
+		config = gosip.RegistrationConfig{
+			Registrar:     &sip.SipUri{FHost: "127.0.0.1", FPort: &registrarPort},
+			AOR:           &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"},
+			Contact:       &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "127.0.0.1"},
+			Expires:       time.Minute,
+			RetryInterval: time.Second,
+		}
+	})
+	JustBeforeEach(func() {
+		agent = gosip.NewRegistrationAgent(srv, config, logger)
+	})
+	AfterEach(func() {
+		outMsgs := tpl.OutMsgs
+		go func() {
+			for range outMsgs {
+			}
+		}()
+		srv.Shutdown()
+	}, 3)
+
+	It("should keep the binding alive and remove it on shutdown", func() {
+		req := waitRegister()
+		Expect(req.Destination()).To(Equal("127.0.0.1:5060"))
+		Expect(expires(req)).To(Equal(uint32(60)))
+		answer(req, 423, "Interval Too Brief", &sip.GenericHeader{HeaderName: "Min-Expires", Contents: "120"})
+
+		req = waitRegister()
+		Expect(expires(req)).To(Equal(uint32(120)))
+		callID, _ := req.CallID()
+		cseq, _ := req.CSeq()
+		answer(req, 200, "OK", &sip.ContactHeader{
+			Address: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "127.0.0.1"},
+			Params:  sip.NewParams().Add("expires", sip.String{Str: "2"}),
+		})
+		Expect(waitEvent(gosip.RegistrationRegistered).Expires).To(Equal(2 * time.Second))
+
+		// refreshed at the half of the granted interval
+		waitEvent(gosip.RegistrationRefreshing)
+		req = waitRegister()
+		refreshCallID, _ := req.CallID()
+		refreshCSeq, _ := req.CSeq()
+		Expect(refreshCallID.Value()).To(Equal(callID.Value()))
+		Expect(refreshCSeq.SeqNo).To(Equal(cseq.SeqNo + 1))
+		answer(req, 500, "Server Internal Error", &sip.GenericHeader{HeaderName: "Retry-After", Contents: "1"})
+		event := waitEvent(gosip.RegistrationFailed)
+		Expect(event.Response.StatusCode()).To(Equal(sip.StatusCode(500)))
+
+		req = waitRegister()
+		answer(req, 200, "OK")
+		waitEvent(gosip.RegistrationRegistered)
+
+		go agent.Shutdown()
+		req = waitRegister()
+		Expect(expires(req)).To(Equal(uint32(0)))
+		answer(req, 200, "OK")
+		waitEvent(gosip.RegistrationUnregistered)
+		Eventually(agent.Done()).Should(BeClosed())
+		Eventually(agent.Events()).Should(BeClosed())
+	})
+	Context("with SIP Outbound", func() {
+		var keepAlives chan string
+
+		BeforeEach(func() {
+			config.InstanceID = "urn:uuid:00000000-0000-1000-8000-000A95A0E128"
+			config.RegID = 1
+			config.KeepAliveInterval = 50 * time.Millisecond
+
+			keepAlives = make(chan string, 64)
+			var count int32
+			tpl.KeepAliveFunc = func(network, addr string) error {
+				select {
+				case keepAlives <- network + "/" + addr:
+				default:
+				}
+				// the second keep-alive is not answered
+				if atomic.AddInt32(&count, 1) == 2 {
+					return &transport.FlowFailedError{Err: fmt.Errorf("no pong"), Net: network, RAddr: addr}
+				}
+				return nil
+			}
+		})
+
+		It("should register the instance and refresh the binding on flow failure", func() {
+			req := waitRegister()
+			contact, ok := req.GetHeaders("Contact")[0].(*sip.ContactHeader)
+			Expect(ok).To(BeTrue())
+			instance, ok := contact.Params.Get("+sip.instance")
+			Expect(ok).To(BeTrue())
+			Expect(instance.String()).To(Equal(`"<urn:uuid:00000000-0000-1000-8000-000A95A0E128>"`))
+			regID, ok := contact.Params.Get("reg-id")
+			Expect(ok).To(BeTrue())
+			Expect(regID.String()).To(Equal("1"))
+			Expect(req.GetHeaders("Supported")[0].Value()).To(ContainSubstring("outbound"))
+			answer(req, 200, "OK", &sip.RequireHeader{Options: []string{"outbound"}})
+			waitEvent(gosip.RegistrationRegistered)
+
+			Eventually(keepAlives, 3*time.Second).Should(Receive(Equal("UDP/127.0.0.1:5060")))
+			event := waitEvent(gosip.RegistrationFailed)
+			var flowErr *transport.FlowFailedError
+			Expect(errors.As(event.Err, &flowErr)).To(BeTrue())
+
+			// registered again at once
+			req = waitRegister()
+			answer(req, 200, "OK", &sip.RequireHeader{Options: []string{"outbound"}})
+			waitEvent(gosip.RegistrationRegistered)
+
+			go agent.Shutdown()
+			req = waitRegister()
+			Expect(expires(req)).To(Equal(uint32(0)))
+			answer(req, 200, "OK")
+			waitEvent(gosip.RegistrationUnregistered)
+			Eventually(agent.Done()).Should(BeClosed())
+		})
+	})
+})
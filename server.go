@@ -2,13 +2,17 @@ package gosip
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
 
+	"github.com/ygj201011/gosip/dialog"
 	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/proxy"
 	"github.com/ygj201011/gosip/sip"
 	"github.com/ygj201011/gosip/transaction"
 	"github.com/ygj201011/gosip/transport"
@@ -26,6 +30,12 @@ type Server interface {
 	Shutdown()
 
 	Listen(network, addr string, options ...transport.ListenOption) error
+	// ListenOn serves connections accepted by the pre-opened listener.
+	ListenOn(network string, listener net.Listener, options ...transport.ListenOption) error
+	// ListenPacket serves messages received by the pre-opened packet connection.
+	ListenPacket(network string, conn net.PacketConn, options ...transport.ListenOption) error
+	// Unlisten stops one of the listeners without shutdown of the server.
+	Unlisten(network, addr string, options ...transport.UnlistenOption) error
 	Send(msg sip.Message) error
 
 	Request(req sip.Request) (sip.ClientTransaction, error)
@@ -34,6 +44,13 @@ type Server interface {
 		request sip.Request,
 		options ...RequestWithContextOption,
 	) (sip.Response, error)
+	// Fork sends request to the targets in parallel or sequentially - RFC 3261 - 16.6.
+	Fork(
+		ctx context.Context,
+		request sip.Request,
+		targets []proxy.Target,
+		options ...ForkOption,
+	) (*ForkResult, error)
 	OnRequest(method sip.RequestMethod, handler RequestHandler) error
 
 	Respond(res sip.Response) (sip.ServerTransaction, error)
@@ -43,6 +60,19 @@ type Server interface {
 		reason, body string,
 		headers []sip.Header,
 	) (sip.ServerTransaction, error)
+
+	// Dialogs returns layer that tracks dialogs of the server.
+	Dialogs() dialog.Layer
+	// Transactions returns transaction layer of the server,
+	// it is used to build proxy.Proxy on top of the server.
+	Transactions() transaction.Layer
+	// Transport returns transport layer of the server,
+	// it is used to maintain outbound flows - RFC 5626.
+	Transport() transport.Layer
+	// FlowUri returns URI of the server with token of the flow the request was received over,
+	// edge proxy adds it to Path of REGISTER or to Record-Route - RFC 5626 - 5.1.
+	// Requests with the URI in the top Route are sent back over the flow.
+	FlowUri(req sip.Request) (sip.Uri, error)
 }
 
 type TransportLayerFactory func(
@@ -63,6 +93,16 @@ type ServerConfig struct {
 	Extensions []string
 	MsgMapper  sip.MessageMapper
 	UserAgent  string
+	// UDPSizeThreshold is the size of the request sent over TCP instead of UDP - RFC 3261 - 18.1.1,
+	// transport.DefaultUDPSizeThreshold is used if it is zero, negative value disables switching.
+	UDPSizeThreshold int
+	// ContactRewrite replaces local host in Contact of outgoing requests
+	// with the address advertised by the listener, see transport.WithAdvertisedAddr.
+	ContactRewrite bool
+	// TLSRootCAs verify certificates of TLS servers, the system pool is used if nil.
+	TLSRootCAs *x509.CertPool
+	// TLSCertificates are presented to TLS servers requesting client certificate.
+	TLSCertificates []tls.Certificate
 }
 
 // Server is a SIP server
@@ -70,6 +110,7 @@ type server struct {
 	running         abool.AtomicBool
 	tp              transport.Layer
 	tx              transaction.Layer
+	dialogs         dialog.Layer
 	host            string
 	ip              net.IP
 	hwg             *sync.WaitGroup
@@ -89,7 +130,17 @@ func NewServer(
 	logger log.Logger,
 ) Server {
 	if tpFactory == nil {
-		tpFactory = transport.NewLayer
+		tpFactory = func(ip net.IP, dnsResolver *net.Resolver, msgMapper sip.MessageMapper, logger log.Logger) transport.Layer {
+			options := []transport.LayerOption{transport.WithUDPSizeThreshold(config.UDPSizeThreshold)}
+			if config.ContactRewrite {
+				options = append(options, transport.WithContactRewrite(true))
+			}
+			if config.TLSRootCAs != nil || len(config.TLSCertificates) > 0 {
+				options = append(options, transport.WithTLSClient(config.TLSRootCAs, config.TLSCertificates...))
+			}
+
+			return transport.NewLayer(ip, dnsResolver, msgMapper, logger, options...)
+		}
 	}
 	if txFactory == nil {
 		txFactory = transaction.NewLayer
@@ -156,6 +207,7 @@ func NewServer(
 		srv: srv,
 	}
 	srv.tx = txFactory(sipTp, log.AddFieldsFrom(srv.Log(), srv.tp))
+	srv.dialogs = dialog.NewLayer(sipTp, srv.Log())
 
 	srv.running.Set()
 	go srv.serve()
@@ -172,6 +224,18 @@ func (srv *server) Listen(network string, listenAddr string, options ...transpor
 	return srv.tp.Listen(network, listenAddr, options...)
 }
 
+func (srv *server) ListenOn(network string, listener net.Listener, options ...transport.ListenOption) error {
+	return srv.tp.ListenOn(network, listener, options...)
+}
+
+func (srv *server) ListenPacket(network string, conn net.PacketConn, options ...transport.ListenOption) error {
+	return srv.tp.ListenPacket(network, conn, options...)
+}
+
+func (srv *server) Unlisten(network string, listenAddr string, options ...transport.UnlistenOption) error {
+	return srv.tp.Unlisten(network, listenAddr, options...)
+}
+
 func (srv *server) serve() {
 	defer srv.Shutdown()
 
@@ -231,6 +295,22 @@ func (srv *server) handleRequest(req sip.Request, tx sip.ServerTransaction) {
 	logger := srv.Log().WithFields(req.Fields())
 	logger.Debug("routing incoming SIP request...")
 
+	if _, err := srv.dialogs.ReceiveRequest(req); err != nil {
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) && !req.IsAck() {
+			logger.Warnf("SIP request rejected by dialog layer: %s", err)
+
+			res := sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, "")
+			if _, err := srv.Respond(res); err != nil {
+				logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+			}
+
+			return
+		}
+
+		logger.Warnf("dialog layer failed to handle SIP request: %s", err)
+	}
+
 	srv.hmu.RLock()
 	handler, ok := srv.requestHandlers[req.Method()]
 	srv.hmu.RUnlock()
@@ -270,7 +350,25 @@ func (srv *server) Request(req sip.Request) (sip.ClientTransaction, error) {
 		return nil, fmt.Errorf("can not send through stopped server")
 	}
 
-	return srv.tx.Request(srv.prepareRequest(req))
+	// the flow is selected before the dialog and transaction layers see the request,
+	// so they keep the Route set the request is actually sent with
+	if err := srv.routeOverFlow(req); err != nil {
+		return nil, err
+	}
+
+	// the dialog layer matches responses by the transaction key,
+	// so the request is tracked before the first response can arrive
+	req = transaction.PrepareClientRequest(srv.prepareRequest(req))
+	if _, err := srv.dialogs.Request(req); err != nil {
+		srv.Log().WithFields(req.Fields()).Warnf("dialog layer failed to handle SIP request: %s", err)
+	}
+
+	tx, err := srv.tx.Request(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return srv.trackResponses(tx), nil
 }
 
 func (srv *server) RequestWithContext(
@@ -340,6 +438,14 @@ func (srv *server) requestWithContext(
 					// we continue to pull responses until close
 					continue
 				}
+				var txErr transaction.TxError
+				if errors.As(err, &txErr) && (txErr.Timeout() || txErr.Transport()) {
+					// RFC 3261 - 12.2.1.2. Timeout terminates the dialog.
+					if dlg, ok := srv.dialogs.Match(request); ok {
+						dlg.Terminate()
+					}
+				}
+
 				errs <- err
 				return
 			case response, ok := <-txResponses:
@@ -421,6 +527,62 @@ func (srv *server) requestWithContext(
 	return res, err
 }
 
+// clientTransaction passes up responses of the transaction handled by the dialog layer.
+type clientTransaction struct {
+	sip.ClientTransaction
+	responses chan sip.Response
+}
+
+func (tx *clientTransaction) Responses() <-chan sip.Response {
+	return tx.responses
+}
+
+// trackResponses feeds the dialog layer with all responses of the transaction,
+// even if they are never read from the transaction.
+// Responses are queued without a limit, so the late reader still gets the final response.
+func (srv *server) trackResponses(tx sip.ClientTransaction) sip.ClientTransaction {
+	tracked := &clientTransaction{
+		ClientTransaction: tx,
+		responses:         make(chan sip.Response, 64),
+	}
+
+	go func() {
+		defer close(tracked.responses)
+
+		in := tx.Responses()
+		queue := make([]sip.Response, 0)
+		for in != nil || len(queue) > 0 {
+			var out chan<- sip.Response
+			var next sip.Response
+			if len(queue) > 0 {
+				out = tracked.responses
+				next = queue[0]
+			}
+
+			select {
+			case res, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+
+				srv.receiveResponse(res)
+				queue = append(queue, res)
+			case out <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+
+	return tracked
+}
+
+func (srv *server) receiveResponse(res sip.Response) {
+	if _, err := srv.dialogs.ReceiveResponse(res); err != nil {
+		srv.Log().WithFields(res.Fields()).Warnf("dialog layer failed to handle SIP response: %s", err)
+	}
+}
+
 func (srv *server) prepareRequest(req sip.Request) sip.Request {
 	srv.appendAutoHeaders(req)
 
@@ -432,7 +594,13 @@ func (srv *server) Respond(res sip.Response) (sip.ServerTransaction, error) {
 		return nil, fmt.Errorf("can not send through stopped server")
 	}
 
-	return srv.tx.Respond(srv.prepareResponse(res))
+	res = srv.prepareResponse(res)
+
+	if _, err := srv.dialogs.Respond(res); err != nil {
+		srv.Log().WithFields(res.Fields()).Warnf("dialog layer failed to handle SIP response: %s", err)
+	}
+
+	return srv.tx.Respond(res)
 }
 
 func (srv *server) RespondOnRequest(
@@ -461,6 +629,9 @@ func (srv *server) Send(msg sip.Message) error {
 
 	switch m := msg.(type) {
 	case sip.Request:
+		if err := srv.routeOverFlow(m); err != nil {
+			return err
+		}
 		msg = srv.prepareRequest(m)
 	case sip.Response:
 		msg = srv.prepareResponse(m)
@@ -469,6 +640,55 @@ func (srv *server) Send(msg sip.Message) error {
 	return srv.tp.Send(msg)
 }
 
+// routeOverFlow sets destination of the request with own flow URI in the top Route to the flow,
+// the Route entry is removed - RFC 5626 - 5.3.
+func (srv *server) routeOverFlow(req sip.Request) error {
+	routes := make([]sip.Uri, 0)
+	for _, hdr := range req.GetHeaders("Route") {
+		if route, ok := hdr.(*sip.RouteHeader); ok {
+			routes = append(routes, route.Addresses...)
+		}
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+
+	uri, ok := routes[0].(*sip.SipUri)
+	if !ok || uri.FUser == nil || uri.FUriParams == nil || !uri.FUriParams.Has("ob") {
+		return nil
+	}
+
+	dest, err := srv.tp.Flow(uri.FUser.String())
+	if err != nil {
+		var tokenErr transport.InvalidFlowTokenError
+		if errors.As(err, &tokenErr) {
+			// not our flow
+			return nil
+		}
+
+		return fmt.Errorf("route %s over flow: %w", req.Short(), err)
+	}
+
+	req.RemoveHeader("Route")
+	if len(routes) > 1 {
+		route := &sip.RouteHeader{Addresses: routes[1:]}
+		if len(req.GetHeaders("Via")) > 0 {
+			req.PrependHeaderAfter(route, "Via")
+		} else {
+			req.PrependHeader(route)
+		}
+	}
+
+	req.SetDestination(dest.Addr())
+	if viaHop, ok := req.ViaHop(); ok {
+		viaHop.Transport = dest.Transport
+	}
+
+	srv.Log().WithFields(req.Fields()).Debugf("route %s over flow %s", req.Short(), dest)
+
+	return nil
+}
+
 func (srv *server) prepareResponse(res sip.Response) sip.Response {
 	srv.appendAutoHeaders(res)
 
@@ -481,6 +701,8 @@ func (srv *server) Shutdown() {
 		return
 	}
 	srv.running.UnSet()
+	// terminate dialogs
+	srv.dialogs.Cancel()
 	// stop transaction layer
 	srv.tx.Cancel()
 	<-srv.tx.Done()
@@ -491,6 +713,31 @@ func (srv *server) Shutdown() {
 	srv.hwg.Wait()
 }
 
+func (srv *server) Dialogs() dialog.Layer {
+	return srv.dialogs
+}
+
+func (srv *server) Transactions() transaction.Layer {
+	return srv.tx
+}
+
+func (srv *server) Transport() transport.Layer {
+	return srv.tp
+}
+
+func (srv *server) FlowUri(req sip.Request) (sip.Uri, error) {
+	token, err := srv.tp.FlowToken(req)
+	if err != nil {
+		return nil, fmt.Errorf("get flow token of %s: %w", req.Short(), err)
+	}
+
+	return &sip.SipUri{
+		FUser:      sip.String{Str: token},
+		FHost:      srv.host,
+		FUriParams: sip.NewParams().Add("lr", nil).Add("ob", nil),
+	}, nil
+}
+
 // OnRequest registers new request callback
 func (srv *server) OnRequest(method sip.RequestMethod, handler RequestHandler) error {
 	srv.hmu.Lock()
@@ -2,7 +2,9 @@ package gosip_test
 
 import (
 	"context"
+	"errors"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +15,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/ygj201011/gosip"
+	"github.com/ygj201011/gosip/proxy"
 	"github.com/ygj201011/gosip/sip"
 	"github.com/ygj201011/gosip/sip/parser"
 	"github.com/ygj201011/gosip/testutils"
@@ -263,6 +266,155 @@ var _ = Describe("GoSIP Server", func() {
 		wg.Wait()
 	}, 3)
 
+	It("should create dialog from responses of the transaction sent by Request", func(done Done) {
+		defer close(done)
+
+		dialogClientAddr := "127.0.0.1:9002"
+		conn, err := net.ListenPacket("udp", dialogClientAddr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+
+		go func() {
+			defer GinkgoRecover()
+
+			buf := make([]byte, transport.MTU)
+			num, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := parser.ParseMessage(buf[:num], logger)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			res := sip.NewResponseFromRequest("", msg.(sip.Request), 200, "Ok", "")
+			to, _ := res.To()
+			to.Params.Add("tag", sip.String{Str: "as6151ad25"})
+			raddr, err := net.ResolveUDPAddr("udp", res.Destination())
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = conn.WriteTo([]byte(res.String()), raddr)
+			Expect(err).ShouldNot(HaveOccurred())
+		}()
+
+		tx, err := srv.Request(testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Route: <sip:" + dialogClientAddr + ";lr>",
+			"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+			"To: \"Bob\" <sip:bob@far-far-away.com>",
+			"Call-ID: dialog-by-request",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@127.0.0.1>",
+			"",
+			"",
+		}))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var res sip.Response
+		Eventually(tx.Responses(), 2*time.Second).Should(Receive(&res))
+		Expect(int(res.StatusCode())).Should(Equal(200))
+
+		dlg, ok := srv.Dialogs().Match(res)
+		Expect(ok).Should(BeTrue())
+		Expect(dlg.State()).Should(Equal(sip.DialogStateConfirmed))
+	}, 3)
+
+	It("should keep the final response for the late reader of Request", func(done Done) {
+		defer close(done)
+
+		dialogClientAddr := "127.0.0.1:9002"
+		conn, err := net.ListenPacket("udp", dialogClientAddr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+
+		go func() {
+			defer GinkgoRecover()
+
+			buf := make([]byte, transport.MTU)
+			num, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := parser.ParseMessage(buf[:num], logger)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			send := func(code sip.StatusCode, reason string) {
+				res := sip.NewResponseFromRequest("", msg.(sip.Request), code, reason, "")
+				to, _ := res.To()
+				to.Params.Add("tag", sip.String{Str: "as6151ad25"})
+				raddr, err := net.ResolveUDPAddr("udp", res.Destination())
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = conn.WriteTo([]byte(res.String()), raddr)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			for i := 0; i < 70; i++ {
+				send(180, "Ringing")
+				time.Sleep(time.Millisecond)
+			}
+			send(200, "Ok")
+		}()
+
+		tx, err := srv.Request(testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Route: <sip:" + dialogClientAddr + ";lr>",
+			"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+			"To: \"Bob\" <sip:bob@far-far-away.com>",
+			"Call-ID: late-reader",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@127.0.0.1>",
+			"",
+			"",
+		}))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Eventually(func() bool {
+			for _, dlg := range srv.Dialogs().All() {
+				if dlg.CallID() == "late-reader" && dlg.State() == sip.DialogStateConfirmed {
+					return true
+				}
+			}
+			return false
+		}, 2*time.Second).Should(BeTrue())
+
+		var last sip.Response
+		for res := range tx.Responses() {
+			last = res
+			if !res.IsProvisional() {
+				break
+			}
+		}
+		Expect(last).ShouldNot(BeNil())
+		Expect(int(last.StatusCode())).Should(Equal(200))
+	}, 5)
+
+	It("should complete timed out non-INVITE branch of the forked request", func(done Done) {
+		defer close(done)
+
+		// the target receives the request and never answers
+		conn, err := net.ListenPacket("udp", "127.0.0.1:9002")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+
+		port := sip.Port(9002)
+		targets := []proxy.Target{{
+			Uri:     &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "127.0.0.1", FPort: &port},
+			Q:       1,
+			Timeout: 300 * time.Millisecond,
+		}}
+		result, err := srv.Fork(context.Background(), testutils.Request([]string{
+			"OPTIONS sip:bob@example.com SIP/2.0",
+			"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+			"To: \"Bob\" <sip:bob@far-far-away.com>",
+			"Call-ID: fork-timeout",
+			"CSeq: 1 OPTIONS",
+			"",
+			"",
+		}), targets)
+
+		var reqErr *sip.RequestError
+		Expect(errors.As(err, &reqErr)).Should(BeTrue())
+		Expect(reqErr.Code).Should(Equal(uint(408)))
+		Expect(result.Branches).Should(HaveLen(1))
+		Expect(result.Branches[0].Final()).ShouldNot(BeNil())
+	}, 3)
+
 	It("should send INVITE request through TX layer with TCP transport", func(done Done) {
 		defer close(done)
 
@@ -346,4 +498,122 @@ var _ = Describe("GoSIP Server", func() {
 
 		wg.Wait()
 	}, 3)
+
+	// registerFlow registers alice over a new TCP connection and returns the connection with the flow URI
+	registerFlow := func(callID string) (net.Conn, sip.Uri) {
+		flowUris := make(chan sip.Uri, 1)
+		Expect(srv.OnRequest(sip.REGISTER, func(req sip.Request, tx sip.ServerTransaction) {
+			uri, err := srv.FlowUri(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			flowUris <- uri
+
+			_, err = srv.RespondOnRequest(req, 200, "OK", "", nil)
+			Expect(err).ShouldNot(HaveOccurred())
+		})).To(Succeed())
+
+		conn, err := net.Dial("tcp", localTarget.Addr())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		_, err = conn.Write([]byte(testutils.Request([]string{
+			"REGISTER sip:example.com SIP/2.0",
+			"Via: SIP/2.0/TCP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=1",
+			"To: <sip:alice@example.com>",
+			"Contact: <sip:alice@" + clientAddr + ";transport=tcp>",
+			"Call-ID: " + callID,
+			"CSeq: 1 REGISTER",
+			"Content-Length: 0",
+			"",
+			"",
+		}).String()))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var flowUri sip.Uri
+		Eventually(flowUris, 2*time.Second).Should(Receive(&flowUri))
+		Expect(flowUri.UriParams().Has("ob")).To(BeTrue())
+
+		return conn, flowUri
+	}
+	// readRequest reads data from the connection until the request line of the method
+	readRequest := func(conn net.Conn, method sip.RequestMethod) string {
+		data := ""
+		buf := make([]byte, transport.MTU)
+		for {
+			if start := strings.Index(data, string(method)+" sip:"); start >= 0 {
+				if end := strings.Index(data[start:], "\r\n\r\n"); end >= 0 {
+					return data[start : start+end+4]
+				}
+			}
+
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			num, err := conn.Read(buf)
+			Expect(err).ShouldNot(HaveOccurred())
+			data += string(buf[:num])
+		}
+	}
+
+	It("should route request with flow URI over the flow", func(done Done) {
+		defer close(done)
+
+		conn, flowUri := registerFlow("outbound")
+		defer conn.Close()
+
+		// the client does not listen on the contact address, so only the flow reaches it
+		_, err := srv.Request(testutils.Request([]string{
+			"OPTIONS sip:alice@" + clientAddr + ";transport=tcp SIP/2.0",
+			"Route: <" + flowUri.String() + ">",
+			"Via: SIP/2.0/TCP 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:proxy@example.com>;tag=2",
+			"To: <sip:alice@example.com>",
+			"Call-ID: outbound-options",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(readRequest(conn, sip.OPTIONS)).ShouldNot(ContainSubstring("Route:"))
+	}, 5)
+
+	It("should send INVITE with flow URI over the flow", func(done Done) {
+		defer close(done)
+
+		conn, flowUri := registerFlow("outbound-invite-register")
+		defer conn.Close()
+
+		invite := testutils.Request([]string{
+			"INVITE sip:alice@" + clientAddr + ";transport=tcp SIP/2.0",
+			"Route: <" + flowUri.String() + ">",
+			"Via: SIP/2.0/TCP 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:proxy@example.com>;tag=2",
+			"To: <sip:alice@example.com>",
+			"Contact: <sip:proxy@" + localTarget.Addr() + ";transport=tcp>",
+			"Call-ID: outbound-invite",
+			"CSeq: 1 INVITE",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		tx, err := srv.Request(invite)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(invite.GetHeaders("Route")).To(BeEmpty())
+
+		msg, err := parser.ParseMessage([]byte(readRequest(conn, sip.INVITE)), logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		req, ok := msg.(sip.Request)
+		Expect(ok).Should(BeTrue())
+		Expect(req.GetHeaders("Route")).To(BeEmpty())
+
+		res := sip.NewResponseFromRequest("", req, 486, "Busy Here", "")
+		_, err = conn.Write([]byte(res.String()))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Eventually(tx.Responses(), 2*time.Second).Should(Receive(WithTransform(
+			func(res sip.Response) sip.StatusCode { return res.StatusCode() },
+			Equal(sip.StatusCode(486)),
+		)))
+		// ACK of the final response goes over the flow too - RFC 3261 - 17.1.1.3
+		Expect(readRequest(conn, sip.ACK)).ShouldNot(ContainSubstring("Route:"))
+	}, 5)
 })
@@ -2,48 +2,135 @@ package sip
 
 import (
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-// currently only Digest and MD5
+// maxNonceCounts limits nonces remembered by DefaultAuthorizer.
+const maxNonceCounts = 32
+
+// Digest authorization - RFC 7616, algorithms MD5, SHA-256 and SHA-512-256 with -sess variants.
 type Authorization struct {
 	realm     string
 	nonce     string
 	algorithm string
 	username  string
 	password  string
+	ha1       string
 	uri       string
 	response  string
 	method    string
-	other     map[string]string
+	body      string
+	// qop is the list of offered qop values until the response is calculated
+	qop    string
+	cnonce string
+	nc     uint32
+	opaque string
+	other  map[string]string
 }
 
+// authParamRe matches 'name=token' and 'name="quoted string"' params of challenge or credentials.
+var authParamRe = regexp.MustCompile(`([\w.!%*+'~-]+)\s*=\s*(?:"((?:[^"\\]|\\.)*)"|([^\s,"]+))`)
+
+var authEscapeRe = regexp.MustCompile(`\\(.)`)
+
+// AuthFromValue reads Digest challenge or credentials of the value.
+// The value should hold one challenge or credentials, parser.ParseAuthValues splits several ones.
 func AuthFromValue(value string) *Authorization {
+	authValue := authValueFromString(value)
+
+	return authFromAuthValue(&authValue)
+}
+
+// authValueFromString reads scheme and params of the single challenge or credentials.
+// Parsed messages carry typed headers, so it is used only for values and generic headers built by hand.
+func authValueFromString(text string) AuthValue {
+	text = strings.TrimSpace(text)
+
+	value := AuthValue{Scheme: text}
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		value.Scheme = text[:i]
+		text = text[i:]
+	} else {
+		return value
+	}
+
+	for _, match := range authParamRe.FindAllStringSubmatch(text, -1) {
+		if match[3] != "" {
+			value.Params = append(value.Params, AuthParam{Name: match[1], Value: match[3]})
+		} else {
+			value.Params = append(value.Params, AuthParam{
+				Name:   match[1],
+				Value:  authEscapeRe.ReplaceAllString(match[2], "$1"),
+				Quoted: true,
+			})
+		}
+	}
+
+	return value
+}
+
+// AuthFromHeader reads Digest challenge or credentials of the typed or generic header.
+func AuthFromHeader(hdr Header) *Authorization {
+	switch h := hdr.(type) {
+	case *AuthorizationHeader:
+		return authFromAuthValue(&h.AuthValue)
+	case *ProxyAuthorizationHeader:
+		return authFromAuthValue(&h.AuthValue)
+	case *WWWAuthenticateHeader:
+		return authFromAuthValue(&h.AuthValue)
+	case *ProxyAuthenticateHeader:
+		return authFromAuthValue(&h.AuthValue)
+	default:
+		return AuthFromValue(hdr.Value())
+	}
+}
+
+func authFromAuthValue(value *AuthValue) *Authorization {
 	auth := &Authorization{
 		algorithm: "MD5",
 		other:     make(map[string]string),
 	}
 
-	re := regexp.MustCompile(`([\w]+)="([^"]+)"`)
-	matches := re.FindAllStringSubmatch(value, -1)
-	for _, match := range matches {
-		switch match[1] {
+	for _, param := range value.Params {
+		name := strings.ToLower(param.Name)
+		switch name {
 		case "username":
-			auth.username = match[2]
+			auth.username = param.Value
 		case "realm":
-			auth.realm = match[2]
+			auth.realm = param.Value
 		case "algorithm":
-			auth.algorithm = match[2]
+			auth.algorithm = param.Value
 		case "nonce":
-			auth.nonce = match[2]
+			auth.nonce = param.Value
 		case "response":
-			auth.response = match[2]
+			auth.response = param.Value
 		case "uri":
-			auth.uri = match[2]
+			auth.uri = param.Value
 		default:
-			auth.other[match[1]] = match[2]
+			// parsed parameters are kept available through Param as well
+			auth.other[name] = param.Value
+		}
+
+		switch name {
+		case "qop":
+			auth.qop = param.Value
+		case "cnonce":
+			auth.cnonce = param.Value
+		case "opaque":
+			auth.opaque = param.Value
+		case "nc":
+			if nc, err := strconv.ParseUint(param.Value, 16, 32); err == nil {
+				auth.nc = uint32(nc)
+			}
 		}
 	}
 
@@ -73,95 +160,306 @@ func (auth *Authorization) SetPassword(password string) *Authorization {
 
 	return auth
 }
+
+// SetHA1 sets precomputed H(username:realm:password), it is used instead of the password.
+func (auth *Authorization) SetHA1(ha1 string) *Authorization {
+	auth.ha1 = ha1
+
+	return auth
+}
+
+// SetBody sets the message body protected with qop=auth-int.
+func (auth *Authorization) SetBody(body string) *Authorization {
+	auth.body = body
+
+	return auth
+}
+
+// SetNonceCount sets count of requests sent with the nonce, 1 is used if not set.
+func (auth *Authorization) SetNonceCount(nc uint32) *Authorization {
+	auth.nc = nc
+
+	return auth
+}
+
+func (auth *Authorization) SetCNonce(cnonce string) *Authorization {
+	auth.cnonce = cnonce
+
+	return auth
+}
+
 func (auth *Authorization) GetResponse() string {
 	return auth.response
 }
 
+func (auth *Authorization) Realm() string {
+	return auth.realm
+}
+
+func (auth *Authorization) Nonce() string {
+	return auth.nonce
+}
+
+func (auth *Authorization) Algorithm() string {
+	return auth.algorithm
+}
+
+func (auth *Authorization) Username() string {
+	return auth.username
+}
+
+func (auth *Authorization) Uri() string {
+	return auth.uri
+}
+
+func (auth *Authorization) Qop() string {
+	return auth.qop
+}
+
+func (auth *Authorization) CNonce() string {
+	return auth.cnonce
+}
+
+func (auth *Authorization) NonceCount() uint32 {
+	return auth.nc
+}
+
+// Param returns other parameter of the header, like qop, nc or stale.
+func (auth *Authorization) Param(name string) (string, bool) {
+	value, ok := auth.other[name]
+	return value, ok
+}
+
+// CalcResponse selects qop from the offered ones and calculates the response - RFC 7616 - 3.4.1.
+// The response is empty if the algorithm is not supported.
 func (auth *Authorization) CalcResponse() *Authorization {
-	auth.response = calcResponse(
-		auth.username,
-		auth.realm,
-		auth.password,
-		auth.method,
-		auth.uri,
-		auth.nonce,
-	)
+	auth.calc()
 
 	return auth
 }
 
+func (auth *Authorization) calc() error {
+	auth.qop = selectQop(auth.qop)
+
+	if auth.qop != "" || isSessAlgorithm(auth.algorithm) {
+		if auth.cnonce == "" {
+			auth.cnonce = generateCNonce()
+		}
+	}
+	if auth.qop != "" && auth.nc == 0 {
+		auth.nc = 1
+	}
+
+	response, err := calcResponse(auth)
+	auth.response = response
+
+	return err
+}
+
 func (auth *Authorization) String() string {
-	return fmt.Sprintf(
-		`Digest realm="%s",algorithm=%s,nonce="%s",username="%s",uri="%s",response="%s"`,
-		auth.realm,
-		auth.algorithm,
-		auth.nonce,
-		auth.username,
-		auth.uri,
-		auth.response,
-	)
-}
-
-// calculates Authorization response https://www.ietf.org/rfc/rfc2617.txt
-func calcResponse(username string, realm string, password string, method string, uri string, nonce string) string {
-	calcA1 := func() string {
-		encoder := md5.New()
-		encoder.Write([]byte(username + ":" + realm + ":" + password))
+	value := auth.AuthValue()
 
-		return hex.EncodeToString(encoder.Sum(nil))
+	return value.String()
+}
+
+// AuthValue returns Digest credentials - RFC 3261 - 25.1.
+func (auth *Authorization) AuthValue() AuthValue {
+	value := AuthValue{
+		Scheme: "Digest",
+		Params: []AuthParam{
+			{Name: "realm", Value: auth.realm, Quoted: true},
+			{Name: "algorithm", Value: auth.algorithm},
+			{Name: "nonce", Value: auth.nonce, Quoted: true},
+			{Name: "username", Value: auth.username, Quoted: true},
+			{Name: "uri", Value: auth.uri, Quoted: true},
+			{Name: "response", Value: auth.response, Quoted: true},
+		},
+	}
+	if auth.qop != "" {
+		value.Params = append(value.Params,
+			AuthParam{Name: "qop", Value: auth.qop},
+			AuthParam{Name: "nc", Value: fmt.Sprintf("%08x", auth.nc)},
+		)
+	}
+	if auth.cnonce != "" {
+		value.Params = append(value.Params, AuthParam{Name: "cnonce", Value: auth.cnonce, Quoted: true})
+	}
+	if auth.opaque != "" {
+		value.Params = append(value.Params, AuthParam{Name: "opaque", Value: auth.opaque, Quoted: true})
 	}
-	calcA2 := func() string {
-		encoder := md5.New()
-		encoder.Write([]byte(method + ":" + uri))
+
+	return value
+}
+
+// calculates Authorization response - RFC 7616 - 3.4.1, RFC 2617 - 3.2.2.1.
+func calcResponse(auth *Authorization) (string, error) {
+	newHash, ok := digestHash(auth.algorithm)
+	if !ok {
+		return "", fmt.Errorf("digest algorithm %s is not supported", auth.algorithm)
+	}
+	h := func(value string) string {
+		encoder := newHash()
+		encoder.Write([]byte(value))
 
 		return hex.EncodeToString(encoder.Sum(nil))
 	}
 
-	encoder := md5.New()
-	encoder.Write([]byte(calcA1() + ":" + nonce + ":" + calcA2()))
+	ha1 := auth.ha1
+	if ha1 == "" {
+		ha1 = h(auth.username + ":" + auth.realm + ":" + auth.password)
+	}
+	if isSessAlgorithm(auth.algorithm) {
+		ha1 = h(ha1 + ":" + auth.nonce + ":" + auth.cnonce)
+	}
+
+	a2 := auth.method + ":" + auth.uri
+	if auth.qop == "auth-int" {
+		a2 += ":" + h(auth.body)
+	}
+	ha2 := h(a2)
+
+	if auth.qop == "" {
+		return h(ha1 + ":" + auth.nonce + ":" + ha2), nil
+	}
+
+	return h(fmt.Sprintf("%s:%s:%08x:%s:%s:%s", ha1, auth.nonce, auth.nc, auth.cnonce, auth.qop, ha2)), nil
+}
+
+func digestHash(algorithm string) (func() hash.Hash, bool) {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New, true
+	case "SHA-256":
+		return sha256.New, true
+	case "SHA-512-256":
+		return sha512.New512_256, true
+	default:
+		return nil, false
+	}
+}
+
+// algorithmStrength ranks supported algorithms, 0 is returned for unsupported ones.
+func algorithmStrength(algorithm string) int {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return 1
+	case "SHA-256":
+		return 2
+	case "SHA-512-256":
+		return 3
+	default:
+		return 0
+	}
+}
+
+func isSessAlgorithm(algorithm string) bool {
+	return strings.HasSuffix(strings.ToUpper(algorithm), "-SESS")
+}
+
+// selectQop prefers auth, auth-int is used only when auth is not offered.
+func selectQop(offered string) string {
+	qop := ""
+	for _, value := range strings.Split(offered, ",") {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "auth":
+			return "auth"
+		case "auth-int":
+			qop = "auth-int"
+		}
+	}
 
-	return hex.EncodeToString(encoder.Sum(nil))
+	return qop
+}
+
+func generateCNonce() string {
+	randomness := make([]byte, 16)
+	if _, err := rand.Read(randomness); err != nil {
+		return GenerateNonce()
+	}
+
+	return hex.EncodeToString(randomness)
 }
 
 func AuthorizeRequest(request Request, response Response, user, password MaybeString) error {
+	return authorizeRequest(request, response, user, password, nil)
+}
+
+func authorizeRequest(
+	request Request,
+	response Response,
+	user, password MaybeString,
+	nonceCount func(nonce string) uint32,
+) error {
 	if user == nil {
 		return fmt.Errorf("authorize request: user is nil")
 	}
 
 	var authenticateHeaderName, authorizeHeaderName string
+	var newAuthorization func(value AuthValue) Header
 	if response.StatusCode() == 401 {
 		// on 401 Unauthorized increase request seq num, add Authorization header and send once again
 		authenticateHeaderName = "WWW-Authenticate"
 		authorizeHeaderName = "Authorization"
+		newAuthorization = func(value AuthValue) Header { return &AuthorizationHeader{value} }
 	} else {
 		// 407 Proxy authentication
 		authenticateHeaderName = "Proxy-Authenticate"
 		authorizeHeaderName = "Proxy-Authorization"
+		newAuthorization = func(value AuthValue) Header { return &ProxyAuthorizationHeader{value} }
 	}
 
-	if hdrs := response.GetHeaders(authenticateHeaderName); len(hdrs) > 0 {
-		authenticateHeader := hdrs[0].(*GenericHeader)
-		auth := AuthFromValue(authenticateHeader.Contents).
-			SetMethod(string(request.Method())).
-			SetUri(request.Recipient().String()).
-			SetUsername(user.String())
-		if password != nil {
-			auth.SetPassword(password.String())
+	// RFC 8760 - 2.4. The strongest of the offered algorithms is used,
+	// challenges with unsupported algorithms are skipped - RFC 7616 - 3.7.
+	var auth *Authorization
+	challenged := false
+	for _, challenge := range authValues(response.GetHeaders(authenticateHeaderName)) {
+		if !strings.EqualFold(challenge.Scheme, "Digest") {
+			continue
+		}
+		challenged = true
+
+		digest := authFromAuthValue(&challenge)
+		strength := algorithmStrength(digest.algorithm)
+		if strength > 0 && (auth == nil || strength > algorithmStrength(auth.algorithm)) {
+			auth = digest
+		}
+	}
+	if auth == nil {
+		if challenged {
+			return fmt.Errorf("authorize request: no '%s' challenge with supported algorithm", authenticateHeaderName)
 		}
+		return fmt.Errorf("authorize request: header '%s' not found in response", authenticateHeaderName)
+	}
 
-		auth.CalcResponse()
+	auth.SetMethod(string(request.Method())).
+		SetUri(request.Recipient().String()).
+		SetUsername(user.String()).
+		SetBody(request.Body())
+	if password != nil {
+		auth.SetPassword(password.String())
+	}
+	if nonceCount != nil {
+		auth.SetNonceCount(nonceCount(auth.nonce))
+	}
 
-		if hdrs = request.GetHeaders(authorizeHeaderName); len(hdrs) > 0 {
-			authorizationHeader := hdrs[0].(*GenericHeader)
-			authorizationHeader.Contents = auth.String()
-		} else {
-			request.AppendHeader(&GenericHeader{
-				HeaderName: authorizeHeaderName,
-				Contents:   auth.String(),
-			})
+	if err := auth.calc(); err != nil {
+		return fmt.Errorf("authorize request: %w", err)
+	}
+
+	// credentials for the same realm are replaced
+	hdrs := request.GetHeaders(authorizeHeaderName)
+	replaced := false
+	for i, hdr := range hdrs {
+		if AuthFromHeader(hdr).realm == auth.realm {
+			hdrs[i] = newAuthorization(auth.AuthValue())
+			replaced = true
+			break
 		}
+	}
+	if replaced {
+		request.ReplaceHeaders(authorizeHeaderName, hdrs)
 	} else {
-		return fmt.Errorf("authorize request: header '%s' not found in response", authenticateHeaderName)
+		request.AppendHeader(newAuthorization(auth.AuthValue()))
 	}
 
 	if viaHop, ok := request.ViaHop(); ok {
@@ -175,6 +473,28 @@ func AuthorizeRequest(request Request, response Response, user, password MaybeSt
 	return nil
 }
 
+// authValues returns challenges or credentials of the headers,
+// generic header is read as one challenge or credentials.
+func authValues(hdrs []Header) []AuthValue {
+	values := make([]AuthValue, 0)
+	for _, hdr := range hdrs {
+		switch h := hdr.(type) {
+		case *AuthorizationHeader:
+			values = append(values, h.AuthValue)
+		case *ProxyAuthorizationHeader:
+			values = append(values, h.AuthValue)
+		case *WWWAuthenticateHeader:
+			values = append(values, h.AuthValue)
+		case *ProxyAuthenticateHeader:
+			values = append(values, h.AuthValue)
+		default:
+			values = append(values, authValueFromString(hdr.Value()))
+		}
+	}
+
+	return values
+}
+
 type Authorizer interface {
 	AuthorizeRequest(request Request, response Response) error
 }
@@ -182,8 +502,24 @@ type Authorizer interface {
 type DefaultAuthorizer struct {
 	User     MaybeString
 	Password MaybeString
+
+	// nonceCounts holds count of requests sent with the nonce - RFC 7616 - 3.4.
+	nonceCounts map[string]uint32
+	mu          sync.Mutex
 }
 
 func (auth *DefaultAuthorizer) AuthorizeRequest(request Request, response Response) error {
-	return AuthorizeRequest(request, response, auth.User, auth.Password)
+	return authorizeRequest(request, response, auth.User, auth.Password, auth.nextNonceCount)
+}
+
+func (auth *DefaultAuthorizer) nextNonceCount(nonce string) uint32 {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	if auth.nonceCounts == nil || len(auth.nonceCounts) >= maxNonceCounts {
+		auth.nonceCounts = make(map[string]uint32)
+	}
+	auth.nonceCounts[nonce]++
+
+	return auth.nonceCounts[nonce]
 }
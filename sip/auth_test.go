@@ -0,0 +1,125 @@
+package sip_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ygj201011/gosip/sip"
+)
+
+func TestAuthorization_CalcResponse(t *testing.T) {
+	// RFC 7616 - 3.9.1 examples
+	challenge := `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=%s, ` +
+		`nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", ` +
+		`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+	tests := []struct {
+		algorithm string
+		response  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			auth := sip.AuthFromValue(strings.Replace(challenge, "%s", tt.algorithm, 1)).
+				SetUsername("Mufasa").
+				SetPassword("Circle of Life").
+				SetMethod("GET").
+				SetUri("/dir/index.html").
+				SetCNonce("f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ").
+				CalcResponse()
+
+			if auth.GetResponse() != tt.response {
+				t.Errorf("response = %s, want %s", auth.GetResponse(), tt.response)
+			}
+			if auth.Qop() != "auth" || auth.NonceCount() != 1 {
+				t.Errorf("qop = %s, nc = %d, want auth, 1", auth.Qop(), auth.NonceCount())
+			}
+
+			parsed := sip.AuthFromValue(auth.String())
+			if parsed.GetResponse() != tt.response || parsed.NonceCount() != 1 || parsed.CNonce() != auth.CNonce() {
+				t.Errorf("parsed %s does not match %s", parsed, auth)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRequest_StrongestChallenge(t *testing.T) {
+	req := sip.NewRequest(
+		"",
+		sip.REGISTER,
+		&sip.SipUri{FHost: "example.com"},
+		"SIP/2.0",
+		[]sip.Header{
+			&sip.CSeq{SeqNo: 1, MethodName: sip.REGISTER},
+		},
+		"",
+		nil,
+	)
+	res := sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
+	for _, algorithm := range []string{"MD5", "SHA-512-256", "UNKNOWN", "SHA-256"} {
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "WWW-Authenticate",
+			Contents:   `Digest realm="example.com", nonce="abc", qop="auth", algorithm=` + algorithm,
+		})
+	}
+
+	authorizer := &sip.DefaultAuthorizer{User: sip.String{Str: "alice"}, Password: sip.String{Str: "secret"}}
+	for nc := uint32(1); nc <= 2; nc++ {
+		if err := authorizer.AuthorizeRequest(req, res); err != nil {
+			t.Fatalf("authorize request failed: %s", err)
+		}
+
+		hdrs := req.GetHeaders("Authorization")
+		if len(hdrs) != 1 {
+			t.Fatalf("got %d Authorization headers, want 1", len(hdrs))
+		}
+		auth := sip.AuthFromValue(hdrs[0].Value())
+		if auth.Algorithm() != "SHA-512-256" || auth.NonceCount() != nc {
+			t.Errorf("algorithm = %s, nc = %d, want SHA-512-256, %d", auth.Algorithm(), auth.NonceCount(), nc)
+		}
+	}
+	if cseq, _ := req.CSeq(); cseq.SeqNo != 3 {
+		t.Errorf("CSeq = %d, want 3", cseq.SeqNo)
+	}
+}
+
+func TestAuthorization_CalcResponseUnsupportedAlgorithm(t *testing.T) {
+	auth := sip.AuthFromValue(`Digest realm="example.com", nonce="abc", algorithm=SHA-1`).
+		SetUsername("alice").
+		SetPassword("secret").
+		SetMethod("REGISTER").
+		SetUri("sip:example.com").
+		CalcResponse()
+
+	if auth.GetResponse() != "" {
+		t.Errorf("response = %s, want empty for unsupported algorithm", auth.GetResponse())
+	}
+}
+
+func TestAuthorizeRequest_UnsupportedAlgorithm(t *testing.T) {
+	req := sip.NewRequest(
+		"",
+		sip.REGISTER,
+		&sip.SipUri{FHost: "example.com"},
+		"SIP/2.0",
+		[]sip.Header{
+			&sip.CSeq{SeqNo: 1, MethodName: sip.REGISTER},
+		},
+		"",
+		nil,
+	)
+	res := sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
+	res.AppendHeader(&sip.GenericHeader{
+		HeaderName: "WWW-Authenticate",
+		Contents:   `Digest realm="example.com", nonce="abc", qop="auth", algorithm=SHA-1`,
+	})
+
+	authorizer := &sip.DefaultAuthorizer{User: sip.String{Str: "alice"}, Password: sip.String{Str: "secret"}}
+	if err := authorizer.AuthorizeRequest(req, res); err == nil {
+		t.Fatal("authorize request succeeded, want error for unsupported algorithm")
+	}
+	if hdrs := req.GetHeaders("Authorization"); len(hdrs) != 0 {
+		t.Errorf("got %d Authorization headers, want 0", len(hdrs))
+	}
+}
@@ -0,0 +1,56 @@
+package sip
+
+// DialogState describes dialog life cycle - RFC 3261 - 12.
+type DialogState int
+
+const (
+	DialogStateEarly DialogState = iota
+	DialogStateConfirmed
+	DialogStateTerminated
+)
+
+func (state DialogState) String() string {
+	switch state {
+	case DialogStateEarly:
+		return "Early"
+	case DialogStateConfirmed:
+		return "Confirmed"
+	case DialogStateTerminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+// Dialog represents a peer-to-peer SIP relationship between two UAs - RFC 3261 - 12.
+type Dialog interface {
+	// ID returns dialog ID built from Call-ID, local and remote tags.
+	ID() string
+	String() string
+	State() DialogState
+	// Server is true if the dialog was created by the UAS core.
+	Server() bool
+	CallID() CallID
+	LocalTag() string
+	RemoteTag() string
+	LocalUri() *Address
+	RemoteUri() *Address
+	// LocalTarget returns Contact URI sent in the dialog-creating request or response.
+	LocalTarget() Uri
+	RemoteTarget() Uri
+	RouteSet() []Uri
+	// LocalSeq returns last CSeq number used for requests sent within the dialog.
+	LocalSeq() uint32
+	// RemoteSeq returns last CSeq number received within the dialog.
+	RemoteSeq() uint32
+	Secure() bool
+	// NewRequest builds request within the dialog - RFC 3261 - 12.2.1.1.
+	// The local sequence number is incremented for every method except ACK and CANCEL.
+	NewRequest(method RequestMethod) (Request, error)
+	// Terminate moves dialog to the terminated state.
+	Terminate()
+	Done() <-chan struct{}
+	// Errors returns channel of asynchronous dialog errors,
+	// like missing ACK on 2xx response - RFC 3261 - 13.3.1.4.
+	Errors() <-chan error
+}
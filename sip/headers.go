@@ -3,6 +3,8 @@ package sip
 import (
 	"bytes"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -16,6 +18,25 @@ import (
 // Whitespace recognised by SIP protocol.
 const abnfWs = " \t"
 
+// formatHost encloses IPv6 reference in brackets - RFC 3261 - 25.1, RFC 5118 - 4.
+func formatHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+
+	return host
+}
+
+// equalHosts compares IP addresses by value, so that different IPv6 notations match - RFC 5118 - 4.4.
+func equalHosts(host1, host2 string) bool {
+	if host1 == host2 {
+		return true
+	}
+	ip1, ip2 := net.ParseIP(strings.Trim(host1, "[]")), net.ParseIP(strings.Trim(host2, "[]"))
+
+	return ip1 != nil && ip1.Equal(ip2)
+}
+
 // Header is a single SIP header.
 type Header interface {
 	// Name returns header name.
@@ -282,6 +303,7 @@ type SipUri struct {
 	FPassword MaybeString
 
 	// The host part of the URI. This can be a domain, or a string representation of an IP address.
+	// IPv6 reference is kept without brackets, they are added on serialization.
 	FHost string
 
 	// The port part of the URI. This is optional, and so is represented here as a pointer type.
@@ -380,7 +402,7 @@ func (uri *SipUri) Equals(val interface{}) bool {
 	result := uri.FIsEncrypted == other.FIsEncrypted &&
 		uri.FUser == other.FUser &&
 		uri.FPassword == other.FPassword &&
-		uri.FHost == other.FHost &&
+		equalHosts(uri.FHost, other.FHost) &&
 		util.Uint16PtrEq((*uint16)(uri.FPort), (*uint16)(other.FPort))
 
 	if !result {
@@ -430,7 +452,7 @@ func (uri *SipUri) String() string {
 	}
 
 	// Compulsory hostname.
-	buffer.WriteString(uri.FHost)
+	buffer.WriteString(formatHost(uri.FHost))
 
 	// Optional port number.
 	if uri.FPort != nil {
@@ -1110,7 +1132,7 @@ type ViaHop struct {
 
 func (hop *ViaHop) SentBy() string {
 	var buf bytes.Buffer
-	buf.WriteString(hop.Host)
+	buf.WriteString(formatHost(hop.Host))
 	if hop.Port != nil {
 		buf.WriteString(fmt.Sprintf(":%d", *hop.Port))
 	}
@@ -1118,6 +1140,30 @@ func (hop *ViaHop) SentBy() string {
 	return buf.String()
 }
 
+// Received returns address of the hop sender observed by the next hop,
+// it is built from received and rport params - RFC 3261 - 18.2.1, RFC 3581 - 4.
+func (hop *ViaHop) Received() (string, bool) {
+	if hop.Params == nil {
+		return "", false
+	}
+	received, ok := hop.Params.Get("received")
+	if !ok || received == nil || received.String() == "" {
+		return "", false
+	}
+
+	port := DefaultPort(hop.Transport)
+	if hop.Port != nil {
+		port = *hop.Port
+	}
+	if rport, ok := hop.Params.Get("rport"); ok && rport != nil && rport.String() != "" {
+		if p, err := strconv.Atoi(rport.String()); err == nil {
+			port = Port(uint16(p))
+		}
+	}
+
+	return net.JoinHostPort(strings.Trim(received.String(), "[]"), strconv.Itoa(int(port))), true
+}
+
 func (hop *ViaHop) String() string {
 	var buffer bytes.Buffer
 	buffer.WriteString(
@@ -1126,7 +1172,7 @@ func (hop *ViaHop) String() string {
 			hop.ProtocolName,
 			hop.ProtocolVersion,
 			hop.Transport,
-			hop.Host,
+			formatHost(hop.Host),
 		),
 	)
 	if hop.Port != nil {
@@ -1176,7 +1222,7 @@ func (hop *ViaHop) Equals(other interface{}) bool {
 		res := hop.ProtocolName == h.ProtocolName &&
 			hop.ProtocolVersion == h.ProtocolVersion &&
 			hop.Transport == h.Transport &&
-			hop.Host == h.Host &&
+			equalHosts(hop.Host, h.Host) &&
 			util.Uint16PtrEq((*uint16)(hop.Port), (*uint16)(h.Port))
 
 		if hop.Params != h.Params {
@@ -1650,3 +1696,338 @@ func (route *RecordRouteHeader) Equals(other interface{}) bool {
 
 	return false
 }
+
+
+// AuthParam is a parameter of challenge or credentials - RFC 3261 - 25.1.
+type AuthParam struct {
+	Name  string
+	Value string
+	// Quoted forces quoted-string form, values that are not tokens are quoted anyway.
+	Quoted bool
+}
+
+func (param AuthParam) String() string {
+	if !param.Quoted && isAuthToken(param.Value) {
+		return param.Name + "=" + param.Value
+	}
+
+	return param.Name + "=" + quoteAuthValue(param.Value)
+}
+
+// AuthValue is a challenge or credentials of the scheme, like Digest - RFC 7235 - 2.1.
+type AuthValue struct {
+	Scheme string
+	// Token is token68 form of credentials, it is used instead of Params.
+	Token  string
+	Params []AuthParam
+}
+
+// Param returns value of the parameter, names are case-insensitive.
+func (value *AuthValue) Param(name string) (string, bool) {
+	return authParam(value.Params, name)
+}
+
+// SetParam replaces value of the parameter or appends new one.
+func (value *AuthValue) SetParam(name, val string, quoted bool) {
+	value.Params = setAuthParam(value.Params, AuthParam{Name: name, Value: val, Quoted: quoted})
+}
+
+func (value *AuthValue) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(value.Scheme)
+	if value.Token != "" {
+		buffer.WriteString(" " + value.Token)
+	}
+	if len(value.Params) > 0 {
+		buffer.WriteString(" " + authParamsString(value.Params))
+	}
+
+	return buffer.String()
+}
+
+func (value *AuthValue) clone() AuthValue {
+	params := make([]AuthParam, len(value.Params))
+	copy(params, value.Params)
+
+	return AuthValue{Scheme: value.Scheme, Token: value.Token, Params: params}
+}
+
+func (value *AuthValue) equals(other *AuthValue) bool {
+	return strings.EqualFold(value.Scheme, other.Scheme) &&
+		value.Token == other.Token &&
+		authParamsEqual(value.Params, other.Params)
+}
+
+// AuthorizationHeader carries credentials of the user agent - RFC 3261 - 20.7.
+type AuthorizationHeader struct {
+	AuthValue
+}
+
+func (auth *AuthorizationHeader) String() string {
+	return fmt.Sprintf("%s: %s", auth.Name(), auth.Value())
+}
+
+func (auth *AuthorizationHeader) Name() string { return "Authorization" }
+
+func (auth *AuthorizationHeader) Value() string { return auth.AuthValue.String() }
+
+func (auth *AuthorizationHeader) Clone() Header {
+	if auth == nil {
+		var newAuth *AuthorizationHeader
+		return newAuth
+	}
+
+	return &AuthorizationHeader{auth.clone()}
+}
+
+func (auth *AuthorizationHeader) Equals(other interface{}) bool {
+	if h, ok := other.(*AuthorizationHeader); ok {
+		if auth == h {
+			return true
+		}
+		if auth == nil && h != nil || auth != nil && h == nil {
+			return false
+		}
+
+		return auth.equals(&h.AuthValue)
+	}
+
+	return false
+}
+
+// ProxyAuthorizationHeader carries credentials for the proxy - RFC 3261 - 20.28.
+type ProxyAuthorizationHeader struct {
+	AuthValue
+}
+
+func (auth *ProxyAuthorizationHeader) String() string {
+	return fmt.Sprintf("%s: %s", auth.Name(), auth.Value())
+}
+
+func (auth *ProxyAuthorizationHeader) Name() string { return "Proxy-Authorization" }
+
+func (auth *ProxyAuthorizationHeader) Value() string { return auth.AuthValue.String() }
+
+func (auth *ProxyAuthorizationHeader) Clone() Header {
+	if auth == nil {
+		var newAuth *ProxyAuthorizationHeader
+		return newAuth
+	}
+
+	return &ProxyAuthorizationHeader{auth.clone()}
+}
+
+func (auth *ProxyAuthorizationHeader) Equals(other interface{}) bool {
+	if h, ok := other.(*ProxyAuthorizationHeader); ok {
+		if auth == h {
+			return true
+		}
+		if auth == nil && h != nil || auth != nil && h == nil {
+			return false
+		}
+
+		return auth.equals(&h.AuthValue)
+	}
+
+	return false
+}
+
+// WWWAuthenticateHeader carries a challenge of the UAS or registrar - RFC 3261 - 20.44.
+type WWWAuthenticateHeader struct {
+	AuthValue
+}
+
+func (auth *WWWAuthenticateHeader) String() string {
+	return fmt.Sprintf("%s: %s", auth.Name(), auth.Value())
+}
+
+func (auth *WWWAuthenticateHeader) Name() string { return "WWW-Authenticate" }
+
+func (auth *WWWAuthenticateHeader) Value() string { return auth.AuthValue.String() }
+
+func (auth *WWWAuthenticateHeader) Clone() Header {
+	if auth == nil {
+		var newAuth *WWWAuthenticateHeader
+		return newAuth
+	}
+
+	return &WWWAuthenticateHeader{auth.clone()}
+}
+
+func (auth *WWWAuthenticateHeader) Equals(other interface{}) bool {
+	if h, ok := other.(*WWWAuthenticateHeader); ok {
+		if auth == h {
+			return true
+		}
+		if auth == nil && h != nil || auth != nil && h == nil {
+			return false
+		}
+
+		return auth.equals(&h.AuthValue)
+	}
+
+	return false
+}
+
+// ProxyAuthenticateHeader carries a challenge of the proxy - RFC 3261 - 20.27.
+type ProxyAuthenticateHeader struct {
+	AuthValue
+}
+
+func (auth *ProxyAuthenticateHeader) String() string {
+	return fmt.Sprintf("%s: %s", auth.Name(), auth.Value())
+}
+
+func (auth *ProxyAuthenticateHeader) Name() string { return "Proxy-Authenticate" }
+
+func (auth *ProxyAuthenticateHeader) Value() string { return auth.AuthValue.String() }
+
+func (auth *ProxyAuthenticateHeader) Clone() Header {
+	if auth == nil {
+		var newAuth *ProxyAuthenticateHeader
+		return newAuth
+	}
+
+	return &ProxyAuthenticateHeader{auth.clone()}
+}
+
+func (auth *ProxyAuthenticateHeader) Equals(other interface{}) bool {
+	if h, ok := other.(*ProxyAuthenticateHeader); ok {
+		if auth == h {
+			return true
+		}
+		if auth == nil && h != nil || auth != nil && h == nil {
+			return false
+		}
+
+		return auth.equals(&h.AuthValue)
+	}
+
+	return false
+}
+
+// AuthenticationInfoHeader carries mutual authentication info, like nextnonce - RFC 3261 - 20.6.
+type AuthenticationInfoHeader struct {
+	Params []AuthParam
+}
+
+func (info *AuthenticationInfoHeader) String() string {
+	return fmt.Sprintf("%s: %s", info.Name(), info.Value())
+}
+
+func (info *AuthenticationInfoHeader) Name() string { return "Authentication-Info" }
+
+func (info *AuthenticationInfoHeader) Value() string { return authParamsString(info.Params) }
+
+// Param returns value of the parameter, names are case-insensitive.
+func (info *AuthenticationInfoHeader) Param(name string) (string, bool) {
+	return authParam(info.Params, name)
+}
+
+// SetParam replaces value of the parameter or appends new one.
+func (info *AuthenticationInfoHeader) SetParam(name, val string, quoted bool) {
+	info.Params = setAuthParam(info.Params, AuthParam{Name: name, Value: val, Quoted: quoted})
+}
+
+func (info *AuthenticationInfoHeader) Clone() Header {
+	if info == nil {
+		var newInfo *AuthenticationInfoHeader
+		return newInfo
+	}
+
+	params := make([]AuthParam, len(info.Params))
+	copy(params, info.Params)
+
+	return &AuthenticationInfoHeader{params}
+}
+
+func (info *AuthenticationInfoHeader) Equals(other interface{}) bool {
+	if h, ok := other.(*AuthenticationInfoHeader); ok {
+		if info == h {
+			return true
+		}
+		if info == nil && h != nil || info != nil && h == nil {
+			return false
+		}
+
+		return authParamsEqual(info.Params, h.Params)
+	}
+
+	return false
+}
+
+// isAuthTokenChar checks token char - RFC 3261 - 25.1.
+func isAuthTokenChar(c uint8) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("-.!%*_+`'~", c) >= 0
+}
+
+func isAuthToken(value string) bool {
+	if value == "" {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if !isAuthTokenChar(value[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func quoteAuthValue(value string) string {
+	var buffer bytes.Buffer
+	buffer.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' {
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteByte(value[i])
+	}
+	buffer.WriteByte('"')
+
+	return buffer.String()
+}
+
+func authParamsString(params []AuthParam) string {
+	parts := make([]string, len(params))
+	for i, param := range params {
+		parts[i] = param.String()
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func authParam(params []AuthParam, name string) (string, bool) {
+	for _, param := range params {
+		if strings.EqualFold(param.Name, name) {
+			return param.Value, true
+		}
+	}
+
+	return "", false
+}
+
+func setAuthParam(params []AuthParam, param AuthParam) []AuthParam {
+	for i := range params {
+		if strings.EqualFold(params[i].Name, param.Name) {
+			params[i] = param
+			return params
+		}
+	}
+
+	return append(params, param)
+}
+
+func authParamsEqual(params, other []AuthParam) bool {
+	if len(params) != len(other) {
+		return false
+	}
+	for i, param := range params {
+		if !strings.EqualFold(param.Name, other[i].Name) || param.Value != other[i].Value {
+			return false
+		}
+	}
+
+	return true
+}
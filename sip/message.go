@@ -2,6 +2,7 @@ package sip
 
 import (
 	"bytes"
+	"net"
 	"strings"
 	"sync"
 
@@ -43,6 +44,7 @@ const (
 	REFER     RequestMethod = "REFER"
 	INFO      RequestMethod = "INFO"
 	MESSAGE   RequestMethod = "MESSAGE"
+	UPDATE    RequestMethod = "UPDATE"
 )
 
 type MessageID string
@@ -411,6 +413,7 @@ type message struct {
 	startLine  func() string
 	src        string
 	dest       string
+	conn       net.Conn
 	fields     log.Fields
 }
 
@@ -510,6 +513,38 @@ func (msg *message) SetDestination(dest string) {
 	msg.mu.Unlock()
 }
 
+// connMessage is implemented by messages of this package, the connection is not a part of Message,
+// so other implementations of Message keep working without it.
+type connMessage interface {
+	Connection() net.Conn
+	SetConnection(conn net.Conn)
+}
+
+// copyConnection copies the connection the message was received over if both messages carry it.
+func copyConnection(from, to Message) {
+	src, ok := from.(connMessage)
+	if !ok {
+		return
+	}
+	if dst, ok := to.(connMessage); ok {
+		dst.SetConnection(src.Connection())
+	}
+}
+
+// Connection returns the connection the message was received over,
+// it is nil for messages created locally.
+func (msg *message) Connection() net.Conn {
+	msg.mu.RLock()
+	defer msg.mu.RUnlock()
+	return msg.conn
+}
+
+func (msg *message) SetConnection(conn net.Conn) {
+	msg.mu.Lock()
+	msg.conn = conn
+	msg.mu.Unlock()
+}
+
 // Copy all headers of one type from one message to another.
 // Appending to any headers that were already there.
 func CopyHeaders(name string, from, to Message) {
@@ -214,6 +214,26 @@ func TestSipUri_String(t *testing.T) {
 			},
 			"sip:alice@wonderland.com;food=cake?CakeLocation=\"Tea Party\"",
 		},
+		{
+			"SIP URI with IPv6 host",
+			&sip.SipUri{
+				FUser:      sip.String{"alice"},
+				FHost:      "2001:db8::10",
+				FPort:      &port5060,
+				FUriParams: sip.NewParams().Add("transport", sip.String{"tcp"}),
+				FHeaders:   noParams,
+			},
+			"sip:alice@[2001:db8::10]:5060;transport=tcp",
+		},
+		{
+			"SIP URI with bracketed IPv6 host",
+			&sip.SipUri{
+				FHost:      "[2001:db8::10]",
+				FUriParams: noParams,
+				FHeaders:   noParams,
+			},
+			"sip:[2001:db8::10]",
+		},
 		{
 			"Wildcard URI",
 			&sip.WildcardUri{},
@@ -566,3 +586,65 @@ func TestHeaders_String(t *testing.T) {
 		},
 	}, t)
 }
+
+func TestViaHop_Received(t *testing.T) {
+	tests := []struct {
+		description string
+		params      sip.Params
+		expected    string
+		ok          bool
+	}{
+		{"No received", sip.NewParams().Add("rport", nil), "", false},
+		{"Received with sent-by port", sip.NewParams().Add("received", sip.String{Str: "192.0.2.1"}), "192.0.2.1:6060", true},
+		{
+			"Received with rport",
+			sip.NewParams().
+				Add("rport", sip.String{Str: "40000"}).
+				Add("received", sip.String{Str: "192.0.2.1"}),
+			"192.0.2.1:40000",
+			true,
+		},
+		{"IPv6 received", sip.NewParams().Add("received", sip.String{Str: "2001:db8::9:255"}), "[2001:db8::9:255]:6060", true},
+		{"Bracketed IPv6 received", sip.NewParams().Add("received", sip.String{Str: "[2001:db8::9:255]"}), "[2001:db8::9:255]:6060", true},
+	}
+
+	for _, test := range tests {
+		hop := &sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       "UDP",
+			Host:            "10.0.0.1",
+			Port:            &port6060,
+			Params:          test.params,
+		}
+		addr, ok := hop.Received()
+		if addr != test.expected || ok != test.ok {
+			t.Errorf("[FAIL] %v: Expected: \"%v\" %v, Got: \"%v\" %v", test.description, test.expected, test.ok, addr, ok)
+		}
+	}
+}
+
+func TestViaHop_IPv6(t *testing.T) {
+	hop := &sip.ViaHop{
+		ProtocolName:    "SIP",
+		ProtocolVersion: "2.0",
+		Transport:       "UDP",
+		Host:            "2001:db8::9:1",
+		Port:            &port5060,
+		Params:          sip.NewParams().Add("branch", sip.String{Str: "z9hG4bKas3-111"}),
+	}
+
+	expected := "SIP/2.0/UDP [2001:db8::9:1]:5060;branch=z9hG4bKas3-111"
+	if hop.String() != expected {
+		t.Errorf("[FAIL] Expected: \"%v\", Got: \"%v\"", expected, hop.String())
+	}
+	if hop.SentBy() != "[2001:db8::9:1]:5060" {
+		t.Errorf("[FAIL] Expected sent-by: \"[2001:db8::9:1]:5060\", Got: \"%v\"", hop.SentBy())
+	}
+
+	other := hop.Clone()
+	other.Host = "2001:db8:0:0:0:0:9:1"
+	if !hop.Equals(other) {
+		t.Errorf("[FAIL] Expected %v equal to %v", hop, other)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +21,9 @@ import (
 // that SIP uses (RFC 3261 S.25).
 const abnfWs = " \t"
 
+// authWs includes line breaks of folded auth header values.
+const authWs = " \t\r\n"
+
 // The maximum permissible CSeq number in a SIP message (2**31 - 1).
 // C.f. RFC 3261 S. 8.1.1.5.
 const maxCseq = 2147483647
@@ -80,6 +84,12 @@ func defaultHeaderParsers() map[string]HeaderParser {
 		"k":              parseSupported,
 		"route":          parseRouteHeader,
 		"record-route":   parseRecordRouteHeader,
+
+		"authorization":       parseAuthorization,
+		"proxy-authorization": parseAuthorization,
+		"www-authenticate":    parseAuthenticate,
+		"proxy-authenticate":  parseAuthenticate,
+		"authentication-info": parseAuthenticationInfo,
 		//"content-encoding","e"
 		//"subject":          "s",
 	}
@@ -699,18 +709,48 @@ func ParseSipUri(uriStr string) (uri sip.SipUri, err error) {
 // Parse a text representation of a host[:port] pair.
 // The port may or may not be present, so we represent it with a *uint16,
 // and return 'nil' if no port was present.
+// IPv6 reference must be enclosed in brackets, the host is returned without them - RFC 5118 - 4.
 func ParseHostPort(rawText string) (host string, port *sip.Port, err error) {
-	colonIdx := strings.Index(rawText, ":")
-	if colonIdx == -1 {
-		host = rawText
-		return
+	var portText string
+	if strings.HasPrefix(rawText, "[") {
+		endIdx := strings.Index(rawText, "]")
+		if endIdx == -1 {
+			err = fmt.Errorf("missing closing bracket of IPv6 reference in '%s'", rawText)
+			return
+		}
+		host = rawText[1:endIdx]
+		if net.ParseIP(host) == nil || !strings.Contains(host, ":") {
+			err = fmt.Errorf("invalid IPv6 reference in '%s'", rawText)
+			return
+		}
+
+		rest := rawText[endIdx+1:]
+		if rest == "" {
+			return
+		}
+		if rest[0] != ':' {
+			err = fmt.Errorf("unexpected characters after IPv6 reference in '%s'", rawText)
+			return
+		}
+		portText = rest[1:]
+	} else {
+		colonIdx := strings.Index(rawText, ":")
+		if colonIdx == -1 {
+			host = rawText
+			return
+		}
+		if strings.Count(rawText, ":") > 1 {
+			err = fmt.Errorf("IPv6 reference must be enclosed in brackets in '%s'", rawText)
+			return
+		}
+		host = rawText[:colonIdx]
+		portText = rawText[colonIdx+1:]
 	}
 
 	// Surely there must be a better way..!
 	var portRaw64 uint64
 	var portRaw16 uint16
-	host = rawText[:colonIdx]
-	portRaw64, err = strconv.ParseUint(rawText[colonIdx+1:], 10, 16)
+	portRaw64, err = strconv.ParseUint(portText, 10, 16)
 	portRaw16 = uint16(portRaw64)
 	port = (*sip.Port)(&portRaw16)
 
@@ -1444,6 +1484,218 @@ func parseRecordRouteHeader(headerName string, headerText string) (headers []sip
 	return []sip.Header{&routeHeader}, nil
 }
 
+// Parse Authorization or Proxy-Authorization header into a header per credentials.
+func parseAuthorization(headerName string, headerText string) (headers []sip.Header, err error) {
+	values, err := ParseAuthValues(headerText)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range values {
+		if headerName == "proxy-authorization" {
+			headers = append(headers, &sip.ProxyAuthorizationHeader{AuthValue: value})
+		} else {
+			headers = append(headers, &sip.AuthorizationHeader{AuthValue: value})
+		}
+	}
+
+	return headers, nil
+}
+
+// Parse WWW-Authenticate or Proxy-Authenticate header into a header per challenge.
+func parseAuthenticate(headerName string, headerText string) (headers []sip.Header, err error) {
+	values, err := ParseAuthValues(headerText)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range values {
+		if headerName == "proxy-authenticate" {
+			headers = append(headers, &sip.ProxyAuthenticateHeader{AuthValue: value})
+		} else {
+			headers = append(headers, &sip.WWWAuthenticateHeader{AuthValue: value})
+		}
+	}
+
+	return headers, nil
+}
+
+func parseAuthenticationInfo(headerName string, headerText string) (headers []sip.Header, err error) {
+	params, err := ParseAuthParams(headerText)
+	if err != nil {
+		return nil, err
+	}
+
+	return []sip.Header{&sip.AuthenticationInfoHeader{Params: params}}, nil
+}
+
+// ParseAuthValues parses comma separated challenges or credentials - RFC 7235 - 2.1,
+// like `Digest realm="a, b", nonce="1", Basic realm="c"`.
+func ParseAuthValues(text string) ([]sip.AuthValue, error) {
+	values := make([]sip.AuthValue, 0)
+	pos := skipAuthSeparators(text, 0)
+	for pos < len(text) {
+		start := pos
+		pos = scanAuthToken(text, pos)
+		if pos == start {
+			return nil, fmt.Errorf("expected auth scheme at %d: %s", start, text)
+		}
+		value := sip.AuthValue{Scheme: text[start:pos]}
+		pos = skipAuthWs(text, pos)
+
+		if pos < len(text) && text[pos] != ',' && !isAuthParamStart(text, pos) {
+			// token68 form, like Basic credentials
+			start = pos
+			for pos < len(text) && text[pos] != ',' && strings.IndexByte(authWs, text[pos]) < 0 {
+				pos++
+			}
+			value.Token = text[start:pos]
+			pos = skipAuthWs(text, pos)
+		} else {
+			for pos < len(text) && isAuthParamStart(text, pos) {
+				var param sip.AuthParam
+				var err error
+				if param, pos, err = parseAuthParam(text, pos); err != nil {
+					return nil, err
+				}
+				value.Params = append(value.Params, param)
+
+				pos = skipAuthWs(text, pos)
+				if pos < len(text) && text[pos] != ',' {
+					return nil, fmt.Errorf("unexpected char '%c' at %d: %s", text[pos], pos, text)
+				}
+				// the next item is either a parameter or the next challenge
+				next := skipAuthSeparators(text, pos)
+				if next < len(text) && !isAuthParamStart(text, next) {
+					break
+				}
+				pos = next
+			}
+		}
+
+		if pos < len(text) && text[pos] != ',' {
+			return nil, fmt.Errorf("unexpected char '%c' at %d: %s", text[pos], pos, text)
+		}
+		values = append(values, value)
+		pos = skipAuthSeparators(text, pos)
+	}
+
+	return values, nil
+}
+
+// ParseAuthParams parses comma separated auth params, like Authentication-Info value - RFC 3261 - 20.6.
+func ParseAuthParams(text string) ([]sip.AuthParam, error) {
+	params := make([]sip.AuthParam, 0)
+	pos := skipAuthSeparators(text, 0)
+	for pos < len(text) {
+		var param sip.AuthParam
+		var err error
+		if param, pos, err = parseAuthParam(text, pos); err != nil {
+			return nil, err
+		}
+		params = append(params, param)
+
+		pos = skipAuthWs(text, pos)
+		if pos < len(text) && text[pos] != ',' {
+			return nil, fmt.Errorf("unexpected char '%c' at %d: %s", text[pos], pos, text)
+		}
+		pos = skipAuthSeparators(text, pos)
+	}
+
+	return params, nil
+}
+
+func parseAuthParam(text string, pos int) (sip.AuthParam, int, error) {
+	var param sip.AuthParam
+
+	start := pos
+	pos = scanAuthToken(text, pos)
+	if pos == start {
+		return param, pos, fmt.Errorf("expected auth param name at %d: %s", start, text)
+	}
+	param.Name = text[start:pos]
+
+	pos = skipAuthWs(text, pos)
+	if pos >= len(text) || text[pos] != '=' {
+		return param, pos, fmt.Errorf("expected '=' after auth param '%s': %s", param.Name, text)
+	}
+	pos = skipAuthWs(text, pos+1)
+
+	if pos < len(text) && text[pos] == '"' {
+		var buffer bytes.Buffer
+		for pos++; ; pos++ {
+			if pos >= len(text) {
+				return param, pos, fmt.Errorf("unterminated quoted string of auth param '%s': %s", param.Name, text)
+			}
+			if text[pos] == '\\' && pos+1 < len(text) {
+				pos++
+			} else if text[pos] == '"' {
+				break
+			}
+			buffer.WriteByte(text[pos])
+		}
+		param.Value = buffer.String()
+		param.Quoted = true
+
+		return param, pos + 1, nil
+	}
+
+	start = pos
+	for pos < len(text) && text[pos] != ',' && text[pos] != '"' && strings.IndexByte(authWs, text[pos]) < 0 {
+		pos++
+	}
+	param.Value = text[start:pos]
+
+	return param, pos, nil
+}
+
+// isAuthParamStart checks that text at the position looks like 'name=value' rather than scheme or token68.
+func isAuthParamStart(text string, pos int) bool {
+	end := scanAuthToken(text, pos)
+	if end == pos {
+		return false
+	}
+	end = skipAuthWs(text, end)
+	if end >= len(text) || text[end] != '=' {
+		return false
+	}
+	// token68 may end with '=' padding
+	end = skipAuthWs(text, end+1)
+
+	return end < len(text) && text[end] != ',' && text[end] != '='
+}
+
+func scanAuthToken(text string, pos int) int {
+	for pos < len(text) && isTokenChar(text[pos]) {
+		pos++
+	}
+
+	return pos
+}
+
+func skipAuthWs(text string, pos int) int {
+	for pos < len(text) && strings.IndexByte(authWs, text[pos]) >= 0 {
+		pos++
+	}
+
+	return pos
+}
+
+// skipAuthSeparators skips whitespaces and empty list elements.
+func skipAuthSeparators(text string, pos int) int {
+	for pos < len(text) && (text[pos] == ',' || strings.IndexByte(authWs, text[pos]) >= 0) {
+		pos++
+	}
+
+	return pos
+}
+
+// isTokenChar checks token char - RFC 3261 - 25.1.
+func isTokenChar(c uint8) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("-.!%*_+`'~", c) >= 0
+}
+
 // Extract the next logical header line from the message.
 // This may run over several actual lines; lines that start with whitespace are
 // a continuation of the previous line.
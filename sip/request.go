@@ -3,6 +3,7 @@ package sip
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 
@@ -160,10 +161,6 @@ func (req *request) Transport() string {
 		}
 	}
 
-	if tp == "UDP" && len(req.String()) > int(MTU)-200 {
-		tp = "TCP"
-	}
-
 	return tp
 }
 
@@ -194,7 +191,8 @@ func (req *request) Source() string {
 
 	if viaHop.Params != nil {
 		if received, ok := viaHop.Params.Get("received"); ok && received.String() != "" {
-			host = received.String()
+			// IPv6 received may be enclosed in brackets - RFC 5118 - 4.5.
+			host = strings.Trim(received.String(), "[]")
 		}
 		if rport, ok := viaHop.Params.Get("rport"); ok && rport != nil && rport.String() != "" {
 			if p, err := strconv.Atoi(rport.String()); err == nil {
@@ -203,7 +201,7 @@ func (req *request) Source() string {
 		}
 	}
 
-	return fmt.Sprintf("%v:%v", host, port)
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
 }
 
 func (req *request) Destination() string {
@@ -237,7 +235,7 @@ func (req *request) Destination() string {
 		port = DefaultPort(req.Transport())
 	}
 
-	return fmt.Sprintf("%v:%v", host, port)
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
 }
 
 // NewAckForInvite creates ACK request for 2xx INVITE
@@ -349,6 +347,7 @@ func cloneRequest(req Request, id MessageID, fields log.Fields) Request {
 	)
 	newReq.SetSource(req.Source())
 	newReq.SetDestination(req.Destination())
+	copyConnection(req, newReq)
 
 	return newReq
 }
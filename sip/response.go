@@ -3,7 +3,9 @@ package sip
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"strconv"
+	"strings"
 
 	"github.com/ygj201011/gosip/log"
 )
@@ -210,7 +212,8 @@ func (res *response) Destination() string {
 
 	if viaHop.Params != nil {
 		if received, ok := viaHop.Params.Get("received"); ok && received.String() != "" {
-			host = received.String()
+			// IPv6 received may be enclosed in brackets - RFC 5118 - 4.5.
+			host = strings.Trim(received.String(), "[]")
 		}
 		if rport, ok := viaHop.Params.Get("rport"); ok && rport != nil && rport.String() != "" {
 			if p, err := strconv.Atoi(rport.String()); err == nil {
@@ -219,7 +222,7 @@ func (res *response) Destination() string {
 		}
 	}
 
-	return fmt.Sprintf("%v:%v", host, port)
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
 }
 
 // RFC 3261 - 8.2.6
@@ -276,6 +279,7 @@ func cloneResponse(res Response, id MessageID, fields log.Fields) Response {
 	newRes.SetPrevious(res.Previous())
 	newRes.SetSource(res.Source())
 	newRes.SetDestination(res.Destination())
+	copyConnection(res, newRes)
 
 	return newRes
 }
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/ygj201011/gosip/log"
 	"github.com/ygj201011/gosip/sip"
@@ -100,12 +101,14 @@ func (conn *MockConn) RemoteAddr() net.Addr {
 }
 
 type MockTransportLayer struct {
-	InMsgs     chan sip.Message
-	InErrs     chan error
-	OutMsgs    chan sip.Message
-	cancelOnce sync.Once
-	done       chan struct{}
-	logger     log.Logger
+	InMsgs  chan sip.Message
+	InErrs  chan error
+	OutMsgs chan sip.Message
+	// KeepAliveFunc answers on keep-alives, they succeed if it is nil
+	KeepAliveFunc func(network, addr string) error
+	cancelOnce    sync.Once
+	done          chan struct{}
+	logger        log.Logger
 }
 
 func NewMockTransportLayer() *MockTransportLayer {
@@ -134,6 +137,22 @@ func (tpl *MockTransportLayer) Listen(network string, addr string, options ...tr
 	return nil
 }
 
+func (tpl *MockTransportLayer) ListenOn(network string, listener net.Listener, options ...transport.ListenOption) error {
+	return nil
+}
+
+func (tpl *MockTransportLayer) ListenPacket(network string, conn net.PacketConn, options ...transport.ListenOption) error {
+	return nil
+}
+
+func (tpl *MockTransportLayer) Unlisten(network string, addr string, options ...transport.UnlistenOption) error {
+	return nil
+}
+
+func (tpl *MockTransportLayer) ListenAddrs(network string) []net.Addr {
+	return nil
+}
+
 func (tpl *MockTransportLayer) Send(msg sip.Message) error {
 	select {
 	case <-tpl.done:
@@ -151,6 +170,26 @@ func (tpl *MockTransportLayer) IsStreamed(network string) bool {
 	return true
 }
 
+func (tpl *MockTransportLayer) ObservedAddr(network string) (string, bool) {
+	return "", false
+}
+
+func (tpl *MockTransportLayer) FlowToken(msg sip.Message) (string, error) {
+	return "", transport.UnsupportedProtocolError("flows are not supported by mock")
+}
+
+func (tpl *MockTransportLayer) Flow(token string) (transport.Destination, error) {
+	return transport.Destination{}, transport.InvalidFlowTokenError(token)
+}
+
+func (tpl *MockTransportLayer) KeepAlive(network string, addr string, timeout time.Duration) error {
+	if tpl.KeepAliveFunc == nil {
+		return nil
+	}
+
+	return tpl.KeepAliveFunc(network, addr)
+}
+
 func (tpl *MockTransportLayer) String() string {
 	if tpl == nil {
 		return "<nil>"
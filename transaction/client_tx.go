@@ -34,7 +34,7 @@ type clientTx struct {
 }
 
 func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (ClientTx, error) {
-	origin = prepareClientRequest(origin)
+	origin = PrepareClientRequest(origin)
 	key, err := MakeClientTxKey(origin)
 	if err != nil {
 		return nil, err
@@ -64,7 +64,9 @@ func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (Clie
 	return tx, nil
 }
 
-func prepareClientRequest(origin sip.Request) sip.Request {
+// PrepareClientRequest sets branch of the top Via the client transaction is matched by,
+// Via is added if the request has no one.
+func PrepareClientRequest(origin sip.Request) sip.Request {
 	if viaHop, ok := origin.ViaHop(); ok {
 		if viaHop.Params == nil {
 			viaHop.Params = sip.NewParams()
@@ -105,6 +107,12 @@ func (tx *clientTx) Init() error {
 		return err
 	}
 
+	// RFC 3261 - 18.1.1. Transport layer can send large request over TCP or fall back to UDP,
+	// so timers are chosen by the transport of the sent Via.
+	if viaHop, ok := tx.Origin().ViaHop(); ok {
+		tx.reliable = tx.tpl.IsReliable(viaHop.Transport)
+	}
+
 	if tx.reliable {
 		tx.mu.Lock()
 		tx.timer_d_time = 0
@@ -238,6 +246,8 @@ func (tx *clientTx) cancel() {
 	cancelRequest := sip.NewCancelRequest("", tx.Origin(), log.Fields{
 		"sent_at": time.Now(),
 	})
+	// CANCEL goes to the same address as the original request, which can be a flow - RFC 3261 - 9.1
+	cancelRequest.SetDestination(tx.Origin().Destination())
 	if err := tx.tpl.Send(cancelRequest); err != nil {
 		tx.Log().WithFields(map[string]interface{}{
 			"invite_request":  tx.Origin().Short(),
@@ -265,6 +275,8 @@ func (tx *clientTx) ack() {
 	ack := sip.NewAckRequest("", tx.Origin(), lastResp, "", log.Fields{
 		"sent_at": time.Now(),
 	})
+	// ACK goes to the same address as the INVITE, which can be a flow - RFC 3261 - 17.1.1.3
+	ack.SetDestination(tx.Origin().Destination())
 	err := tx.tpl.Send(ack)
 	if err != nil {
 		tx.Log().WithFields(log.Fields{
@@ -0,0 +1,438 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/transport"
+)
+
+// TxAttempt is a client transaction sent to one of the destinations - RFC 3263 - 4.3.
+type TxAttempt struct {
+	Destination transport.Destination
+	Key         TxKey
+	StartedAt   time.Time
+	Duration    time.Duration
+	// Response is the final response of the attempt.
+	Response sip.Response
+	Err      error
+}
+
+func (attempt TxAttempt) String() string {
+	result := "pending"
+	switch {
+	case attempt.Err != nil:
+		result = attempt.Err.Error()
+	case attempt.Response != nil:
+		result = fmt.Sprintf("%d %s", attempt.Response.StatusCode(), attempt.Response.Reason())
+	}
+
+	return fmt.Sprintf("%s (%s): %s", attempt.Destination, attempt.Duration, result)
+}
+
+// TxFailoverError is returned when all destinations of the request failed,
+// Err is the error of the last attempt.
+type TxFailoverError struct {
+	Err      error
+	Attempts []TxAttempt
+	TxKey    TxKey
+	TxPtr    string
+}
+
+func (err *TxFailoverError) Unwrap() error { return err.Err }
+func (err *TxFailoverError) Terminated() bool {
+	var txErr TxError
+	return errors.As(err.Err, &txErr) && txErr.Terminated()
+}
+func (err *TxFailoverError) Timeout() bool {
+	var txErr TxError
+	return errors.As(err.Err, &txErr) && txErr.Timeout()
+}
+func (err *TxFailoverError) Transport() bool {
+	var txErr TxError
+	return errors.As(err.Err, &txErr) && txErr.Transport()
+}
+func (err *TxFailoverError) Key() TxKey { return err.TxKey }
+func (err *TxFailoverError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	fields := log.Fields{
+		"transaction_key": "???",
+		"transaction_ptr": "???",
+	}
+
+	if err.TxKey != "" {
+		fields["transaction_key"] = err.TxKey
+	}
+	if err.TxPtr != "" {
+		fields["transaction_ptr"] = err.TxPtr
+	}
+
+	attempts := make([]string, 0, len(err.Attempts))
+	for _, attempt := range err.Attempts {
+		attempts = append(attempts, attempt.String())
+	}
+
+	return fmt.Sprintf(
+		"transaction.TxFailoverError<%s>: %d attempts failed: %s",
+		fields,
+		len(err.Attempts),
+		strings.Join(attempts, "; "),
+	)
+}
+
+// FailoverTx is a client transaction that tries destinations in order,
+// every attempt is a new client transaction with a new branch - RFC 3263 - 4.3.
+type FailoverTx interface {
+	ClientTx
+	// Attempts returns trace of the started attempts.
+	Attempts() []TxAttempt
+}
+
+type failoverTx struct {
+	txl    *layer
+	origin sip.Request
+	dests  []transport.Destination
+
+	responses chan sip.Response
+	errs      chan error
+	done      chan bool
+
+	tx       ClientTx
+	attempts []TxAttempt
+	canceled bool
+	mu       sync.RWMutex
+
+	log log.Logger
+}
+
+func newFailoverTx(origin sip.Request, dests []transport.Destination, txl *layer, logger log.Logger) *failoverTx {
+	tx := &failoverTx{
+		txl:       txl,
+		origin:    PrepareClientRequest(origin),
+		dests:     dests,
+		responses: make(chan sip.Response, 64),
+		errs:      make(chan error, 64),
+		done:      make(chan bool),
+		attempts:  make([]TxAttempt, 0, len(dests)),
+	}
+	tx.log = logger.
+		WithPrefix("transaction.FailoverTx").
+		WithFields(
+			origin.Fields().WithFields(log.Fields{
+				"failover_transaction_ptr": fmt.Sprintf("%p", tx),
+			}),
+		)
+
+	return tx
+}
+
+func (tx *failoverTx) String() string {
+	if tx == nil {
+		return "<nil>"
+	}
+
+	fields := tx.Log().Fields().WithFields(log.Fields{
+		"key": tx.Key(),
+	})
+
+	return fmt.Sprintf("%s<%s>", tx.Log().Prefix(), fields)
+}
+
+func (tx *failoverTx) Log() log.Logger {
+	return tx.log
+}
+
+// Init starts the first destination that accepts the request.
+func (tx *failoverTx) Init() error {
+	if err := tx.next(); err != nil {
+		return err
+	}
+
+	go tx.serve()
+
+	return nil
+}
+
+// Key returns key of the current attempt.
+func (tx *failoverTx) Key() TxKey {
+	if current := tx.current(); current != nil {
+		return current.Key()
+	}
+
+	return ""
+}
+
+// Origin returns request of the current attempt.
+func (tx *failoverTx) Origin() sip.Request {
+	if current := tx.current(); current != nil {
+		return current.Origin()
+	}
+
+	return tx.origin
+}
+
+func (tx *failoverTx) Receive(msg sip.Message) error {
+	current := tx.current()
+	if current == nil {
+		return fmt.Errorf("%s has no started attempts", tx)
+	}
+
+	return current.Receive(msg)
+}
+
+func (tx *failoverTx) Transport() sip.Transport {
+	return tx.txl.tpl
+}
+
+func (tx *failoverTx) Responses() <-chan sip.Response {
+	return tx.responses
+}
+
+func (tx *failoverTx) Errors() <-chan error {
+	return tx.errs
+}
+
+func (tx *failoverTx) Done() <-chan bool {
+	return tx.done
+}
+
+// Cancel cancels the current attempt and stops failover.
+func (tx *failoverTx) Cancel() error {
+	tx.mu.Lock()
+	tx.canceled = true
+	current := tx.tx
+	tx.mu.Unlock()
+
+	if current == nil {
+		return nil
+	}
+
+	return current.Cancel()
+}
+
+func (tx *failoverTx) Terminate() {
+	tx.mu.Lock()
+	tx.canceled = true
+	current := tx.tx
+	tx.mu.Unlock()
+
+	if current != nil {
+		current.Terminate()
+	}
+}
+
+func (tx *failoverTx) Attempts() []TxAttempt {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	attempts := make([]TxAttempt, len(tx.attempts))
+	copy(attempts, tx.attempts)
+
+	return attempts
+}
+
+func (tx *failoverTx) current() ClientTx {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	return tx.tx
+}
+
+// hasNext checks that the next destination can be tried.
+func (tx *failoverTx) hasNext() bool {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	return !tx.canceled && len(tx.attempts) < len(tx.dests)
+}
+
+// next starts client transaction to the next destination,
+// the destinations that fail to send are skipped.
+func (tx *failoverTx) next() error {
+	for {
+		tx.mu.Lock()
+		if tx.canceled || len(tx.attempts) >= len(tx.dests) {
+			tx.mu.Unlock()
+
+			return tx.failure()
+		}
+
+		i := len(tx.attempts)
+		dest := tx.dests[i]
+		req := tx.origin
+		if i > 0 {
+			// RFC 3263 - 4.3. New request identical to the previous but with a new branch.
+			req = tx.origin.Clone().(sip.Request)
+			if viaHop, ok := req.ViaHop(); ok {
+				viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+			}
+		}
+		req.SetDestination(dest.Addr())
+		if viaHop, ok := req.ViaHop(); ok {
+			viaHop.Transport = dest.Transport
+		}
+
+		key, _ := MakeClientTxKey(req)
+		tx.attempts = append(tx.attempts, TxAttempt{
+			Destination: dest,
+			Key:         key,
+			StartedAt:   time.Now(),
+		})
+		tx.mu.Unlock()
+
+		tx.Log().Debugf("attempt %d: sending %s to %s", i+1, req.Short(), dest)
+
+		current, err := tx.txl.request(req)
+		if err != nil {
+			tx.finishAttempt(nil, &TxTransportError{
+				fmt.Errorf("transaction failed to send %s: %w", req.Short(), err),
+				key,
+				fmt.Sprintf("%p", tx),
+			})
+
+			select {
+			case <-tx.txl.canceled:
+				tx.mu.Lock()
+				tx.canceled = true
+				tx.mu.Unlock()
+			default:
+			}
+
+			continue
+		}
+
+		tx.mu.Lock()
+		tx.tx = current
+		tx.mu.Unlock()
+
+		return nil
+	}
+}
+
+func (tx *failoverTx) finishAttempt(res sip.Response, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	attempt := &tx.attempts[len(tx.attempts)-1]
+	if attempt.Response != nil || attempt.Err != nil {
+		return
+	}
+
+	attempt.Duration = time.Since(attempt.StartedAt)
+	attempt.Response = res
+	attempt.Err = err
+
+	tx.Log().Debugf("attempt %d finished: %s", len(tx.attempts), attempt)
+}
+
+func (tx *failoverTx) failure() error {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	var err error
+	var key TxKey
+	if len(tx.attempts) > 0 {
+		err = tx.attempts[len(tx.attempts)-1].Err
+		key = tx.attempts[len(tx.attempts)-1].Key
+	}
+	if err == nil {
+		err = fmt.Errorf("transaction canceled")
+	}
+
+	attempts := make([]TxAttempt, len(tx.attempts))
+	copy(attempts, tx.attempts)
+
+	return &TxFailoverError{
+		Err:      err,
+		Attempts: attempts,
+		TxKey:    key,
+		TxPtr:    fmt.Sprintf("%p", tx),
+	}
+}
+
+func (tx *failoverTx) serve() {
+	defer func() {
+		close(tx.done)
+		close(tx.responses)
+		close(tx.errs)
+	}()
+
+	for {
+		current := tx.current()
+		if !tx.serveAttempt(current) {
+			return
+		}
+
+		if err := tx.next(); err != nil {
+			tx.Log().Debug(err)
+
+			tx.passUpErr(err)
+
+			return
+		}
+	}
+}
+
+// serveAttempt passes up responses and errors of the attempt,
+// returns true if the next destination should be tried.
+func (tx *failoverTx) serveAttempt(current ClientTx) bool {
+	responses := current.Responses()
+	errs := current.Errors()
+	for responses != nil || errs != nil {
+		select {
+		case res, ok := <-responses:
+			if !ok {
+				responses = nil
+				continue
+			}
+
+			if !res.IsProvisional() {
+				// RFC 3263 - 4.3. 503 means that the next destination should be tried.
+				if res.StatusCode() == 503 && tx.hasNext() {
+					tx.finishAttempt(res, nil)
+					return true
+				}
+				tx.finishAttempt(res, nil)
+			}
+
+			select {
+			case <-tx.txl.canceled:
+			case tx.responses <- res:
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			tx.finishAttempt(nil, err)
+
+			var txErr TxError
+			if errors.As(err, &txErr) && (txErr.Timeout() || txErr.Transport()) {
+				if tx.hasNext() {
+					return true
+				}
+				err = tx.failure()
+			}
+
+			tx.passUpErr(err)
+		}
+	}
+
+	return false
+}
+
+func (tx *failoverTx) passUpErr(err error) {
+	select {
+	case <-tx.txl.canceled:
+	case tx.errs <- err:
+	}
+}
@@ -0,0 +1,150 @@
+package transaction_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/timing"
+	"github.com/ygj201011/gosip/transaction"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("FailoverTx", func() {
+	var (
+		tpl  *testutils.MockTransportLayer
+		txl  transaction.Layer
+		sent chan sip.Request
+		req  sip.Request
+	)
+
+	dests := []transport.Destination{
+		{Transport: "UDP", Host: "10.0.0.1", Port: 5060},
+		{Transport: "TCP", Host: "10.0.0.2", Port: 5070},
+	}
+
+	nextRequest := func() sip.Request {
+		var msg sip.Request
+		Eventually(sent, 3*time.Second).Should(Receive(&msg))
+		return msg
+	}
+	respond := func(req sip.Request, code sip.StatusCode, reason string) {
+		// client transaction is stored after sending
+		time.Sleep(10 * time.Millisecond)
+		tpl.InMsgs <- sip.NewResponseFromRequest("", req, code, reason, "")
+	}
+	branch := func(req sip.Request) string {
+		viaHop, ok := req.ViaHop()
+		Expect(ok).To(BeTrue())
+		value, ok := viaHop.Params.Get("branch")
+		Expect(ok).To(BeTrue())
+		return value.String()
+	}
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger())
+		sent = make(chan sip.Request, 16)
+		go func() {
+			for msg := range tpl.OutMsgs {
+				if req, ok := msg.(sip.Request); ok {
+					sent <- req
+				}
+			}
+		}()
+
+		req = testutils.Request([]string{
+			"OPTIONS sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=1",
+			"To: <sip:bob@example.com>",
+			"Call-ID: failover",
+			"CSeq: 1 OPTIONS",
+			"",
+			"",
+		})
+	})
+	AfterEach(func(done Done) {
+		txl.Cancel()
+		<-txl.Done()
+		tpl.Cancel()
+		close(done)
+	}, 3)
+
+	It("should try the next destination on 503 response", func() {
+		tx, err := txl.Request(req, dests...)
+		Expect(err).ToNot(HaveOccurred())
+
+		first := nextRequest()
+		Expect(first.Destination()).To(Equal("10.0.0.1:5060"))
+		respond(first, 503, "Service Unavailable")
+
+		second := nextRequest()
+		Expect(second.Destination()).To(Equal("10.0.0.2:5070"))
+		Expect(second.Transport()).To(Equal("TCP"))
+		Expect(branch(second)).ToNot(Equal(branch(first)))
+		respond(second, 200, "OK")
+
+		var res sip.Response
+		Eventually(tx.Responses(), 3*time.Second).Should(Receive(&res))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+
+		attempts := tx.(transaction.FailoverTx).Attempts()
+		Expect(attempts).To(HaveLen(2))
+		Expect(attempts[0].Destination).To(Equal(dests[0]))
+		Expect(attempts[0].Response.StatusCode()).To(Equal(sip.StatusCode(503)))
+		Expect(attempts[1].Destination).To(Equal(dests[1]))
+		Expect(attempts[1].Response.StatusCode()).To(Equal(sip.StatusCode(200)))
+	})
+
+	It("should pass up 503 response of the last destination", func() {
+		tx, err := txl.Request(req, dests...)
+		Expect(err).ToNot(HaveOccurred())
+
+		respond(nextRequest(), 503, "Service Unavailable")
+		respond(nextRequest(), 503, "Service Unavailable")
+
+		var res sip.Response
+		Eventually(tx.Responses(), 3*time.Second).Should(Receive(&res))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(503)))
+		Expect(tx.(transaction.FailoverTx).Attempts()).To(HaveLen(2))
+	})
+
+	Context("with mocked timers", func() {
+		BeforeEach(func() {
+			timing.MockMode = true
+		})
+		AfterEach(func() {
+			timing.MockMode = false
+		})
+
+		It("should report all attempts when every destination timed out", func() {
+			tx, err := txl.Request(req, dests...)
+			Expect(err).ToNot(HaveOccurred())
+
+			first := nextRequest()
+			time.Sleep(10 * time.Millisecond)
+			timing.Elapse(transaction.Timer_F)
+
+			second := nextRequest()
+			Expect(second.Destination()).To(Equal("10.0.0.2:5070"))
+			Expect(branch(second)).ToNot(Equal(branch(first)))
+			time.Sleep(10 * time.Millisecond)
+			timing.Elapse(transaction.Timer_F)
+
+			var err2 error
+			Eventually(tx.Errors(), 3*time.Second).Should(Receive(&err2))
+
+			var failoverErr *transaction.TxFailoverError
+			Expect(errors.As(err2, &failoverErr)).To(BeTrue())
+			Expect(failoverErr.Timeout()).To(BeTrue())
+			Expect(failoverErr.Attempts).To(HaveLen(2))
+			Expect(failoverErr.Error()).To(ContainSubstring("UDP/10.0.0.1:5060"))
+			Expect(failoverErr.Error()).To(ContainSubstring("TCP/10.0.0.2:5070"))
+		})
+	})
+})
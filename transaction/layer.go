@@ -6,6 +6,7 @@ import (
 
 	"github.com/ygj201011/gosip/log"
 	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/transport"
 )
 
 // Layer serves client and server transactions.
@@ -13,7 +14,9 @@ type Layer interface {
 	Cancel()
 	Done() <-chan struct{}
 	String() string
-	Request(req sip.Request) (sip.ClientTransaction, error)
+	// Request starts client transaction, when destinations are given they are tried in order
+	// on timeout, transport error or 503 response and the transaction is FailoverTx.
+	Request(req sip.Request, dests ...transport.Destination) (sip.ClientTransaction, error)
 	Respond(res sip.Response) (sip.ServerTransaction, error)
 	Transport() sip.Transport
 	// Requests returns channel with new incoming server transactions.
@@ -118,7 +121,7 @@ func (txl *layer) Transport() sip.Transport {
 	return txl.tpl
 }
 
-func (txl *layer) Request(req sip.Request) (sip.ClientTransaction, error) {
+func (txl *layer) Request(req sip.Request, dests ...transport.Destination) (sip.ClientTransaction, error) {
 	select {
 	case <-txl.canceled:
 		return nil, fmt.Errorf("transaction layer is canceled")
@@ -129,6 +132,19 @@ func (txl *layer) Request(req sip.Request) (sip.ClientTransaction, error) {
 		return nil, fmt.Errorf("ACK request must be sent directly through transport")
 	}
 
+	if len(dests) == 0 {
+		return txl.request(req)
+	}
+
+	tx := newFailoverTx(req, dests, txl, txl.Log())
+	if err := tx.Init(); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (txl *layer) request(req sip.Request) (ClientTx, error) {
 	tx, err := NewClientTx(req, txl.tpl, txl.Log())
 	if err != nil {
 		return nil, err
@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ygj201011/gosip/sip"
+)
+
+// aliasProtocol reuses inbound connections for requests to the Via sent-by of the peer - RFC 5923.
+type aliasProtocol interface {
+	// addAlias indexes the connection the request was received over by its Via sent-by.
+	addAlias(req sip.Request) bool
+}
+
+// connectionAliases maps sent-by addresses to the keys of inbound connections.
+type connectionAliases struct {
+	keys map[string]ConnectionKey
+	mu   sync.RWMutex
+}
+
+func newConnectionAliases() *connectionAliases {
+	return &connectionAliases{
+		keys: make(map[string]ConnectionKey),
+	}
+}
+
+func (aliases *connectionAliases) put(addr string, key ConnectionKey) {
+	aliases.mu.Lock()
+	aliases.keys[strings.ToLower(addr)] = key
+	aliases.mu.Unlock()
+}
+
+func (aliases *connectionAliases) get(addr string) (ConnectionKey, bool) {
+	aliases.mu.RLock()
+	key, ok := aliases.keys[strings.ToLower(addr)]
+	aliases.mu.RUnlock()
+
+	return key, ok
+}
+
+func (aliases *connectionAliases) drop(addr string) {
+	aliases.mu.Lock()
+	delete(aliases.keys, strings.ToLower(addr))
+	aliases.mu.Unlock()
+}
+
+// addAlias indexes the inbound connection by the Via sent-by if the request has 'alias' parameter - RFC 5923 - 5.
+// TCP alias is accepted only when the sent-by host is the source IP of the connection,
+// TLS alias is verified against the peer certificate when the connection is reused.
+func (p *tcpProtocol) addAlias(req sip.Request) bool {
+	viaHop, ok := req.ViaHop()
+	if !ok || viaHop.Params == nil || !viaHop.Params.Has("alias") {
+		return false
+	}
+
+	srcHost, _, err := net.SplitHostPort(req.Source())
+	if err != nil {
+		return false
+	}
+	if p.network == "tcp" {
+		if ip := net.ParseIP(viaHop.Host); ip == nil || !ip.Equal(net.ParseIP(srcHost)) {
+			p.Log().Debugf("ignore alias of %s: sent-by host %s differs from source %s", req.Short(), viaHop.Host, srcHost)
+
+			return false
+		}
+	}
+
+	port := sip.DefaultPort(p.Network())
+	if viaHop.Port != nil {
+		port = *viaHop.Port
+	}
+	sentBy := net.JoinHostPort(viaHop.Host, strconv.Itoa(int(port)))
+	key := ConnectionKey(p.network + ":" + req.Source())
+	if _, err := p.connections.Get(key); err != nil {
+		return false
+	}
+
+	p.aliases.put(sentBy, key)
+
+	p.Log().Debugf("%s connection %s aliased by %s", p.Network(), key, sentBy)
+
+	return true
+}
+
+// aliasConnection returns the inbound connection aliased by the remote address
+// or by the domain of the next hop with the remote port.
+func (p *tcpProtocol) aliasConnection(raddr *net.TCPAddr, domain string) (Connection, bool) {
+	addrs := []string{raddr.String()}
+	if domain != "" && net.ParseIP(domain) == nil {
+		addrs = append(addrs, net.JoinHostPort(domain, strconv.Itoa(raddr.Port)))
+	}
+
+	for _, addr := range addrs {
+		key, ok := p.aliases.get(addr)
+		if !ok {
+			continue
+		}
+
+		conn, err := p.connections.Get(key)
+		if err != nil {
+			p.aliases.drop(addr)
+			continue
+		}
+
+		if p.network == "tls" && !verifyAliasCertificate(conn, domain) {
+			p.Log().Debugf("%s connection %s is not reused for %s: peer certificate does not match", p.Network(), key, domain)
+			continue
+		}
+
+		return conn, true
+	}
+
+	return nil, false
+}
+
+// verifyAliasCertificate checks that the TLS peer presented certificate for the target domain - RFC 5923 - 6.
+func verifyAliasCertificate(conn Connection, domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	c, ok := conn.(*connection)
+	if !ok {
+		return false
+	}
+	tlsConn, ok := c.baseConn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return false
+	}
+
+	return certs[0].VerifyHostname(domain) == nil
+}
+
+// nextHopDomain returns host of the top Route or the Request-URI of the request.
+func nextHopDomain(msg sip.Message) string {
+	req, ok := msg.(sip.Request)
+	if !ok {
+		return ""
+	}
+
+	uri := req.Recipient()
+	if hdrs := req.GetHeaders("Route"); len(hdrs) > 0 {
+		if route, ok := hdrs[0].(*sip.RouteHeader); ok && len(route.Addresses) > 0 {
+			uri = route.Addresses[0]
+		}
+	}
+	if sipUri, ok := uri.(*sip.SipUri); ok {
+		return sipUri.FHost
+	}
+
+	return ""
+}
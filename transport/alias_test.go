@@ -0,0 +1,124 @@
+package transport_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("TransportLayer with connection reuse", func() {
+	var (
+		tpl  transport.Layer
+		peer net.Conn
+	)
+	logger := testutils.NewLogrusLogger()
+	layerAddr := "127.0.0.1:5094"
+	// nobody listens on the sent-by port of the peer
+	peerSentBy := "127.0.0.1:5096"
+
+	request := func(via string) string {
+		return strings.Join([]string{
+			"OPTIONS sip:bob@" + layerAddr + ";transport=tcp SIP/2.0",
+			"Via: " + via,
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: alias",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}, "\r\n")
+	}
+	outRequest := func() sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:alice@" + peerSentBy + ";transport=tcp SIP/2.0",
+			"Via: SIP/2.0/TCP 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:bob@far-far-away.com>;tag=2",
+			"To: <sip:alice@wonderland.com>",
+			"Call-ID: alias-back",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(peerSentBy)
+		return req
+	}
+	receive := func() sip.Message {
+		var msg sip.Message
+		Eventually(tpl.Messages(), 3*time.Second).Should(Receive(&msg))
+		return msg
+	}
+
+	BeforeEach(func() {
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger,
+			transport.WithConnectionReuse(true))
+		Expect(tpl.Listen("tcp", layerAddr)).To(Succeed())
+
+		var err error
+		peer, err = net.Dial("tcp", layerAddr)
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		peer.Close()
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	It("should reuse inbound connection aliased by sent-by", func(done Done) {
+		_, err := peer.Write([]byte(request("SIP/2.0/TCP " + peerSentBy + ";branch=" + sip.GenerateBranch() + ";alias")))
+		Expect(err).ToNot(HaveOccurred())
+		receive()
+
+		Expect(tpl.Send(outRequest())).To(Succeed())
+
+		Expect(peer.SetReadDeadline(time.Now().Add(3 * time.Second))).To(Succeed())
+		line, err := bufio.NewReader(peer).ReadString('\n')
+		Expect(err).ToNot(HaveOccurred())
+		Expect(line).To(HavePrefix("OPTIONS sip:alice@" + peerSentBy))
+		close(done)
+	}, 5)
+
+	It("should not reuse inbound connection without alias", func(done Done) {
+		_, err := peer.Write([]byte(request("SIP/2.0/TCP " + peerSentBy + ";branch=" + sip.GenerateBranch())))
+		Expect(err).ToNot(HaveOccurred())
+		receive()
+
+		Expect(tpl.Send(outRequest())).ToNot(Succeed())
+		close(done)
+	}, 5)
+
+	It("should ignore alias with sent-by host other than the source", func(done Done) {
+		_, err := peer.Write([]byte(request("SIP/2.0/TCP 127.0.0.2:5096;branch=" + sip.GenerateBranch() + ";alias")))
+		Expect(err).ToNot(HaveOccurred())
+		receive()
+
+		req := outRequest()
+		req.SetDestination("127.0.0.2:5096")
+		Expect(tpl.Send(req)).ToNot(Succeed())
+		close(done)
+	}, 5)
+
+	It("should add alias to Via of requests sent over TCP", func(done Done) {
+		server, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer server.Close()
+
+		req := outRequest()
+		req.SetDestination(server.Addr().String())
+		Expect(tpl.Send(req)).To(Succeed())
+
+		viaHop, ok := req.ViaHop()
+		Expect(ok).To(BeTrue())
+		Expect(viaHop.Params.Has("alias")).To(BeTrue())
+		close(done)
+	}, 5)
+})
@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ygj201011/gosip/log"
+)
+
+// certificateReloader serves the certificate of TLS listener,
+// the certificate is reloaded when the watched files are modified.
+type certificateReloader struct {
+	config  TLSConfig
+	cert    *tls.Certificate
+	modTime time.Time
+	mu      sync.RWMutex
+	errs    chan<- error
+	log     log.Logger
+}
+
+func newCertificateReloader(config TLSConfig, errs chan<- error, logger log.Logger) (*certificateReloader, error) {
+	r := &certificateReloader{
+		config: config,
+		errs:   errs,
+		log: logger.WithFields(log.Fields{
+			"certificate_file": config.Cert,
+		}),
+	}
+	r.modTime = r.filesModTime()
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certificateReloader) Log() log.Logger {
+	return r.log
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+func (r *certificateReloader) load() error {
+	cert, err := loadKeyPair(r.config.Cert, r.config.Key, r.config.Pass)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate %s: %w", r.config.Cert, err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	return nil
+}
+
+// matches checks that the certificate is configured for the SNI domain or issued for it.
+func (r *certificateReloader) matches(serverName string) bool {
+	if r.config.Domain != "" && strings.EqualFold(r.config.Domain, serverName) {
+		return true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert.Leaf != nil && r.cert.Leaf.VerifyHostname(serverName) == nil
+}
+
+// loadKeyPair loads the certificate and the key, the encrypted PEM key is decrypted with the password.
+func loadKeyPair(certFile, keyFile, pass string) (tls.Certificate, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	if pass == "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = loadEncryptedKeyPair(certFile, keyFile, pass)
+	}
+	if err != nil {
+		return cert, err
+	}
+	// the leaf matches SNI of the handshakes
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+
+	return cert, err
+}
+
+func loadEncryptedKeyPair(certFile, keyFile, pass string) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("no PEM data in key file %s", keyFile)
+	}
+	// legacy RFC 1423 encryption is the one with the password in PEM headers
+	if x509.IsEncryptedPEMBlock(block) {
+		der, err := x509.DecryptPEMBlock(block, []byte(pass))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("decrypt key file %s: %w", keyFile, err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// certificateSelector serves the certificate of TLS listener by SNI, the first one is the default.
+type certificateSelector []*certificateReloader
+
+func (s certificateSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" {
+		for _, r := range s {
+			if r.matches(hello.ServerName) {
+				return r.GetCertificate(hello)
+			}
+		}
+	}
+
+	return s[0].GetCertificate(hello)
+}
+
+// filesModTime returns the latest modification time of the certificate and key files.
+func (r *certificateReloader) filesModTime() time.Time {
+	var modTime time.Time
+	for _, file := range []string{r.config.Cert, r.config.Key} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime
+}
+
+// watch polls the files until the listener is closed or the protocol is canceled,
+// the current certificate is kept if the reload fails, e.g. while the files are being replaced.
+func (r *certificateReloader) watch(interval time.Duration, stop <-chan struct{}, cancel <-chan struct{}) {
+	r.Log().Debug("begin watch certificate files")
+	defer r.Log().Debug("stop watch certificate files")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+
+		modTime := r.filesModTime()
+		if modTime.Equal(r.modTime) {
+			continue
+		}
+		r.modTime = modTime
+
+		if err := r.load(); err != nil {
+			r.Log().Warnf("reload certificate failed: %s", err)
+
+			select {
+			case <-stop:
+				return
+			case <-cancel:
+				return
+			case r.errs <- err:
+			}
+
+			continue
+		}
+
+		r.Log().Info("certificate reloaded")
+	}
+}
+
+// reportCertificateErrors passes up errors of the certificate callback.
+func reportCertificateErrors(
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+	errs chan<- error,
+	cancel <-chan struct{},
+) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+		if err != nil {
+			err = fmt.Errorf("get TLS certificate for %q: %w", hello.ServerName, err)
+			// the handshake is not blocked until the error is read
+			go func(err error) {
+				select {
+				case <-cancel:
+				case errs <- err:
+				}
+			}(err)
+		}
+
+		return cert, err
+	}
+}
+
+// watchedListener stops watching of the certificate files on close.
+type watchedListener struct {
+	net.Listener
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (l *watchedListener) Close() error {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+
+	return l.Listener.Close()
+}
@@ -0,0 +1,260 @@
+package transport_test
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("TransportLayer with TLS certificate reload", func() {
+	var (
+		tpl       transport.Layer
+		ca        *testCA
+		dir       string
+		layerAddr string
+		errs      chan error
+	)
+	logger := testutils.NewLogrusLogger()
+
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", layerAddr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+	// serverName returns DNS name of the certificate presented by the layer.
+	serverName := func() string {
+		conn := dial()
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].DNSNames[1]
+	}
+	// renew replaces the certificate files, modification time is moved forward
+	// so the change is noticed on file systems with coarse timestamps.
+	renew := func(cert tls.Certificate, age time.Duration) {
+		certFile, keyFile := writeCertificate(dir, cert)
+		modTime := time.Now().Add(age)
+		Expect(os.Chtimes(certFile, modTime, modTime)).To(Succeed())
+		Expect(os.Chtimes(keyFile, modTime, modTime)).To(Succeed())
+	}
+	request := func(callID string) string {
+		return strings.Join([]string{
+			"OPTIONS sip:bob@" + layerAddr + ";transport=tls SIP/2.0",
+			"Via: SIP/2.0/TLS 127.0.0.1:5128;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: " + callID,
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}, "\r\n")
+	}
+
+	BeforeEach(func() {
+		ca = newTestCA()
+
+		var err error
+		dir, err = ioutil.TempDir("", "gosip-tls")
+		Expect(err).ToNot(HaveOccurred())
+		renew(ca.issue(nil, "localhost", "first.example.com"), -time.Minute)
+
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		Expect(tpl.Listen("tls", "127.0.0.1:0",
+			transport.TLSConfig{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem")},
+			transport.WithCertificateReload(20*time.Millisecond),
+		)).To(Succeed())
+		layerAddr = tpl.ListenAddrs("tls")[0].String()
+
+		// the layer is blocked until the errors are read, e.g. EOF of the probe connections
+		errs = make(chan error, 100)
+		go func() {
+			for err := range tpl.Errors() {
+				errs <- err
+			}
+		}()
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+		os.RemoveAll(dir)
+	})
+
+	It("should use renewed certificate for new connections and keep the existing ones", func(done Done) {
+		conn := dial()
+		defer conn.Close()
+		Expect(serverName()).To(Equal("first.example.com"))
+
+		renew(ca.issue(nil, "localhost", "second.example.com"), 0)
+		Eventually(serverName, 2*time.Second, 50*time.Millisecond).Should(Equal("second.example.com"))
+
+		_, err := conn.Write([]byte(request("reload-old")))
+		Expect(err).ToNot(HaveOccurred())
+		var msg sip.Message
+		Eventually(tpl.Messages(), 2*time.Second).Should(Receive(&msg))
+		callID, _ := msg.CallID()
+		Expect(callID.Value()).To(Equal("reload-old"))
+		close(done)
+	}, 5)
+
+	It("should report reload errors and keep the current certificate", func(done Done) {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("broken"), 0600)).To(Succeed())
+
+		var err error
+		Eventually(errs, 2*time.Second).Should(Receive(&err))
+		Expect(err.Error()).To(ContainSubstring("load TLS certificate"))
+		Expect(serverName()).To(Equal("first.example.com"))
+		close(done)
+	}, 5)
+})
+
+var _ = Describe("TransportLayer with TLS certificate callback", func() {
+	var (
+		tpl       transport.Layer
+		ca        *testCA
+		cert      *tls.Certificate
+		layerAddr string
+	)
+	logger := testutils.NewLogrusLogger()
+
+	BeforeEach(func() {
+		ca = newTestCA()
+		cert = nil
+
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		Expect(tpl.Listen("tls", "127.0.0.1:0",
+			transport.WithGetCertificate(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if cert == nil {
+					return nil, fmt.Errorf("no certificate for %s", hello.ServerName)
+				}
+				return cert, nil
+			}),
+		)).To(Succeed())
+		layerAddr = tpl.ListenAddrs("tls")[0].String()
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	It("should present the certificate returned by the callback", func(done Done) {
+		issued := ca.issue(nil, "localhost")
+		cert = &issued
+
+		conn, err := tls.Dial("tcp", layerAddr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+		Expect(err).ToNot(HaveOccurred())
+		conn.Close()
+		close(done)
+	}, 5)
+
+	It("should report callback errors", func(done Done) {
+		_, err := tls.Dial("tcp", layerAddr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+		Expect(err).To(HaveOccurred())
+
+		Eventually(tpl.Errors(), 2*time.Second).Should(Receive(&err))
+		Expect(err.Error()).To(ContainSubstring("no certificate for localhost"))
+		close(done)
+	}, 5)
+})
+
+var _ = Describe("TransportLayer with multiple TLS certificates", func() {
+	var (
+		tpl transport.Layer
+		ca  *testCA
+		dir string
+	)
+	logger := testutils.NewLogrusLogger()
+
+	// certificate writes the certificate for the domain to the subdirectory,
+	// the key is encrypted if the password is given.
+	certificate := func(domain, pass string) transport.TLSConfig {
+		sub := filepath.Join(dir, domain)
+		Expect(os.Mkdir(sub, 0700)).To(Succeed())
+		certFile, keyFile := writeCertificate(sub, ca.issue(nil, domain))
+		if pass != "" {
+			keyPEM, err := ioutil.ReadFile(keyFile)
+			Expect(err).ToNot(HaveOccurred())
+			block, _ := pem.Decode(keyPEM)
+			block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(pass), x509.PEMCipherAES256)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)).To(Succeed())
+		}
+		return transport.TLSConfig{Domain: domain, Cert: certFile, Key: keyFile, Pass: pass}
+	}
+	dial := func(addr string, config *tls.Config) (*tls.Conn, error) {
+		config.RootCAs = ca.pool
+		return tls.Dial("tcp", addr, config)
+	}
+
+	BeforeEach(func() {
+		ca = newTestCA()
+
+		var err error
+		dir, err = ioutil.TempDir("", "gosip-tls")
+		Expect(err).ToNot(HaveOccurred())
+
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+		os.RemoveAll(dir)
+	})
+
+	for _, network := range []string{"tls", "wss"} {
+		network := network
+
+		Context("on "+network+" listener", func() {
+			var layerAddr string
+
+			BeforeEach(func() {
+				Expect(tpl.Listen(network, "127.0.0.1:0",
+					certificate("a.example.com", ""),
+					certificate("b.example.org", "secret"),
+					transport.WithTLSServerConfig(&tls.Config{
+						MinVersion: tls.VersionTLS13,
+						NextProtos: []string{"sip"},
+					}),
+				)).To(Succeed())
+				layerAddr = tpl.ListenAddrs(network)[0].String()
+			})
+
+			It("should select the certificate by SNI", func() {
+				conn, err := dial(layerAddr, &tls.Config{ServerName: "b.example.org", NextProtos: []string{"sip"}})
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+
+				state := conn.ConnectionState()
+				Expect(state.PeerCertificates[0].DNSNames).To(ConsistOf("b.example.org"))
+				Expect(state.NegotiatedProtocol).To(Equal("sip"))
+				Expect(state.Version).To(Equal(uint16(tls.VersionTLS13)))
+			})
+
+			It("should present the first certificate for unknown SNI", func() {
+				conn, err := dial(layerAddr, &tls.Config{ServerName: "c.example.net", InsecureSkipVerify: true})
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+
+				Expect(conn.ConnectionState().PeerCertificates[0].DNSNames).To(ConsistOf("a.example.com"))
+			})
+
+			It("should refuse TLS versions below the minimum one", func() {
+				_, err := dial(layerAddr, &tls.Config{ServerName: "a.example.com", MaxVersion: tls.VersionTLS12})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	}
+})
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/util"
 )
 
 var (
@@ -26,15 +28,37 @@ type Connection interface {
 	WriteTo(buf []byte, raddr net.Addr) (num int, err error)
 }
 
+// connMessage is implemented by messages of the sip package, the connection is not a part of sip.Message,
+// so messages returned by custom mappers can go without it.
+type connMessage interface {
+	Connection() net.Conn
+	SetConnection(conn net.Conn)
+}
+
+// messageConnection returns the connection the message was received over, nil if it is unknown.
+func messageConnection(msg sip.Message) Connection {
+	m, ok := msg.(connMessage)
+	if !ok {
+		return nil
+	}
+	conn, _ := m.Connection().(Connection)
+
+	return conn
+}
+
 // Connection implementation.
 type connection struct {
 	baseConn net.Conn
+	// id identifies the connection in flow tokens, unlike the pointer it is not reused by new connections
+	id       string
 	key      ConnectionKey
 	network  string
 	laddr    net.Addr
 	raddr    net.Addr
 	streamed bool
-	mu       sync.RWMutex
+	// pongs are waiting keep-alive responses by STUN transaction ID, empty for CRLF pong
+	pongs map[string]chan string
+	mu    sync.RWMutex
 
 	log log.Logger
 }
@@ -50,11 +74,13 @@ func NewConnection(baseConn net.Conn, key ConnectionKey, network string, logger
 
 	conn := &connection{
 		baseConn: baseConn,
+		id:       util.RandString(16),
 		key:      key,
 		network:  network,
 		laddr:    baseConn.LocalAddr(),
 		raddr:    baseConn.RemoteAddr(),
 		streamed: stream,
+		pongs:    make(map[string]chan string),
 	}
 	conn.log = logger.
 		WithPrefix("transport.Connection").
@@ -217,3 +243,37 @@ func (conn *connection) SetReadDeadline(t time.Time) error {
 func (conn *connection) SetWriteDeadline(t time.Time) error {
 	return conn.baseConn.SetWriteDeadline(t)
 }
+
+// expectPong registers keep-alive request with the id, the channel receives
+// mapped address of the STUN response or empty string for CRLF pong - RFC 5626 - 4.4.
+func (conn *connection) expectPong(id string) <-chan string {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	pong := make(chan string, 1)
+	conn.pongs[id] = pong
+
+	return pong
+}
+
+func (conn *connection) cancelPong(id string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	delete(conn.pongs, id)
+}
+
+// receivePong passes up keep-alive response, returns false if nobody waits for it.
+func (conn *connection) receivePong(id string, mappedAddr string) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	pong, ok := conn.pongs[id]
+	if !ok {
+		return false
+	}
+	delete(conn.pongs, id)
+	pong <- mappedAddr
+
+	return true
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -514,7 +515,11 @@ func (pool *connectionPool) serveHandlers() {
 
 				var connErr *ConnectionError
 				if errors.As(herr.Err, &connErr) {
-					pool.errs <- herr.Err
+					select {
+					case <-pool.cancel:
+						return
+					case pool.errs <- herr.Err:
+					}
 				}
 
 				continue
@@ -939,6 +944,10 @@ func (handler *connectionHandler) readConnection() (<-chan sip.Message, <-chan e
 				continue
 			}
 
+			if handler.handleKeepAlive(data, raddr) {
+				continue
+			}
+
 			if !streamed {
 				handler.addrs.In <- fmt.Sprintf("%v", raddr)
 			}
@@ -957,6 +966,62 @@ func (handler *connectionHandler) readConnection() (<-chan sip.Message, <-chan e
 	return msgs, errs
 }
 
+// handleKeepAlive answers keep-alive pings and passes up pongs - RFC 5626 - 4.4.
+// It returns true if the data is consumed, i.e. STUN message over UDP.
+// CRLFs over the stream go to the parser too, they can be a part of the message split by reads.
+func (handler *connectionHandler) handleKeepAlive(data []byte, raddr net.Addr) bool {
+	conn, _ := handler.Connection().(keepAliveConn)
+
+	if !handler.Connection().Streamed() {
+		msg, ok := parseStunMessage(data)
+		if !ok {
+			return false
+		}
+
+		switch msg.Type {
+		case stunBindingRequest:
+			udpAddr, ok := raddr.(*net.UDPAddr)
+			if !ok {
+				break
+			}
+
+			handler.Log().Tracef("answer STUN keep-alive from %s", raddr)
+
+			res := &stunMessage{
+				Type:          stunBindingSuccess,
+				TransactionID: msg.TransactionID,
+				MappedAddr:    udpAddr,
+			}
+			if _, err := handler.Connection().WriteTo(res.Bytes(), raddr); err != nil {
+				handler.Log().Warnf("send STUN response to %s failed: %s", raddr, err)
+			}
+		case stunBindingSuccess:
+			var mappedAddr string
+			if msg.MappedAddr != nil {
+				mappedAddr = msg.MappedAddr.String()
+			}
+			if conn != nil {
+				conn.receivePong(string(msg.TransactionID[:]), mappedAddr)
+			}
+		}
+
+		return true
+	}
+
+	switch {
+	case bytes.HasPrefix(data, keepAlivePing):
+		handler.Log().Tracef("answer CRLF keep-alive from %s", raddr)
+
+		if _, err := handler.Connection().Write(keepAlivePong); err != nil {
+			handler.Log().Warnf("send CRLF pong to %s failed: %s", raddr, err)
+		}
+	case bytes.HasPrefix(data, keepAlivePong) && conn != nil:
+		conn.receivePong("", "")
+	}
+
+	return false
+}
+
 func (handler *connectionHandler) pipeOutputs(msgs <-chan sip.Message, errs <-chan error) {
 	streamed := handler.Connection().Streamed()
 	getRemoteAddr := func() string {
@@ -1032,6 +1097,9 @@ func (handler *connectionHandler) pipeOutputs(msgs <-chan sip.Message, errs <-ch
 				"connection_key": handler.Connection().Key(),
 				"received_at":    time.Now(),
 			})
+			if m, ok := msg.(connMessage); ok {
+				m.SetConnection(handler.Connection())
+			}
 
 			logger := handler.Log().WithFields(msg.Fields())
 
@@ -1051,7 +1119,10 @@ func (handler *connectionHandler) pipeOutputs(msgs <-chan sip.Message, errs <-ch
 					continue
 				}
 
-				if rhost != "" {
+				// received is required if sent-by differs from the source address,
+				// and always with rport - RFC 3581 - 4.
+				if ip := net.ParseIP(viaHop.Host); rhost != "" &&
+					(ip == nil || !ip.Equal(net.ParseIP(rhost)) || viaHop.Params.Has("rport")) {
 					viaHop.Params.Add("received", sip.String{Str: rhost})
 				}
 
@@ -1068,7 +1139,7 @@ func (handler *connectionHandler) pipeOutputs(msgs <-chan sip.Message, errs <-ch
 						} else {
 							port = sip.DefaultPort(handler.Connection().Network())
 						}
-						raddr = fmt.Sprintf("%s:%d", rhost, port)
+						raddr = net.JoinHostPort(rhost, strconv.Itoa(int(port)))
 					}
 				}
 				msg.SetSource(raddr)
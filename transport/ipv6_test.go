@@ -0,0 +1,149 @@
+package transport_test
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("TransportLayer over IPv6", func() {
+	var tpl transport.Layer
+	logger := testutils.NewLogrusLogger()
+
+	request := func(network string, dest string) sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@" + dest + " SIP/2.0",
+			"Via: SIP/2.0/" + network + " 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: ipv6",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(dest)
+		return req
+	}
+	readFrom := func(conn net.PacketConn) string {
+		buf := make([]byte, 65535)
+		Expect(conn.SetReadDeadline(time.Now().Add(3 * time.Second))).To(Succeed())
+		n, _, err := conn.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		return string(buf[:n])
+	}
+
+	BeforeEach(func() {
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger,
+			transport.WithHostIPs(net.IPv6loopback))
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	Context("with UDP listener on IPv6 loopback", func() {
+		var peer net.PacketConn
+
+		BeforeEach(func() {
+			Expect(tpl.Listen("udp", "[::1]:5098")).To(Succeed())
+
+			var err error
+			peer, err = net.ListenPacket("udp", "[::1]:0")
+			Expect(err).ToNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			peer.Close()
+		})
+
+		It("should send request with bracketed IPv6 in Via and Request-URI", func(done Done) {
+			Expect(tpl.Send(request("UDP", peer.LocalAddr().String()))).To(Succeed())
+
+			data := readFrom(peer)
+			Expect(data).To(HavePrefix("OPTIONS sip:bob@" + peer.LocalAddr().String() + " SIP/2.0\r\n"))
+			Expect(data).To(ContainSubstring("Via: SIP/2.0/UDP [::1]:5098;"))
+			close(done)
+		}, 5)
+
+		It("should receive request and send response back to the IPv6 source", func(done Done) {
+			peerAddr := peer.LocalAddr().String()
+			msg := strings.Join([]string{
+				"OPTIONS sip:bob@[::1]:5098 SIP/2.0",
+				"Via: SIP/2.0/UDP " + peerAddr + ";branch=" + sip.GenerateBranch() + ";rport",
+				"From: <sip:alice@[2001:db8::10]>;tag=1",
+				"To: <sip:bob@[::1]>",
+				"Contact: <sip:alice@" + peerAddr + ";transport=udp>",
+				"Call-ID: ipv6-in",
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			}, "\r\n")
+			raddr, err := net.ResolveUDPAddr("udp", "[::1]:5098")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = peer.WriteTo([]byte(msg), raddr)
+			Expect(err).ToNot(HaveOccurred())
+
+			var in sip.Message
+			Eventually(tpl.Messages(), 3*time.Second).Should(Receive(&in))
+			req := in.(sip.Request)
+			Expect(req.Source()).To(Equal(peerAddr))
+			contact, ok := req.Contact()
+			Expect(ok).To(BeTrue())
+			Expect(contact.Address.Host()).To(Equal("::1"))
+			Expect(contact.Address.String()).To(Equal("sip:alice@" + peerAddr + ";transport=udp"))
+
+			res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+			Expect(tpl.Send(res)).To(Succeed())
+			Expect(readFrom(peer)).To(HavePrefix("SIP/2.0 200 OK\r\n"))
+			close(done)
+		}, 5)
+	})
+
+	Context("with TCP listener on IPv6 loopback", func() {
+		It("should send request over IPv6 connection", func(done Done) {
+			Expect(tpl.Listen("tcp", "[::1]:5098")).To(Succeed())
+			server, err := net.Listen("tcp", "[::1]:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer server.Close()
+
+			Expect(tpl.Send(request("TCP", server.Addr().String()))).To(Succeed())
+
+			conn, err := server.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			buf := make([]byte, 65535)
+			Expect(conn.SetReadDeadline(time.Now().Add(3 * time.Second))).To(Succeed())
+			n, err := conn.Read(buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(ContainSubstring("Via: SIP/2.0/TCP [::1]:5098;"))
+			close(done)
+		}, 5)
+	})
+
+	Context("with dual-stack UDP listener", func() {
+		It("should select source address by the destination family", func(done Done) {
+			Expect(tpl.Listen("udp", "[::]:5100")).To(Succeed())
+			peer4, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer peer4.Close()
+			peer6, err := net.ListenPacket("udp", "[::1]:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer peer6.Close()
+
+			Expect(tpl.Send(request("UDP", peer4.LocalAddr().String()))).To(Succeed())
+			Expect(readFrom(peer4)).To(ContainSubstring("Via: SIP/2.0/UDP 127.0.0.1:5100;"))
+
+			Expect(tpl.Send(request("UDP", peer6.LocalAddr().String()))).To(Succeed())
+			Expect(readFrom(peer6)).To(ContainSubstring("Via: SIP/2.0/UDP [::1]:5100;"))
+			close(done)
+		}, 5)
+	})
+})
@@ -2,6 +2,9 @@ package transport
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -12,8 +15,21 @@ import (
 
 	"github.com/ygj201011/gosip/log"
 	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/util"
 )
 
+// udpFallbackTTL keeps UDP for the destination during the transaction lifetime (Timer B)
+// after failed TCP connection.
+const udpFallbackTTL = 32 * time.Second
+
+// resolvedTTL keeps destinations of the URI during the transaction lifetime (Timer B),
+// so retransmissions and requests of the same transaction are not resolved again.
+const resolvedTTL = 32 * time.Second
+
+// routeSourceTTL is the lifetime of the cached source IP of the route to the destination,
+// routing table changes are picked up after it.
+const routeSourceTTL = 30 * time.Second
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -26,11 +42,30 @@ type Layer interface {
 	Errors() <-chan error
 	// Listen starts listening on `addr` for each registered protocol.
 	Listen(network string, addr string, options ...ListenOption) error
+	// ListenOn serves connections accepted by the pre-opened listener, e.g. socket passed by systemd.
+	ListenOn(network string, listener net.Listener, options ...ListenOption) error
+	// ListenPacket serves messages received by the pre-opened packet connection.
+	ListenPacket(network string, conn net.PacketConn, options ...ListenOption) error
+	// Unlisten stops the listener bound to `addr`, connections accepted by the listener
+	// are drained by default or closed with UnlistenClose policy.
+	Unlisten(network string, addr string, options ...UnlistenOption) error
+	// ListenAddrs returns addresses the layer listens on for the network,
+	// the bound port is returned if port 0 was requested.
+	ListenAddrs(network string) []net.Addr
 	// Send sends message on suitable protocol.
 	Send(msg sip.Message) error
 	String() string
 	IsReliable(network string) bool
 	IsStreamed(network string) bool
+	// ObservedAddr returns our address as seen by the last remote peer that answered
+	// over the network, it is taken from received and rport params - RFC 3581 - 4.
+	ObservedAddr(network string) (string, bool)
+	// FlowToken returns token of the flow the message was received over - RFC 5626 - 5.2.
+	FlowToken(msg sip.Message) (string, error)
+	// Flow returns destination of the flow token if the flow is alive - RFC 5626 - 5.3.
+	Flow(token string) (Destination, error)
+	// KeepAlive sends keep-alive over the flow and waits for the response - RFC 5626 - 4.4.
+	KeepAlive(network string, addr string, timeout time.Duration) error
 }
 
 var protocolFactory ProtocolFactory = func(
@@ -72,8 +107,36 @@ type layer struct {
 	protocols   *protocolStore
 	listenPorts map[string][]sip.Port
 	ip          net.IP
-	dnsResolver *net.Resolver
+	ips         []net.IP
+	resolver    Resolver
 	msgMapper   sip.MessageMapper
+	observed    map[string]string
+	observedMu  sync.RWMutex
+	// requests larger than udpSizeThreshold are sent over TCP, disabled if negative
+	udpSizeThreshold int
+	udpFallbacks     map[string]time.Time
+	udpFallbacksMu   sync.Mutex
+	// connectionReuse adds 'alias' to Via of requests sent over TCP and TLS
+	connectionReuse bool
+	// listenAddrs select Via sent-by of requests on multi-homed host
+	listenAddrs    []*listenAddr
+	listenAddrsMu  sync.RWMutex
+	routeSources   map[string]routeSource
+	routeSourcesMu sync.Mutex
+	resolved       map[string]resolvedDestinations
+	resolvedMu     sync.Mutex
+	contactRewrite bool
+	// tlsRootCAs and tlsCertificates are used on connections dialed by TLS protocol
+	tlsRootCAs      *x509.CertPool
+	tlsCertificates []tls.Certificate
+	// wsPingInterval is the keep-alive interval of WS and WSS connections,
+	// wsHost is the .invalid sent-by of requests sent over WebSocket without listener - RFC 7118 - 5.2
+	wsPingInterval time.Duration
+	wsHost         string
+	// flowKey signs flow tokens, mappedAddrs are the last STUN mapped addresses of UDP flows
+	flowKey     []byte
+	mappedAddrs map[string]string
+	flowsMu     sync.Mutex
 
 	msgs     chan sip.Message
 	errs     chan error
@@ -96,13 +159,43 @@ func NewLayer(
 	dnsResolver *net.Resolver,
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...LayerOption,
 ) Layer {
+	opts := LayerOptions{
+		Options: Options{
+			MessageMapper: msgMapper,
+			Logger:        logger,
+		},
+		DNSResolver:           dnsResolver,
+		UDPSizeThreshold:      DefaultUDPSizeThreshold,
+		WebSocketPingInterval: DefaultWebSocketPingInterval,
+	}
+	for _, opt := range options {
+		opt.ApplyLayer(&opts)
+	}
+	if opts.UDPSizeThreshold == 0 {
+		opts.UDPSizeThreshold = DefaultUDPSizeThreshold
+	}
+
 	tpl := &layer{
-		protocols:   newProtocolStore(),
-		listenPorts: make(map[string][]sip.Port),
-		ip:          ip,
-		dnsResolver: dnsResolver,
-		msgMapper:   msgMapper,
+		protocols:        newProtocolStore(),
+		listenPorts:      make(map[string][]sip.Port),
+		ip:               ip,
+		ips:              hostIPs(ip, opts.HostIPs),
+		msgMapper:        opts.MessageMapper,
+		observed:         make(map[string]string),
+		udpSizeThreshold: opts.UDPSizeThreshold,
+		udpFallbacks:     make(map[string]time.Time),
+		routeSources:     make(map[string]routeSource),
+		resolved:         make(map[string]resolvedDestinations),
+		connectionReuse:  opts.ConnectionReuse,
+		contactRewrite:   opts.ContactRewrite,
+		tlsRootCAs:       opts.TLSRootCAs,
+		tlsCertificates:  opts.TLSCertificates,
+		wsPingInterval:   opts.WebSocketPingInterval,
+		wsHost:           strings.ToLower(util.RandString(12)) + ".invalid",
+		flowKey:          make([]byte, 32),
+		mappedAddrs:      make(map[string]string),
 
 		msgs:     make(chan sip.Message),
 		errs:     make(chan error),
@@ -112,11 +205,15 @@ func NewLayer(
 		done:     make(chan struct{}),
 	}
 
-	tpl.log = logger.
+	tpl.log = opts.Logger.
 		WithPrefix("transport.Layer").
 		WithFields(map[string]interface{}{
 			"transport_layer_ptr": fmt.Sprintf("%p", tpl),
 		})
+	tpl.resolver = NewResolver(opts.DNSResolver, tpl.Log())
+	if _, err := cryptorand.Read(tpl.flowKey); err != nil {
+		tpl.Log().Panicf("generate flow token key failed: %s", err)
+	}
 
 	go tpl.serveProtocols()
 
@@ -175,14 +272,131 @@ func (tpl *layer) IsStreamed(network string) bool {
 	return false
 }
 
+func (tpl *layer) ObservedAddr(network string) (string, bool) {
+	tpl.observedMu.RLock()
+	defer tpl.observedMu.RUnlock()
+
+	addr, ok := tpl.observed[strings.ToUpper(network)]
+	return addr, ok
+}
+
 func (tpl *layer) Listen(network string, addr string, options ...ListenOption) error {
+	protocol, err := tpl.listenProtocol(network)
+	if err != nil {
+		return err
+	}
+	target, err := NewTargetFromAddr(addr)
+	if err != nil {
+		return err
+	}
+	target = FillTargetHostAndPort(protocol.Network(), target)
+
+	err = protocol.Listen(target, options...)
+	if err == nil {
+		tpl.addListenAddr(protocol.Network(), resolveListenIP(target.Host), *target.Port, options...)
+	}
+
+	return err
+}
+
+func (tpl *layer) ListenOn(network string, listener net.Listener, options ...ListenOption) error {
+	protocol, err := tpl.listenProtocol(network)
+	if err != nil {
+		return err
+	}
+	listenerProto, ok := protocol.(listenerProtocol)
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("protocol %s does not accept listeners", protocol.Network()))
+	}
+	laddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unsupported listener address %s", listener.Addr())
+	}
+
+	err = listenerProto.listenOn(listener, options...)
+	if err == nil {
+		tpl.addListenAddr(protocol.Network(), laddr.IP, sip.Port(laddr.Port), options...)
+	}
+
+	return err
+}
+
+func (tpl *layer) ListenPacket(network string, conn net.PacketConn, options ...ListenOption) error {
+	protocol, err := tpl.listenProtocol(network)
+	if err != nil {
+		return err
+	}
+	packetProto, ok := protocol.(packetProtocol)
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("protocol %s does not accept packet connections", protocol.Network()))
+	}
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("unsupported packet connection address %s", conn.LocalAddr())
+	}
+
+	err = packetProto.listenPacket(conn)
+	if err == nil {
+		tpl.addListenAddr(protocol.Network(), laddr.IP, sip.Port(laddr.Port), options...)
+	}
+
+	return err
+}
+
+// serveConn serves the connection accepted outside of the layer, see WebSocketHandler.
+func (tpl *layer) serveConn(network string, conn net.Conn) error {
+	protocol, err := tpl.listenProtocol(network)
+	if err != nil {
+		return err
+	}
+	connProto, ok := protocol.(connProtocol)
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("protocol %s does not serve accepted connections", protocol.Network()))
+	}
+
+	return connProto.serveConn(conn)
+}
+
+func (tpl *layer) Unlisten(network string, addr string, options ...UnlistenOption) error {
+	protocol, ok := tpl.protocols.get(protocolKey(strings.ToUpper(network)))
+	if !ok {
+		return fmt.Errorf("protocol %s is not listening", network)
+	}
+	unlistenProto, ok := protocol.(unlistenProtocol)
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("protocol %s does not support unlisten", protocol.Network()))
+	}
+	target, err := NewTargetFromAddr(addr)
+	if err != nil {
+		return err
+	}
+	target = FillTargetHostAndPort(protocol.Network(), target)
+
+	opts := UnlistenOptions{}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyUnlisten(&opts)
+		}
+	}
+
+	ip := resolveListenIP(target.Host)
+	err = unlistenProto.unlisten(ip, *target.Port, opts.Policy)
+	if err == nil {
+		tpl.removeListenAddr(protocol.Network(), ip, *target.Port)
+	}
+
+	return err
+}
+
+// listenProtocol returns protocol of the network, it is created on the first listen.
+func (tpl *layer) listenProtocol(network string) (Protocol, error) {
 	select {
 	case <-tpl.canceled:
-		return fmt.Errorf("transport layer is canceled")
+		return nil, fmt.Errorf("transport layer is canceled")
 	default:
 	}
 
-	protocol, ok := tpl.protocols.get(protocolKey(network))
+	protocol, ok := tpl.protocols.get(protocolKey(strings.ToUpper(network)))
 	if !ok {
 		var err error
 		protocol, err = protocolFactory(
@@ -194,27 +408,18 @@ func (tpl *layer) Listen(network string, addr string, options ...ListenOption) e
 			tpl.Log(),
 		)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		tpl.protocols.put(protocolKey(protocol.Network()), protocol)
-	}
-	target, err := NewTargetFromAddr(addr)
-	if err != nil {
-		return err
-	}
-	target = FillTargetHostAndPort(protocol.Network(), target)
-
-	err = protocol.Listen(target, options...)
-	if err == nil {
-		if _, ok := tpl.listenPorts[protocol.Network()]; !ok {
-			if tpl.listenPorts[protocol.Network()] == nil {
-				tpl.listenPorts[protocol.Network()] = make([]sip.Port, 0)
-			}
-			tpl.listenPorts[protocol.Network()] = append(tpl.listenPorts[protocol.Network()], *target.Port)
+		if tlsProto, ok := protocol.(tlsClientProtocol); ok {
+			tlsProto.setTLSClient(tpl.tlsRootCAs, tpl.tlsCertificates)
 		}
+		if pingProto, ok := protocol.(pingProtocol); ok {
+			pingProto.setPingInterval(tpl.wsPingInterval)
+		}
+		tpl.protocols.put(protocolKey(protocol.Network()), protocol)
 	}
 
-	return err
+	return protocol, nil
 }
 
 func (tpl *layer) Send(msg sip.Message) error {
@@ -238,22 +443,12 @@ func (tpl *layer) Send(msg sip.Message) error {
 		network := msg.Transport()
 		// rewrite sent-by transport
 		viaHop.Transport = network
-		viaHop.Host = tpl.ip.String()
-
-		protocol, ok := tpl.protocols.get(protocolKey(network))
-		if !ok {
-			return UnsupportedProtocolError(fmt.Sprintf("protocol %s is not supported", network))
+		// RFC 3581 - 3. Responses should be sent back to the source port.
+		if viaHop.Params == nil {
+			viaHop.Params = sip.NewParams()
 		}
-
-		// rewrite sent-by port
-		if viaHop.Port == nil {
-			if ports, ok := tpl.listenPorts[network]; ok {
-				port := ports[rand.Intn(len(ports))]
-				viaHop.Port = &port
-			} else {
-				defPort := sip.DefaultPort(network)
-				viaHop.Port = &defPort
-			}
+		if !viaHop.Params.Has("rport") {
+			viaHop.Params.Add("rport", nil)
 		}
 
 		target, err := NewTargetFromAddr(msg.Destination())
@@ -261,44 +456,53 @@ func (tpl *layer) Send(msg sip.Message) error {
 			return fmt.Errorf("build address target for %s: %w", msg.Destination(), err)
 		}
 
-		// dns srv lookup
-		if net.ParseIP(target.Host) == nil {
-			ctx := context.Background()
-			proto := strings.ToLower(network)
-			if _, addrs, err := tpl.dnsResolver.LookupSRV(ctx, "sip", proto, target.Host); err == nil && len(addrs) > 0 {
-				addr := addrs[0]
-				addrStr := fmt.Sprintf("%s:%d", addr.Target[:len(addr.Target)-1], addr.Port)
-				switch network {
-				case "UDP":
-					if addr, err := net.ResolveUDPAddr("udp", addrStr); err == nil {
-						port := sip.Port(addr.Port)
-						target.Host = addr.IP.String()
-						target.Port = &port
-					}
-				case "TLS":
-					fallthrough
-				case "WS":
-					fallthrough
-				case "WSS":
-					fallthrough
-				case "TCP":
-					if addr, err := net.ResolveTCPAddr("tcp", addrStr); err == nil {
-						port := sip.Port(addr.Port)
-						target.Host = addr.IP.String()
-						target.Port = &port
-					}
-				}
+		dests := []Destination{{Transport: network, Host: target.Host, Port: *target.Port}}
+		resolved := net.ParseIP(target.Host) == nil
+		if resolved {
+			if dests, err = tpl.resolve(msg, target); err != nil {
+				return err
 			}
 		}
 
-		logger := log.AddFieldsFrom(tpl.Log(), protocol, msg)
-		logger.Debugf("sending SIP request:\n%s", msg)
+		// RFC 3261 - 18.1.1. Large requests must be sent over congestion controlled transport.
+		switchToTCP := network == "UDP" && tpl.udpSizeThreshold > 0 && len(msg.String()) > tpl.udpSizeThreshold
+		if switchToTCP {
+			// the request goes over TCP even if the layer doesn't listen on it
+			if _, err := tpl.listenProtocol("TCP"); err != nil {
+				return fmt.Errorf("switch large request to TCP: %w", err)
+			}
+		}
 
-		if err = protocol.Send(target, msg); err != nil {
-			return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
+		viaPort := viaHop.Port
+		var lastErr error
+		for _, dest := range dests {
+			attempts := []Destination{dest}
+			if switchToTCP && dest.Transport == "UDP" && !tpl.hasUDPFallback(dest) {
+				// the same address is tried over TCP first, UDP is used if TCP connection fails
+				attempts = []Destination{{Transport: "TCP", Host: dest.Host, Port: dest.Port}, dest}
+			}
+
+			for _, attempt := range attempts {
+				if lastErr = tpl.sendRequest(msg, attempt, network, viaPort); lastErr != nil {
+					if attempt.Transport != dest.Transport {
+						tpl.Log().Debugf("%s, falling back to UDP", lastErr)
+						tpl.addUDPFallback(dest)
+					} else {
+						tpl.Log().Debugf("%s, trying next destination", lastErr)
+					}
+					continue
+				}
+
+				// retransmissions go to the same destination - RFC 3263 - 4.
+				if resolved {
+					msg.SetDestination(dest.Addr())
+				}
+
+				return nil
+			}
 		}
 
-		return nil
+		return lastErr
 		// RFC 3261 - 18.2.2.
 	case sip.Response:
 		// resolve protocol from Via
@@ -316,7 +520,31 @@ func (tpl *layer) Send(msg sip.Message) error {
 		logger.Debugf("sending SIP response:\n%s", msg)
 
 		if err = protocol.Send(target, msg); err != nil {
-			return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
+			err = fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
+			if !protocol.Reliable() {
+				return err
+			}
+
+			// RFC 3261 - 18.2.2. If the connection is no longer open,
+			// a new connection is opened to the received address and the sent-by port.
+			received, ok := viaHop.Params.Get("received")
+			if !ok || received == nil || received.String() == "" {
+				return err
+			}
+			port := sip.DefaultPort(protocol.Network())
+			if viaHop.Port != nil {
+				port = *viaHop.Port
+			}
+			fallback := NewTarget(received.String(), int(port))
+			if fallback.Addr() == target.Addr() {
+				return err
+			}
+
+			logger.Debugf("%s, trying %s", err, fallback.Addr())
+
+			if err = protocol.Send(fallback, msg); err != nil {
+				return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), fallback.Addr(), err)
+			}
 		}
 
 		return nil
@@ -328,6 +556,247 @@ func (tpl *layer) Send(msg sip.Message) error {
 	}
 }
 
+// sendRequest sends the request to the destination, sent-by port set by user
+// is kept if the request goes over the original network.
+func (tpl *layer) sendRequest(req sip.Request, dest Destination, network string, viaPort *sip.Port) error {
+	protocol, ok := tpl.protocols.get(protocolKey(dest.Transport))
+	if !ok && isWebSocket(dest.Transport) {
+		// WebSocket clients usually do not listen - RFC 7118 - 5.2
+		var err error
+		if protocol, err = tpl.listenProtocol(dest.Transport); err == nil {
+			ok = true
+		}
+	}
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("protocol %s is not supported", dest.Transport))
+	}
+
+	// rewrite sent-by host, transport and port
+	viaHop, _ := req.ViaHop()
+	viaHop.Transport = protocol.Network()
+	var preferPort *sip.Port
+	if protocol.Network() == network {
+		preferPort = viaPort
+	}
+	if addr, ok := tpl.selectListenAddr(protocol.Network(), dest.Host, preferPort); ok {
+		host, port := addr.sentBy(tpl.hostIP(dest.Host))
+		viaHop.Host = host
+		viaHop.Port = &port
+		// the message leaves the listener, not the advertised address
+		req.SetSource(addr.localAddr())
+		if tpl.contactRewrite {
+			tpl.rewriteContact(req, host, &port)
+		}
+	} else if isWebSocket(protocol.Network()) {
+		// RFC 7118 - 5.2. The client does not accept connections, so its sent-by and Contact
+		// have the random .invalid domain, requests come back over the same connection.
+		viaHop.Host = tpl.wsHost
+		viaHop.Port = nil
+		req.SetSource("")
+		tpl.rewriteContact(req, tpl.wsHost, nil)
+	} else {
+		viaHop.Host = tpl.hostIP(dest.Host).String()
+		if preferPort != nil {
+			viaHop.Port = preferPort
+		} else if port, ok := tpl.listenPort(protocol.Network()); ok {
+			viaHop.Port = &port
+		} else {
+			defPort := sip.DefaultPort(protocol.Network())
+			viaHop.Port = &defPort
+		}
+		req.SetSource("")
+	}
+	// RFC 5923 - 5. The connection may be reused by the peer for requests to the sent-by.
+	if tpl.connectionReuse && (protocol.Network() == "TCP" || protocol.Network() == "TLS") {
+		if !viaHop.Params.Has("alias") {
+			viaHop.Params.Add("alias", nil)
+		}
+	} else {
+		viaHop.Params.Remove("alias")
+	}
+
+	if isWebSocket(protocol.Network()) {
+		tpl.setContactTransport(req, viaHop.Host, "ws")
+	}
+
+	target := NewTarget(dest.Host, int(dest.Port))
+
+	logger := log.AddFieldsFrom(tpl.Log(), protocol, req)
+	logger.Debugf("sending SIP request:\n%s", req)
+
+	if err := protocol.Send(target, req); err != nil {
+		return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
+	}
+
+	return nil
+}
+
+// hostIP returns the host address of the destination IP family.
+func (tpl *layer) hostIP(destHost string) net.IP {
+	dest := net.ParseIP(destHost)
+	if dest == nil || isIPv4(dest) == isIPv4(tpl.ip) {
+		return tpl.ip
+	}
+
+	for _, ip := range tpl.ips {
+		if isIPv4(ip) == isIPv4(dest) {
+			return ip
+		}
+	}
+	// loopback peers are reached over loopback of the same family
+	if dest.IsLoopback() {
+		if isIPv4(dest) {
+			return net.IPv4(127, 0, 0, 1)
+		}
+		return net.IPv6loopback
+	}
+
+	return tpl.ip
+}
+
+// hostIPs returns the layer IP followed by the additional addresses,
+// the host address of the other family is resolved if it is not set.
+func hostIPs(ip net.IP, ips []net.IP) []net.IP {
+	all := append([]net.IP{ip}, ips...)
+	for _, other := range ips {
+		if isIPv4(other) != isIPv4(ip) {
+			return all
+		}
+	}
+
+	resolve := util.ResolveSelfIPv6
+	if !isIPv4(ip) {
+		resolve = util.ResolveSelfIP
+	}
+	if other, err := resolve(); err == nil {
+		all = append(all, other)
+	}
+
+	return all
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// hasUDPFallback checks that TCP connection to the destination failed recently,
+// so retransmissions of the large request go over UDP directly.
+func (tpl *layer) hasUDPFallback(dest Destination) bool {
+	tpl.udpFallbacksMu.Lock()
+	defer tpl.udpFallbacksMu.Unlock()
+
+	expiry, ok := tpl.udpFallbacks[dest.Addr()]
+	if ok && time.Now().After(expiry) {
+		delete(tpl.udpFallbacks, dest.Addr())
+		return false
+	}
+
+	return ok
+}
+
+func (tpl *layer) addUDPFallback(dest Destination) {
+	tpl.udpFallbacksMu.Lock()
+	defer tpl.udpFallbacksMu.Unlock()
+
+	tpl.udpFallbacks[dest.Addr()] = time.Now().Add(udpFallbackTTL)
+}
+
+// resolve locates destinations of the request - RFC 3263 - 4.
+// Servers of the next hop URI are located with NAPTR and SRV records if the port is not set,
+// the destination set to other host is resolved with A/AAAA records only.
+func (tpl *layer) resolve(req sip.Request, target *Target) ([]Destination, error) {
+	uri := req.Recipient()
+	if hdrs := req.GetHeaders("Route"); len(hdrs) > 0 {
+		if route, ok := hdrs[0].(*sip.RouteHeader); ok && len(route.Addresses) > 0 {
+			uri = route.Addresses[0]
+		}
+	}
+
+	sipUri, ok := uri.(*sip.SipUri)
+	if !ok || !strings.EqualFold(sipUri.FHost, target.Host) {
+		sipUri = &sip.SipUri{
+			FHost: target.Host,
+			FPort: target.Port,
+			FUriParams: sip.NewParams().
+				Add("transport", sip.String{Str: strings.ToLower(req.Transport())}),
+		}
+	} else if sipUri.FPort == nil && *target.Port != sip.DefaultPort(req.Transport()) {
+		sipUri = sipUri.Clone().(*sip.SipUri)
+		sipUri.FPort = target.Port
+	}
+
+	dests, err := tpl.resolveUri(sipUri)
+	if err != nil {
+		return nil, fmt.Errorf("resolve destination of %s: %w", req.Short(), err)
+	}
+
+	// URI transport parameter and large requests require the transport of the request
+	network := req.Transport()
+	if sipUri.FUriParams != nil {
+		if _, ok := sipUri.FUriParams.Get("transport"); ok {
+			return filterDestinations(dests, network), nil
+		}
+	}
+	if network != "UDP" {
+		if filtered := filterDestinations(dests, network); len(filtered) > 0 {
+			return filtered, nil
+		}
+	}
+
+	return dests, nil
+}
+
+// resolvedDestinations are the cached destinations of the URI.
+type resolvedDestinations struct {
+	dests  []Destination
+	expiry time.Time
+}
+
+// resolveUri returns destinations of the URI, the URI is resolved once per resolvedTTL
+// instead of every sent message. Failed lookups are not cached.
+func (tpl *layer) resolveUri(uri *sip.SipUri) ([]Destination, error) {
+	key := uri.String()
+	now := time.Now()
+
+	tpl.resolvedMu.Lock()
+	resolved, ok := tpl.resolved[key]
+	tpl.resolvedMu.Unlock()
+	if ok && now.Before(resolved.expiry) {
+		return append([]Destination(nil), resolved.dests...), nil
+	}
+
+	dests, err := tpl.resolver.Resolve(context.Background(), uri)
+	if err != nil {
+		return nil, err
+	}
+
+	tpl.resolvedMu.Lock()
+	defer tpl.resolvedMu.Unlock()
+
+	for k, resolved := range tpl.resolved {
+		if now.After(resolved.expiry) {
+			delete(tpl.resolved, k)
+		}
+	}
+	tpl.resolved[key] = resolvedDestinations{
+		dests:  append([]Destination(nil), dests...),
+		expiry: now.Add(resolvedTTL),
+	}
+
+	return dests, nil
+}
+
+func filterDestinations(dests []Destination, transport string) []Destination {
+	filtered := make([]Destination, 0, len(dests))
+	for _, dest := range dests {
+		if strings.EqualFold(dest.Transport, transport) {
+			filtered = append(filtered, dest)
+		}
+	}
+
+	return filtered
+}
+
 func (tpl *layer) serveProtocols() {
 	defer func() {
 		tpl.dispose()
@@ -357,7 +826,10 @@ func (tpl *layer) dispose() {
 		<-protocol.Done()
 	}
 
+	tpl.listenAddrsMu.Lock()
 	tpl.listenPorts = make(map[string][]sip.Port)
+	tpl.listenAddrs = nil
+	tpl.listenAddrsMu.Unlock()
 
 	close(tpl.pmsgs)
 	close(tpl.perrs)
@@ -371,6 +843,29 @@ func (tpl *layer) handleMessage(msg sip.Message) {
 	logger := tpl.Log().WithFields(msg.Fields())
 
 	logger.Debugf("received SIP message:\n%s", msg)
+
+	// RFC 5923 - 5. The inbound connection is reused for requests to the sent-by of the peer.
+	if req, ok := msg.(sip.Request); ok {
+		if viaHop, ok := req.ViaHop(); ok {
+			if protocol, ok := tpl.protocols.get(protocolKey(viaHop.Transport)); ok {
+				if aliasProto, ok := protocol.(aliasProtocol); ok {
+					aliasProto.addAlias(req)
+				}
+			}
+		}
+	}
+
+	// the top Via of a response is ours, it has the address seen by the remote peer
+	if res, ok := msg.(sip.Response); ok {
+		if viaHop, ok := res.ViaHop(); ok {
+			if addr, ok := viaHop.Received(); ok {
+				tpl.observedMu.Lock()
+				tpl.observed[strings.ToUpper(viaHop.Transport)] = addr
+				tpl.observedMu.Unlock()
+			}
+		}
+	}
+
 	logger.Trace("passing up SIP message...")
 
 	// pass up message
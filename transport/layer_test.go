@@ -3,6 +3,7 @@ package transport_test
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/sip/parser"
 	"github.com/ygj201011/gosip/testutils"
 	"github.com/ygj201011/gosip/transport"
 )
@@ -230,6 +232,110 @@ var _ = Describe("TransportLayer", func() {
 			})
 		})
 
+		Context("when remote UDP client behind NAT sends request with 'rport'", func() {
+			var client net.PacketConn
+
+			BeforeEach(func() {
+				var err error
+				client, err = net.ListenPacket("udp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+			})
+			AfterEach(func() {
+				client.Close()
+			})
+
+			It("should fill 'rport' and send response to the source port", func(done Done) {
+				msg := "OPTIONS sip:bob@far-far-away.com SIP/2.0\r\n" +
+					"Via: SIP/2.0/UDP 127.0.0.1:" + fmt.Sprintf("%v", clientPort) + ";branch=z9hG4bK776asdhds;rport\r\n" +
+					"To: \"Bob\" <sip:bob@far-far-away.com>\r\n" +
+					"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774\r\n" +
+					"Content-Length: 0\r\n" +
+					"\r\n"
+				expectedMsg := "OPTIONS sip:bob@far-far-away.com SIP/2.0\r\n" +
+					"Via: SIP/2.0/UDP 127.0.0.1:" + fmt.Sprintf("%v", clientPort) + ";branch=z9hG4bK776asdhds;rport=%d;received=%s\r\n" +
+					"To: \"Bob\" <sip:bob@far-far-away.com>\r\n" +
+					"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774\r\n" +
+					"Content-Length: 0\r\n" +
+					"\r\n"
+
+				raddr, err := net.ResolveUDPAddr("udp", localAddr1)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.WriteTo([]byte(msg), raddr)
+				Expect(err).ToNot(HaveOccurred())
+
+				req := testutils.AssertMessageArrived(
+					tpl.Messages(),
+					fmt.Sprintf(expectedMsg, client.LocalAddr().(*net.UDPAddr).Port, clientHost),
+					client.LocalAddr().String(),
+					localAddr1,
+				).(sip.Request)
+
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				Expect(tpl.Send(res)).To(Succeed())
+
+				buf := make([]byte, 65535)
+				Expect(client.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+				num, _, err := client.ReadFrom(buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buf[:num])).To(HavePrefix("SIP/2.0 200 OK"))
+				close(done)
+			}, 3)
+		})
+
+		Context("when sends request to remote UDP server", func() {
+			var server net.PacketConn
+
+			BeforeEach(func() {
+				var err error
+				server, err = net.ListenPacket("udp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+
+			It("should add 'rport' and remember address observed by the server", func(done Done) {
+				req := testutils.Request([]string{
+					fmt.Sprintf("OPTIONS sip:bob@%s SIP/2.0", server.LocalAddr()),
+					"Via: SIP/2.0/UDP 127.0.0.1;branch=" + sip.GenerateBranch(),
+					"From: <sip:alice@wonderland.com>;tag=1",
+					"To: <sip:bob@far-far-away.com>",
+					"Call-ID: rport",
+					"CSeq: 1 OPTIONS",
+					"Content-Length: 0",
+					"",
+					"",
+				})
+				Expect(tpl.Send(req)).To(Succeed())
+
+				buf := make([]byte, 65535)
+				Expect(server.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+				num, raddr, err := server.ReadFrom(buf)
+				Expect(err).ToNot(HaveOccurred())
+				received, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ToNot(HaveOccurred())
+
+				viaHop, ok := received.ViaHop()
+				Expect(ok).To(BeTrue())
+				Expect(viaHop.Params.Has("rport")).To(BeTrue())
+				_, ok = tpl.ObservedAddr("udp")
+				Expect(ok).To(BeFalse())
+
+				// server behind NAT sees another address
+				viaHop.Params.Add("received", sip.String{Str: "203.0.113.1"})
+				viaHop.Params.Add("rport", sip.String{Str: "40000"})
+				res := sip.NewResponseFromRequest("", received.(sip.Request), 200, "OK", "")
+				_, err = server.WriteTo([]byte(res.String()), raddr)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(tpl.Messages()).Should(Receive())
+				addr, ok := tpl.ObservedAddr("udp")
+				Expect(ok).To(BeTrue())
+				Expect(addr).To(Equal("203.0.113.1:40000"))
+				close(done)
+			}, 3)
+		})
+
 		Context("when cancels", func() {
 			BeforeEach(func() {
 				time.Sleep(time.Millisecond)
@@ -242,3 +348,144 @@ var _ = Describe("TransportLayer", func() {
 		})
 	})
 })
+
+var _ = Describe("TransportLayer with large requests", func() {
+	var (
+		tpl       transport.Layer
+		udpServer net.PacketConn
+		tcpServer net.Listener
+		options   []transport.LayerOption
+		listenTCP bool
+	)
+	logger := testutils.NewLogrusLogger()
+	localAddr := "127.0.0.1:5080"
+	body := strings.Repeat("a", 1500) + "END"
+
+	request := func() sip.Request {
+		return testutils.Request([]string{
+			fmt.Sprintf("MESSAGE sip:bob@%s SIP/2.0", udpServer.LocalAddr()),
+			"Via: SIP/2.0/UDP 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: large",
+			"CSeq: 1 MESSAGE",
+			fmt.Sprintf("Content-Length: %d", len(body)),
+			"",
+			body,
+		})
+	}
+	readUDP := func() string {
+		buf := make([]byte, 65535)
+		Expect(udpServer.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		num, _, err := udpServer.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		return string(buf[:num])
+	}
+	// readTCP reads the request from the first connection accepted by the TCP server
+	readTCP := func() <-chan string {
+		received := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+
+			conn, err := tcpServer.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			data := make([]byte, 0)
+			buf := make([]byte, 65535)
+			for !strings.Contains(string(data), "END") {
+				num, err := conn.Read(buf)
+				Expect(err).ToNot(HaveOccurred())
+				data = append(data, buf[:num]...)
+			}
+			received <- string(data)
+		}()
+		return received
+	}
+
+	BeforeEach(func() {
+		options = nil
+		listenTCP = true
+
+		var err error
+		tcpServer, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		udpServer, err = net.ListenPacket("udp", tcpServer.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger, options...)
+		Expect(tpl.Listen("udp", localAddr)).To(Succeed())
+		if listenTCP {
+			Expect(tpl.Listen("tcp", localAddr)).To(Succeed())
+		}
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+		tcpServer.Close()
+		udpServer.Close()
+	})
+
+	It("should send request over TCP", func(done Done) {
+		received := readTCP()
+		Expect(tpl.Send(request())).To(Succeed())
+		Expect(<-received).To(ContainSubstring("Via: SIP/2.0/TCP 127.0.0.1:5080"))
+		close(done)
+	}, 3)
+
+	Context("when TCP connection fails", func() {
+		BeforeEach(func() {
+			tcpServer.Close()
+		})
+
+		It("should fall back to UDP", func(done Done) {
+			req := request()
+			Expect(tpl.Send(req)).To(Succeed())
+			Expect(readUDP()).To(ContainSubstring("Via: SIP/2.0/UDP 127.0.0.1:5080"))
+
+			// retransmission goes over UDP directly
+			Expect(tpl.Send(req)).To(Succeed())
+			Expect(readUDP()).To(ContainSubstring("Via: SIP/2.0/UDP 127.0.0.1:5080"))
+			close(done)
+		}, 3)
+	})
+
+	Context("without TCP listener", func() {
+		BeforeEach(func() {
+			listenTCP = false
+		})
+
+		It("should send request over TCP", func(done Done) {
+			received := readTCP()
+			Expect(tpl.Send(request())).To(Succeed())
+			Expect(<-received).To(ContainSubstring("Via: SIP/2.0/TCP 127.0.0.1"))
+			close(done)
+		}, 3)
+	})
+
+	Context("when threshold is zero", func() {
+		BeforeEach(func() {
+			options = []transport.LayerOption{transport.WithUDPSizeThreshold(0)}
+		})
+
+		It("should use the default threshold", func(done Done) {
+			received := readTCP()
+			Expect(tpl.Send(request())).To(Succeed())
+			Expect(<-received).To(ContainSubstring("Via: SIP/2.0/TCP 127.0.0.1:5080"))
+			close(done)
+		}, 3)
+	})
+
+	Context("when switching is disabled", func() {
+		BeforeEach(func() {
+			options = []transport.LayerOption{transport.WithUDPSizeThreshold(-1)}
+		})
+
+		It("should send request over UDP", func(done Done) {
+			Expect(tpl.Send(request())).To(Succeed())
+			Expect(readUDP()).To(ContainSubstring("Via: SIP/2.0/UDP 127.0.0.1:5080"))
+			close(done)
+		}, 3)
+	})
+})
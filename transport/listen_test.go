@@ -0,0 +1,243 @@
+package transport_test
+
+import (
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("TransportLayer listening on pre-opened sockets", func() {
+	var tpl transport.Layer
+	logger := testutils.NewLogrusLogger()
+
+	request := func(network, dest string) sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@" + dest + " SIP/2.0",
+			"Via: SIP/2.0/" + network + " 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: pre-opened",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(dest)
+		return req
+	}
+
+	BeforeEach(func() {
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	Context("with pre-opened TCP listener", func() {
+		var listener net.Listener
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tpl.ListenOn("tcp", listener)).To(Succeed())
+		})
+
+		It("should report the listener address", func() {
+			addrs := tpl.ListenAddrs("tcp")
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].String()).To(Equal(listener.Addr().String()))
+		})
+
+		It("should receive requests over accepted connections", func(done Done) {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			_, err = conn.Write([]byte(request("TCP", listener.Addr().String()).String()))
+			Expect(err).ToNot(HaveOccurred())
+
+			msg := <-tpl.Messages()
+			Expect(msg.(sip.Request).Method()).To(Equal(sip.OPTIONS))
+			close(done)
+		}, 3)
+	})
+
+	Context("with pre-opened UDP connection", func() {
+		var conn net.PacketConn
+
+		BeforeEach(func() {
+			var err error
+			conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tpl.ListenPacket("udp", conn)).To(Succeed())
+		})
+
+		It("should receive and send requests over the connection", func(done Done) {
+			peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer peer.Close()
+
+			_, err = peer.WriteTo([]byte(request("UDP", conn.LocalAddr().String()).String()), conn.LocalAddr())
+			Expect(err).ToNot(HaveOccurred())
+			msg := <-tpl.Messages()
+			Expect(msg.(sip.Request).Method()).To(Equal(sip.OPTIONS))
+
+			Expect(tpl.Send(request("UDP", peer.LocalAddr().String()))).To(Succeed())
+			buf := make([]byte, 65535)
+			Expect(peer.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			_, raddr, err := peer.ReadFrom(buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(raddr.String()).To(Equal(conn.LocalAddr().String()))
+			close(done)
+		}, 3)
+
+		It("should not accept packet connections for stream protocols", func() {
+			err := tpl.ListenPacket("tcp", conn)
+			Expect(err).To(HaveOccurred())
+			_, ok := err.(transport.UnsupportedProtocolError)
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("with port 0 requested", func() {
+		BeforeEach(func() {
+			Expect(tpl.Listen("udp", "127.0.0.1:0")).To(Succeed())
+			Expect(tpl.Listen("tcp", "127.0.0.1:0")).To(Succeed())
+		})
+
+		It("should report the bound ports", func() {
+			for _, network := range []string{"udp", "tcp"} {
+				addrs := tpl.ListenAddrs(network)
+				Expect(addrs).To(HaveLen(1))
+				_, port, err := net.SplitHostPort(addrs[0].String())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(port).ToNot(Equal("0"))
+			}
+		})
+
+		It("should put the bound port to Via", func(done Done) {
+			peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer peer.Close()
+
+			Expect(tpl.Send(request("UDP", peer.LocalAddr().String()))).To(Succeed())
+			buf := make([]byte, 65535)
+			Expect(peer.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			n, _, err := peer.ReadFrom(buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(ContainSubstring("Via: SIP/2.0/UDP " + tpl.ListenAddrs("udp")[0].String() + ";"))
+			close(done)
+		}, 3)
+	})
+})
+
+var _ = Describe("TransportLayer stopping listeners", func() {
+	var tpl transport.Layer
+	logger := testutils.NewLogrusLogger()
+
+	request := func(network, dest string) sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@" + dest + " SIP/2.0",
+			"Via: SIP/2.0/" + network + " 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: unlisten",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(dest)
+		return req
+	}
+
+	BeforeEach(func() {
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	Context("with TCP listeners", func() {
+		var conn net.Conn
+
+		BeforeEach(func() {
+			Expect(tpl.Listen("tcp", "127.0.0.1:5108")).To(Succeed())
+			Expect(tpl.Listen("tcp", "127.0.0.1:5110")).To(Succeed())
+
+			var err error
+			conn, err = net.Dial("tcp", "127.0.0.1:5108")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = conn.Write([]byte(request("TCP", "127.0.0.1:5108").String()))
+			Expect(err).ToNot(HaveOccurred())
+			<-tpl.Messages()
+		})
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		It("should stop accepting and keep the connections by default", func(done Done) {
+			Expect(tpl.Unlisten("tcp", "127.0.0.1:5108")).To(Succeed())
+
+			_, err := net.Dial("tcp", "127.0.0.1:5108")
+			Expect(err).To(HaveOccurred())
+			Expect(tpl.ListenAddrs("tcp")).To(HaveLen(1))
+			Expect(tpl.ListenAddrs("tcp")[0].String()).To(Equal("127.0.0.1:5110"))
+
+			_, err = conn.Write([]byte(request("TCP", "127.0.0.1:5108").String()))
+			Expect(err).ToNot(HaveOccurred())
+			msg := <-tpl.Messages()
+			Expect(msg.(sip.Request).Method()).To(Equal(sip.OPTIONS))
+			close(done)
+		}, 3)
+
+		It("should close the connections with close policy", func(done Done) {
+			Expect(tpl.Unlisten("tcp", "127.0.0.1:5108", transport.UnlistenClose)).To(Succeed())
+
+			Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			_, err := conn.Read(make([]byte, 1024))
+			Expect(err).To(Equal(io.EOF))
+			close(done)
+		}, 3)
+	})
+
+	Context("with UDP listeners", func() {
+		BeforeEach(func() {
+			Expect(tpl.Listen("udp", "127.0.0.1:5112")).To(Succeed())
+			Expect(tpl.Listen("udp", "127.0.0.1:5114")).To(Succeed())
+		})
+
+		It("should not put the port of the stopped listener to Via", func(done Done) {
+			Expect(tpl.Unlisten("udp", "127.0.0.1:5112")).To(Succeed())
+
+			peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer peer.Close()
+
+			for i := 0; i < 5; i++ {
+				Expect(tpl.Send(request("UDP", peer.LocalAddr().String()))).To(Succeed())
+				buf := make([]byte, 65535)
+				Expect(peer.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+				n, raddr, err := peer.ReadFrom(buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(raddr.String()).To(Equal("127.0.0.1:5114"))
+				Expect(string(buf[:n])).To(ContainSubstring("Via: SIP/2.0/UDP 127.0.0.1:5114;"))
+			}
+			close(done)
+		}, 3)
+
+		It("should fail on unknown listener", func() {
+			Expect(tpl.Unlisten("udp", "127.0.0.1:5116")).ToNot(Succeed())
+		})
+	})
+})
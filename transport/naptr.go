@@ -0,0 +1,285 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeNAPTR    = 35
+	dnsClassINET    = 1
+	dnsRcodeNoError = 0
+	dnsRcodeNXName  = 3
+	dnsHeaderSize   = 12
+	dnsTimeout      = 5 * time.Second
+)
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// naptrRecord is NAPTR resource record - RFC 3403 - 4.1.
+type naptrRecord struct {
+	order       uint16
+	preference  uint16
+	flags       string
+	service     string
+	regexp      string
+	replacement string
+}
+
+// lookupNAPTR queries NAPTR records, net.Resolver has no such lookup,
+// so the query is sent through the connection of the resolver dial function.
+func lookupNAPTR(ctx context.Context, resolver *net.Resolver, name string) ([]naptrRecord, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildDNSQuery(id, name, dnsTypeNAPTR)
+	if err != nil {
+		return nil, err
+	}
+
+	// nameservers are tried in order until one of them answers, each one within dnsTimeout
+	var lastErr error
+	for _, server := range dnsServers() {
+		res, err := exchangeNAPTR(ctx, resolver, server, query)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		return parseNAPTRResponse(id, res)
+	}
+
+	return nil, lastErr
+}
+
+func exchangeNAPTR(ctx context.Context, resolver *net.Resolver, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	res, err := exchangeDNS(ctx, resolver, "udp", server, query)
+	// truncated response is repeated over TCP - RFC 1035 - 4.2.1.
+	if err == nil && len(res) > 2 && res[2]&0x02 != 0 {
+		res, err = exchangeDNS(ctx, resolver, "tcp", server, query)
+	}
+
+	return res, err
+}
+
+func exchangeDNS(ctx context.Context, resolver *net.Resolver, network, server string, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if resolver != nil && resolver.Dial != nil {
+		conn, err = resolver.Dial(ctx, network, server)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, network, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// stream connections prefix messages with length - RFC 1035 - 4.2.2.
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// dnsServers returns nameservers of resolv.conf, 127.0.0.1:53 if there are none,
+// custom dial function of net.Resolver can ignore them.
+func dnsServers() []string {
+	defaults := []string{"127.0.0.1:53"}
+
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return defaults
+	}
+	defer file.Close()
+
+	servers := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return defaults
+	}
+
+	return servers
+}
+
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderSize, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// recursion desired
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	// one question
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %s", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassINET)
+
+	return msg, nil
+}
+
+func parseNAPTRResponse(id uint16, msg []byte) ([]naptrRecord, error) {
+	if len(msg) < dnsHeaderSize || binary.BigEndian.Uint16(msg) != id {
+		return nil, errDNSMalformed
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case dnsRcodeNoError:
+	case dnsRcodeNXName:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	offset := dnsHeaderSize
+	var err error
+	for i := 0; i < questions; i++ {
+		if _, offset, err = readDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+
+	records := make([]naptrRecord, 0, answers)
+	for i := 0; i < answers; i++ {
+		if _, offset, err = readDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, errDNSMalformed
+		}
+		// answers can include CNAME records
+		if rtype == dnsTypeNAPTR {
+			record, err := parseNAPTR(msg, offset, offset+length)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		offset += length
+	}
+
+	return records, nil
+}
+
+func parseNAPTR(msg []byte, offset, end int) (naptrRecord, error) {
+	var record naptrRecord
+	if offset+4 > end {
+		return record, errDNSMalformed
+	}
+	record.order = binary.BigEndian.Uint16(msg[offset:])
+	record.preference = binary.BigEndian.Uint16(msg[offset+2:])
+	offset += 4
+
+	var err error
+	for _, field := range []*string{&record.flags, &record.service, &record.regexp} {
+		if offset >= end || offset+1+int(msg[offset]) > end {
+			return record, errDNSMalformed
+		}
+		*field = string(msg[offset+1 : offset+1+int(msg[offset])])
+		offset += 1 + int(msg[offset])
+	}
+	if record.replacement, _, err = readDNSName(msg, offset); err != nil {
+		return record, err
+	}
+
+	return record, nil
+}
+
+// readDNSName reads possibly compressed domain name - RFC 1035 - 4.1.4.
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	labels := make([]string, 0)
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			offset++
+			if next < 0 {
+				next = offset
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
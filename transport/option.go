@@ -1,7 +1,12 @@
 package transport
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/ygj201011/gosip/log"
 	"github.com/ygj201011/gosip/sip"
@@ -20,6 +25,24 @@ type LayerOption interface {
 type LayerOptions struct {
 	Options
 	DNSResolver *net.Resolver
+	// UDPSizeThreshold is the size of the request sent over TCP instead of UDP,
+	// DefaultUDPSizeThreshold is used if it is zero, negative value disables switching.
+	UDPSizeThreshold int
+	// ConnectionReuse adds 'alias' parameter to Via of requests sent over TCP and TLS,
+	// so the peer may send its requests back over the same connection - RFC 5923.
+	ConnectionReuse bool
+	// HostIPs are addresses of the families other than the layer IP,
+	// they are used in Via of requests sent to the destinations of the family.
+	HostIPs []net.IP
+	// ContactRewrite replaces local address in Contact of requests with the sent-by of the listener.
+	ContactRewrite bool
+	// TLSRootCAs verify certificates of TLS servers, the system pool is used if nil.
+	TLSRootCAs *x509.CertPool
+	// TLSCertificates are presented to TLS servers requesting client certificate.
+	TLSCertificates []tls.Certificate
+	// WebSocketPingInterval is the interval of pings sent over WS and WSS connections,
+	// the connection is closed if the peer sends nothing in reply. Pings are disabled if it is zero.
+	WebSocketPingInterval time.Duration
 }
 
 type ProtocolOption interface {
@@ -80,6 +103,91 @@ func (o withDnsResolver) ApplyLayer(opts *LayerOptions) {
 	opts.DNSResolver = o.resolver
 }
 
+// WithUDPSizeThreshold sets size of the request that is sent over TCP instead of UDP - RFC 3261 - 18.1.1,
+// it should be 200 bytes less than the path MTU. Zero size keeps DefaultUDPSizeThreshold, negative size disables switching.
+func WithUDPSizeThreshold(size int) LayerOption {
+	return withUDPSizeThreshold{size}
+}
+
+type withUDPSizeThreshold struct {
+	size int
+}
+
+func (o withUDPSizeThreshold) ApplyLayer(opts *LayerOptions) {
+	opts.UDPSizeThreshold = o.size
+}
+
+// WithConnectionReuse allows the peers to reuse connections opened by the layer - RFC 5923.
+func WithConnectionReuse(enabled bool) LayerOption {
+	return withConnectionReuse{enabled}
+}
+
+type withConnectionReuse struct {
+	enabled bool
+}
+
+func (o withConnectionReuse) ApplyLayer(opts *LayerOptions) {
+	opts.ConnectionReuse = o.enabled
+}
+
+// WithHostIPs sets the host addresses used for destinations of other IP families than the layer IP,
+// e.g. IPv6 address of the dual-stack host with IPv4 layer IP.
+func WithHostIPs(ips ...net.IP) LayerOption {
+	return withHostIPs{ips}
+}
+
+type withHostIPs struct {
+	ips []net.IP
+}
+
+func (o withHostIPs) ApplyLayer(opts *LayerOptions) {
+	opts.HostIPs = append(opts.HostIPs, o.ips...)
+}
+
+// WithContactRewrite enables rewriting of Contact URI with local host of the layer
+// to the address advertised by the listener the request is sent from.
+func WithContactRewrite(enabled bool) LayerOption {
+	return withContactRewrite{enabled}
+}
+
+type withContactRewrite struct {
+	enabled bool
+}
+
+func (o withContactRewrite) ApplyLayer(opts *LayerOptions) {
+	opts.ContactRewrite = o.enabled
+}
+
+// WithTLSClient sets CA pool verifying TLS servers and client certificates for mutual TLS
+// on the connections opened by the layer.
+func WithTLSClient(rootCAs *x509.CertPool, certificates ...tls.Certificate) LayerOption {
+	return withTLSClient{rootCAs, certificates}
+}
+
+type withTLSClient struct {
+	rootCAs      *x509.CertPool
+	certificates []tls.Certificate
+}
+
+func (o withTLSClient) ApplyLayer(opts *LayerOptions) {
+	opts.TLSRootCAs = o.rootCAs
+	opts.TLSCertificates = append(opts.TLSCertificates, o.certificates...)
+}
+
+// WithWebSocketPing sets the interval of pings detecting dead WebSocket peers - RFC 6455 - 5.5.2,
+// zero interval disables pings.
+func WithWebSocketPing(interval time.Duration) LayerOption {
+	return withWebSocketPing{interval}
+}
+
+type withWebSocketPing struct {
+	interval time.Duration
+}
+
+func (o withWebSocketPing) ApplyLayer(opts *LayerOptions) {
+	opts.WebSocketPingInterval = o.interval
+}
+
 // Listen method options
 type ListenOption interface {
 	ApplyListen(opts *ListenOptions)
@@ -87,4 +195,190 @@ type ListenOption interface {
 
 type ListenOptions struct {
 	TLSConfig TLSConfig
+	// TLSConfigs are certificates of the listener selected by SNI
+	TLSConfigs []TLSConfig
+	// TLSServerConfig is the base config of TLS listener, e.g. with cipher suites, minimum version and ALPN,
+	// certificates of TLSConfig and other options are applied to its copy.
+	TLSServerConfig *tls.Config
+	// AdvertisedHost and AdvertisedPort are put to Via sent-by of requests sent from the listener
+	// instead of the bound address, e.g. public address of 1:1 NAT. Zero port means the bound port.
+	AdvertisedHost string
+	AdvertisedPort sip.Port
+	// ClientAuth is the policy of TLS client certificates verified with ClientCAs,
+	// identities of verified clients are exposed on received messages by PeerIdentities.
+	ClientAuth tls.ClientAuthType
+	ClientCAs  *x509.CertPool
+	// CertificateReload is the interval of polling TLSConfig files for the renewed certificate,
+	// the certificate is loaded once if it is zero.
+	CertificateReload time.Duration
+	// GetCertificate returns the certificate for new TLS handshakes instead of TLSConfig files.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// WithAdvertisedAddr sets the address the peers reach the listener at.
+func WithAdvertisedAddr(host string, port sip.Port) ListenOption {
+	return withAdvertisedAddr{host, port}
+}
+
+type withAdvertisedAddr struct {
+	host string
+	port sip.Port
+}
+
+func (o withAdvertisedAddr) ApplyListen(opts *ListenOptions) {
+	opts.AdvertisedHost = o.host
+	opts.AdvertisedPort = o.port
+}
+
+// WithClientAuth requests client certificates on TLS listener.
+func WithClientAuth(clientAuth tls.ClientAuthType, clientCAs *x509.CertPool) ListenOption {
+	return withClientAuth{clientAuth, clientCAs}
+}
+
+type withClientAuth struct {
+	clientAuth tls.ClientAuthType
+	clientCAs  *x509.CertPool
+}
+
+func (o withClientAuth) ApplyListen(opts *ListenOptions) {
+	opts.ClientAuth = o.clientAuth
+	opts.ClientCAs = o.clientCAs
+}
+
+// WithTLSServerConfig sets the config of TLS and WSS listener.
+func WithTLSServerConfig(config *tls.Config) ListenOption {
+	return withTLSServerConfig{config}
+}
+
+type withTLSServerConfig struct {
+	config *tls.Config
+}
+
+func (o withTLSServerConfig) ApplyListen(opts *ListenOptions) {
+	opts.TLSServerConfig = o.config
+}
+
+// WithCertificateReload reloads the certificate of TLSConfig files if they are modified,
+// connections established with the previous certificate are kept.
+func WithCertificateReload(interval time.Duration) ListenOption {
+	return withCertificateReload{interval}
+}
+
+type withCertificateReload struct {
+	interval time.Duration
+}
+
+func (o withCertificateReload) ApplyListen(opts *ListenOptions) {
+	opts.CertificateReload = o.interval
+}
+
+// WithGetCertificate sets the callback returning the certificate of TLS listener on each handshake,
+// e.g. from ACME client cache.
+func WithGetCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) ListenOption {
+	return withGetCertificate{getCertificate}
+}
+
+type withGetCertificate struct {
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+func (o withGetCertificate) ApplyListen(opts *ListenOptions) {
+	opts.GetCertificate = o.getCertificate
+}
+
+// Unlisten method options
+type UnlistenOption interface {
+	ApplyUnlisten(opts *UnlistenOptions)
+}
+
+type UnlistenOptions struct {
+	Policy UnlistenPolicy
+}
+
+// UnlistenPolicy defines what happens with the connections accepted by the stopped listener.
+type UnlistenPolicy int
+
+const (
+	// UnlistenDrain keeps the connections until they are closed by the peers or expire.
+	UnlistenDrain UnlistenPolicy = iota
+	// UnlistenClose closes the connections immediately.
+	UnlistenClose
+)
+
+func (p UnlistenPolicy) ApplyUnlisten(opts *UnlistenOptions) {
+	opts.Policy = p
+}
+
+// WebSocketHandler options
+type WebSocketOption interface {
+	ApplyWebSocket(opts *WebSocketOptions)
+}
+
+type WebSocketOptions struct {
+	// CheckOrigin accepts the Origin of the upgrade request,
+	// by default the Origin host must be the requested host if the header is present.
+	CheckOrigin func(r *http.Request) bool
+	// Authorize rejects the upgrade request with 403 Forbidden if it returns error,
+	// e.g. on missing session cookie or bearer token.
+	Authorize func(r *http.Request) error
+	// ForwardedHeaders trusts Forwarded and X-Forwarded-For headers set by the reverse proxy,
+	// the peer address of the connection is taken from them.
+	ForwardedHeaders bool
+}
+
+// WithCheckOrigin sets the callback accepting the Origin of the upgrade request.
+func WithCheckOrigin(checkOrigin func(r *http.Request) bool) WebSocketOption {
+	return withCheckOrigin{checkOrigin}
+}
+
+type withCheckOrigin struct {
+	checkOrigin func(r *http.Request) bool
+}
+
+func (o withCheckOrigin) ApplyWebSocket(opts *WebSocketOptions) {
+	opts.CheckOrigin = o.checkOrigin
+}
+
+// WithAllowedOrigins accepts upgrade requests with the Origin in the list or without it.
+func WithAllowedOrigins(origins ...string) WebSocketOption {
+	return withCheckOrigin{func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range origins {
+			if strings.EqualFold(origin, allowed) {
+				return true
+			}
+		}
+
+		return false
+	}}
+}
+
+// WithAuthorize sets the callback authorizing the upgrade request by its headers and cookies.
+func WithAuthorize(authorize func(r *http.Request) error) WebSocketOption {
+	return withAuthorize{authorize}
+}
+
+type withAuthorize struct {
+	authorize func(r *http.Request) error
+}
+
+func (o withAuthorize) ApplyWebSocket(opts *WebSocketOptions) {
+	opts.Authorize = o.authorize
+}
+
+// WithForwardedHeaders enables the peer address from Forwarded and X-Forwarded-For headers,
+// it must be enabled only behind the reverse proxy overwriting them.
+func WithForwardedHeaders(enabled bool) WebSocketOption {
+	return withForwardedHeaders{enabled}
+}
+
+type withForwardedHeaders struct {
+	enabled bool
+}
+
+func (o withForwardedHeaders) ApplyWebSocket(opts *WebSocketOptions) {
+	opts.ForwardedHeaders = o.enabled
 }
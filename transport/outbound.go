@@ -0,0 +1,273 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ygj201011/gosip/sip"
+)
+
+// KeepAliveTimeout is the time to wait for the keep-alive response - RFC 5626 - 4.4.1.
+const KeepAliveTimeout = 10 * time.Second
+
+const flowTokenMacSize = 10
+
+var (
+	keepAlivePing = []byte("\r\n\r\n")
+	keepAlivePong = []byte("\r\n")
+)
+
+// keepAliveConn delivers keep-alive responses to the sender of the ping.
+type keepAliveConn interface {
+	expectPong(id string) <-chan string
+	cancelPong(id string)
+	receivePong(id string, mappedAddr string) bool
+}
+
+// flowProtocol finds the connection of the flow - RFC 5626 - 3.
+type flowProtocol interface {
+	// flowConnection returns the connection of the stream to raddr,
+	// or UDP connection listening on the port of laddr.
+	flowConnection(laddr, raddr string) (Connection, error)
+}
+
+func (p *tcpProtocol) flowConnection(laddr, raddr string) (Connection, error) {
+	addr, err := p.resolveAddr(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.connections.Get(ConnectionKey(p.network + ":" + addr.String()))
+}
+
+func (p *wsProtocol) flowConnection(laddr, raddr string) (Connection, error) {
+	addr, err := p.resolveAddr(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.connections.Get(ConnectionKey(p.network + ":" + addr.String()))
+}
+
+func (p *udpProtocol) flowConnection(laddr, raddr string) (Connection, error) {
+	var port string
+	if laddr != "" {
+		if _, lport, err := net.SplitHostPort(laddr); err == nil {
+			port = lport
+		}
+	}
+
+	for _, conn := range p.connections.All() {
+		if port == "" || connectionPort(conn) == port {
+			return conn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s connection on port %s not found", p.Network(), port)
+}
+
+// flow is a bidirectional stream of messages between the peers - RFC 5626 - 3.
+type flow struct {
+	network string
+	laddr   string
+	raddr   string
+	connID  string
+}
+
+func (f flow) payload() string {
+	return strings.Join([]string{f.network, f.laddr, f.raddr, f.connID}, "|")
+}
+
+// FlowToken returns token of the flow the message was received over.
+// Edge proxy puts it to the user part of its Path or Record-Route URI - RFC 5626 - 5.2.
+// The token is bound to the connection, a new connection from the same address is a different flow.
+func (tpl *layer) FlowToken(msg sip.Message) (string, error) {
+	viaHop, ok := msg.ViaHop()
+	if !ok {
+		return "", fmt.Errorf("missing required 'Via' header")
+	}
+
+	protocol, ok := tpl.protocols.get(protocolKey(viaHop.Transport))
+	if !ok {
+		return "", UnsupportedProtocolError(fmt.Sprintf("protocol %s is not supported", viaHop.Transport))
+	}
+	flowProto, ok := protocol.(flowProtocol)
+	if !ok {
+		return "", UnsupportedProtocolError(fmt.Sprintf("protocol %s does not support flows", protocol.Network()))
+	}
+
+	conn, err := flowProto.flowConnection(msg.Destination(), msg.Source())
+	if err != nil {
+		return "", fmt.Errorf("find connection of %s: %w", msg.Short(), err)
+	}
+
+	f := flow{
+		network: protocol.Network(),
+		laddr:   msg.Destination(),
+		raddr:   msg.Source(),
+		connID:  connectionID(conn),
+	}
+	payload := []byte(f.payload())
+
+	return base64.RawURLEncoding.EncodeToString(append(tpl.flowMac(payload), payload...)), nil
+}
+
+// Flow returns destination of the flow token,
+// *FlowFailedError is returned if the connection of the flow is closed - RFC 5626 - 5.3.
+func (tpl *layer) Flow(token string) (Destination, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) <= flowTokenMacSize {
+		return Destination{}, InvalidFlowTokenError(fmt.Sprintf("malformed flow token %s", token))
+	}
+	mac, payload := data[:flowTokenMacSize], data[flowTokenMacSize:]
+	if !hmac.Equal(mac, tpl.flowMac(payload)) {
+		return Destination{}, InvalidFlowTokenError(fmt.Sprintf("flow token %s is not issued by %s", token, tpl))
+	}
+
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 4 {
+		return Destination{}, InvalidFlowTokenError(fmt.Sprintf("malformed flow token %s", token))
+	}
+	f := flow{network: parts[0], laddr: parts[1], raddr: parts[2], connID: parts[3]}
+
+	host, port, err := net.SplitHostPort(f.raddr)
+	if err != nil {
+		return Destination{}, InvalidFlowTokenError(fmt.Sprintf("malformed flow token %s", token))
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return Destination{}, InvalidFlowTokenError(fmt.Sprintf("malformed flow token %s", token))
+	}
+	dest := Destination{Transport: f.network, Host: host, Port: sip.Port(portNum)}
+
+	protocol, ok := tpl.protocols.get(protocolKey(f.network))
+	if !ok {
+		return Destination{}, &FlowFailedError{
+			UnsupportedProtocolError(fmt.Sprintf("protocol %s is not supported", f.network)),
+			f.network,
+			f.raddr,
+		}
+	}
+
+	conn, err := protocol.(flowProtocol).flowConnection(f.laddr, f.raddr)
+	if err == nil && connectionID(conn) != f.connID {
+		err = fmt.Errorf("connection %s is replaced", conn.Key())
+	}
+	if err != nil {
+		return Destination{}, &FlowFailedError{err, f.network, f.raddr}
+	}
+
+	return dest, nil
+}
+
+// connectionID returns identifier of the connection the flow is bound to.
+func connectionID(conn Connection) string {
+	if c, ok := conn.(*connection); ok {
+		return c.id
+	}
+
+	return fmt.Sprintf("%p", conn)
+}
+
+func (tpl *layer) flowMac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, tpl.flowKey)
+	mac.Write(payload)
+
+	return mac.Sum(nil)[:flowTokenMacSize]
+}
+
+// KeepAlive sends keep-alive over the flow to addr and waits for the response during timeout - RFC 5626 - 4.4.
+// Double CRLF is sent over streams, STUN binding request over UDP.
+// *FlowFailedError is returned if the flow is closed, the response is not received
+// or the UDP mapped address is changed.
+func (tpl *layer) KeepAlive(network string, addr string, timeout time.Duration) error {
+	protocol, ok := tpl.protocols.get(protocolKey(network))
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("protocol %s is not supported", network))
+	}
+	flowProto, ok := protocol.(flowProtocol)
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("protocol %s does not support flows", protocol.Network()))
+	}
+
+	target, err := NewTargetFromAddr(addr)
+	if err != nil {
+		return fmt.Errorf("build address target for %s: %w", addr, err)
+	}
+	target = FillTargetHostAndPort(protocol.Network(), target)
+
+	failed := func(err error) error {
+		return &FlowFailedError{err, protocol.Network(), target.Addr()}
+	}
+
+	conn, err := flowProto.flowConnection("", target.Addr())
+	if err != nil {
+		return failed(err)
+	}
+	kaConn, ok := conn.(keepAliveConn)
+	if !ok {
+		return UnsupportedProtocolError(fmt.Sprintf("connection %s does not support keep-alives", conn.Key()))
+	}
+
+	var id string
+	var pong <-chan string
+	if conn.Streamed() {
+		pong = kaConn.expectPong(id)
+		_, err = conn.Write(keepAlivePing)
+	} else {
+		var raddr *net.UDPAddr
+		if raddr, err = net.ResolveUDPAddr("udp", target.Addr()); err == nil {
+			req := newStunBindingRequest()
+			id = string(req.TransactionID[:])
+			pong = kaConn.expectPong(id)
+			_, err = conn.WriteTo(req.Bytes(), raddr)
+		}
+	}
+	defer kaConn.cancelPong(id)
+	if err != nil {
+		return failed(fmt.Errorf("send keep-alive: %w", err))
+	}
+
+	tpl.Log().Tracef("keep-alive sent to %s %s", protocol.Network(), target.Addr())
+
+	select {
+	case <-tpl.canceled:
+		return fmt.Errorf("transport layer is canceled")
+	case <-time.After(timeout):
+		if conn.Streamed() {
+			// the flow is dead, so the connection is closed and dropped out from the pool,
+			// the next request opens a new flow
+			if err := conn.Close(); err != nil {
+				tpl.Log().Warnf("close connection %s failed: %s", conn.Key(), err)
+			}
+		}
+
+		return failed(fmt.Errorf("keep-alive response is not received in %s", timeout))
+	case mappedAddr := <-pong:
+		if conn.Streamed() || mappedAddr == "" {
+			return nil
+		}
+
+		// RFC 5626 - 4.4.2. Changed mapped address means that NAT binding is lost.
+		tpl.flowsMu.Lock()
+		prev, ok := tpl.mappedAddrs[target.Addr()]
+		tpl.mappedAddrs[target.Addr()] = mappedAddr
+		tpl.flowsMu.Unlock()
+
+		tpl.observedMu.Lock()
+		tpl.observed[protocol.Network()] = mappedAddr
+		tpl.observedMu.Unlock()
+
+		if ok && prev != mappedAddr {
+			return failed(fmt.Errorf("mapped address changed from %s to %s", prev, mappedAddr))
+		}
+
+		return nil
+	}
+}
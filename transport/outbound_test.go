@@ -0,0 +1,173 @@
+package transport_test
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("TransportLayer with SIP Outbound", func() {
+	var (
+		client transport.Layer
+		edge   transport.Layer
+	)
+	logger := testutils.NewLogrusLogger()
+	clientAddr := "127.0.0.1:5090"
+	edgeAddr := "127.0.0.1:5092"
+
+	request := func(network string, dest string) sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@" + dest + " SIP/2.0",
+			"Via: SIP/2.0/" + network + " 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: outbound",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(dest)
+		return req
+	}
+	receive := func(tpl transport.Layer) sip.Message {
+		var msg sip.Message
+		Eventually(tpl.Messages(), 3*time.Second).Should(Receive(&msg))
+		return msg
+	}
+
+	BeforeEach(func() {
+		client = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		Expect(client.Listen("udp", clientAddr)).To(Succeed())
+		Expect(client.Listen("tcp", clientAddr)).To(Succeed())
+		edge = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		Expect(edge.Listen("udp", edgeAddr)).To(Succeed())
+		Expect(edge.Listen("tcp", edgeAddr)).To(Succeed())
+	})
+	AfterEach(func() {
+		client.Cancel()
+		<-client.Done()
+		edge.Cancel()
+		<-edge.Done()
+	})
+
+	Context("when client connects over TCP", func() {
+		var token string
+
+		BeforeEach(func() {
+			Expect(client.Send(request("TCP", edgeAddr))).To(Succeed())
+
+			var err error
+			token, err = edge.FlowToken(receive(edge))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should route request back over the flow", func(done Done) {
+			dest, err := edge.Flow(token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dest.Transport).To(Equal("TCP"))
+			// the client does not listen on the port of the flow
+			Expect(dest.Addr()).ToNot(Equal(clientAddr))
+
+			Expect(edge.Send(request("TCP", dest.Addr()))).To(Succeed())
+			Expect(receive(client).(sip.Request).Method()).To(Equal(sip.OPTIONS))
+			close(done)
+		}, 5)
+
+		It("should answer CRLF keep-alives", func(done Done) {
+			Expect(client.KeepAlive("TCP", edgeAddr, time.Second)).To(Succeed())
+			Expect(client.KeepAlive("TCP", edgeAddr, time.Second)).To(Succeed())
+			close(done)
+		}, 5)
+
+		It("should reject foreign flow tokens", func(done Done) {
+			_, err := edge.Flow(token[:len(token)-2] + "xx")
+			var tokenErr transport.InvalidFlowTokenError
+			Expect(errors.As(err, &tokenErr)).To(BeTrue())
+
+			_, err = client.Flow(token)
+			Expect(errors.As(err, &tokenErr)).To(BeTrue())
+			close(done)
+		}, 5)
+
+		It("should fail the flow when the connection is closed", func(done Done) {
+			client.Cancel()
+			<-client.Done()
+
+			Eventually(func() error {
+				_, err := edge.Flow(token)
+				return err
+			}, 3*time.Second).Should(BeAssignableToTypeOf(&transport.FlowFailedError{}))
+			close(done)
+		}, 5)
+	})
+
+	Context("when client sends over UDP", func() {
+		It("should route request back over the flow", func(done Done) {
+			Expect(client.Send(request("UDP", edgeAddr))).To(Succeed())
+			token, err := edge.FlowToken(receive(edge))
+			Expect(err).ToNot(HaveOccurred())
+
+			dest, err := edge.Flow(token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dest).To(Equal(transport.Destination{Transport: "UDP", Host: "127.0.0.1", Port: 5090}))
+			close(done)
+		}, 5)
+
+		It("should answer STUN keep-alives", func(done Done) {
+			Expect(client.KeepAlive("UDP", edgeAddr, time.Second)).To(Succeed())
+
+			addr, ok := client.ObservedAddr("UDP")
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(clientAddr))
+			close(done)
+		}, 5)
+	})
+
+	Context("when keep-alive is not answered", func() {
+		var server net.Listener
+
+		BeforeEach(func() {
+			var err error
+			server, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should close the flow", func(done Done) {
+			closed := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+
+				conn, err := server.Accept()
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+
+				buf := make([]byte, 65535)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						close(closed)
+						return
+					}
+				}
+			}()
+
+			addr := server.Addr().String()
+			Expect(client.Send(request("TCP", addr))).To(Succeed())
+
+			err := client.KeepAlive("TCP", addr, 200*time.Millisecond)
+			Expect(err).To(BeAssignableToTypeOf(&transport.FlowFailedError{}))
+			Eventually(closed, time.Second).Should(BeClosed())
+			close(done)
+		}, 5)
+	})
+})
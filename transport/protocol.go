@@ -1,7 +1,10 @@
 package transport
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -25,6 +28,36 @@ type Protocol interface {
 	String() string
 }
 
+// listenerProtocol serves connections accepted by pre-opened listener.
+type listenerProtocol interface {
+	listenOn(listener net.Listener, options ...ListenOption) error
+}
+
+// packetProtocol serves messages received by pre-opened packet connection.
+type packetProtocol interface {
+	listenPacket(conn net.PacketConn) error
+}
+
+// connProtocol serves connections accepted outside of the protocol, e.g. by WebSocketHandler.
+type connProtocol interface {
+	serveConn(conn net.Conn) error
+}
+
+// pingProtocol pings peers of the connections to detect dead ones.
+type pingProtocol interface {
+	setPingInterval(interval time.Duration)
+}
+
+// tlsClientProtocol verifies servers and presents client certificates on the dialed connections.
+type tlsClientProtocol interface {
+	setTLSClient(rootCAs *x509.CertPool, certificates []tls.Certificate)
+}
+
+// unlistenProtocol stops the listener bound to the address.
+type unlistenProtocol interface {
+	unlisten(ip net.IP, port sip.Port, policy UnlistenPolicy) error
+}
+
 type ProtocolFactory func(
 	network string,
 	output chan<- sip.Message,
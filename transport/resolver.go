@@ -0,0 +1,281 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+)
+
+// Destination is a located SIP server - RFC 3263 - 4.
+type Destination struct {
+	Transport string
+	Host      string
+	Port      sip.Port
+}
+
+// Addr returns host:port of the destination.
+func (dest Destination) Addr() string {
+	return net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port)))
+}
+
+func (dest Destination) String() string {
+	return fmt.Sprintf("%s/%s", dest.Transport, dest.Addr())
+}
+
+// Resolver locates SIP servers of the URI - RFC 3263.
+type Resolver interface {
+	// Resolve returns destinations ordered by preference, the next one should be tried
+	// on timeout, transport error or 503 Service Unavailable - RFC 3263 - 4.3.
+	Resolve(ctx context.Context, uri sip.Uri) ([]Destination, error)
+}
+
+// naptrServices maps NAPTR services to transports - RFC 3263 - 4.1, RFC 7118 - 5.
+var naptrServices = map[string]string{
+	"SIP+D2U":  "UDP",
+	"SIP+D2T":  "TCP",
+	"SIPS+D2T": "TLS",
+	"SIP+D2W":  "WS",
+	"SIPS+D2W": "WSS",
+}
+
+// srvServices are queried in order when there are no NAPTR records - RFC 3263 - 4.1.
+var srvServices = []struct {
+	service   string
+	proto     string
+	transport string
+	secure    bool
+}{
+	{"sip", "udp", "UDP", false},
+	{"sip", "tcp", "TCP", false},
+	{"sips", "tcp", "TLS", true},
+}
+
+type resolver struct {
+	dns *net.Resolver
+
+	log log.Logger
+}
+
+// NewResolver creates RFC 3263 resolver, net.DefaultResolver is used if dns is nil.
+func NewResolver(dns *net.Resolver, logger log.Logger) Resolver {
+	if dns == nil {
+		dns = net.DefaultResolver
+	}
+
+	r := &resolver{
+		dns: dns,
+	}
+	r.log = logger.
+		WithPrefix("transport.Resolver").
+		WithFields(log.Fields{
+			"resolver_ptr": fmt.Sprintf("%p", r),
+		})
+
+	return r
+}
+
+func (r *resolver) String() string {
+	if r == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("transport.Resolver<%s>", r.Log().Fields())
+}
+
+func (r *resolver) Log() log.Logger {
+	return r.log
+}
+
+func (r *resolver) Resolve(ctx context.Context, uri sip.Uri) ([]Destination, error) {
+	sipUri, ok := uri.(*sip.SipUri)
+	if !ok {
+		return nil, fmt.Errorf("resolve %s: not a SIP URI", uri)
+	}
+
+	host := strings.TrimSuffix(strings.Trim(sipUri.FHost, "[]"), ".")
+	secure := sipUri.FIsEncrypted
+
+	transport := ""
+	if sipUri.FUriParams != nil {
+		if value, ok := sipUri.FUriParams.Get("transport"); ok && value != nil {
+			transport = strings.ToUpper(value.String())
+		}
+	}
+	if secure {
+		switch transport {
+		case "", "TCP":
+			transport = "TLS"
+		case "WS":
+			transport = "WSS"
+		}
+	}
+
+	var dests []Destination
+	var err error
+	switch {
+	case net.ParseIP(host) != nil || sipUri.FPort != nil:
+		// RFC 3263 - 4.1, 4.2. Numeric IP or explicit port skips NAPTR and SRV.
+		if transport == "" {
+			transport = "UDP"
+		}
+		port := sip.DefaultPort(transport)
+		if sipUri.FPort != nil {
+			port = *sipUri.FPort
+		}
+		dests, err = r.lookupHost(ctx, host, transport, port)
+	case transport != "":
+		dests, err = r.lookupService(ctx, host, transport)
+	default:
+		dests, err = r.lookupNAPTR(ctx, host, secure)
+		if err == nil && len(dests) == 0 {
+			for _, srv := range srvServices {
+				if secure && !srv.secure {
+					continue
+				}
+				found, srvErr := r.lookupSRV(ctx, srv.service, srv.proto, host, srv.transport)
+				if srvErr != nil {
+					r.Log().Debugf("SRV lookup _%s._%s.%s failed: %s", srv.service, srv.proto, host, srvErr)
+					continue
+				}
+				dests = append(dests, found...)
+			}
+		}
+		if err == nil && len(dests) == 0 {
+			transport = "UDP"
+			if secure {
+				transport = "TLS"
+			}
+			dests, err = r.lookupHost(ctx, host, transport, sip.DefaultPort(transport))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", uri, err)
+	}
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("resolve %s: no destinations found", uri)
+	}
+
+	r.Log().Debugf("%s resolved to %v", uri, dests)
+
+	return dests, nil
+}
+
+// lookupNAPTR returns destinations of supported NAPTR records in order - RFC 3263 - 4.1.
+func (r *resolver) lookupNAPTR(ctx context.Context, host string, secure bool) ([]Destination, error) {
+	records, err := lookupNAPTR(ctx, r.dns, host)
+	if err != nil {
+		// NAPTR is optional, so SRV records are tried next
+		r.Log().Debugf("NAPTR lookup %s failed: %s", host, err)
+		return nil, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].order != records[j].order {
+			return records[i].order < records[j].order
+		}
+		return records[i].preference < records[j].preference
+	})
+
+	dests := make([]Destination, 0)
+	for _, record := range records {
+		transport, ok := naptrServices[strings.ToUpper(record.service)]
+		if !ok || !strings.EqualFold(record.flags, "s") || record.replacement == "." {
+			continue
+		}
+		if secure && !strings.HasPrefix(strings.ToUpper(record.service), "SIPS") {
+			continue
+		}
+
+		found, err := r.lookupSRVName(ctx, record.replacement, transport)
+		if err != nil {
+			r.Log().Debugf("SRV lookup %s failed: %s", record.replacement, err)
+			continue
+		}
+		dests = append(dests, found...)
+	}
+
+	return dests, nil
+}
+
+// lookupService returns destinations of the transport using SRV or A/AAAA records - RFC 3263 - 4.2.
+func (r *resolver) lookupService(ctx context.Context, host, transport string) ([]Destination, error) {
+	service, proto := "sip", "udp"
+	switch transport {
+	case "TCP":
+		proto = "tcp"
+	case "TLS":
+		service, proto = "sips", "tcp"
+	case "WS":
+		proto = "ws"
+	case "WSS":
+		service, proto = "sips", "ws"
+	}
+
+	if dests, err := r.lookupSRV(ctx, service, proto, host, transport); err == nil && len(dests) > 0 {
+		return dests, nil
+	}
+
+	return r.lookupHost(ctx, host, transport, sip.DefaultPort(transport))
+}
+
+// lookupSRV returns SRV targets ordered by priority and randomized by weight - RFC 2782.
+func (r *resolver) lookupSRV(ctx context.Context, service, proto, host, transport string) ([]Destination, error) {
+	_, srvs, err := r.dns.LookupSRV(ctx, service, proto, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.srvDestinations(ctx, srvs, transport), nil
+}
+
+func (r *resolver) lookupSRVName(ctx context.Context, name, transport string) ([]Destination, error) {
+	_, srvs, err := r.dns.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.srvDestinations(ctx, srvs, transport), nil
+}
+
+func (r *resolver) srvDestinations(ctx context.Context, srvs []*net.SRV, transport string) []Destination {
+	dests := make([]Destination, 0)
+	for _, srv := range srvs {
+		// RFC 2782. Target "." means the service is not available.
+		if srv.Target == "." {
+			continue
+		}
+
+		found, err := r.lookupHost(ctx, strings.TrimSuffix(srv.Target, "."), transport, sip.Port(srv.Port))
+		if err != nil {
+			r.Log().Debugf("lookup SRV target %s failed: %s", srv.Target, err)
+			continue
+		}
+		dests = append(dests, found...)
+	}
+
+	return dests
+}
+
+func (r *resolver) lookupHost(ctx context.Context, host, transport string, port sip.Port) ([]Destination, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []Destination{{Transport: transport, Host: ip.String(), Port: port}}, nil
+	}
+
+	addrs, err := r.dns.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dests := make([]Destination, 0, len(addrs))
+	for _, addr := range addrs {
+		dests = append(dests, Destination{Transport: transport, Host: addr.IP.String(), Port: port})
+	}
+
+	return dests, nil
+}
@@ -0,0 +1,345 @@
+package transport_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/sip/parser"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeSRV   = 33
+	dnsTypeNAPTR = 35
+)
+
+type naptr struct {
+	order, preference uint16
+	service           string
+	replacement       string
+}
+
+type srv struct {
+	priority, weight, port uint16
+	target                 string
+}
+
+// stubDNS answers queries from the zone over UDP.
+type stubDNS struct {
+	conn    net.PacketConn
+	queries int32
+	naptrs  map[string][]naptr
+	srvs    map[string][]srv
+	hosts   map[string]net.IP
+}
+
+func newStubDNS() *stubDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	dns := &stubDNS{
+		conn:   conn,
+		naptrs: make(map[string][]naptr),
+		srvs:   make(map[string][]srv),
+		hosts:  make(map[string]net.IP),
+	}
+	go dns.serve()
+
+	return dns
+}
+
+func (dns *stubDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", dns.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (dns *stubDNS) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := dns.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&dns.queries, 1)
+		if res := dns.answer(buf[:n]); res != nil {
+			_, _ = dns.conn.WriteTo(res, addr)
+		}
+	}
+}
+
+func (dns *stubDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// question name
+	offset := 12
+	labels := make([]string, 0)
+	for offset < len(query) && query[offset] != 0 {
+		length := int(query[offset])
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	offset++
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	question := query[12 : offset+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	answers := make([][]byte, 0)
+	switch qtype {
+	case dnsTypeNAPTR:
+		for _, rr := range dns.naptrs[name] {
+			rdata := make([]byte, 4)
+			binary.BigEndian.PutUint16(rdata, rr.order)
+			binary.BigEndian.PutUint16(rdata[2:], rr.preference)
+			rdata = append(rdata, 1, 's')
+			rdata = append(rdata, byte(len(rr.service)))
+			rdata = append(rdata, rr.service...)
+			rdata = append(rdata, 0)
+			rdata = append(rdata, encodeName(rr.replacement)...)
+			answers = append(answers, rdata)
+		}
+	case dnsTypeSRV:
+		for _, rr := range dns.srvs[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata, rr.priority)
+			binary.BigEndian.PutUint16(rdata[2:], rr.weight)
+			binary.BigEndian.PutUint16(rdata[4:], rr.port)
+			rdata = append(rdata, encodeName(rr.target)...)
+			answers = append(answers, rdata)
+		}
+	case dnsTypeA:
+		if ip, ok := dns.hosts[name]; ok {
+			answers = append(answers, ip.To4())
+		}
+	}
+
+	_, known := dns.hosts[name]
+	known = known || len(dns.naptrs[name]) > 0 || len(dns.srvs[name]) > 0
+
+	res := make([]byte, 12)
+	copy(res, query[:2])
+	flags := uint16(0x8180)
+	if !known {
+		// NXDOMAIN
+		flags |= 3
+	}
+	binary.BigEndian.PutUint16(res[2:], flags)
+	binary.BigEndian.PutUint16(res[4:], 1)
+	binary.BigEndian.PutUint16(res[6:], uint16(len(answers)))
+	res = append(res, question...)
+	for _, rdata := range answers {
+		// pointer to the question name
+		res = append(res, 0xc0, 12)
+		rr := make([]byte, 10)
+		binary.BigEndian.PutUint16(rr, qtype)
+		binary.BigEndian.PutUint16(rr[2:], 1)
+		binary.BigEndian.PutUint32(rr[4:], 60)
+		binary.BigEndian.PutUint16(rr[8:], uint16(len(rdata)))
+		res = append(res, rr...)
+		res = append(res, rdata...)
+	}
+
+	return res
+}
+
+func (dns *stubDNS) close() {
+	_ = dns.conn.Close()
+}
+
+func encodeName(name string) []byte {
+	buf := make([]byte, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	return append(buf, 0)
+}
+
+func mustParseUri(value string) sip.Uri {
+	uri, err := parser.ParseUri(value)
+	Expect(err).ToNot(HaveOccurred())
+
+	return uri
+}
+
+var _ = Describe("Resolver", func() {
+	var (
+		dns      *stubDNS
+		resolver transport.Resolver
+	)
+	logger := testutils.NewLogrusLogger()
+
+	resolve := func(uri string) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		dests, err := resolver.Resolve(ctx, mustParseUri(uri))
+		Expect(err).ToNot(HaveOccurred())
+
+		result := make([]string, 0, len(dests))
+		for _, dest := range dests {
+			result = append(result, dest.String())
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		dns = newStubDNS()
+		dns.naptrs["example.test"] = []naptr{
+			{30, 10, "SIPS+D2T", "_sips._tcp.example.test"},
+			{20, 10, "SIP+D2U", "_sip._udp.example.test"},
+			{10, 10, "SIP+D2T", "_sip._tcp.example.test"},
+			{10, 20, "E2U+sip", "ignored.example.test"},
+		}
+		dns.srvs["_sip._tcp.example.test"] = []srv{
+			{20, 0, 5080, "proxy2.example.test"},
+			{10, 0, 5070, "proxy1.example.test"},
+		}
+		dns.srvs["_sip._udp.example.test"] = []srv{{10, 0, 5060, "proxy3.example.test"}}
+		dns.srvs["_sips._tcp.example.test"] = []srv{{10, 0, 5061, "proxy1.example.test"}}
+		dns.srvs["_sip._udp.srv.test"] = []srv{{10, 0, 5090, "proxy3.example.test"}}
+		dns.hosts["proxy1.example.test"] = net.ParseIP("10.0.0.1")
+		dns.hosts["proxy2.example.test"] = net.ParseIP("10.0.0.2")
+		dns.hosts["proxy3.example.test"] = net.ParseIP("10.0.0.3")
+		dns.hosts["host.test"] = net.ParseIP("10.0.0.9")
+
+		resolver = transport.NewResolver(dns.resolver(), logger)
+	})
+	AfterEach(func() {
+		dns.close()
+	})
+
+	It("should follow NAPTR order and SRV priority", func() {
+		Expect(resolve("sip:example.test")).To(Equal([]string{
+			"TCP/10.0.0.1:5070",
+			"TCP/10.0.0.2:5080",
+			"UDP/10.0.0.3:5060",
+			"TLS/10.0.0.1:5061",
+		}))
+	})
+
+	It("should use only SIPS services for sips URI", func() {
+		Expect(resolve("sips:example.test")).To(Equal([]string{"TLS/10.0.0.1:5061"}))
+	})
+
+	It("should use SRV records of the transport parameter", func() {
+		Expect(resolve("sip:example.test;transport=udp")).To(Equal([]string{"UDP/10.0.0.3:5060"}))
+	})
+
+	It("should query SRV records without NAPTR", func() {
+		Expect(resolve("sip:srv.test")).To(Equal([]string{"UDP/10.0.0.3:5090"}))
+	})
+
+	It("should fall back to A records with the default port", func() {
+		Expect(resolve("sip:host.test")).To(Equal([]string{"UDP/10.0.0.9:5060"}))
+		Expect(resolve("sip:host.test;transport=tcp")).To(Equal([]string{"TCP/10.0.0.9:5060"}))
+		Expect(resolve("sips:host.test")).To(Equal([]string{"TLS/10.0.0.9:5061"}))
+	})
+
+	It("should skip NAPTR and SRV for explicit port and IP", func() {
+		Expect(resolve("sip:proxy1.example.test:5099")).To(Equal([]string{"UDP/10.0.0.1:5099"}))
+		Expect(resolve("sip:10.0.0.5;transport=tcp")).To(Equal([]string{"TCP/10.0.0.5:5060"}))
+	})
+
+	It("should fail on unknown host", func() {
+		_, err := resolver.Resolve(context.Background(), mustParseUri("sip:unknown.test"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("used by transport layer", func() {
+		var (
+			tpl    transport.Layer
+			server net.PacketConn
+		)
+
+		BeforeEach(func() {
+			var err error
+			server, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			closed, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			closedPort := closed.Addr().(*net.TCPAddr).Port
+			Expect(closed.Close()).To(Succeed())
+
+			dns.naptrs["failover.test"] = []naptr{
+				{10, 10, "SIP+D2T", "_sip._tcp.failover.test"},
+				{20, 10, "SIP+D2U", "_sip._udp.failover.test"},
+			}
+			dns.srvs["_sip._tcp.failover.test"] = []srv{{10, 0, uint16(closedPort), "local.test"}}
+			dns.srvs["_sip._udp.failover.test"] = []srv{{10, 0, uint16(server.LocalAddr().(*net.UDPAddr).Port), "local.test"}}
+			dns.hosts["local.test"] = net.ParseIP("127.0.0.1")
+
+			tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), dns.resolver(), nil, logger)
+			Expect(tpl.Listen("udp", "127.0.0.1:0")).To(Succeed())
+			Expect(tpl.Listen("tcp", "127.0.0.1:0")).To(Succeed())
+		})
+		AfterEach(func() {
+			tpl.Cancel()
+			<-tpl.Done()
+			_ = server.Close()
+		})
+
+		It("should send request to the next destination after connect failure", func() {
+			req := testutils.Request([]string{
+				"OPTIONS sip:bob@failover.test SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@example.test>;tag=1",
+				"To: <sip:bob@failover.test>",
+				"Call-ID: resolver-test",
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+			Expect(tpl.Send(req)).To(Succeed())
+
+			buf := make([]byte, 4096)
+			Expect(server.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			n, _, err := server.ReadFrom(buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(ContainSubstring("OPTIONS sip:bob@failover.test SIP/2.0"))
+			Expect(string(buf[:n])).To(ContainSubstring("Via: SIP/2.0/UDP 127.0.0.1"))
+			Expect(req.Destination()).To(Equal(server.LocalAddr().String()))
+		})
+
+		It("should not resolve the same URI again for the next request", func() {
+			request := func(callID string) sip.Request {
+				return testutils.Request([]string{
+					"OPTIONS sip:bob@failover.test SIP/2.0",
+					"Via: SIP/2.0/UDP 127.0.0.1;branch=" + sip.GenerateBranch(),
+					"From: <sip:alice@example.test>;tag=1",
+					"To: <sip:bob@failover.test>",
+					"Call-ID: " + callID,
+					"CSeq: 1 OPTIONS",
+					"Content-Length: 0",
+					"",
+					"",
+				})
+			}
+			Expect(tpl.Send(request("resolver-cache-1"))).To(Succeed())
+			queries := atomic.LoadInt32(&dns.queries)
+			Expect(queries).To(BeNumerically(">", 0))
+
+			req := request("resolver-cache-2")
+			Expect(tpl.Send(req)).To(Succeed())
+			Expect(atomic.LoadInt32(&dns.queries)).To(Equal(queries))
+			Expect(req.Destination()).To(Equal(server.LocalAddr().String()))
+		})
+	})
+})
@@ -0,0 +1,321 @@
+package transport
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ygj201011/gosip/sip"
+)
+
+// listenAddr is the bound and advertised address of the layer listener.
+type listenAddr struct {
+	network string
+	// ip is nil or unspecified for wildcard listeners
+	ip             net.IP
+	port           sip.Port
+	advertisedHost string
+	advertisedPort sip.Port
+}
+
+func (addr *listenAddr) wildcard() bool {
+	return addr.ip == nil || addr.ip.IsUnspecified()
+}
+
+// sentBy returns host and port for Via sent-by of requests sent from the listener,
+// host IP is used for wildcard listeners without advertised host.
+func (addr *listenAddr) sentBy(hostIP net.IP) (string, sip.Port) {
+	host := addr.advertisedHost
+	if host == "" {
+		if addr.wildcard() {
+			host = hostIP.String()
+		} else {
+			host = addr.ip.String()
+		}
+	}
+	port := addr.advertisedPort
+	if port == 0 {
+		port = addr.port
+	}
+
+	return host, port
+}
+
+// localAddr returns the address the listener is bound to.
+func (addr *listenAddr) localAddr() string {
+	host := ""
+	if !addr.wildcard() {
+		host = addr.ip.String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(addr.port)))
+}
+
+// addListenAddr registers the listener address and its port for Via sent-by.
+func (tpl *layer) addListenAddr(network string, ip net.IP, port sip.Port, options ...ListenOption) {
+	opts := ListenOptions{}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyListen(&opts)
+		}
+	}
+
+	tpl.listenAddrsMu.Lock()
+	tpl.listenAddrs = append(tpl.listenAddrs, &listenAddr{
+		network:        network,
+		ip:             ip,
+		port:           port,
+		advertisedHost: opts.AdvertisedHost,
+		advertisedPort: opts.AdvertisedPort,
+	})
+	tpl.updateListenPorts(network)
+	tpl.listenAddrsMu.Unlock()
+}
+
+// removeListenAddr unregisters the stopped listener, so its port is not put to Via anymore.
+func (tpl *layer) removeListenAddr(network string, ip net.IP, port sip.Port) {
+	tpl.listenAddrsMu.Lock()
+	defer tpl.listenAddrsMu.Unlock()
+
+	for i, addr := range tpl.listenAddrs {
+		if addr.network != network || addr.port != port {
+			continue
+		}
+		if (addr.wildcard() && (ip == nil || ip.IsUnspecified())) || addr.ip.Equal(ip) {
+			tpl.listenAddrs = append(tpl.listenAddrs[:i], tpl.listenAddrs[i+1:]...)
+			break
+		}
+	}
+	tpl.updateListenPorts(network)
+}
+
+// updateListenPorts collects distinct ports of the network listeners,
+// should be called under listenAddrsMu lock.
+func (tpl *layer) updateListenPorts(network string) {
+	ports := make([]sip.Port, 0)
+	seen := make(map[sip.Port]bool)
+	for _, addr := range tpl.listenAddrs {
+		if addr.network == network && !seen[addr.port] {
+			seen[addr.port] = true
+			ports = append(ports, addr.port)
+		}
+	}
+
+	if len(ports) == 0 {
+		delete(tpl.listenPorts, network)
+	} else {
+		tpl.listenPorts[network] = ports
+	}
+}
+
+// listenPort returns random port of the network listeners.
+func (tpl *layer) listenPort(network string) (sip.Port, bool) {
+	tpl.listenAddrsMu.RLock()
+	defer tpl.listenAddrsMu.RUnlock()
+
+	ports, ok := tpl.listenPorts[network]
+	if !ok {
+		return 0, false
+	}
+
+	return ports[rand.Intn(len(ports))], true
+}
+
+func (tpl *layer) ListenAddrs(network string) []net.Addr {
+	network = strings.ToUpper(network)
+
+	tpl.listenAddrsMu.RLock()
+	defer tpl.listenAddrsMu.RUnlock()
+
+	addrs := make([]net.Addr, 0)
+	for _, addr := range tpl.listenAddrs {
+		if addr.network != network {
+			continue
+		}
+		if network == "UDP" {
+			addrs = append(addrs, &net.UDPAddr{IP: addr.ip, Port: int(addr.port)})
+		} else {
+			addrs = append(addrs, &net.TCPAddr{IP: addr.ip, Port: int(addr.port)})
+		}
+	}
+
+	return addrs
+}
+
+// resolveListenIP returns IP of the listen host, nil is returned if the host is not resolved.
+func resolveListenIP(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	if addr, err := net.ResolveIPAddr("ip", host); err == nil {
+		return addr.IP
+	}
+
+	return nil
+}
+
+// selectListenAddr finds the listener of the network for the destination on multi-homed host:
+// listener bound to the source IP of the route to the destination is preferred over wildcard listener,
+// the listener with the port is preferred among the equal ones.
+func (tpl *layer) selectListenAddr(network string, destHost string, port *sip.Port) (*listenAddr, bool) {
+	dest := net.ParseIP(destHost)
+
+	tpl.listenAddrsMu.RLock()
+	defer tpl.listenAddrsMu.RUnlock()
+
+	var srcIP net.IP
+	var bound, wildcard []*listenAddr
+	for _, addr := range tpl.listenAddrs {
+		if addr.network != network {
+			continue
+		}
+		if addr.wildcard() {
+			wildcard = append(wildcard, addr)
+			continue
+		}
+
+		if dest == nil {
+			continue
+		}
+		if srcIP == nil {
+			if srcIP = tpl.routeSourceIP(dest); srcIP == nil {
+				continue
+			}
+		}
+		if addr.ip.Equal(srcIP) {
+			bound = append(bound, addr)
+		}
+	}
+
+	for _, candidates := range [][]*listenAddr{bound, wildcard} {
+		if len(candidates) == 0 {
+			continue
+		}
+		for _, addr := range candidates {
+			if port != nil && addr.port == *port {
+				return addr, true
+			}
+		}
+
+		return candidates[0], true
+	}
+
+	return nil, false
+}
+
+// routeSource is the cached source IP of the route to the destination, ip is nil if there is no route.
+type routeSource struct {
+	ip     net.IP
+	expiry time.Time
+}
+
+// routeSourceIP returns the source IP of the route to the destination,
+// the route is looked up once per routeSourceTTL instead of every sent message.
+func (tpl *layer) routeSourceIP(dest net.IP) net.IP {
+	key := dest.String()
+	now := time.Now()
+
+	tpl.routeSourcesMu.Lock()
+	src, ok := tpl.routeSources[key]
+	tpl.routeSourcesMu.Unlock()
+	if ok && now.Before(src.expiry) {
+		return src.ip
+	}
+
+	ip := lookupRouteSourceIP(dest)
+
+	tpl.routeSourcesMu.Lock()
+	defer tpl.routeSourcesMu.Unlock()
+
+	for k, src := range tpl.routeSources {
+		if now.After(src.expiry) {
+			delete(tpl.routeSources, k)
+		}
+	}
+	tpl.routeSources[key] = routeSource{ip: ip, expiry: now.Add(routeSourceTTL)}
+
+	return ip
+}
+
+// lookupRouteSourceIP returns the source IP the host routes packets to the destination from,
+// connected UDP socket sends nothing.
+func lookupRouteSourceIP(dest net.IP) net.IP {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dest, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// rewriteContact replaces local host in Contact URIs of the request with the sent-by, the port is removed if it is nil.
+func (tpl *layer) rewriteContact(req sip.Request, host string, port *sip.Port) {
+	for _, hdr := range req.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil {
+			continue
+		}
+		uri, ok := contact.Address.(*sip.SipUri)
+		if !ok || !tpl.isLocalHost(uri.FHost) {
+			continue
+		}
+
+		uri.FHost = host
+		if port != nil {
+			p := *port
+			uri.FPort = &p
+		} else {
+			uri.FPort = nil
+		}
+	}
+}
+
+// setContactTransport adds transport parameter to Contact URIs of the request with local host or the sent-by one,
+// e.g. 'ws' for both WS and WSS - RFC 7118 - 5.
+func (tpl *layer) setContactTransport(req sip.Request, sentBy string, transport string) {
+	for _, hdr := range req.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil {
+			continue
+		}
+		uri, ok := contact.Address.(*sip.SipUri)
+		if !ok || (!strings.EqualFold(uri.FHost, sentBy) && !tpl.isLocalHost(uri.FHost)) {
+			continue
+		}
+
+		if uri.FUriParams == nil {
+			uri.FUriParams = sip.NewParams()
+		}
+		uri.FUriParams.Add("transport", sip.String{Str: transport})
+	}
+}
+
+// isLocalHost checks that the host is unspecified or the address of the layer or its listener.
+func (tpl *layer) isLocalHost(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsUnspecified() {
+		return true
+	}
+	for _, hostIP := range tpl.ips {
+		if ip.Equal(hostIP) {
+			return true
+		}
+	}
+
+	tpl.listenAddrsMu.RLock()
+	defer tpl.listenAddrsMu.RUnlock()
+
+	for _, addr := range tpl.listenAddrs {
+		if ip.Equal(addr.ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+package transport_test
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("TransportLayer on multi-homed host", func() {
+	var (
+		tpl  transport.Layer
+		peer net.PacketConn
+	)
+	logger := testutils.NewLogrusLogger()
+
+	request := func(dest string) sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@" + dest + " SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Contact: <sip:alice@127.0.0.1:5060>",
+			"Call-ID: multi-homed",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(dest)
+		return req
+	}
+	read := func() (string, net.Addr) {
+		buf := make([]byte, 65535)
+		Expect(peer.SetReadDeadline(time.Now().Add(3 * time.Second))).To(Succeed())
+		n, raddr, err := peer.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		return string(buf[:n]), raddr
+	}
+
+	BeforeEach(func() {
+		var err error
+		peer, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		peer.Close()
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	Context("with listeners on several interfaces", func() {
+		BeforeEach(func() {
+			tpl = transport.NewLayer(net.ParseIP("127.0.0.2"), net.DefaultResolver, nil, logger)
+			Expect(tpl.Listen("udp", "127.0.0.2:5102")).To(Succeed())
+			Expect(tpl.Listen("udp", "127.0.0.1:5102")).To(Succeed())
+		})
+
+		It("should send request from the listener on the route to the destination", func(done Done) {
+			Expect(tpl.Send(request(peer.LocalAddr().String()))).To(Succeed())
+
+			data, raddr := read()
+			Expect(raddr.String()).To(Equal("127.0.0.1:5102"))
+			Expect(data).To(ContainSubstring("Via: SIP/2.0/UDP 127.0.0.1:5102;"))
+			close(done)
+		}, 5)
+	})
+
+	Context("with listener behind 1:1 NAT", func() {
+		BeforeEach(func() {
+			tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger,
+				transport.WithContactRewrite(true))
+			Expect(tpl.Listen("udp", "127.0.0.2:5104")).To(Succeed())
+			Expect(tpl.Listen("udp", "127.0.0.1:5104", transport.WithAdvertisedAddr("203.0.113.1", 5062))).To(Succeed())
+		})
+
+		It("should put advertised address to Via and Contact", func(done Done) {
+			Expect(tpl.Send(request(peer.LocalAddr().String()))).To(Succeed())
+
+			data, raddr := read()
+			Expect(raddr.String()).To(Equal("127.0.0.1:5104"))
+			Expect(data).To(ContainSubstring("Via: SIP/2.0/UDP 203.0.113.1:5062;"))
+			Expect(data).To(ContainSubstring("Contact: <sip:alice@203.0.113.1:5062>"))
+			close(done)
+		}, 5)
+	})
+
+	Context("with wildcard listener", func() {
+		BeforeEach(func() {
+			tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+			Expect(tpl.Listen("udp", "0.0.0.0:5106", transport.WithAdvertisedAddr("203.0.113.1", 0))).To(Succeed())
+		})
+
+		It("should put advertised host with the bound port to Via and keep Contact", func(done Done) {
+			Expect(tpl.Send(request(peer.LocalAddr().String()))).To(Succeed())
+
+			data, _ := read()
+			Expect(data).To(ContainSubstring("Via: SIP/2.0/UDP 203.0.113.1:5106;"))
+			Expect(data).To(ContainSubstring("Contact: <sip:alice@127.0.0.1:5060>"))
+			close(done)
+		}, 5)
+	})
+})
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+)
+
+// Minimal STUN used for SIP Outbound keep-alives over UDP - RFC 5626 - 4.4.2, RFC 5389.
+const (
+	stunHeaderSize       = 20
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunXorMappedAddress = 0x0020
+)
+
+type stunMessage struct {
+	Type          uint16
+	TransactionID [12]byte
+	// MappedAddr is XOR-MAPPED-ADDRESS of the binding response.
+	MappedAddr *net.UDPAddr
+}
+
+func newStunBindingRequest() *stunMessage {
+	msg := &stunMessage{Type: stunBindingRequest}
+	_, _ = rand.Read(msg.TransactionID[:])
+
+	return msg
+}
+
+// isStunMessage checks data with the first two zero bits and the magic cookie - RFC 5389 - 6.
+func isStunMessage(data []byte) bool {
+	return len(data) >= stunHeaderSize &&
+		data[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(data[4:8]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(data[2:4]))+stunHeaderSize == len(data)
+}
+
+func parseStunMessage(data []byte) (*stunMessage, bool) {
+	if !isStunMessage(data) {
+		return nil, false
+	}
+
+	msg := &stunMessage{Type: binary.BigEndian.Uint16(data[0:2])}
+	copy(msg.TransactionID[:], data[8:20])
+
+	for attrs := data[stunHeaderSize:]; len(attrs) >= 4; {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return nil, false
+		}
+		if attrType == stunXorMappedAddress {
+			msg.MappedAddr = msg.xorAddr(attrs[4 : 4+attrLen])
+		}
+		// attributes are padded to 4 bytes
+		next := 4 + (attrLen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	return msg, true
+}
+
+func (msg *stunMessage) Bytes() []byte {
+	var attrs []byte
+	if msg.MappedAddr != nil {
+		value := msg.xorAddrValue(msg.MappedAddr)
+		attrs = make([]byte, 4+len(value))
+		binary.BigEndian.PutUint16(attrs[0:2], stunXorMappedAddress)
+		binary.BigEndian.PutUint16(attrs[2:4], uint16(len(value)))
+		copy(attrs[4:], value)
+	}
+
+	data := make([]byte, stunHeaderSize+len(attrs))
+	binary.BigEndian.PutUint16(data[0:2], msg.Type)
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(data[4:8], stunMagicCookie)
+	copy(data[8:20], msg.TransactionID[:])
+	copy(data[stunHeaderSize:], attrs)
+
+	return data
+}
+
+// xorKey is the magic cookie followed by the transaction ID - RFC 5389 - 15.2.
+func (msg *stunMessage) xorKey() []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key[0:4], stunMagicCookie)
+	copy(key[4:], msg.TransactionID[:])
+
+	return key
+}
+
+func (msg *stunMessage) xorAddrValue(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+
+	key := msg.xorKey()
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ key[i]
+	}
+
+	return value
+}
+
+func (msg *stunMessage) xorAddr(value []byte) *net.UDPAddr {
+	if len(value) != 8 && len(value) != 20 {
+		return nil
+	}
+
+	key := msg.xorKey()
+	ip := make(net.IP, len(value)-4)
+	for i := range ip {
+		ip[i] = value[4+i] ^ key[i]
+	}
+
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: int(binary.BigEndian.Uint16(value[2:4]) ^ uint16(stunMagicCookie>>16)),
+	}
+}
@@ -25,8 +25,11 @@ type tcpProtocol struct {
 	connections ConnectionPool
 	conns       chan Connection
 	listen      func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error)
-	dial        func(addr *net.TCPAddr) (net.Conn, error)
+	dial        func(addr *net.TCPAddr, domain string) (net.Conn, error)
 	resolveAddr func(addr string) (*net.TCPAddr, error)
+	aliases     *connectionAliases
+	// wrapListener secures connections accepted by the listener, e.g. with TLS
+	wrapListener func(listener net.Listener, options ...ListenOption) (net.Listener, error)
 }
 
 func NewTcpProtocol(
@@ -41,6 +44,7 @@ func NewTcpProtocol(
 	p.reliable = true
 	p.streamed = true
 	p.conns = make(chan Connection)
+	p.aliases = newConnectionAliases()
 	p.log = logger.
 		WithPrefix("transport.Protocol").
 		WithFields(log.Fields{
@@ -52,6 +56,7 @@ func NewTcpProtocol(
 	p.listen = p.defaultListen
 	p.dial = p.defaultDial
 	p.resolveAddr = p.defaultResolveAddr
+	p.wrapListener = p.defaultWrapListener
 	// pipe listener and connection pools
 	go p.pipePools()
 
@@ -62,7 +67,7 @@ func (p *tcpProtocol) defaultListen(addr *net.TCPAddr, options ...ListenOption)
 	return net.ListenTCP(p.network, addr)
 }
 
-func (p *tcpProtocol) defaultDial(addr *net.TCPAddr) (net.Conn, error) {
+func (p *tcpProtocol) defaultDial(addr *net.TCPAddr, domain string) (net.Conn, error) {
 	return net.DialTCP(p.network, nil, addr)
 }
 
@@ -70,6 +75,10 @@ func (p *tcpProtocol) defaultResolveAddr(addr string) (*net.TCPAddr, error) {
 	return net.ResolveTCPAddr(p.network, addr)
 }
 
+func (p *tcpProtocol) defaultWrapListener(listener net.Listener, options ...ListenOption) (net.Listener, error) {
+	return listener, nil
+}
+
 func (p *tcpProtocol) Done() <-chan struct{} {
 	return p.connections.Done()
 }
@@ -120,13 +129,36 @@ func (p *tcpProtocol) Listen(target *Target, options ...ListenOption) error {
 		}
 	}
 
-	p.Log().Debugf("begin listening on %s %s", p.Network(), target.Addr())
+	// the layer advertises the bound port if any port was requested
+	port := sip.Port(listener.Addr().(*net.TCPAddr).Port)
+	target.Port = &port
+
+	if err := p.listenOn(listener, options...); err != nil {
+		listener.Close()
+		return err
+	}
+
+	return nil
+}
+
+// listenOn serves connections accepted by the listener.
+func (p *tcpProtocol) listenOn(listener net.Listener, options ...ListenOption) error {
+	wrapped, err := p.wrapListener(listener, options...)
+	if err != nil {
+		return &ProtocolError{
+			err,
+			fmt.Sprintf("listen on %s %s address", p.Network(), listener.Addr()),
+			fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("begin listening on %s %s", p.Network(), listener.Addr())
 
 	// index listeners by local address
 	// should live infinitely
-	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, target.Port))
+	key := ListenerKey(p.network + ":" + listener.Addr().String())
 	err = p.listeners.Put(key, &tcpListener{
-		Listener: listener,
+		Listener: wrapped,
 		network:  p.network,
 	})
 	if err != nil {
@@ -162,7 +194,7 @@ func (p *tcpProtocol) Send(target *Target, msg sip.Message) error {
 	}
 
 	// find or create connection
-	conn, err := p.getOrCreateConnection(raddr)
+	conn, err := p.getOrCreateConnection(raddr, nextHopDomain(msg))
 	if err != nil {
 		return &ProtocolError{
 			Err:      err,
@@ -187,13 +219,19 @@ func (p *tcpProtocol) Send(target *Target, msg sip.Message) error {
 	return err
 }
 
-func (p *tcpProtocol) getOrCreateConnection(raddr *net.TCPAddr) (Connection, error) {
+func (p *tcpProtocol) getOrCreateConnection(raddr *net.TCPAddr, domain string) (Connection, error) {
 	key := ConnectionKey(p.network + ":" + raddr.String())
 	conn, err := p.connections.Get(key)
 	if err != nil {
+		if conn, ok := p.aliasConnection(raddr, domain); ok {
+			p.Log().Debugf("reuse %s connection %s aliased by %s", p.Network(), conn.Key(), raddr)
+
+			return conn, nil
+		}
+
 		p.Log().Debugf("connection for remote address %s %s not found, create a new one", p.Network(), raddr)
 
-		tcpConn, err := p.dial(raddr)
+		tcpConn, err := p.dial(raddr, domain)
 		if err != nil {
 			return nil, fmt.Errorf("dial to %s %s: %w", p.Network(), raddr, err)
 		}
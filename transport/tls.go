@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/ygj201011/gosip/log"
 	"github.com/ygj201011/gosip/sip"
@@ -12,6 +13,9 @@ import (
 
 type tlsProtocol struct {
 	tcpProtocol
+	// rootCAs and certificates are used on the dialed connections, see WithTLSClient
+	rootCAs      *x509.CertPool
+	certificates []tls.Certificate
 }
 
 func NewTlsProtocol(
@@ -26,6 +30,7 @@ func NewTlsProtocol(
 	p.reliable = true
 	p.streamed = true
 	p.conns = make(chan Connection)
+	p.aliases = newConnectionAliases()
 	p.log = logger.
 		WithPrefix("transport.Protocol").
 		WithFields(log.Fields{
@@ -35,27 +40,13 @@ func NewTlsProtocol(
 	p.listeners = NewListenerPool(p.conns, errs, cancel, p.Log())
 	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
 	p.listen = func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error) {
-		if len(options) == 0 {
-			return net.ListenTCP("tcp", addr)
-		}
-		optsHash := ListenOptions{}
-		for _, opt := range options {
-			opt.ApplyListen(&optsHash)
-		}
-		cert, err := tls.LoadX509KeyPair(optsHash.TLSConfig.Cert, optsHash.TLSConfig.Key)
-		if err != nil {
-			return nil, fmt.Errorf("load TLS certficate %s: %w", optsHash.TLSConfig.Cert, err)
-		}
-		return tls.Listen("tcp", addr.String(), &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
+		return net.ListenTCP("tcp", addr)
 	}
-	p.dial = func(addr *net.TCPAddr) (net.Conn, error) {
-		return tls.Dial("tcp", addr.String(), &tls.Config{
-			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-				return nil
-			},
-		})
+	p.wrapListener = func(listener net.Listener, options ...ListenOption) (net.Listener, error) {
+		return tlsListener(listener, errs, cancel, p.Log(), options...)
+	}
+	p.dial = func(addr *net.TCPAddr, domain string) (net.Conn, error) {
+		return tls.Dial("tcp", addr.String(), p.clientConfig(addr, domain))
 	}
 	p.resolveAddr = func(addr string) (*net.TCPAddr, error) {
 		return net.ResolveTCPAddr("tcp", addr)
@@ -65,3 +56,200 @@ func NewTlsProtocol(
 
 	return p
 }
+
+func (p *tlsProtocol) setTLSClient(rootCAs *x509.CertPool, certificates []tls.Certificate) {
+	p.rootCAs = rootCAs
+	p.certificates = certificates
+}
+
+// clientConfig returns config of the connection to the next hop domain,
+// SNI is sent for the domain name and the server certificate is verified against it - RFC 5922 - 7.3.
+// The IP address is verified if the domain is unknown, e.g. for responses.
+func (p *tlsProtocol) clientConfig(addr *net.TCPAddr, domain string) *tls.Config {
+	config := &tls.Config{
+		Certificates: p.certificates,
+		// the chain and the SIP domain are verified by VerifyPeerCertificate
+		InsecureSkipVerify: true,
+	}
+	if domain != "" && net.ParseIP(domain) == nil {
+		config.ServerName = domain
+	} else {
+		domain = addr.IP.String()
+	}
+	config.VerifyPeerCertificate = verifyServerCertificate(p.rootCAs, domain)
+
+	return config
+}
+
+// tlsListener accepts TLS connections with the certificates of TLSConfig, GetCertificate or TLSServerConfig options,
+// the listener is not wrapped without the certificate. Certificate reload errors are passed to errs.
+func tlsListener(
+	listener net.Listener,
+	errs chan<- error,
+	cancel <-chan struct{},
+	logger log.Logger,
+	options ...ListenOption,
+) (net.Listener, error) {
+	optsHash := ListenOptions{}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyListen(&optsHash)
+		}
+	}
+
+	var config *tls.Config
+	if optsHash.TLSServerConfig != nil {
+		config = optsHash.TLSServerConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if optsHash.ClientAuth != tls.NoClientCert {
+		config.ClientAuth = optsHash.ClientAuth
+	}
+	if optsHash.ClientCAs != nil {
+		config.ClientCAs = optsHash.ClientCAs
+	}
+
+	switch {
+	case optsHash.GetCertificate != nil:
+		config.GetCertificate = reportCertificateErrors(optsHash.GetCertificate, errs, cancel)
+	case len(optsHash.TLSConfigs) > 0:
+		selector := make(certificateSelector, 0, len(optsHash.TLSConfigs))
+		for _, tlsConfig := range optsHash.TLSConfigs {
+			reloader, err := newCertificateReloader(tlsConfig, errs, logger)
+			if err != nil {
+				return nil, err
+			}
+			selector = append(selector, reloader)
+		}
+		config.GetCertificate = selector.GetCertificate
+
+		if optsHash.CertificateReload > 0 {
+			watched := &watchedListener{
+				Listener: tls.NewListener(listener, config),
+				stop:     make(chan struct{}),
+			}
+			for _, reloader := range selector {
+				go reloader.watch(optsHash.CertificateReload, watched.stop, cancel)
+			}
+
+			return watched, nil
+		}
+	case len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil:
+		// certificates of the server config are used
+	default:
+		return listener, nil
+	}
+
+	return tls.NewListener(listener, config), nil
+}
+
+// verifyServerCertificate verifies the certificate chain with the root CAs
+// and matches the certificate against the SIP domain or the IP address.
+func verifyServerCertificate(rootCAs *x509.CertPool, domain string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("parse server certificate: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return fmt.Errorf("server presented no certificate")
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         rootCAs,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return err
+		}
+
+		if net.ParseIP(domain) != nil {
+			return certs[0].VerifyHostname(domain)
+		}
+		if !matchSIPDomain(certs[0], domain) {
+			return fmt.Errorf("certificate is not valid for SIP domain %s", domain)
+		}
+
+		return nil
+	}
+}
+
+// sipIdentities returns SIP domains the certificate is issued for - RFC 5922 - 7.1:
+// hosts of SIP URIs in subjectAltName, DNS names if there are no such URIs,
+// the common name only if subjectAltName is absent.
+func sipIdentities(cert *x509.Certificate) []string {
+	identities := make([]string, 0)
+	for _, uri := range cert.URIs {
+		if !strings.EqualFold(uri.Scheme, "sip") || uri.Opaque == "" {
+			continue
+		}
+		// domain identities have no user part
+		host := strings.SplitN(uri.Opaque, ";", 2)[0]
+		if strings.Contains(host, "@") {
+			continue
+		}
+		identities = append(identities, host)
+	}
+	if len(identities) > 0 {
+		return identities
+	}
+	if len(cert.DNSNames) > 0 {
+		return append(identities, cert.DNSNames...)
+	}
+	if len(cert.URIs) == 0 && len(cert.IPAddresses) == 0 && len(cert.EmailAddresses) == 0 &&
+		cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	return identities
+}
+
+// matchSIPDomain checks that the certificate is issued for the domain,
+// wildcard identities are not matched - RFC 5922 - 7.2.
+func matchSIPDomain(cert *x509.Certificate, domain string) bool {
+	for _, identity := range sipIdentities(cert) {
+		if strings.EqualFold(identity, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerIdentities returns SIP identities of the verified client certificate of the TLS or WSS connection.
+func peerIdentities(conn Connection) []string {
+	c, ok := conn.(*connection)
+	if !ok {
+		return nil
+	}
+	baseConn := c.baseConn
+	if wc, ok := baseConn.(*wsConn); ok {
+		baseConn = wc.Conn
+	}
+	tlsConn, ok := baseConn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return sipIdentities(state.PeerCertificates[0])
+}
+
+// PeerIdentities returns SIP domains of the verified TLS client certificate the message was received with,
+// client certificates are requested by WithClientAuth listen option.
+func PeerIdentities(msg sip.Message) []string {
+	return peerIdentities(messageConnection(msg))
+}
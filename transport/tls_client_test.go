@@ -0,0 +1,255 @@
+package transport_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+// testCA issues short-living certificates for TLS specs.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gosip test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert, key, pool}
+}
+
+// issue returns certificate for the SIP URIs and the DNS names.
+func (ca *testCA) issue(uris []string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "gosip test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		Expect(err).ToNot(HaveOccurred())
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCertificate saves the certificate and its key to PEM files for TLSConfig.
+func writeCertificate(dir string, cert tls.Certificate) (string, string) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+var _ = Describe("TransportLayer with TLS client", func() {
+	var (
+		tpl      transport.Layer
+		ca       *testCA
+		server   net.Listener
+		accepted chan *tls.Conn
+		sni      chan string
+	)
+	logger := testutils.NewLogrusLogger()
+
+	request := func(host string) sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@" + host + ";transport=tls SIP/2.0",
+			"Via: SIP/2.0/TLS 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@" + host + ">",
+			"Call-ID: tls-client",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(server.Addr().String())
+		return req
+	}
+
+	BeforeEach(func() {
+		ca = newTestCA()
+		accepted = make(chan *tls.Conn, 1)
+		sni = make(chan string, 1)
+
+		var err error
+		server, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{ca.issue([]string{"sip:example.com"}, "*.example.com")},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.pool,
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				sni <- hello.ServerName
+				return nil, nil
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			// the client waits for the server handshake
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err != nil {
+				tlsConn.Close()
+				return
+			}
+			accepted <- tlsConn
+		}()
+
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger,
+			transport.WithTLSClient(ca.pool, ca.issue(nil, "client.example.org")))
+		Expect(tpl.Listen("tls", "127.0.0.1:0")).To(Succeed())
+	})
+	AfterEach(func() {
+		server.Close()
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	It("should send SNI of the Request-URI host and present client certificate", func(done Done) {
+		Expect(tpl.Send(request("example.com"))).To(Succeed())
+		Expect(<-sni).To(Equal("example.com"))
+
+		conn := <-accepted
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		Expect(err).ToNot(HaveOccurred())
+		Expect(line).To(HavePrefix("OPTIONS sip:bob@example.com;transport=tls SIP/2.0"))
+		Expect(conn.ConnectionState().PeerCertificates[0].DNSNames).To(ConsistOf("client.example.org"))
+		close(done)
+	}, 5)
+
+	It("should not match DNS names if the certificate has SIP URIs", func(done Done) {
+		Expect(tpl.Send(request("sip.example.com"))).ToNot(Succeed())
+		close(done)
+	}, 5)
+
+	It("should refuse server certificate for other domain", func(done Done) {
+		Expect(tpl.Send(request("far-far-away.com"))).ToNot(Succeed())
+		close(done)
+	}, 5)
+})
+
+var _ = Describe("TransportLayer with TLS client certificates", func() {
+	var (
+		tpl       transport.Layer
+		ca        *testCA
+		dir       string
+		layerAddr string
+	)
+	logger := testutils.NewLogrusLogger()
+
+	BeforeEach(func() {
+		ca = newTestCA()
+
+		var err error
+		dir, err = ioutil.TempDir("", "gosip-tls")
+		Expect(err).ToNot(HaveOccurred())
+		certFile, keyFile := writeCertificate(dir, ca.issue(nil, "localhost"))
+
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		Expect(tpl.Listen("tls", "127.0.0.1:0",
+			transport.TLSConfig{Cert: certFile, Key: keyFile},
+			transport.WithClientAuth(tls.VerifyClientCertIfGiven, ca.pool),
+		)).To(Succeed())
+		layerAddr = tpl.ListenAddrs("tls")[0].String()
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+		os.RemoveAll(dir)
+	})
+
+	send := func(certificates ...tls.Certificate) sip.Message {
+		conn, err := tls.Dial("tcp", layerAddr, &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      ca.pool,
+			Certificates: certificates,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(strings.Join([]string{
+			"OPTIONS sip:bob@" + layerAddr + ";transport=tls SIP/2.0",
+			"Via: SIP/2.0/TLS 127.0.0.1:5124;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: tls-client-cert",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}, "\r\n")))
+		Expect(err).ToNot(HaveOccurred())
+
+		var msg sip.Message
+		Eventually(tpl.Messages(), 3*time.Second).Should(Receive(&msg))
+		return msg
+	}
+
+	It("should expose SIP identities of the verified client certificate", func(done Done) {
+		msg := send(ca.issue([]string{"sip:wonderland.com", "sip:alice@wonderland.com"}, "pc33.wonderland.com"))
+		Expect(transport.PeerIdentities(msg)).To(Equal([]string{"wonderland.com"}))
+		close(done)
+	}, 5)
+
+	It("should not expose identities without client certificate", func(done Done) {
+		msg := send()
+		Expect(transport.PeerIdentities(msg)).To(BeEmpty())
+		close(done)
+	}, 5)
+})
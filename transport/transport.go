@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ygj201011/gosip/log"
 	"github.com/ygj201011/gosip/sip"
@@ -25,6 +26,12 @@ const (
 	DefaultTlsPort = sip.DefaultTlsPort
 	DefaultWsPort  = sip.DefaultWsPort
 	DefaultWssPort = sip.DefaultWssPort
+
+	// DefaultUDPSizeThreshold is the size of the request sent over TCP instead of UDP
+	// when the path MTU is unknown - RFC 3261 - 18.1.1.
+	DefaultUDPSizeThreshold = int(MTU) - 200
+	// DefaultWebSocketPingInterval is the interval of pings detecting dead WebSocket peers.
+	DefaultWebSocketPingInterval = 30 * time.Second
 )
 
 // Target endpoint
@@ -49,7 +56,7 @@ func (trg *Target) Addr() string {
 		port = *trg.Port
 	}
 
-	return fmt.Sprintf("%v:%v", host, port)
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
 }
 
 func (trg *Target) String() string {
@@ -341,12 +348,57 @@ func (err UnsupportedProtocolError) Error() string {
 	return "transport.UnsupportedProtocolError: " + string(err)
 }
 
-//TLSConfig for TLS and WSS only
+// InvalidFlowTokenError is returned if the flow token is not issued by the transport layer,
+// edge proxy should reply 403 Forbidden on it - RFC 5626 - 5.3.
+type InvalidFlowTokenError string
+
+func (err InvalidFlowTokenError) Network() bool   { return false }
+func (err InvalidFlowTokenError) Timeout() bool   { return false }
+func (err InvalidFlowTokenError) Temporary() bool { return false }
+func (err InvalidFlowTokenError) Error() string {
+	return "transport.InvalidFlowTokenError: " + string(err)
+}
+
+// FlowFailedError is returned if the flow is closed or does not answer on keep-alives,
+// edge proxy should reply 430 Flow Failed on it - RFC 5626 - 5.3.
+type FlowFailedError struct {
+	Err   error
+	Net   string
+	RAddr string
+}
+
+func (err *FlowFailedError) Unwrap() error   { return err.Err }
+func (err *FlowFailedError) Network() bool   { return true }
+func (err *FlowFailedError) Timeout() bool   { return isTimeout(err.Err) }
+func (err *FlowFailedError) Temporary() bool { return false }
+func (err *FlowFailedError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	fields := log.Fields{
+		"network":     "???",
+		"remote_addr": "???",
+	}
+
+	if err.Net != "" {
+		fields["network"] = err.Net
+	}
+	if err.RAddr != "" {
+		fields["remote_addr"] = err.RAddr
+	}
+
+	return fmt.Sprintf("transport.FlowFailedError<%s>: %s", fields, err.Err)
+}
+
+// TLSConfig is the certificate of TLS and WSS listeners, several configs may be passed to Listen:
+// the certificate is selected by SNI matching Domain or the certificate names, the first one is the default.
 type TLSConfig struct {
 	Domain string
 	Cert   string
 	Key    string
-	Pass   string
+	// Pass decrypts the encrypted PEM key
+	Pass string
 }
 
 func (c TLSConfig) ApplyListen(opts *ListenOptions) {
@@ -354,4 +406,7 @@ func (c TLSConfig) ApplyListen(opts *ListenOptions) {
 	opts.TLSConfig.Cert = c.Cert
 	opts.TLSConfig.Key = c.Key
 	opts.TLSConfig.Pass = c.Pass
+	if c.Cert != "" {
+		opts.TLSConfigs = append(opts.TLSConfigs, c)
+	}
 }
@@ -63,13 +63,36 @@ func (p *udpProtocol) Listen(target *Target, options ...ListenOption) error {
 		}
 	}
 
-	p.Log().Debugf("begin listening on %s %s", p.Network(), laddr)
+	// the layer advertises the bound port if any port was requested
+	port := sip.Port(udpConn.LocalAddr().(*net.UDPAddr).Port)
+	target.Port = &port
+
+	if err := p.listenPacket(udpConn); err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	return nil
+}
+
+// listenPacket serves messages received by the packet connection.
+func (p *udpProtocol) listenPacket(packetConn net.PacketConn) error {
+	baseConn, ok := packetConn.(net.Conn)
+	if !ok {
+		return &ProtocolError{
+			fmt.Errorf("%T is not a connection", packetConn),
+			fmt.Sprintf("listen on %s %s address", p.Network(), packetConn.LocalAddr()),
+			fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("begin listening on %s %s", p.Network(), packetConn.LocalAddr())
 
 	// register new connection
 	// index by local address, TTL=0 - unlimited expiry time
-	key := ConnectionKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, laddr.Port))
-	conn := NewConnection(udpConn, key, p.network, p.Log())
-	err = p.connections.Put(conn, 0)
+	key := ConnectionKey(p.network + ":" + packetConn.LocalAddr().String())
+	conn := NewConnection(baseConn, key, p.network, p.Log())
+	err := p.connections.Put(conn, 0)
 	if err != nil {
 		err = &ProtocolError{
 			Err:      err,
@@ -103,7 +126,7 @@ func (p *udpProtocol) Send(target *Target, msg sip.Message) error {
 		}
 	}
 
-	_, port, err := net.SplitHostPort(msg.Source())
+	host, port, err := net.SplitHostPort(msg.Source())
 	if err != nil {
 		return &ProtocolError{
 			Err:      err,
@@ -112,27 +135,57 @@ func (p *udpProtocol) Send(target *Target, msg sip.Message) error {
 		}
 	}
 
-	for _, conn := range p.connections.All() {
-		parts := strings.Split(string(conn.Key()), ":")
-		if parts[2] == port {
-			logger := log.AddFieldsFrom(p.Log(), conn, msg)
-			logger.Tracef("writing SIP message to %s %s", p.Network(), raddr)
-
-			if _, err = conn.WriteTo([]byte(msg.String()), raddr); err != nil {
-				return &ProtocolError{
-					Err:      err,
-					Op:       fmt.Sprintf("write SIP message to the %s connection", conn.Key()),
-					ProtoPtr: fmt.Sprintf("%p", p),
-				}
-			}
-
-			return nil
+	// the socket bound to the source IP is preferred on multi-homed hosts
+	srcIP := net.ParseIP(host)
+	var conn Connection
+	for _, c := range p.connections.All() {
+		if connectionPort(c) != port || !canSendTo(c, raddr) {
+			continue
+		}
+		if laddr, ok := c.LocalAddr().(*net.UDPAddr); ok && srcIP != nil && laddr.IP.Equal(srcIP) {
+			conn = c
+			break
+		}
+		if conn == nil {
+			conn = c
 		}
 	}
+	if conn == nil {
+		return &ProtocolError{
+			fmt.Errorf("connection on port %s to %s not found", port, raddr),
+			"search connection",
+			fmt.Sprintf("%p", p),
+		}
+	}
+
+	logger := log.AddFieldsFrom(p.Log(), conn, msg)
+	logger.Tracef("writing SIP message to %s %s", p.Network(), raddr)
+
+	if _, err = conn.WriteTo([]byte(msg.String()), raddr); err != nil {
+		return &ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("write SIP message to the %s connection", conn.Key()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	return nil
+}
+
+// connectionPort returns local port of the connection.
+func connectionPort(conn Connection) string {
+	key := string(conn.Key())
 
-	return &ProtocolError{
-		fmt.Errorf("connection on port %s not found", port),
-		"search connection",
-		fmt.Sprintf("%p", p),
+	return key[strings.LastIndex(key, ":")+1:]
+}
+
+// canSendTo checks that the socket bound to the address of one family is not used for the other,
+// wildcard sockets are dual-stack.
+func canSendTo(conn Connection, raddr *net.UDPAddr) bool {
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || laddr.IP == nil || laddr.IP.IsUnspecified() {
+		return true
 	}
+
+	return isIPv4(laddr.IP) == isIPv4(raddr.IP)
 }
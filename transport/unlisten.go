@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ygj201011/gosip/sip"
+)
+
+func (p *tcpProtocol) unlisten(ip net.IP, port sip.Port, policy UnlistenPolicy) error {
+	return unlistenStream(&p.protocol, p.listeners, p.connections, ip, port, policy)
+}
+
+func (p *wsProtocol) unlisten(ip net.IP, port sip.Port, policy UnlistenPolicy) error {
+	return unlistenStream(&p.protocol, p.listeners, p.connections, ip, port, policy)
+}
+
+// unlisten closes the socket bound to the address, there are no accepted connections to drain.
+func (p *udpProtocol) unlisten(ip net.IP, port sip.Port, policy UnlistenPolicy) error {
+	for _, conn := range p.connections.All() {
+		if !boundTo(conn.LocalAddr(), ip, port) {
+			continue
+		}
+
+		p.Log().Debugf("stop listening on %s %s", p.Network(), conn.LocalAddr())
+
+		if err := p.connections.Drop(conn.Key()); err != nil {
+			return &ProtocolError{
+				Err:      err,
+				Op:       fmt.Sprintf("drop %s connection from the pool", conn.Key()),
+				ProtoPtr: fmt.Sprintf("%p", p),
+			}
+		}
+
+		return nil
+	}
+
+	return &ProtocolError{
+		fmt.Errorf("listener not found"),
+		fmt.Sprintf("unlisten %s %s", p.Network(), net.JoinHostPort(ip.String(), port.String())),
+		fmt.Sprintf("%p", p),
+	}
+}
+
+// unlistenStream stops accepting on the listener bound to the address,
+// connections accepted by the listener are closed with UnlistenClose policy.
+func unlistenStream(
+	p *protocol,
+	listeners ListenerPool,
+	connections ConnectionPool,
+	ip net.IP,
+	port sip.Port,
+	policy UnlistenPolicy,
+) error {
+	var listener net.Listener
+	for _, l := range listeners.All() {
+		if boundTo(l.Addr(), ip, port) {
+			listener = l
+			break
+		}
+	}
+	if listener == nil {
+		return &ProtocolError{
+			fmt.Errorf("listener not found"),
+			fmt.Sprintf("unlisten %s %s", p.Network(), net.JoinHostPort(ip.String(), port.String())),
+			fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("stop listening on %s %s", p.Network(), listener.Addr())
+
+	key := ListenerKey(p.network + ":" + listener.Addr().String())
+	if err := listeners.Drop(key); err != nil {
+		return &ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("drop %s listener from the pool", key),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	if policy != UnlistenClose {
+		return nil
+	}
+
+	for _, conn := range connections.All() {
+		if !acceptedBy(conn, listener) {
+			continue
+		}
+
+		p.Log().Debugf("close %s connection %s accepted by the stopped listener", p.Network(), conn.Key())
+
+		if err := connections.Drop(conn.Key()); err != nil {
+			p.Log().Warnf("drop %s connection from the pool failed: %s", conn.Key(), err)
+		}
+	}
+
+	return nil
+}
+
+// boundTo checks that the address has the port and the IP, unspecified IPs are equal.
+func boundTo(addr net.Addr, ip net.IP, port sip.Port) bool {
+	var (
+		addrIP   net.IP
+		addrPort int
+	)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		addrIP, addrPort = a.IP, a.Port
+	case *net.UDPAddr:
+		addrIP, addrPort = a.IP, a.Port
+	default:
+		return false
+	}
+	if addrPort != int(port) {
+		return false
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return addrIP == nil || addrIP.IsUnspecified()
+	}
+
+	return ip.Equal(addrIP)
+}
+
+// acceptedBy checks that the connection is on the local address of the listener,
+// any local IP matches wildcard listeners.
+func acceptedBy(conn Connection, listener net.Listener) bool {
+	laddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	caddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || caddr.Port != laddr.Port {
+		return false
+	}
+
+	return laddr.IP == nil || laddr.IP.IsUnspecified() || laddr.IP.Equal(caddr.IP)
+}
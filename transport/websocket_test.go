@@ -0,0 +1,311 @@
+package transport_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/sip/parser"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("TransportLayer over WebSocket", func() {
+	var (
+		tpl       transport.Layer
+		layerAddr string
+	)
+	logger := testutils.NewLogrusLogger()
+
+	request := func(callID string) string {
+		return strings.Join([]string{
+			"OPTIONS sip:bob@" + layerAddr + ";transport=ws SIP/2.0",
+			"Via: SIP/2.0/WS df7jal23ls0d.invalid;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: " + callID,
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}, "\r\n")
+	}
+	dial := func(protocols ...string) (net.Conn, error) {
+		dialer := ws.Dialer{Protocols: protocols, Timeout: time.Second}
+		conn, _, _, err := dialer.Dial(context.Background(), "ws://"+layerAddr)
+		return conn, err
+	}
+	// frame writes the masked client frame
+	frame := func(conn net.Conn, fin bool, op ws.OpCode, payload string) {
+		Expect(ws.WriteFrame(conn, ws.MaskFrameInPlace(ws.NewFrame(op, fin, []byte(payload))))).To(Succeed())
+	}
+	// closeCode reads frames until the close frame of the layer and returns its status code
+	closeCode := func(conn net.Conn) ws.StatusCode {
+		Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+		for {
+			f, err := ws.ReadFrame(conn)
+			Expect(err).ToNot(HaveOccurred())
+			if f.Header.OpCode == ws.OpClose {
+				code, _ := ws.ParseCloseFrameData(f.Payload)
+				return code
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger,
+			transport.WithWebSocketPing(100*time.Millisecond))
+		Expect(tpl.Listen("ws", "127.0.0.1:0")).To(Succeed())
+		layerAddr = tpl.ListenAddrs("ws")[0].String()
+		// the layer is blocked until the errors are read, e.g. EOF of the closed connections
+		go func() {
+			for range tpl.Errors() {
+			}
+		}()
+	})
+	AfterEach(func() {
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	It("should refuse peers not upgrading to WebSocket", func(done Done) {
+		conn, err := net.Dial("tcp", layerAddr)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(request("plain-tcp")))
+		Expect(err).ToNot(HaveOccurred())
+		// the malformed HTTP request is not answered
+		Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+		_, err = ioutil.ReadAll(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(tpl.Messages(), 200*time.Millisecond).ShouldNot(Receive())
+		close(done)
+	}, 5)
+
+	It("should negotiate 'sip' subprotocol", func(done Done) {
+		dialer := ws.Dialer{Protocols: []string{"chat", "sip"}, Timeout: time.Second}
+		conn, _, hs, err := dialer.Dial(context.Background(), "ws://"+layerAddr)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		Expect(hs.Protocol).To(Equal("sip"))
+		close(done)
+	}, 5)
+
+	It("should reassemble fragmented message and answer pings between fragments", func(done Done) {
+		conn, err := dial("sip")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		msg := request("fragmented")
+		frame(conn, false, ws.OpText, msg[:20])
+		frame(conn, true, ws.OpPing, "are you there")
+		frame(conn, false, ws.OpContinuation, msg[20:50])
+		frame(conn, true, ws.OpContinuation, msg[50:])
+
+		f, err := ws.ReadFrame(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Header.OpCode).To(Equal(ws.OpPong))
+		Expect(string(f.Payload)).To(Equal("are you there"))
+
+		var received sip.Message
+		Eventually(tpl.Messages(), 2*time.Second).Should(Receive(&received))
+		callID, _ := received.CallID()
+		Expect(callID.Value()).To(Equal("fragmented"))
+		close(done)
+	}, 5)
+
+	It("should accept messages in binary frames", func(done Done) {
+		conn, err := dial("sip")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		Expect(wsutil.WriteClientBinary(conn, []byte(request("binary")))).To(Succeed())
+		var received sip.Message
+		Eventually(tpl.Messages(), 2*time.Second).Should(Receive(&received))
+		callID, _ := received.CallID()
+		Expect(callID.Value()).To(Equal("binary"))
+		close(done)
+	}, 5)
+
+	It("should ping the peer and close the connection if it does not answer", func(done Done) {
+		conn, err := dial("sip")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		// pings are read without pong replies
+		Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+		f, err := ws.ReadFrame(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Header.OpCode).To(Equal(ws.OpPing))
+		for err == nil {
+			_, err = ws.ReadFrame(conn)
+		}
+		Expect(err).To(Equal(io.EOF))
+		close(done)
+	}, 5)
+
+	It("should keep the connection of the peer answering pings", func(done Done) {
+		conn, err := dial("sip")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		// the client state answers pings
+		go func() {
+			for {
+				if _, _, err := wsutil.ReadServerData(conn); err != nil {
+					return
+				}
+			}
+		}()
+		time.Sleep(500 * time.Millisecond)
+
+		Expect(wsutil.WriteClientText(conn, []byte(request("alive")))).To(Succeed())
+		Eventually(tpl.Messages(), 2*time.Second).Should(Receive())
+		close(done)
+	}, 5)
+
+	It("should close the connection with protocol error status on unmasked frames", func(done Done) {
+		conn, err := dial("sip")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		Expect(ws.WriteFrame(conn, ws.NewTextFrame([]byte(request("unmasked"))))).To(Succeed())
+		Expect(closeCode(conn)).To(Equal(ws.StatusProtocolError))
+		close(done)
+	}, 5)
+
+	It("should close the connection with invalid payload status on invalid UTF-8 text", func(done Done) {
+		conn, err := dial("sip")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		frame(conn, true, ws.OpText, "OPTIONS \xff\xfe")
+		Expect(closeCode(conn)).To(Equal(ws.StatusInvalidFramePayloadData))
+		close(done)
+	}, 5)
+
+	It("should close connections with normal closure status", func(done Done) {
+		conn, err := dial("sip")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		Expect(wsutil.WriteClientText(conn, []byte(request("normal-closure")))).To(Succeed())
+		Eventually(tpl.Messages(), 2*time.Second).Should(Receive())
+
+		Expect(tpl.Unlisten("ws", layerAddr, transport.UnlistenClose)).To(Succeed())
+		Expect(closeCode(conn)).To(Equal(ws.StatusNormalClosure))
+		close(done)
+	}, 5)
+})
+
+var _ = Describe("TransportLayer as WebSocket client", func() {
+	var (
+		tpl      transport.Layer
+		server   net.Listener
+		accepted chan net.Conn
+	)
+	logger := testutils.NewLogrusLogger()
+
+	// serve upgrades the connections accepted by the server, 'sip' subprotocol is accepted if it is enabled
+	serve := func(sipProtocol bool) {
+		go func() {
+			defer GinkgoRecover()
+			for {
+				conn, err := server.Accept()
+				if err != nil {
+					return
+				}
+				u := ws.Upgrader{}
+				if sipProtocol {
+					u.Protocol = func(val []byte) bool {
+						return string(val) == "sip"
+					}
+				}
+				if _, err := u.Upgrade(conn); err != nil {
+					conn.Close()
+					continue
+				}
+				accepted <- conn
+			}
+		}()
+	}
+	request := func() sip.Request {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@" + server.Addr().String() + ";transport=ws SIP/2.0",
+			"Via: SIP/2.0/WS 127.0.0.1;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Contact: <sip:alice@127.0.0.1>",
+			"Call-ID: ws-client",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetDestination(server.Addr().String())
+		return req
+	}
+
+	BeforeEach(func() {
+		var err error
+		server, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		accepted = make(chan net.Conn, 1)
+
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		go func() {
+			for range tpl.Errors() {
+			}
+		}()
+	})
+	AfterEach(func() {
+		server.Close()
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	It("should send requests with .invalid sent-by and 'ws' transport of Contact", func(done Done) {
+		serve(true)
+		Expect(tpl.Send(request())).To(Succeed())
+
+		conn := <-accepted
+		defer conn.Close()
+		data, err := wsutil.ReadClientText(conn)
+		Expect(err).ToNot(HaveOccurred())
+
+		msg, err := parser.ParseMessage(data, logger)
+		Expect(err).ToNot(HaveOccurred())
+		viaHop, ok := msg.ViaHop()
+		Expect(ok).To(BeTrue())
+		Expect(viaHop.Transport).To(Equal("WS"))
+		Expect(viaHop.Host).To(HaveSuffix(".invalid"))
+		Expect(viaHop.Port).To(BeNil())
+
+		contact, ok := msg.Contact()
+		Expect(ok).To(BeTrue())
+		uri := contact.Address.(*sip.SipUri)
+		Expect(uri.FHost).To(Equal(viaHop.Host))
+		Expect(uri.FPort).To(BeNil())
+		transportParam, ok := uri.FUriParams.Get("transport")
+		Expect(ok).To(BeTrue())
+		Expect(transportParam.String()).To(Equal("ws"))
+		close(done)
+	}, 5)
+
+	It("should refuse servers not accepting 'sip' subprotocol", func(done Done) {
+		serve(false)
+		Expect(tpl.Send(request())).ToNot(Succeed())
+		close(done)
+	}, 5)
+})
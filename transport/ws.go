@@ -1,13 +1,19 @@
 package transport
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
@@ -18,65 +24,281 @@ import (
 
 var (
 	wsSubProtocol = "sip"
+	// wsHandshakeTimeout limits the upgrade of accepted connections
+	wsHandshakeTimeout = 10 * time.Second
+	// wsCloseTimeout limits writing of the close frame to the unresponsive peer
+	wsCloseTimeout = time.Second
 )
 
 type wsConn struct {
 	net.Conn
 	client bool
+	// br holds data read with the HTTP handshake of hijacked connection
+	br *bufio.Reader
+	// raddr overrides the address of the reverse proxy, see WebSocketHandler
+	raddr net.Addr
+	// request is the HTTP upgrade request of the connection accepted by WebSocketHandler
+	request *http.Request
+	// pending is the rest of the message that did not fit the read buffer
+	pending []byte
+	// wmu serializes frames of SIP messages, pings and replies to control frames
+	wmu sync.Mutex
+	// received is set on each frame read from the peer, see keepAlive
+	received  int32
+	dead      int32
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
 }
 
-func (wc *wsConn) Read(b []byte) (n int, err error) {
-	var msg []byte
-	var op ws.OpCode
+func newWsConn(conn net.Conn, client bool) *wsConn {
+	return &wsConn{
+		Conn:   conn,
+		client: client,
+		closed: make(chan struct{}),
+	}
+}
+
+func (wc *wsConn) RemoteAddr() net.Addr {
+	if wc.raddr != nil {
+		return wc.raddr
+	}
+
+	return wc.Conn.RemoteAddr()
+}
+
+func (wc *wsConn) state() ws.State {
 	if wc.client {
-		msg, op, err = wsutil.ReadServerData(wc.Conn)
-	} else {
-		msg, op, err = wsutil.ReadClientData(wc.Conn)
+		return ws.StateClientSide
 	}
-	if err != nil {
-		// handle error
-		var wsErr wsutil.ClosedError
-		if errors.As(err, &wsErr) {
-			return n, io.EOF
+
+	return ws.StateServerSide
+}
+
+// rw returns the connection stream, buffered data of the handshake is read first.
+func (wc *wsConn) rw() io.ReadWriter {
+	if wc.br == nil {
+		return wc.Conn
+	}
+
+	return struct {
+		io.Reader
+		io.Writer
+	}{wc.br, wc.Conn}
+}
+
+func (wc *wsConn) Read(b []byte) (n int, err error) {
+	if len(wc.pending) == 0 {
+		if wc.pending, err = wc.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(b, wc.pending)
+	wc.pending = wc.pending[n:]
+
+	return n, nil
+}
+
+// readMessage returns payload of the next text or binary message, fragmented messages are reassembled
+// and control frames are answered - RFC 6455 - 5.4, 5.5.
+func (wc *wsConn) readMessage() ([]byte, error) {
+	control := wsutil.ControlFrameHandler(wsControlWriter{wc}, wc.state())
+	rd := wsutil.Reader{
+		Source:    wc.rw(),
+		State:     wc.state(),
+		CheckUTF8: true,
+		OnIntermediate: func(hdr ws.Header, r io.Reader) error {
+			atomic.StoreInt32(&wc.received, 1)
+
+			return wc.handleControl(control, hdr, r)
+		},
+	}
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, wc.readError(err)
+		}
+		atomic.StoreInt32(&wc.received, 1)
+
+		if hdr.OpCode.IsControl() {
+			if err := wc.handleControl(control, hdr, &rd); err != nil {
+				return nil, wc.readError(err)
+			}
+
+			continue
+		}
+
+		msg, err := ioutil.ReadAll(&rd)
+		if err != nil {
+			return nil, wc.readError(err)
+		}
+		if len(msg) > 0 {
+			return msg, nil
 		}
-		return n, err
 	}
-	if op == ws.OpClose {
-		return n, io.EOF
+}
+
+// handleControl answers the control frame, the connection is closed after the close frame of the peer is answered.
+func (wc *wsConn) handleControl(control wsutil.FrameHandlerFunc, hdr ws.Header, r io.Reader) error {
+	err := control(hdr, r)
+	if hdr.OpCode == ws.OpClose {
+		wc.closeWith(0, "")
+		if err == nil {
+			err = io.EOF
+		}
 	}
-	copy(b, msg)
-	return len(msg), err
+
+	return err
 }
 
+// readError closes the connection with the status code of the violation - RFC 6455 - 7.4.1,
+// the close frame of the peer ends the stream.
+func (wc *wsConn) readError(err error) error {
+	var (
+		closedErr wsutil.ClosedError
+		protoErr  ws.ProtocolError
+	)
+	switch {
+	case errors.As(err, &closedErr):
+		return io.EOF
+	case errors.Is(err, wsutil.ErrInvalidUTF8):
+		wc.closeWith(ws.StatusInvalidFramePayloadData, err.Error())
+	case errors.As(err, &protoErr):
+		wc.closeWith(ws.StatusProtocolError, err.Error())
+	case atomic.LoadInt32(&wc.dead) == 1:
+		return fmt.Errorf("WebSocket peer did not answer ping: %w", err)
+	}
+
+	return err
+}
+
+// Write sends the SIP message in a text frame, or in a binary frame if it is not valid UTF-8 - RFC 7118 - 5.
 func (wc *wsConn) Write(b []byte) (n int, err error) {
+	op := ws.OpText
+	if !utf8.Valid(b) {
+		op = ws.OpBinary
+	}
+
+	wc.wmu.Lock()
+	defer wc.wmu.Unlock()
+
+	select {
+	case <-wc.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
 	if wc.client {
-		err = wsutil.WriteClientMessage(wc.Conn, ws.OpText, b)
+		err = wsutil.WriteClientMessage(wc.Conn, op, b)
 	} else {
-		err = wsutil.WriteServerMessage(wc.Conn, ws.OpText, b)
+		err = wsutil.WriteServerMessage(wc.Conn, op, b)
 	}
 	if err != nil {
-		// handle error
-		var wsErr wsutil.ClosedError
-		if errors.As(err, &wsErr) {
-			return n, io.EOF
-		}
 		return n, err
 	}
 	return len(b), nil
 }
 
+// writeFrame writes the control frame, frames of the client are masked.
+func (wc *wsConn) writeFrame(frame ws.Frame) error {
+	if wc.client {
+		frame = ws.MaskFrameInPlace(frame)
+	}
+
+	wc.wmu.Lock()
+	defer wc.wmu.Unlock()
+
+	return ws.WriteFrame(wc.Conn, frame)
+}
+
+// Close sends the close frame with normal closure status before closing the connection.
+func (wc *wsConn) Close() error {
+	return wc.closeWith(ws.StatusNormalClosure, "")
+}
+
+// closeWith closes the connection once, the close frame is not sent with zero code,
+// e.g. if the close frame of the peer is already answered or the peer is dead.
+func (wc *wsConn) closeWith(code ws.StatusCode, reason string) error {
+	wc.closeOnce.Do(func() {
+		if code != 0 {
+			wc.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+			wc.writeFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+		}
+
+		wc.wmu.Lock()
+		close(wc.closed)
+		wc.wmu.Unlock()
+
+		wc.closeErr = wc.Conn.Close()
+	})
+
+	return wc.closeErr
+}
+
+// keepAlive pings the peer every interval, the connection is closed if nothing is received
+// from the peer since the previous ping - RFC 6455 - 5.5.2.
+func (wc *wsConn) keepAlive(interval time.Duration, logger log.Logger) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pinged := false
+	for {
+		select {
+		case <-wc.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if atomic.SwapInt32(&wc.received, 0) == 0 && pinged {
+			logger.Warnf("WebSocket peer %s did not answer ping in %s, close connection", wc.RemoteAddr(), interval)
+
+			atomic.StoreInt32(&wc.dead, 1)
+			wc.closeWith(0, "")
+
+			return
+		}
+
+		if err := wc.writeFrame(ws.NewPingFrame(nil)); err != nil {
+			logger.Debugf("send ping to WebSocket peer %s failed: %s", wc.RemoteAddr(), err)
+
+			return
+		}
+		pinged = true
+	}
+}
+
+// wsControlWriter writes replies to control frames between frames of SIP messages.
+type wsControlWriter struct {
+	wc *wsConn
+}
+
+func (w wsControlWriter) Write(p []byte) (int, error) {
+	w.wc.wmu.Lock()
+	defer w.wc.wmu.Unlock()
+
+	return w.wc.Conn.Write(p)
+}
+
 type wsListener struct {
 	net.Listener
 	network string
 	u       ws.Upgrader
 	log     log.Logger
+	// pingInterval is the keep-alive interval of accepted connections
+	pingInterval time.Duration
 }
 
 func NewWsListener(listener net.Listener, network string, log log.Logger) *wsListener {
 	l := &wsListener{
-		Listener: listener,
-		network:  network,
-		log:      log,
+		Listener:     listener,
+		network:      network,
+		log:          log,
+		pingInterval: DefaultWebSocketPingInterval,
 	}
 	l.u.Protocol = func(val []byte) bool {
 		return string(val) == wsSubProtocol
@@ -84,21 +306,37 @@ func NewWsListener(listener net.Listener, network string, log log.Logger) *wsLis
 	return l
 }
 
+// Accept returns the next upgraded connection, peers failed to upgrade to WebSocket are refused - RFC 7118 - 4.
 func (l *wsListener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
-	if err != nil {
-		return nil, fmt.Errorf("accept new connection: %w", err)
-	}
-	if _, err = l.u.Upgrade(conn); err == nil {
-		conn = &wsConn{
-			Conn:   conn,
-			client: false,
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, fmt.Errorf("accept new connection: %w", err)
 		}
-	} else {
-		l.log.Warnf("fallback to simple TCP connection due to WS upgrade error: %s", err)
-		err = nil
+
+		if err := l.upgrade(conn); err != nil {
+			l.log.Warnf("refuse %s connection from %s due to WS upgrade error: %s", l.Network(), conn.RemoteAddr(), err)
+			conn.Close()
+
+			continue
+		}
+
+		wc := newWsConn(conn, false)
+		go wc.keepAlive(l.pingInterval, l.log)
+
+		return wc, nil
+	}
+}
+
+func (l *wsListener) upgrade(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(wsHandshakeTimeout)); err != nil {
+		return err
+	}
+	if _, err := l.u.Upgrade(conn); err != nil {
+		return err
 	}
-	return conn, err
+
+	return conn.SetDeadline(time.Time{})
 }
 
 func (l *wsListener) Network() string {
@@ -113,6 +351,10 @@ type wsProtocol struct {
 	listen      func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error)
 	resolveAddr func(addr string) (*net.TCPAddr, error)
 	dialer      ws.Dialer
+	// pingInterval is the keep-alive interval of the connections, see WithWebSocketPing
+	pingInterval time.Duration
+	// wrapListener secures connections accepted by the listener, e.g. with TLS
+	wrapListener func(listener net.Listener, options ...ListenOption) (net.Listener, error)
 }
 
 func NewWsProtocol(
@@ -137,8 +379,10 @@ func NewWsProtocol(
 	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
 	p.listen = p.defaultListen
 	p.resolveAddr = p.defaultResolveAddr
+	p.wrapListener = p.defaultWrapListener
 	p.dialer.Protocols = []string{wsSubProtocol}
 	p.dialer.Timeout = time.Minute
+	p.pingInterval = DefaultWebSocketPingInterval
 	//pipe listener and connection pools
 	go p.pipePools()
 
@@ -153,6 +397,14 @@ func (p *wsProtocol) defaultResolveAddr(addr string) (*net.TCPAddr, error) {
 	return net.ResolveTCPAddr("tcp", addr)
 }
 
+func (p *wsProtocol) defaultWrapListener(listener net.Listener, options ...ListenOption) (net.Listener, error) {
+	return listener, nil
+}
+
+func (p *wsProtocol) setPingInterval(interval time.Duration) {
+	p.pingInterval = interval
+}
+
 func (p *wsProtocol) Done() <-chan struct{} {
 	return p.connections.Done()
 }
@@ -203,12 +455,37 @@ func (p *wsProtocol) Listen(target *Target, options ...ListenOption) error {
 		}
 	}
 
-	p.Log().Debugf("begin listening on %s %s", p.Network(), target.Addr())
+	// the layer advertises the bound port if any port was requested
+	port := sip.Port(listener.Addr().(*net.TCPAddr).Port)
+	target.Port = &port
+
+	if err := p.listenOn(listener, options...); err != nil {
+		listener.Close()
+		return err
+	}
+
+	return nil
+}
+
+// listenOn serves WebSocket connections accepted by the listener.
+func (p *wsProtocol) listenOn(listener net.Listener, options ...ListenOption) error {
+	wrapped, err := p.wrapListener(listener, options...)
+	if err != nil {
+		return &ProtocolError{
+			err,
+			fmt.Sprintf("listen on %s %s address", p.Network(), listener.Addr()),
+			fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("begin listening on %s %s", p.Network(), listener.Addr())
 
 	//index listeners by local address
 	// should live infinitely
-	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, target.Port))
-	err = p.listeners.Put(key, NewWsListener(listener, p.network, p.Log()))
+	key := ListenerKey(p.network + ":" + listener.Addr().String())
+	wsl := NewWsListener(wrapped, p.network, p.Log())
+	wsl.pingInterval = p.pingInterval
+	err = p.listeners.Put(key, wsl)
 	if err != nil {
 		err = &ProtocolError{
 			Err:      err,
@@ -220,6 +497,26 @@ func (p *wsProtocol) Listen(target *Target, options ...ListenOption) error {
 	return err //should be nil here
 }
 
+// serveConn puts the upgraded WebSocket connection to the connection pool.
+func (p *wsProtocol) serveConn(conn net.Conn) error {
+	key := ConnectionKey(p.network + ":" + conn.RemoteAddr().String())
+	connection := NewConnection(conn, key, p.network, p.Log())
+	if err := p.connections.Put(connection, sockTTL); err != nil {
+		connection.Close()
+
+		return &ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("put %s connection to the pool", key),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+	if wc, ok := conn.(*wsConn); ok {
+		go wc.keepAlive(p.pingInterval, log.AddFieldsFrom(p.Log(), connection))
+	}
+
+	return nil
+}
+
 func (p *wsProtocol) Send(target *Target, msg sip.Message) error {
 	target = FillTargetHostAndPort(p.Network(), target)
 
@@ -276,26 +573,35 @@ func (p *wsProtocol) getOrCreateConnection(raddr *net.TCPAddr) (Connection, erro
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 		defer cancel()
 		url := fmt.Sprintf("%s://%s", p.network, raddr)
-		baseConn, _, _, err := p.dialer.Dial(ctx, url)
-		if err == nil {
-			baseConn = &wsConn{
-				Conn:   baseConn,
-				client: true,
+		baseConn, br, hs, err := p.dialer.Dial(ctx, url)
+		if err != nil {
+			if baseConn != nil {
+				baseConn.Close()
 			}
-		} else {
-			if baseConn == nil {
-				return nil, fmt.Errorf("dial to %s %s: %w", p.Network(), raddr, err)
-			}
-
-			p.Log().Warnf("fallback to TCP connection due to WS upgrade error: %s", err)
+			return nil, fmt.Errorf("dial to %s %s: %w", p.Network(), raddr, err)
+		}
+		// RFC 7118 - 4.1. The connection is closed if the server does not accept 'sip' subprotocol.
+		if hs.Protocol != wsSubProtocol {
+			baseConn.Close()
+			return nil, fmt.Errorf("%s %s did not accept '%s' WebSocket subprotocol", p.Network(), raddr, wsSubProtocol)
 		}
 
-		conn = NewConnection(baseConn, key, p.network, p.Log())
+		wc := newWsConn(baseConn, true)
+		wc.br = br
+		conn = NewConnection(wc, key, p.network, p.Log())
 
 		if err := p.connections.Put(conn, sockTTL); err != nil {
 			return conn, fmt.Errorf("put %s connection to the pool: %w", conn.Key(), err)
 		}
+		go wc.keepAlive(p.pingInterval, log.AddFieldsFrom(p.Log(), conn))
 	}
 
 	return conn, nil
 }
+
+// isWebSocket checks that the network is WS or WSS.
+func isWebSocket(network string) bool {
+	network = strings.ToUpper(network)
+
+	return network == "WS" || network == "WSS"
+}
@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/ws"
+
+	"github.com/ygj201011/gosip/log"
+	"github.com/ygj201011/gosip/sip"
+)
+
+// connLayer serves connections accepted outside of the layer.
+type connLayer interface {
+	Log() log.Logger
+	serveConn(network string, conn net.Conn) error
+}
+
+type webSocketHandler struct {
+	tpl      connLayer
+	opts     WebSocketOptions
+	upgrader ws.HTTPUpgrader
+	log      log.Logger
+}
+
+// WebSocketHandler returns HTTP handler upgrading requests with 'sip' subprotocol to SIP over WebSocket - RFC 7118,
+// the connections are served by WS protocol of the layer, or WSS one if the request is received over TLS.
+// It allows to share the HTTP server and its routes with other services.
+func WebSocketHandler(tpl Layer, options ...WebSocketOption) http.Handler {
+	h := &webSocketHandler{}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyWebSocket(&h.opts)
+		}
+	}
+	if h.opts.CheckOrigin == nil {
+		h.opts.CheckOrigin = sameOrigin
+	}
+	h.upgrader.Protocol = func(val string) bool {
+		return val == wsSubProtocol
+	}
+
+	var logger log.Logger
+	if connTpl, ok := tpl.(connLayer); ok {
+		h.tpl = connTpl
+		logger = connTpl.Log()
+	} else {
+		logger = log.NewDefaultLogrusLogger()
+	}
+	h.log = logger.
+		WithPrefix("transport.WebSocketHandler").
+		WithFields(log.Fields{
+			"handler_ptr": fmt.Sprintf("%p", h),
+		})
+
+	return h
+}
+
+func (h *webSocketHandler) Log() log.Logger {
+	return h.log
+}
+
+func (h *webSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Log().WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"request_uri": r.RequestURI,
+	})
+
+	if h.tpl == nil {
+		http.Error(w, "SIP over WebSocket is not supported by the transport layer", http.StatusNotImplemented)
+		return
+	}
+	if !hasSubProtocol(r, wsSubProtocol) {
+		http.Error(w, "'sip' WebSocket subprotocol is required", http.StatusBadRequest)
+		return
+	}
+	if !h.opts.CheckOrigin(r) {
+		logger.Debugf("reject WebSocket upgrade from origin %s", r.Header.Get("Origin"))
+		http.Error(w, "origin is not allowed", http.StatusForbidden)
+		return
+	}
+	if h.opts.Authorize != nil {
+		if err := h.opts.Authorize(r); err != nil {
+			logger.Debugf("reject unauthorized WebSocket upgrade: %s", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	network := "ws"
+	if r.TLS != nil {
+		network = "wss"
+	}
+	var raddr net.Addr
+	if h.opts.ForwardedHeaders {
+		var proto string
+		raddr, proto = forwardedPeer(r)
+		if strings.EqualFold(proto, "https") {
+			network = "wss"
+		}
+	}
+
+	conn, rw, _, err := h.upgrader.Upgrade(r, w)
+	if err != nil {
+		// the upgrader responds with the error
+		logger.Debugf("WebSocket upgrade failed: %s", err)
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+
+	wc := newWsConn(conn, false)
+	wc.raddr = raddr
+	wc.request = r.Clone(context.Background())
+	if rw != nil && rw.Reader.Buffered() > 0 {
+		wc.br = rw.Reader
+	}
+
+	if err := h.tpl.serveConn(network, wc); err != nil {
+		logger.Errorf("serve %s connection failed: %s", strings.ToUpper(network), err)
+		conn.Close()
+	}
+}
+
+// sameOrigin accepts requests without Origin, e.g. from SIP devices, or with the Origin host equal to the requested one.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func hasSubProtocol(r *http.Request, protocol string) bool {
+	for _, header := range r.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, val := range strings.Split(header, ",") {
+			if strings.TrimSpace(val) == protocol {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// forwardedPeer returns the peer address and the protocol the reverse proxy received the request with.
+// The last value of the headers is used as the one appended by the nearest proxy,
+// the port of the proxy connection is kept if the header has no port.
+func forwardedPeer(r *http.Request) (net.Addr, string) {
+	var peer, proto string
+	if header := r.Header[http.CanonicalHeaderKey("Forwarded")]; len(header) > 0 {
+		elements := strings.Split(strings.Join(header, ","), ",")
+		for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "for":
+				peer = strings.Trim(kv[1], `"`)
+			case "proto":
+				proto = strings.Trim(kv[1], `"`)
+			}
+		}
+	} else if header := r.Header[http.CanonicalHeaderKey("X-Forwarded-For")]; len(header) > 0 {
+		addrs := strings.Split(strings.Join(header, ","), ",")
+		peer = strings.TrimSpace(addrs[len(addrs)-1])
+		if header := r.Header[http.CanonicalHeaderKey("X-Forwarded-Proto")]; len(header) > 0 {
+			proto = strings.TrimSpace(header[len(header)-1])
+		}
+	}
+	if peer == "" {
+		return nil, proto
+	}
+
+	_, port, _ := net.SplitHostPort(r.RemoteAddr)
+	host := peer
+	if h, p, err := net.SplitHostPort(peer); err == nil {
+		host, port = h, p
+	}
+	// obfuscated identifiers and 'unknown' are ignored - RFC 7239 - 6
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return nil, proto
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, proto
+	}
+
+	return &net.TCPAddr{IP: ip, Port: portNum}, proto
+}
+
+// upgradeRequest returns the HTTP upgrade request of the connection accepted by WebSocketHandler.
+func upgradeRequest(conn Connection) *http.Request {
+	c, ok := conn.(*connection)
+	if !ok {
+		return nil
+	}
+	wc, ok := c.baseConn.(*wsConn)
+	if !ok {
+		return nil
+	}
+
+	return wc.request
+}
+
+// WebSocketRequest returns the HTTP upgrade request of the WebSocket connection the message was received with,
+// e.g. to authorize the message by the cookies. It is nil for connections not accepted by WebSocketHandler.
+func WebSocketRequest(msg sip.Message) *http.Request {
+	return upgradeRequest(messageConnection(msg))
+}
@@ -0,0 +1,174 @@
+package transport_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ygj201011/gosip/sip"
+	"github.com/ygj201011/gosip/testutils"
+	"github.com/ygj201011/gosip/transport"
+)
+
+var _ = Describe("WebSocketHandler", func() {
+	var (
+		tpl    transport.Layer
+		server *httptest.Server
+	)
+	logger := testutils.NewLogrusLogger()
+
+	request := func(callID string) string {
+		return strings.Join([]string{
+			"OPTIONS sip:bob@far-far-away.com;transport=ws SIP/2.0",
+			"Via: SIP/2.0/WS df7jal23ls0d.invalid;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@wonderland.com>;tag=1",
+			"To: <sip:bob@far-far-away.com>",
+			"Call-ID: " + callID,
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}, "\r\n")
+	}
+	dial := func(protocols []string, header http.Header) (net.Conn, error) {
+		dialer := ws.Dialer{
+			Protocols: protocols,
+			Header:    ws.HandshakeHeaderHTTP(header),
+			Timeout:   time.Second,
+		}
+		conn, _, _, err := dialer.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/sip")
+		return conn, err
+	}
+	serve := func(options ...transport.WebSocketOption) {
+		mux := http.NewServeMux()
+		mux.Handle("/sip", transport.WebSocketHandler(tpl, options...))
+		server = httptest.NewServer(mux)
+	}
+
+	BeforeEach(func() {
+		tpl = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		// the layer is blocked until the errors are read, e.g. EOF of the closed connections
+		go func() {
+			for range tpl.Errors() {
+			}
+		}()
+	})
+	AfterEach(func() {
+		server.Close()
+		tpl.Cancel()
+		<-tpl.Done()
+	})
+
+	Context("with default options", func() {
+		BeforeEach(func() {
+			serve()
+		})
+
+		It("should pass up messages of the upgraded connection and send responses back", func(done Done) {
+			conn, err := dial([]string{"sip"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			Expect(wsutil.WriteClientText(conn, []byte(request("ws-handler")))).To(Succeed())
+			var msg sip.Message
+			Eventually(tpl.Messages(), 2*time.Second).Should(Receive(&msg))
+			Expect(msg.Source()).To(Equal(conn.LocalAddr().String()))
+			Expect(msg.Transport()).To(Equal("WS"))
+
+			res := sip.NewResponseFromRequest("", msg.(sip.Request), 200, "OK", "")
+			Expect(tpl.Send(res)).To(Succeed())
+
+			data, err := wsutil.ReadServerText(conn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(HavePrefix("SIP/2.0 200 OK\r\n"))
+			close(done)
+		}, 5)
+
+		It("should refuse requests without 'sip' subprotocol", func() {
+			_, err := dial(nil, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(ws.StatusError)).To(BeEquivalentTo(http.StatusBadRequest))
+		})
+
+		It("should refuse requests from other origins", func() {
+			_, err := dial([]string{"sip"}, http.Header{"Origin": {"https://evil.example.com"}})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(ws.StatusError)).To(BeEquivalentTo(http.StatusForbidden))
+		})
+
+		It("should accept requests from the same origin", func() {
+			conn, err := dial([]string{"sip"}, http.Header{"Origin": {server.URL}})
+			Expect(err).ToNot(HaveOccurred())
+			conn.Close()
+		})
+	})
+
+	Context("behind reverse proxy with authorization", func() {
+		BeforeEach(func() {
+			serve(
+				transport.WithAllowedOrigins("https://app.example.com"),
+				transport.WithForwardedHeaders(true),
+				transport.WithAuthorize(func(r *http.Request) error {
+					if _, err := r.Cookie("session"); err != nil {
+						return fmt.Errorf("no session: %w", err)
+					}
+					return nil
+				}),
+			)
+		})
+
+		It("should refuse requests without session cookie", func() {
+			_, err := dial([]string{"sip"}, http.Header{"Origin": {"https://app.example.com"}})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(ws.StatusError)).To(BeEquivalentTo(http.StatusForbidden))
+		})
+
+		It("should expose the upgrade request and the forwarded peer address", func(done Done) {
+			conn, err := dial([]string{"sip"}, http.Header{
+				"Origin":          {"https://app.example.com"},
+				"Cookie":          {"session=abc"},
+				"X-Forwarded-For": {"198.51.100.7, 203.0.113.10"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			Expect(wsutil.WriteClientText(conn, []byte(request("ws-handler-proxy")))).To(Succeed())
+			var msg sip.Message
+			Eventually(tpl.Messages(), 2*time.Second).Should(Receive(&msg))
+			_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+			Expect(msg.Source()).To(Equal("203.0.113.10:" + port))
+
+			req := transport.WebSocketRequest(msg)
+			Expect(req).ToNot(BeNil())
+			cookie, err := req.Cookie("session")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cookie.Value).To(Equal("abc"))
+			close(done)
+		}, 5)
+
+		It("should take the peer address from Forwarded header", func(done Done) {
+			conn, err := dial([]string{"sip"}, http.Header{
+				"Cookie":    {"session=abc"},
+				"Forwarded": {`for=192.0.2.43, for="[2001:db8:cafe::17]:4711";proto=https`},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			Expect(wsutil.WriteClientText(conn, []byte(request("ws-handler-forwarded")))).To(Succeed())
+			var msg sip.Message
+			Eventually(tpl.Messages(), 2*time.Second).Should(Receive(&msg))
+			Expect(msg.Source()).To(Equal("[2001:db8:cafe::17]:4711"))
+			Expect(transport.WebSocketRequest(msg).Header.Get("Forwarded")).To(ContainSubstring("proto=https"))
+			close(done)
+		}, 5)
+	})
+})
@@ -35,25 +35,14 @@ func NewWssProtocol(
 	//TODO: add separate errs chan to listen errors from pool for reconnection?
 	p.listeners = NewListenerPool(p.conns, errs, cancel, p.Log())
 	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
-	p.listen = func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error) {
-		if len(options) == 0 {
-			return net.ListenTCP("tcp", addr)
-		}
-		optsHash := ListenOptions{}
-		for _, opt := range options {
-			opt.ApplyListen(&optsHash)
-		}
-		cert, err := tls.LoadX509KeyPair(optsHash.TLSConfig.Cert, optsHash.TLSConfig.Key)
-		if err != nil {
-			return nil, fmt.Errorf("load TLS certficate %s: %w", optsHash.TLSConfig.Cert, err)
-		}
-		return tls.Listen("tcp", addr.String(), &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
+	p.listen = p.defaultListen
+	p.wrapListener = func(listener net.Listener, options ...ListenOption) (net.Listener, error) {
+		return tlsListener(listener, errs, cancel, p.Log(), options...)
 	}
 	p.resolveAddr = p.defaultResolveAddr
 	p.dialer.Protocols = []string{wsSubProtocol}
 	p.dialer.Timeout = time.Minute
+	p.pingInterval = DefaultWebSocketPingInterval
 	p.dialer.TLSConfig = &tls.Config{
 		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 			return nil
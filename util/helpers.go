@@ -66,7 +66,24 @@ func MergeErrs(chs ...<-chan error) <-chan error {
 	return out
 }
 
+// ResolveSelfIP returns the first IPv4 address of the host.
 func ResolveSelfIP() (net.IP, error) {
+	return resolveSelfIP(func(ip net.IP) net.IP {
+		return ip.To4()
+	})
+}
+
+// ResolveSelfIPv6 returns the first global unicast IPv6 address of the host.
+func ResolveSelfIPv6() (net.IP, error) {
+	return resolveSelfIP(func(ip net.IP) net.IP {
+		if ip.To4() != nil || !ip.IsGlobalUnicast() {
+			return nil
+		}
+		return ip
+	})
+}
+
+func resolveSelfIP(filter func(ip net.IP) net.IP) (net.IP, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
@@ -93,9 +110,9 @@ func ResolveSelfIP() (net.IP, error) {
 			if ip == nil || ip.IsLoopback() {
 				continue
 			}
-			ip = ip.To4()
+			ip = filter(ip)
 			if ip == nil {
-				continue // not an ipv4 address
+				continue // not an address of the family
 			}
 			return ip, nil
 		}